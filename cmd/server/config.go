@@ -15,10 +15,15 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
+	sifimage "github.com/sylabs/singularity-cri/pkg/image"
 	"gopkg.in/yaml.v2"
 )
 
@@ -43,12 +48,215 @@ type Config struct {
 	// When Debug is true all CRI requests and responses will be logged. When false
 	// only requests with error responses will be logged.
 	Debug bool `yaml:"debug"`
+	// Pull holds parameters that tune image pulls.
+	Pull PullConfig `yaml:"pull"`
+	// Credentials holds sources of registry credentials used
+	// for pulls kubelet supplies no credentials for.
+	Credentials CredentialsConfig `yaml:"credentials"`
+	// Build holds parameters of singularity build that converts
+	// docker images and local archives into SIF.
+	Build BuildConfig `yaml:"build"`
+	// Platforms lists platforms images are pulled for in order of preference
+	// in os/arch[/variant] form, e.g. linux/arm64. Host platform by default.
+	Platforms []string `yaml:"platforms"`
+	// Preload lists images that are pulled in background on startup
+	// and pinned, so they are never garbage collected.
+	Preload []string `yaml:"preload"`
+	// ImageGC holds image garbage collection parameters.
+	ImageGC ImageGCConfig `yaml:"imageGC"`
+	// Libraries holds library endpoints keyed by a domain library image
+	// references start with, e.g. library.example.com for references like
+	// library://library.example.com/user/collection/image:tag.
+	Libraries map[string]LibraryConfig `yaml:"libraries"`
+	// Verify holds image signature verification policies. Each pulled image
+	// is verified according to the policy with the most specific scope.
+	Verify []VerifyConfig `yaml:"verify"`
+	// Integrity holds parameters of image integrity checks.
+	Integrity IntegrityConfig `yaml:"integrity"`
+	// DecryptionKeys holds keys encrypted images are opened with. Keys are
+	// scoped by pod namespace and image reference.
+	DecryptionKeys []DecryptionKeyConfig `yaml:"decryptionKeys"`
+	// DropDir holds parameters of a directory SIF images are imported from.
+	DropDir DropDirConfig `yaml:"dropDir"`
+	// SharedStorage holds parameters of storage directory shared by several nodes.
+	SharedStorage SharedStorageConfig `yaml:"sharedStorage"`
+	// LocalCache holds parameters of local cache tier in front of StorageDir.
+	LocalCache LocalCacheConfig `yaml:"localCache"`
+	// SandboxPool holds parameters of pod sandboxes created in advance.
+	SandboxPool SandboxPoolConfig `yaml:"sandboxPool"`
+}
+
+// PullConfig holds parameters that tune image pulls.
+type PullConfig struct {
+	// Timeout limits duration of a single pull attempt. Zero means no limit.
+	Timeout time.Duration `yaml:"timeout"`
+	// RegistryTimeouts overrides Timeout for specific registry domains.
+	RegistryTimeouts map[string]time.Duration `yaml:"registryTimeouts"`
+	// Retries is a number of times a failed pull is retried. Errors that
+	// will not go away with time, e.g. image not found, are never retried.
+	Retries int `yaml:"retries"`
+	// Backoff is a delay before the first retry. Delay is doubled after each attempt.
+	Backoff time.Duration `yaml:"backoff"`
+	// MaxBackoff limits delay between retries. Zero means no limit.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	// Lazy enables lazy pulls of library and HTTP(S) images whose checksum
+	// is known in advance. Root filesystem of such images is fetched on demand.
+	Lazy bool `yaml:"lazy"`
+}
+
+// CredentialsConfig holds sources of registry credentials used for pulls
+// kubelet supplies no credentials for, e.g. from crictl or image preload.
+type CredentialsConfig struct {
+	// DockerConfigs lists docker config.json files consulted in order.
+	// Credential helpers these files refer to are supported.
+	DockerConfigs []string `yaml:"dockerConfigs"`
+	// RegistryDockerConfigs holds docker config.json files keyed by registry
+	// domain that are consulted before DockerConfigs for that registry.
+	RegistryDockerConfigs map[string]string `yaml:"registryDockerConfigs"`
+}
+
+// BuildConfig holds parameters of singularity build that converts
+// docker images and local archives into SIF.
+type BuildConfig struct {
+	// CacheDir is singularity cache directory, e.g. on a dedicated volume.
+	CacheDir string `yaml:"cacheDir"`
+	// TmpDir is a directory temporary build files are created in.
+	TmpDir string `yaml:"tmpDir"`
+	// PassEnv lists environment variables passed to build, e.g. HTTPS_PROXY.
+	PassEnv []string `yaml:"passEnv"`
+	// MksquashfsArgs holds additional mksquashfs options, e.g. "-comp zstd".
+	MksquashfsArgs string `yaml:"mksquashfsArgs"`
+	// FixPerms makes build ensure owner has access to all image files.
+	FixPerms bool `yaml:"fixPerms"`
+	// MaxCacheSize is cache size in bytes that triggers cache cleanup
+	// after build. Zero disables cleanup.
+	MaxCacheSize uint64 `yaml:"maxCacheSize"`
+}
+
+// ImageGCConfig holds image garbage collection parameters.
+type ImageGCConfig struct {
+	// HighWatermark is image storage usage in bytes that triggers garbage
+	// collection. Zero disables garbage collection.
+	HighWatermark uint64 `yaml:"highWatermark"`
+	// LowWatermark is image storage usage in bytes garbage collection
+	// tries to reach by removing unused images.
+	LowWatermark uint64 `yaml:"lowWatermark"`
+	// Interval is a period of storage usage checks.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// IntegrityConfig holds parameters of image integrity checks. Pulled library
+// images are always verified against the checksum library reports.
+type IntegrityConfig struct {
+	// CheckOnCreate enables a fast check of SIF descriptors before
+	// each container is created. Image data is not rehashed.
+	CheckOnCreate bool `yaml:"checkOnCreate"`
+	// Scrub enables periodic rehashing of stored images. Images that
+	// do not match their checksum are quarantined.
+	Scrub bool `yaml:"scrub"`
+	// ScrubInterval is a period of stored images rehashing.
+	ScrubInterval time.Duration `yaml:"scrubInterval"`
+}
+
+// SharedStorageConfig holds parameters of storage directory
+// shared by several nodes, e.g. on a parallel filesystem.
+type SharedStorageConfig struct {
+	// Enabled makes nodes coordinate pulls and removals of images.
+	Enabled bool `yaml:"enabled"`
+	// NodeName tells nodes apart, host name by default. Must be unique.
+	NodeName string `yaml:"nodeName"`
+	// SyncInterval is a period of syncs with other nodes.
+	SyncInterval time.Duration `yaml:"syncInterval"`
+}
+
+// LocalCacheConfig holds parameters of local cache tier, e.g. on a fast SSD,
+// that sits in front of a larger and slower storage directory.
+type LocalCacheConfig struct {
+	// Dir is a directory images are copied to when containers are created
+	// from them. Empty disables cache.
+	Dir string `yaml:"dir"`
+	// Size is cache size in bytes. Least recently used copies are
+	// evicted to fit new ones.
+	Size uint64 `yaml:"size"`
+}
+
+// SandboxPoolConfig holds parameters of empty pod sandboxes that are created in
+// advance and claimed by pods with default configuration, e.g. short batch jobs.
+type SandboxPoolConfig struct {
+	// Size is a number of sandboxes kept ready. Zero disables pool.
+	Size int `yaml:"size"`
+	// Namespaces lists Kubernetes namespaces whose pods may claim
+	// sandboxes. Empty list matches all namespaces.
+	Namespaces []string `yaml:"namespaces"`
+	// Sysctls lists namespaced sysctls set up in claimed sandboxes, a trailing
+	// * matches any suffix, e.g. net.ipv4.*. Pods requesting other sysctls
+	// are run without pool.
+	Sysctls []string `yaml:"sysctls"`
+}
+
+// LibraryConfig holds parameters of a library endpoint.
+type LibraryConfig struct {
+	// BaseURL is library server address, https://<domain> by default.
+	BaseURL string `yaml:"baseURL"`
+	// TokenFile is a path to a file with library access token that is used
+	// when kubelet supplies no credentials.
+	TokenFile string `yaml:"tokenFile"`
+	// KeyServer is a key server URL library images are verified with.
+	KeyServer string `yaml:"keyServer"`
+}
+
+// VerifyConfig holds signature verification policy for images matching scope.
+type VerifyConfig struct {
+	// Scope is a registry domain or an image reference prefix policy applies to.
+	// Empty scope matches all images.
+	Scope string `yaml:"scope"`
+	// Mode is one of ignore, warn or require.
+	Mode string `yaml:"mode"`
+	// TrustedFingerprints restricts keys images may be signed with.
+	// Key IDs, i.e. last 16 hex digits of fingerprints, are also accepted.
+	TrustedFingerprints []string `yaml:"trustedFingerprints"`
+	// Keyring is a path to a public keyring file. When set key server
+	// is never contacted so verification works offline.
+	Keyring string `yaml:"keyring"`
+	// KeyServer is a key server URL to fetch signing keys from.
+	KeyServer string `yaml:"keyServer"`
+}
+
+// DecryptionKeyConfig holds a key for encrypted images matching namespace and scope.
+type DecryptionKeyConfig struct {
+	// Namespace is a Kubernetes namespace key is restricted to.
+	// Empty namespace matches all namespaces.
+	Namespace string `yaml:"namespace"`
+	// Scope is a registry domain or an image reference prefix key applies to.
+	// Empty scope matches all images.
+	Scope string `yaml:"scope"`
+	// PEMFile is a path to RSA private key in PEM format.
+	PEMFile string `yaml:"pemFile"`
+	// PassphraseFile is a path to a file holding plaintext passphrase.
+	PassphraseFile string `yaml:"passphraseFile"`
+}
+
+// DropDirConfig holds parameters of a directory that is watched for SIF files.
+type DropDirConfig struct {
+	// Path is an absolute path of the directory. Empty path disables import.
+	Path string `yaml:"path"`
+	// TagPrefix is prepended to file names without .sif extension to form image
+	// tags, e.g. registry.local/busybox:latest for busybox.sif. When empty images
+	// are tagged with local.file references, e.g. local.file/shared/busybox.sif.
+	TagPrefix string `yaml:"tagPrefix"`
+	// Interval is a period of directory rescans.
+	Interval time.Duration `yaml:"interval"`
 }
 
 var defaultConfig = Config{
 	ListenSocket: "/var/run/singularity.sock",
 	StorageDir:   "/var/lib/singularity",
 	BaseRunDir:   "/var/run/singularity",
+	Pull: PullConfig{
+		Retries:    3,
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+	},
 }
 
 func parseConfig(path string) (Config, error) {
@@ -81,5 +289,118 @@ func validConfig(config Config) (Config, error) {
 	if config.BaseRunDir == "" {
 		return Config{}, fmt.Errorf("directory to run containers cannot be empty")
 	}
+	if config.Pull.Retries < 0 {
+		return Config{}, fmt.Errorf("number of pull retries cannot be negative")
+	}
+	for _, path := range config.Credentials.DockerConfigs {
+		if !filepath.IsAbs(path) {
+			return Config{}, fmt.Errorf("docker config path %q is not absolute", path)
+		}
+	}
+	for host, path := range config.Credentials.RegistryDockerConfigs {
+		if host == "" || strings.ContainsAny(host, "/ ") {
+			return Config{}, fmt.Errorf("invalid docker config registry %q", host)
+		}
+		if !filepath.IsAbs(path) {
+			return Config{}, fmt.Errorf("docker config path %q is not absolute", path)
+		}
+	}
+	for _, dir := range []string{config.Build.CacheDir, config.Build.TmpDir} {
+		if dir != "" && !filepath.IsAbs(dir) {
+			return Config{}, fmt.Errorf("build directory path %q is not absolute", dir)
+		}
+	}
+	if config.Build.MaxCacheSize != 0 && config.Build.CacheDir == "" {
+		return Config{}, fmt.Errorf("build cache size limit requires cache directory")
+	}
+	for _, name := range config.Build.PassEnv {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return Config{}, fmt.Errorf("invalid build environment variable name %q", name)
+		}
+	}
+	if config.ImageGC.LowWatermark > config.ImageGC.HighWatermark {
+		return Config{}, fmt.Errorf("image GC low watermark cannot exceed high watermark")
+	}
+	for _, ref := range config.Preload {
+		if ref == "" || strings.ContainsAny(ref, " \t\n") {
+			return Config{}, fmt.Errorf("invalid preloaded image reference %q", ref)
+		}
+	}
+	for _, platform := range config.Platforms {
+		if _, err := sifimage.ParsePlatform(platform); err != nil {
+			return Config{}, fmt.Errorf("invalid platform %q", platform)
+		}
+	}
+	if config.Integrity.ScrubInterval < 0 {
+		return Config{}, fmt.Errorf("image scrub interval cannot be negative")
+	}
+	for host := range config.Libraries {
+		if host == "" || strings.ContainsAny(host, "/ ") {
+			return Config{}, fmt.Errorf("invalid library domain %q", host)
+		}
+	}
+	scopes := make(map[string]bool)
+	for _, policy := range config.Verify {
+		switch policy.Mode {
+		case "ignore", "warn", "require":
+		default:
+			return Config{}, fmt.Errorf("unknown verification mode %q", policy.Mode)
+		}
+		if scopes[policy.Scope] {
+			return Config{}, fmt.Errorf("duplicate verification policy scope %q", policy.Scope)
+		}
+		scopes[policy.Scope] = true
+		for _, fp := range policy.TrustedFingerprints {
+			fp = strings.Replace(fp, " ", "", -1)
+			if _, err := hex.DecodeString(fp); err != nil || (len(fp) != 16 && len(fp) != 40) {
+				return Config{}, fmt.Errorf("invalid trusted key fingerprint %q", fp)
+			}
+		}
+	}
+	for _, key := range config.DecryptionKeys {
+		if (key.PEMFile == "") == (key.PassphraseFile == "") {
+			return Config{}, fmt.Errorf("exactly one of pemFile and passphraseFile should be set for decryption key")
+		}
+		if path := key.PEMFile + key.PassphraseFile; !filepath.IsAbs(path) {
+			return Config{}, fmt.Errorf("decryption key path %q is not absolute", path)
+		}
+	}
+	if node := config.SharedStorage.NodeName; strings.ContainsAny(node, "/ ") || strings.HasPrefix(node, ".") {
+		return Config{}, fmt.Errorf("invalid shared storage node name %q", node)
+	}
+	if config.SharedStorage.SyncInterval < 0 {
+		return Config{}, fmt.Errorf("shared storage sync interval cannot be negative")
+	}
+	if config.SharedStorage.Enabled && config.Pull.Lazy {
+		return Config{}, fmt.Errorf("lazy pulls cannot be used with shared storage")
+	}
+	if config.LocalCache.Dir != "" && !filepath.IsAbs(config.LocalCache.Dir) {
+		return Config{}, fmt.Errorf("local cache directory path %q is not absolute", config.LocalCache.Dir)
+	}
+	if config.LocalCache.Dir != "" && config.LocalCache.Size == 0 {
+		return Config{}, fmt.Errorf("local cache size cannot be zero")
+	}
+	if config.SandboxPool.Size < 0 {
+		return Config{}, fmt.Errorf("sandbox pool size cannot be negative")
+	}
+	for _, namespace := range config.SandboxPool.Namespaces {
+		if namespace == "" || strings.ContainsAny(namespace, "/ ") {
+			return Config{}, fmt.Errorf("invalid sandbox pool namespace %q", namespace)
+		}
+	}
+	for _, sysctl := range config.SandboxPool.Sysctls {
+		if pattern := strings.TrimSuffix(sysctl, "*"); pattern == "" || strings.ContainsAny(pattern, "* =") {
+			return Config{}, fmt.Errorf("invalid sandbox pool sysctl %q", sysctl)
+		}
+	}
+	if config.DropDir.Path != "" && !filepath.IsAbs(config.DropDir.Path) {
+		return Config{}, fmt.Errorf("drop directory path %q is not absolute", config.DropDir.Path)
+	}
+	if strings.ContainsAny(config.DropDir.TagPrefix, " :@") {
+		return Config{}, fmt.Errorf("invalid drop directory tag prefix %q", config.DropDir.TagPrefix)
+	}
+	if config.DropDir.Interval < 0 {
+		return Config{}, fmt.Errorf("drop directory rescan interval cannot be negative")
+	}
 	return config, nil
 }
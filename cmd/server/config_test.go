@@ -19,6 +19,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -36,6 +37,17 @@ streamingURL: 127.0.0.12:8080
 cniBinDir: /opt/cni/bin
 cniConfDir: /etc/cni/net.d
 baseRunDir: /var/run/cri
+pull:
+  timeout: 10m
+  registryTimeouts:
+    docker.io: 30m
+  retries: 2
+  backoff: 2s
+libraries:
+  library.example.com:
+    baseURL: https://library.example.com:8443
+    tokenFile: /etc/sycri/library-token
+    keyServer: https://keys.example.com
 `)
 
 	require.NoError(t, err, "could not write test YAML config")
@@ -65,6 +77,21 @@ baseRunDir: /var/run/cri
 				CNIBinDir:    "/opt/cni/bin",
 				CNIConfDir:   "/etc/cni/net.d",
 				BaseRunDir:   "/var/run/cri",
+				Pull: PullConfig{
+					Timeout: 10 * time.Minute,
+					RegistryTimeouts: map[string]time.Duration{
+						"docker.io": 30 * time.Minute,
+					},
+					Retries: 2,
+					Backoff: 2 * time.Second,
+				},
+				Libraries: map[string]LibraryConfig{
+					"library.example.com": {
+						BaseURL:   "https://library.example.com:8443",
+						TokenFile: "/etc/sycri/library-token",
+						KeyServer: "https://keys.example.com",
+					},
+				},
 			},
 			expectError: nil,
 		},
@@ -134,6 +161,273 @@ func TestValidConfig(t *testing.T) {
 			expectConfig: Config{},
 			expectError:  fmt.Errorf("directory to run containers cannot be empty"),
 		},
+		{
+			name: "negative pull retries",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Pull: PullConfig{
+					Retries: -1,
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("number of pull retries cannot be negative"),
+		},
+		{
+			name: "image GC low watermark above high",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				ImageGC: ImageGCConfig{
+					HighWatermark: 1 << 30,
+					LowWatermark:  2 << 30,
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("image GC low watermark cannot exceed high watermark"),
+		},
+		{
+			name: "invalid library domain",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Libraries: map[string]LibraryConfig{
+					"library.example.com/sylabs": {BaseURL: "https://library.example.com"},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("invalid library domain \"library.example.com/sylabs\""),
+		},
+		{
+			name: "unknown verification mode",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Verify: []VerifyConfig{
+					{Mode: "strict"},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("unknown verification mode \"strict\""),
+		},
+		{
+			name: "duplicate verification scope",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Verify: []VerifyConfig{
+					{Scope: "cloud.sylabs.io", Mode: "warn"},
+					{Scope: "cloud.sylabs.io", Mode: "require"},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("duplicate verification policy scope \"cloud.sylabs.io\""),
+		},
+		{
+			name: "invalid trusted fingerprint",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Verify: []VerifyConfig{
+					{Mode: "require", TrustedFingerprints: []string{"8883491F"}},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("invalid trusted key fingerprint \"8883491F\""),
+		},
+		{
+			name: "relative drop directory",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				DropDir: DropDirConfig{
+					Path: "shared/sif",
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("drop directory path \"shared/sif\" is not absolute"),
+		},
+		{
+			name: "invalid drop directory tag prefix",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				DropDir: DropDirConfig{
+					Path:      "/shared/sif",
+					TagPrefix: "registry.local:5000",
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("invalid drop directory tag prefix \"registry.local:5000\""),
+		},
+		{
+			name: "malformed platform",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Platforms:    []string{"linux/arm64", "linux//v7"},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("invalid platform \"linux//v7\""),
+		},
+		{
+			name: "invalid preloaded image",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Preload:      []string{"k8s.gcr.io/pause:3.1", "busybox latest"},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("invalid preloaded image reference \"busybox latest\""),
+		},
+		{
+			name: "decryption key with both sources",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				DecryptionKeys: []DecryptionKeyConfig{
+					{Namespace: "test", PEMFile: "/etc/sycri/test.pem", PassphraseFile: "/etc/sycri/test.pass"},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("exactly one of pemFile and passphraseFile should be set for decryption key"),
+		},
+		{
+			name: "relative decryption key path",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				DecryptionKeys: []DecryptionKeyConfig{
+					{Scope: "registry.local", PassphraseFile: "keys/local.pass"},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("decryption key path \"keys/local.pass\" is not absolute"),
+		},
+		{
+			name: "negative scrub interval",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Integrity: IntegrityConfig{
+					Scrub:         true,
+					ScrubInterval: -time.Hour,
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("image scrub interval cannot be negative"),
+		},
+		{
+			name: "relative docker config",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Credentials: CredentialsConfig{
+					RegistryDockerConfigs: map[string]string{
+						"registry.example.com": "config.json",
+					},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("docker config path \"config.json\" is not absolute"),
+		},
+		{
+			name: "relative build cache directory",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Build: BuildConfig{
+					CacheDir: "cache",
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("build directory path \"cache\" is not absolute"),
+		},
+		{
+			name: "build cache limit without directory",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Build: BuildConfig{
+					MaxCacheSize: 10 << 30,
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("build cache size limit requires cache directory"),
+		},
+		{
+			name: "invalid shared storage node name",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				SharedStorage: SharedStorageConfig{
+					Enabled:  true,
+					NodeName: "../node1",
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("invalid shared storage node name \"../node1\""),
+		},
+		{
+			name: "lazy pulls with shared storage",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Pull: PullConfig{
+					Lazy: true,
+				},
+				SharedStorage: SharedStorageConfig{
+					Enabled: true,
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("lazy pulls cannot be used with shared storage"),
+		},
+		{
+			name: "local cache without size",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				LocalCache: LocalCacheConfig{
+					Dir: "/mnt/ssd/singularity",
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("local cache size cannot be zero"),
+		},
+		{
+			name: "invalid sandbox pool sysctl",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				SandboxPool: SandboxPoolConfig{
+					Size:    10,
+					Sysctls: []string{"net.*.ip_forward"},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("invalid sandbox pool sysctl %q", "net.*.ip_forward"),
+		},
 		{
 			name: "minimum valid",
 			input: Config{
@@ -157,6 +451,58 @@ func TestValidConfig(t *testing.T) {
 				CNIBinDir:    "/my/test/cni/bin",
 				CNIConfDir:   "/etc/cni/config",
 				BaseRunDir:   "/var/run/cri",
+				Platforms:    []string{"linux/arm64", "amd64"},
+				Preload:      []string{"k8s.gcr.io/pause:3.1"},
+				Pull: PullConfig{
+					Timeout: 10 * time.Minute,
+					Lazy:    true,
+				},
+				Credentials: CredentialsConfig{
+					DockerConfigs: []string{"/var/lib/kubelet/config.json"},
+					RegistryDockerConfigs: map[string]string{
+						"registry.example.com": "/etc/sycri/registry.example.com.json",
+					},
+				},
+				Build: BuildConfig{
+					CacheDir:       "/var/cache/sycri",
+					TmpDir:         "/var/tmp/sycri",
+					PassEnv:        []string{"HTTPS_PROXY", "NO_PROXY"},
+					MksquashfsArgs: "-comp zstd",
+					FixPerms:       true,
+					MaxCacheSize:   10 << 30,
+				},
+				Verify: []VerifyConfig{
+					{Mode: "warn"},
+					{Scope: "cloud.sylabs.io", Mode: "require", Keyring: "/etc/sycri/pubring.gpg",
+						TrustedFingerprints: []string{"8883491F4268F173C6E5DC49EDECE4F3F38D871E"}},
+				},
+				Integrity: IntegrityConfig{
+					CheckOnCreate: true,
+					Scrub:         true,
+					ScrubInterval: 12 * time.Hour,
+				},
+				DecryptionKeys: []DecryptionKeyConfig{
+					{Namespace: "payments", PEMFile: "/etc/sycri/keys/payments.pem"},
+					{Scope: "registry.local", PassphraseFile: "/etc/sycri/keys/local.pass"},
+				},
+				DropDir: DropDirConfig{
+					Path:      "/shared/sif",
+					TagPrefix: "registry.local",
+					Interval:  time.Minute,
+				},
+				SharedStorage: SharedStorageConfig{
+					NodeName:     "node1",
+					SyncInterval: time.Minute,
+				},
+				LocalCache: LocalCacheConfig{
+					Dir:  "/mnt/ssd/singularity",
+					Size: 100 << 30,
+				},
+				SandboxPool: SandboxPoolConfig{
+					Size:       10,
+					Namespaces: []string{"batch"},
+					Sysctls:    []string{"net.ipv4.*"},
+				},
 			},
 			expectConfig: Config{
 				ListenSocket: "/var/run/sycri.sock",
@@ -165,6 +511,58 @@ func TestValidConfig(t *testing.T) {
 				CNIBinDir:    "/my/test/cni/bin",
 				CNIConfDir:   "/etc/cni/config",
 				BaseRunDir:   "/var/run/cri",
+				Platforms:    []string{"linux/arm64", "amd64"},
+				Preload:      []string{"k8s.gcr.io/pause:3.1"},
+				Pull: PullConfig{
+					Timeout: 10 * time.Minute,
+					Lazy:    true,
+				},
+				Credentials: CredentialsConfig{
+					DockerConfigs: []string{"/var/lib/kubelet/config.json"},
+					RegistryDockerConfigs: map[string]string{
+						"registry.example.com": "/etc/sycri/registry.example.com.json",
+					},
+				},
+				Build: BuildConfig{
+					CacheDir:       "/var/cache/sycri",
+					TmpDir:         "/var/tmp/sycri",
+					PassEnv:        []string{"HTTPS_PROXY", "NO_PROXY"},
+					MksquashfsArgs: "-comp zstd",
+					FixPerms:       true,
+					MaxCacheSize:   10 << 30,
+				},
+				Verify: []VerifyConfig{
+					{Mode: "warn"},
+					{Scope: "cloud.sylabs.io", Mode: "require", Keyring: "/etc/sycri/pubring.gpg",
+						TrustedFingerprints: []string{"8883491F4268F173C6E5DC49EDECE4F3F38D871E"}},
+				},
+				Integrity: IntegrityConfig{
+					CheckOnCreate: true,
+					Scrub:         true,
+					ScrubInterval: 12 * time.Hour,
+				},
+				DecryptionKeys: []DecryptionKeyConfig{
+					{Namespace: "payments", PEMFile: "/etc/sycri/keys/payments.pem"},
+					{Scope: "registry.local", PassphraseFile: "/etc/sycri/keys/local.pass"},
+				},
+				DropDir: DropDirConfig{
+					Path:      "/shared/sif",
+					TagPrefix: "registry.local",
+					Interval:  time.Minute,
+				},
+				SharedStorage: SharedStorageConfig{
+					NodeName:     "node1",
+					SyncInterval: time.Minute,
+				},
+				LocalCache: LocalCacheConfig{
+					Dir:  "/mnt/ssd/singularity",
+					Size: 100 << 30,
+				},
+				SandboxPool: SandboxPoolConfig{
+					Size:       10,
+					Namespaces: []string{"batch"},
+					Sysctls:    []string{"net.ipv4.*"},
+				},
 			},
 			expectError: nil,
 		},
@@ -0,0 +1,119 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sylabs/singularity-cri/pkg/server/image"
+)
+
+// daemonDialTimeout limits time spent on checking whether daemon is running.
+const daemonDialTimeout = time.Second
+
+// runImages runs images subcommand, args hold subcommand name and its arguments.
+// Supported subcommands are:
+//
+//	images export [-o file] [image...]
+//	images import [-i file]
+//
+// Export writes images, all of them unless some are passed, along with their
+// metadata into a single tar bundle. Import restores such bundle into storage
+// directory; when daemon is running bundle is handed to it instead.
+func runImages(config Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("images subcommand is expected: export or import")
+	}
+
+	flags := flag.NewFlagSet("images "+args[0], flag.ContinueOnError)
+	switch args[0] {
+	case "export":
+		output := flags.String("o", "", "file to write bundle to, stdout by default")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return exportImages(config, *output, flags.Args())
+	case "import":
+		input := flags.String("i", "", "file to read bundle from, stdin by default")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		return importImages(config, *input)
+	default:
+		return fmt.Errorf("unknown images subcommand %q", args[0])
+	}
+}
+
+func exportImages(config Config, output string, refs []string) error {
+	if output == "" {
+		return image.ExportBundle(config.StorageDir, os.Stdout, refs...)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("could not create bundle file: %v", err)
+	}
+	err = image.ExportBundle(config.StorageDir, f, refs...)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	return nil
+}
+
+func importImages(config Config, input string) error {
+	var r io.Reader = os.Stdin
+	if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("could not open bundle file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if daemonRunning(config.ListenSocket) {
+		path, err := image.SpoolBundle(config.StorageDir, r)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Bundle is handed to running daemon as %s\n", path)
+		return nil
+	}
+	n, err := image.ImportBundle(config.StorageDir, r)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d images\n", n)
+	return nil
+}
+
+// daemonRunning returns true if daemon accepts connections on socket.
+func daemonRunning(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, daemonDialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -27,7 +27,9 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/sylabs/singularity-cri/pkg/fs"
+	sifimage "github.com/sylabs/singularity-cri/pkg/image"
 	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/kube"
 	"github.com/sylabs/singularity-cri/pkg/server/device"
 	"github.com/sylabs/singularity-cri/pkg/server/image"
 	"github.com/sylabs/singularity-cri/pkg/server/runtime"
@@ -74,6 +76,15 @@ func main() {
 		return
 	}
 
+	if flag.Arg(0) == "images" {
+		if err := runImages(config, flag.Args()[1:]); err != nil {
+			glog.Errorf("Could not run images command: %v", err)
+			logs.FlushLogs()
+			os.Exit(1)
+		}
+		return
+	}
+
 	// initialize user agent strings
 	useragent.InitValue("singularity", "3.1.0")
 	unix.Umask(0)
@@ -150,19 +161,136 @@ func main() {
 
 }
 
+// platforms converts platform preference list into platforms image service uses.
+// Config is validated beforehand, so parse errors are not expected here.
+func platforms(config []string) []sifimage.Platform {
+	platforms := make([]sifimage.Platform, 0, len(config))
+	for _, c := range config {
+		platform, _ := sifimage.ParsePlatform(c)
+		platforms = append(platforms, platform)
+	}
+	return platforms
+}
+
+// verifyPolicies converts verification config into policies image service uses.
+func verifyPolicies(config []VerifyConfig) []sifimage.VerifyPolicy {
+	policies := make([]sifimage.VerifyPolicy, 0, len(config))
+	for _, c := range config {
+		policies = append(policies, sifimage.VerifyPolicy{
+			Scope:               c.Scope,
+			Mode:                sifimage.VerifyMode(c.Mode),
+			TrustedFingerprints: c.TrustedFingerprints,
+			Keyring:             c.Keyring,
+			KeyServer:           c.KeyServer,
+		})
+	}
+	return policies
+}
+
+// decryptionKeys converts decryption key config into keys runtime service uses.
+func decryptionKeys(config []DecryptionKeyConfig) []sifimage.DecryptionKey {
+	keys := make([]sifimage.DecryptionKey, 0, len(config))
+	for _, c := range config {
+		keys = append(keys, sifimage.DecryptionKey{
+			Namespace:      c.Namespace,
+			Scope:          c.Scope,
+			PEMFile:        c.PEMFile,
+			PassphraseFile: c.PassphraseFile,
+		})
+	}
+	return keys
+}
+
+// libraryEndpoints converts library config into endpoints image service uses.
+func libraryEndpoints(config map[string]LibraryConfig) []image.LibraryEndpoint {
+	endpoints := make([]image.LibraryEndpoint, 0, len(config))
+	for host, c := range config {
+		endpoints = append(endpoints, image.LibraryEndpoint{
+			Host:      host,
+			BaseURL:   c.BaseURL,
+			TokenFile: c.TokenFile,
+			KeyServer: c.KeyServer,
+		})
+	}
+	return endpoints
+}
+
 func startCRI(ctx context.Context, wg *sync.WaitGroup, config Config) error {
 	imageIndex := index.NewImageIndex()
-	syImage, err := image.NewSingularityRegistry(config.StorageDir, imageIndex)
+	imageOpts := []image.Option{
+		image.WithPullTimeout(config.Pull.Timeout, config.Pull.RegistryTimeouts),
+		image.WithPullRetries(config.Pull.Retries, config.Pull.Backoff, config.Pull.MaxBackoff),
+		image.WithContainerDir(config.BaseRunDir),
+		image.WithPlatforms(platforms(config.Platforms)...),
+		image.WithPreload(config.Preload...),
+		image.WithVerifyPolicies(verifyPolicies(config.Verify)...),
+		image.WithLibraries(libraryEndpoints(config.Libraries)...),
+		image.WithDockerConfig(config.Credentials.DockerConfigs, config.Credentials.RegistryDockerConfigs),
+		image.WithBuildConfig(&sifimage.BuildConfig{
+			CacheDir:       config.Build.CacheDir,
+			TmpDir:         config.Build.TmpDir,
+			PassEnv:        config.Build.PassEnv,
+			MksquashfsArgs: config.Build.MksquashfsArgs,
+			FixPerms:       config.Build.FixPerms,
+			MaxCacheSize:   config.Build.MaxCacheSize,
+		}),
+	}
+	if config.ImageGC.HighWatermark != 0 {
+		imageOpts = append(imageOpts, image.WithGC(config.ImageGC.HighWatermark,
+			config.ImageGC.LowWatermark, config.ImageGC.Interval))
+	}
+	if config.DropDir.Path != "" {
+		imageOpts = append(imageOpts, image.WithDropDir(config.DropDir.Path,
+			config.DropDir.TagPrefix, config.DropDir.Interval))
+	}
+	if config.Integrity.Scrub {
+		imageOpts = append(imageOpts, image.WithScrubber(config.Integrity.ScrubInterval))
+	}
+	if config.Pull.Lazy {
+		imageOpts = append(imageOpts, image.WithLazyPull())
+	}
+	if config.SharedStorage.Enabled {
+		node := config.SharedStorage.NodeName
+		if node == "" {
+			var err error
+			if node, err = os.Hostname(); err != nil {
+				return fmt.Errorf("could not get host name: %v", err)
+			}
+		}
+		imageOpts = append(imageOpts, image.WithSharedStorage(node, config.SharedStorage.SyncInterval))
+	}
+	var imageCache *sifimage.Cache
+	if config.LocalCache.Dir != "" {
+		var err error
+		imageCache, err = sifimage.NewCache(config.LocalCache.Dir, config.LocalCache.Size)
+		if err != nil {
+			return fmt.Errorf("could not create image cache: %v", err)
+		}
+		imageOpts = append(imageOpts, image.WithLocalCache(imageCache))
+	}
+	syImage, err := image.NewSingularityRegistry(config.StorageDir, imageIndex, imageOpts...)
 	if err != nil {
 		return fmt.Errorf("could not create Singularity image service: %v", err)
 	}
-	syRuntime, err := runtime.NewSingularityRuntime(
-		imageIndex,
+	runtimeOpts := []runtime.Option{
 		runtime.WithStreaming(config.StreamingURL),
 		runtime.WithNetwork(config.CNIBinDir, config.CNIConfDir),
 		runtime.WithBaseRunDir(config.BaseRunDir),
 		runtime.WithTrashDir(config.TrashDir),
-	)
+		runtime.WithDecryptionKeys(decryptionKeys(config.DecryptionKeys)...),
+		runtime.WithImageCache(imageCache),
+		runtime.WithSandboxPool(config.SandboxPool.Size, kube.PoolRules{
+			Namespaces: config.SandboxPool.Namespaces,
+			Sysctls:    config.SandboxPool.Sysctls,
+		}),
+		runtime.WithStatusInfo("imageGC", syImage.GCStatus),
+		runtime.WithStatusInfo("imageScrub", syImage.ScrubStatus),
+		runtime.WithStatusInfo("filesystems", syImage.FsStatus),
+	}
+	if config.Integrity.CheckOnCreate {
+		runtimeOpts = append(runtimeOpts, runtime.WithIntegrityCheck())
+	}
+	syRuntime, err := runtime.NewSingularityRuntime(imageIndex, runtimeOpts...)
 	if err != nil {
 		return fmt.Errorf("could not create Singularity runtime service: %v", err)
 	}
@@ -12,6 +12,7 @@ require (
 	github.com/golang/glog v1.1.0
 	github.com/kr/pty v1.1.8
 	github.com/kubernetes-sigs/cri-o v1.12.3
+	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.1.0-rc4
 	github.com/opencontainers/runc v1.1.8
 	github.com/opencontainers/runtime-spec v1.1.0
@@ -19,8 +20,10 @@ require (
 	github.com/opencontainers/selinux v1.11.0
 	github.com/stretchr/testify v1.8.2
 	github.com/sylabs/scs-library-client v0.4.4
+	github.com/sylabs/sif v1.0.8
 	github.com/sylabs/singularity v0.0.0-20190918134918-5d9975e95fa7
 	github.com/tchap/go-patricia v2.2.6+incompatible
+	golang.org/x/crypto v0.11.0
 	golang.org/x/sys v0.10.0
 	google.golang.org/grpc v1.55.0
 	gopkg.in/yaml.v2 v2.4.0
@@ -57,7 +60,6 @@ require (
 	github.com/moby/sys/mountinfo v0.6.2 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
-	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/safchain/ethtool v0.3.0 // indirect
 	github.com/satori/go.uuid v1.2.0 // indirect
@@ -67,11 +69,9 @@ require (
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/sylabs/json-resp v0.9.0 // indirect
 	github.com/sylabs/scs-key-client v0.3.0-0.20190509220229-bce3b050c4ec // indirect
-	github.com/sylabs/sif v1.0.8 // indirect
 	github.com/syndtr/gocapability v0.0.0-20200815063812-42c35b437635 // indirect
 	github.com/vishvananda/netlink v1.2.1-beta.2 // indirect
 	github.com/vishvananda/netns v0.0.4 // indirect
-	golang.org/x/crypto v0.11.0 // indirect
 	golang.org/x/net v0.11.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/text v0.11.0 // indirect
@@ -0,0 +1,64 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TempSuffix is appended to a path to get a name of the temporary
+// file WriteFileAtomic writes data to before it is renamed.
+const TempSuffix = ".tmp"
+
+// WriteFileAtomic writes data to the file located at path so that readers
+// observe either its previous or its new content even if writer crashes.
+// Data is written to a temporary file in the same directory that is synced
+// to disk and renamed over path. Concurrent writes of the same path
+// should be serialized by the caller.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + TempSuffix
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %v", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not write temporary file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not rename temporary file: %v", err)
+	}
+
+	// sync parent directory so that rename itself survives a crash
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("could not open parent directory: %v", err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("could not sync parent directory: %v", err)
+	}
+	return nil
+}
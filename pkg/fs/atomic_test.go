@@ -0,0 +1,43 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic-test")
+	require.NoError(t, err, "could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "registry.json")
+	require.NoError(t, WriteFileAtomic(path, []byte("first"), 0644), "could not write file")
+	require.NoError(t, WriteFileAtomic(path, []byte("second"), 0644), "could not overwrite file")
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "could not read file")
+	require.Equal(t, "second", string(data))
+	_, err = os.Stat(path + TempSuffix)
+	require.True(t, os.IsNotExist(err), "temporary file is left")
+
+	err = WriteFileAtomic(filepath.Join(dir, "missing", "registry.json"), []byte("third"), 0644)
+	require.Error(t, err, "expected error, but got nil")
+}
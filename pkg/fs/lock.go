@@ -0,0 +1,78 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// minLockPoll and maxLockPoll limit delay between attempts to acquire a
+	// lock held by someone else. Blocking lock calls cannot be interrupted,
+	// so locks are polled to respect context cancellation.
+	minLockPoll = 10 * time.Millisecond
+	maxLockPoll = 500 * time.Millisecond
+)
+
+// Lock is an exclusive advisory lock held on a file. Open file description
+// locks are used, so a lock also excludes other goroutines of the same
+// process and is honored on other hosts by network filesystems that
+// support POSIX locks, e.g. NFS.
+type Lock struct {
+	f *os.File
+}
+
+// LockFile acquires exclusive lock on the file located at path creating
+// that file if needed. It blocks until lock is acquired or ctx is done.
+func LockFile(ctx context.Context, path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file: %v", err)
+	}
+	flock := unix.Flock_t{
+		Type: unix.F_WRLCK,
+	}
+	poll := minLockPoll
+	for {
+		err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &flock)
+		if err == nil {
+			return &Lock{f: f}, nil
+		}
+		if err != unix.EAGAIN && err != unix.EACCES {
+			f.Close()
+			return nil, fmt.Errorf("could not lock %s: %v", path, err)
+		}
+		select {
+		case <-time.After(poll):
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("could not lock %s: %v", path, ctx.Err())
+		}
+		if poll *= 2; poll > maxLockPoll {
+			poll = maxLockPoll
+		}
+	}
+}
+
+// Unlock releases the lock. Closing lock file releases
+// the lock even if process does not exit gracefully.
+func (l *Lock) Unlock() error {
+	return l.f.Close()
+}
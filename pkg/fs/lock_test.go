@@ -0,0 +1,61 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-test")
+	require.NoError(t, err, "could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "registry.lock")
+	lock, err := LockFile(context.Background(), path)
+	require.NoError(t, err, "could not acquire lock")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = LockFile(ctx, path)
+	require.Error(t, err, "lock is acquired twice")
+
+	acquired := make(chan error, 1)
+	go func() {
+		lock, err := LockFile(context.Background(), path)
+		if err == nil {
+			err = lock.Unlock()
+		}
+		acquired <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, lock.Unlock(), "could not release lock")
+	select {
+	case err := <-acquired:
+		require.NoError(t, err, "could not acquire released lock")
+	case <-time.After(5 * time.Second):
+		t.Fatal("released lock is not acquired")
+	}
+
+	_, err = LockFile(context.Background(), filepath.Join(dir, "missing", "registry.lock"))
+	require.Error(t, err, "expected error, but got nil")
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// CapacityInfo holds capacity metrics of a filesystem.
+type CapacityInfo struct {
+	// Bytes is the total size of the filesystem.
+	Bytes uint64
+	// AvailableBytes is the space available to unprivileged users.
+	AvailableBytes uint64
+	// Inodes is the total number of inodes on the filesystem.
+	Inodes uint64
+	// FreeInodes is the number of free inodes on the filesystem.
+	FreeInodes uint64
+}
+
+// Capacity collects capacity metrics of the filesystem path resides on.
+func Capacity(path string) (*CapacityInfo, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return nil, fmt.Errorf("could not statfs %q: %v", path, err)
+	}
+
+	bsize := uint64(stat.Bsize)
+	return &CapacityInfo{
+		Bytes:          stat.Blocks * bsize,
+		AvailableBytes: stat.Bavail * bsize,
+		Inodes:         stat.Files,
+		FreeInodes:     stat.Ffree,
+	}, nil
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapacity(t *testing.T) {
+	t.Run("non-existent path", func(t *testing.T) {
+		info, err := Capacity("/proc/fake")
+		require.Nil(t, info)
+		require.Equal(t, fmt.Errorf(`could not statfs "/proc/fake": no such file or directory`), err)
+	})
+
+	t.Run("all ok", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "capacity-test")
+		require.NoError(t, err, "could not create temp dir")
+		defer os.RemoveAll(dir)
+
+		info, err := Capacity(dir)
+		require.NoError(t, err, "could not get capacity")
+		require.NotZero(t, info.Bytes)
+		require.True(t, info.AvailableBytes <= info.Bytes, "available space exceeds capacity")
+		require.True(t, info.FreeInodes <= info.Inodes, "free inodes exceed capacity")
+	})
+}
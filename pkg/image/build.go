@@ -0,0 +1,252 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const (
+	envCacheDir = "SINGULARITY_CACHEDIR"
+	envTmpDir   = "SINGULARITY_TMPDIR"
+
+	// authFilePrefix is a prefix of private temporary directories
+	// registry credentials are written to for the time of build.
+	authFilePrefix = "sycri-auth-"
+)
+
+// BuildConfig tunes singularity build that converts docker images and local
+// archives into SIF. Zero value builds images with singularity defaults.
+type BuildConfig struct {
+	// CacheDir is singularity cache directory. When empty default cache
+	// directory of the user CRI is running as is used.
+	CacheDir string
+	// TmpDir is a directory temporary build files are created in.
+	// When empty system temporary directory is used.
+	TmpDir string
+	// PassEnv lists names of environment variables that are passed to
+	// build as is, e.g. HTTPS_PROXY. PATH is always passed.
+	PassEnv []string
+	// MksquashfsArgs holds additional mksquashfs options, e.g. compression
+	// settings. Requires singularity that supports --mksquashfs-args.
+	MksquashfsArgs string
+	// FixPerms makes build ensure owner has rwX permissions on all image
+	// files. Requires singularity that supports --fix-perms.
+	FixPerms bool
+	// MaxCacheSize is CacheDir size in bytes that triggers cache cleanup
+	// after build. Zero disables cleanup.
+	MaxCacheSize uint64
+
+	mu sync.RWMutex // locked for reading by builds, for writing by cache cleanup
+}
+
+// WithBuildConfig sets parameters of singularity build that is used
+// to convert docker images and local archives into SIF.
+func WithBuildConfig(config *BuildConfig) PullOption {
+	return func(o *pullOptions) {
+		o.build = config
+	}
+}
+
+// buildImage builds SIF located at pullPath from source, e.g. docker://busybox.
+// Registry credentials, if any, are passed in a private temporary auth file.
+func buildImage(ctx context.Context, pullPath, source string, auth *k8s.AuthConfig, config *BuildConfig) error {
+	if config == nil {
+		config = &BuildConfig{}
+	}
+
+	args := []string{"build", "-F"}
+	if config.FixPerms {
+		args = append(args, "--fix-perms")
+	}
+	if config.MksquashfsArgs != "" {
+		args = append(args, "--mksquashfs-args", config.MksquashfsArgs)
+	}
+	if hasCredentials(auth) {
+		authFile, err := writeAuthFile(config.TmpDir, registryHost(source), auth)
+		if err != nil {
+			return fmt.Errorf("could not write registry auth file: %v", err)
+		}
+		defer func() {
+			if err := os.RemoveAll(filepath.Dir(authFile)); err != nil {
+				glog.Errorf("Could not remove registry auth file: %v", err)
+			}
+		}()
+		args = append(args, "--authfile", authFile)
+	}
+	args = append(args, pullPath, source)
+
+	config.mu.RLock()
+	var errMsg bytes.Buffer
+	buildCmd := exec.CommandContext(ctx, singularity.RuntimeName, args...)
+	buildCmd.Env = config.environ()
+	buildCmd.Stderr = &errMsg
+	buildCmd.Stdout = ioutil.Discard
+	err := buildCmd.Run()
+	config.mu.RUnlock()
+
+	config.cleanupCache()
+	if err != nil {
+		err = fmt.Errorf("could not build image: %s", &errMsg)
+		if isPermanentBuildError(errMsg.String()) {
+			return permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// environ returns environment singularity build is run with.
+func (c *BuildConfig) environ() []string {
+	env := []string{fmt.Sprintf("PATH=%s", os.Getenv("PATH"))}
+	for _, name := range c.PassEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	if c.CacheDir != "" {
+		env = append(env, fmt.Sprintf("%s=%s", envCacheDir, c.CacheDir))
+	}
+	if c.TmpDir != "" {
+		env = append(env,
+			fmt.Sprintf("%s=%s", envTmpDir, c.TmpDir),
+			fmt.Sprintf("TMPDIR=%s", c.TmpDir),
+		)
+	}
+	return env
+}
+
+// cleanupCache removes content of cache directory once its size exceeds
+// MaxCacheSize. Cleanup waits for builds that are in progress to complete.
+func (c *BuildConfig) cleanupCache() {
+	if c.MaxCacheSize == 0 || c.CacheDir == "" {
+		return
+	}
+	size, err := dirSize(c.CacheDir)
+	if err != nil {
+		glog.Errorf("Could not get build cache size: %v", err)
+		return
+	}
+	if size <= c.MaxCacheSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	glog.Infof("Build cache size %d exceeds %d, cleaning up %s", size, c.MaxCacheSize, c.CacheDir)
+	fii, err := ioutil.ReadDir(c.CacheDir)
+	if err != nil {
+		glog.Errorf("Could not read build cache directory: %v", err)
+		return
+	}
+	for _, fi := range fii {
+		if err := os.RemoveAll(filepath.Join(c.CacheDir, fi.Name())); err != nil {
+			glog.Errorf("Could not clean up build cache: %v", err)
+		}
+	}
+}
+
+// dirSize returns total size of regular files located under path.
+func dirSize(path string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += uint64(fi.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+// hasCredentials returns true if auth holds any registry credentials.
+func hasCredentials(auth *k8s.AuthConfig) bool {
+	return auth.GetUsername() != "" || auth.GetPassword() != "" || auth.GetAuth() != "" ||
+		auth.GetIdentityToken() != "" || auth.GetRegistryToken() != ""
+}
+
+// registryHost returns registry domain docker source, e.g.
+// docker://quay.io/sylabs/busybox, is pulled from.
+func registryHost(source string) string {
+	name := source
+	if i := strings.Index(name, "://"); i != -1 {
+		name = name[i+len("://"):]
+	}
+	host := strings.SplitN(name, "/", 2)[0]
+	if !strings.Contains(name, "/") || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return singularity.DockerDomain
+	}
+	return host
+}
+
+// writeAuthFile writes credentials for registry host into a docker config
+// file located in a new private temporary directory under dir and returns
+// path to that file. Caller is responsible for removing the directory.
+func writeAuthFile(dir, host string, auth *k8s.AuthConfig) (string, error) {
+	tmp, err := ioutil.TempDir(dir, authFilePrefix)
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary directory: %v", err)
+	}
+
+	entry := make(map[string]string)
+	if auth.GetUsername() != "" || auth.GetPassword() != "" {
+		creds := fmt.Sprintf("%s:%s", auth.GetUsername(), auth.GetPassword())
+		entry["auth"] = base64.StdEncoding.EncodeToString([]byte(creds))
+	} else if auth.GetAuth() != "" {
+		entry["auth"] = auth.GetAuth()
+	}
+	if auth.GetIdentityToken() != "" {
+		entry["identitytoken"] = auth.GetIdentityToken()
+	}
+	if auth.GetRegistryToken() != "" {
+		entry["registrytoken"] = auth.GetRegistryToken()
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			host: entry,
+		},
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("could not encode credentials: %v", err)
+	}
+
+	path := filepath.Join(tmp, "auth.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("could not write credentials: %v", err)
+	}
+	return path, nil
+}
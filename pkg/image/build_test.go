@@ -0,0 +1,141 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestBuildConfig_Environ(t *testing.T) {
+	os.Setenv("SYCRI_TEST_PROXY", "http://proxy:3128")
+	defer os.Unsetenv("SYCRI_TEST_PROXY")
+	os.Setenv("SYCRI_TEST_SECRET", "secret")
+	defer os.Unsetenv("SYCRI_TEST_SECRET")
+
+	config := &BuildConfig{
+		CacheDir: "/var/cache/sycri",
+		TmpDir:   "/var/tmp/sycri",
+		PassEnv:  []string{"SYCRI_TEST_PROXY", "SYCRI_TEST_MISSING"},
+	}
+	require.Equal(t, []string{
+		"PATH=" + os.Getenv("PATH"),
+		"SYCRI_TEST_PROXY=http://proxy:3128",
+		"SINGULARITY_CACHEDIR=/var/cache/sycri",
+		"SINGULARITY_TMPDIR=/var/tmp/sycri",
+		"TMPDIR=/var/tmp/sycri",
+	}, config.environ())
+	require.Equal(t, []string{"PATH=" + os.Getenv("PATH")}, (&BuildConfig{}).environ())
+}
+
+func TestRegistryHost(t *testing.T) {
+	tt := []struct {
+		source string
+		expect string
+	}{
+		{source: "docker://busybox", expect: "docker.io"},
+		{source: "docker://sylabs/busybox:1.28", expect: "docker.io"},
+		{source: "docker://quay.io/sylabs/busybox", expect: "quay.io"},
+		{source: "docker://localhost/busybox", expect: "localhost"},
+		{source: "docker://registry:5000/busybox", expect: "registry:5000"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.source, func(t *testing.T) {
+			require.Equal(t, tc.expect, registryHost(tc.source))
+		})
+	}
+}
+
+func TestWriteAuthFile(t *testing.T) {
+	tt := []struct {
+		name   string
+		auth   *k8s.AuthConfig
+		expect map[string]string
+	}{
+		{
+			name:   "username and password",
+			auth:   &k8s.AuthConfig{Username: "user", Password: "pass"},
+			expect: map[string]string{"auth": "dXNlcjpwYXNz"},
+		},
+		{
+			name:   "encoded auth",
+			auth:   &k8s.AuthConfig{Auth: "dXNlcjpwYXNz"},
+			expect: map[string]string{"auth": "dXNlcjpwYXNz"},
+		},
+		{
+			name:   "identity token",
+			auth:   &k8s.AuthConfig{IdentityToken: "token"},
+			expect: map[string]string{"identitytoken": "token"},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "auth-file-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := writeAuthFile(dir, "quay.io", tc.auth)
+			require.NoError(t, err, "could not write auth file")
+			defer os.RemoveAll(filepath.Dir(path))
+
+			fi, err := os.Stat(filepath.Dir(path))
+			require.NoError(t, err, "could not stat auth directory")
+			require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+			fi, err = os.Stat(path)
+			require.NoError(t, err, "could not stat auth file")
+			require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+			data, err := ioutil.ReadFile(path)
+			require.NoError(t, err, "could not read auth file")
+			var actual struct {
+				Auths map[string]map[string]string `json:"auths"`
+			}
+			require.NoError(t, json.Unmarshal(data, &actual), "could not decode auth file")
+			require.Equal(t, map[string]map[string]string{"quay.io": tc.expect}, actual.Auths)
+		})
+	}
+	require.False(t, hasCredentials(nil))
+	require.False(t, hasCredentials(&k8s.AuthConfig{ServerAddress: "quay.io"}))
+}
+
+func TestBuildConfig_CleanupCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-cache-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	layers := filepath.Join(dir, "oci-tmp")
+	require.NoError(t, os.Mkdir(layers, 0755), "could not create cache directory")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(layers, "layer"), make([]byte, 1024), 0644), "could not write layer")
+
+	config := &BuildConfig{CacheDir: dir, MaxCacheSize: 1024}
+	config.cleanupCache()
+	_, err = os.Stat(layers)
+	require.NoError(t, err, "cache below limit is cleaned up")
+
+	config.MaxCacheSize = 1000
+	config.cleanupCache()
+	_, err = os.Stat(layers)
+	require.True(t, os.IsNotExist(err), "cache above limit is not cleaned up")
+	_, err = os.Stat(dir)
+	require.NoError(t, err, "cache directory itself is removed")
+}
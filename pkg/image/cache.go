@@ -0,0 +1,334 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+// ErrCacheFull notifies that image does not fit into cache
+// because the rest of cached images are being used.
+var ErrCacheFull = fmt.Errorf("image cache is full")
+
+// Cache is a local tier of image storage, e.g. on a fast SSD, that holds
+// copies of images kept in a larger and slower storage directory. Images are
+// copied when containers are created from them and copies that are not used
+// by any container are evicted least recently used first to fit cache size.
+type Cache struct {
+	dir  string
+	size uint64
+
+	mu      sync.Mutex
+	used    uint64
+	entries map[string]*cacheEntry // keyed by image id
+}
+
+type cacheEntry struct {
+	path     string
+	size     uint64
+	lastUsed time.Time
+	info     *Info         // nil for copies found on startup until promoted again
+	ready    chan struct{} // closed once copy is complete
+	err      error
+}
+
+// NewCache returns cache of images located at dir that takes up to size
+// bytes. Complete copies left by previous runs are reused once their checksum
+// is verified on their first promotion, see Promote.
+func NewCache(dir string, size uint64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %v", err)
+	}
+	c := &Cache{
+		dir:     dir,
+		size:    size,
+		entries: make(map[string]*cacheEntry),
+	}
+	fii, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read cache directory: %v", err)
+	}
+	for _, fi := range fii {
+		path := filepath.Join(dir, fi.Name())
+		if strings.HasPrefix(fi.Name(), pullFilePrefix) {
+			glog.V(2).Infof("Removing incomplete cached image %s", path)
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("could not remove incomplete cached image: %v", err)
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() || len(fi.Name()) != IDLen {
+			continue
+		}
+		ready := make(chan struct{})
+		close(ready)
+		c.entries[fi.Name()] = &cacheEntry{
+			path:     path,
+			size:     uint64(fi.Size()),
+			lastUsed: fi.ModTime(),
+			ready:    ready,
+		}
+		c.used += uint64(fi.Size())
+	}
+	return c, nil
+}
+
+// Dir returns cache directory.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Path returns path to the complete copy of the image with the
+// passed id, or an empty string if image is not cached.
+func (c *Cache) Path(id string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return ""
+	}
+	select {
+	case <-e.ready:
+		if e.err == nil {
+			return e.path
+		}
+	default:
+	}
+	return ""
+}
+
+// Promote returns path to the copy of image in cache, copying image if needed.
+// Copy left by previous run is used once its checksum matches the image, otherwise
+// image is copied again. Concurrent promotions of the same image wait for a single
+// copy. Images that are
+// not kept in storage directory, e.g. local SIF files, as well as lazily pulled
+// images that are not complete yet are not copied and their own path is returned.
+// Image should be borrowed by caller beforehand, so that its copy is not evicted.
+func (c *Cache) Promote(info *Info) (string, error) {
+	if info.Ref.URI() == singularity.LocalFileDomain || info.LazyReader() != nil {
+		return info.Path, nil
+	}
+
+	fi, err := os.Stat(info.Path)
+	if err != nil {
+		return "", fmt.Errorf("could not stat image: %v", err)
+	}
+	size := uint64(fi.Size())
+
+	c.mu.Lock()
+	e, ok := c.entries[info.ID]
+	if ok && e.info != nil {
+		e.lastUsed = time.Now()
+		e.info = info
+		c.mu.Unlock()
+		<-e.ready
+		if e.err != nil {
+			return "", e.err
+		}
+		return e.path, nil
+	}
+	// copy left by previous run is accounted again with size of image
+	reused := e
+	if ok {
+		c.drop(info.ID)
+	}
+	if err := c.reserve(size); err != nil {
+		if ok {
+			c.entries[info.ID] = reused
+			c.used += reused.size
+		}
+		c.mu.Unlock()
+		return "", err
+	}
+	e = &cacheEntry{
+		path:     filepath.Join(c.dir, info.ID),
+		size:     size,
+		lastUsed: time.Now(),
+		info:     info,
+		ready:    make(chan struct{}),
+	}
+	c.entries[info.ID] = e
+	c.mu.Unlock()
+
+	if ok {
+		e.err = checkCopy(info, e.path)
+		if e.err != nil {
+			glog.Warningf("Could not reuse copy of image %s left in cache: %v", info.ID, e.err)
+		}
+	}
+	if !ok || e.err != nil {
+		glog.V(2).Infof("Copying image %s to cache %s", info.ID, c.dir)
+		e.err = copyImage(info, e.path)
+	}
+	close(e.ready)
+	if e.err != nil {
+		c.mu.Lock()
+		c.drop(info.ID)
+		c.mu.Unlock()
+		return "", e.err
+	}
+	return e.path, nil
+}
+
+// Evict removes copy of the image with the passed id from cache. Containers
+// that already use the copy are not affected, since their root filesystems
+// stay mounted. Copies that are being made are left in place.
+func (c *Cache) Evict(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	select {
+	case <-e.ready:
+	default:
+		return nil
+	}
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove cached image: %v", err)
+	}
+	c.drop(id)
+	return nil
+}
+
+// Usage returns number of cached images and their total size in bytes.
+func (c *Cache) Usage() (int, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.used
+}
+
+// reserve evicts unused copies least recently used first until size more
+// bytes fit into cache and accounts them. It should be called with c.mu held.
+func (c *Cache) reserve(size uint64) error {
+	if size > c.size {
+		return ErrCacheFull
+	}
+	var candidates []string
+	for id, e := range c.entries {
+		select {
+		case <-e.ready:
+		default:
+			continue
+		}
+		if e.info != nil && len(e.info.UsedBy()) != 0 {
+			continue
+		}
+		candidates = append(candidates, id)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return c.entries[candidates[i]].lastUsed.Before(c.entries[candidates[j]].lastUsed)
+	})
+	for _, id := range candidates {
+		if c.used+size <= c.size {
+			break
+		}
+		e := c.entries[id]
+		glog.V(2).Infof("Evicting image %s from cache, last used at %s", id, e.lastUsed)
+		if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Could not evict image %s from cache: %v", id, err)
+			continue
+		}
+		c.drop(id)
+	}
+	if c.used+size > c.size {
+		return ErrCacheFull
+	}
+	c.used += size
+	return nil
+}
+
+// drop forgets cached image with the passed id. It should be called with c.mu held.
+func (c *Cache) drop(id string) {
+	e, ok := c.entries[id]
+	if !ok {
+		return
+	}
+	c.used -= e.size
+	delete(c.entries, id)
+}
+
+// checkCopy verifies checksum of image copy located at path. Copies
+// of images with unknown checksum cannot be verified and are rejected.
+func checkCopy(info *Info, path string) error {
+	if info.Sha256 == "" {
+		return fmt.Errorf("image checksum is unknown")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open cached image: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("could not read cached image: %v", err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != info.Sha256 {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// copyImage copies image file to dst verifying its checksum on the way.
+// Data is written to a temporary file that is renamed once complete.
+func copyImage(info *Info, dst string) error {
+	src, err := os.Open(info.Path)
+	if err != nil {
+		return fmt.Errorf("could not open image: %v", err)
+	}
+	defer src.Close()
+
+	tmpPath := filepath.Join(filepath.Dir(dst), pullFilePrefix+info.ID)
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create cached image: %v", err)
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && info.Sha256 != "" && hex.EncodeToString(h.Sum(nil)) != info.Sha256 {
+		err = ErrChecksumMismatch
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dst)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not copy image: %v", err)
+	}
+	return nil
+}
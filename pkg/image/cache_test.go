@@ -0,0 +1,127 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_Promote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+	storage := filepath.Join(dir, "storage")
+	require.NoError(t, os.Mkdir(storage, 0755), "could not create storage directory")
+
+	ref, err := ParseRef("busybox:1.28")
+	require.NoError(t, err, "could not parse reference")
+	newImage := func(data string) *Info {
+		sum := sha256.Sum256([]byte(data))
+		id := hex.EncodeToString(sum[:])
+		path := filepath.Join(storage, id)
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644), "could not write image")
+		return &Info{
+			ID:     id,
+			Sha256: id,
+			Size:   uint64(len(data)),
+			Path:   path,
+			Ref:    ref,
+		}
+	}
+	first := newImage("image #1")
+	second := newImage("image #2")
+	third := newImage("image #3")
+
+	cacheDir := filepath.Join(dir, "cache")
+	cache, err := NewCache(cacheDir, 20)
+	require.NoError(t, err, "could not create cache")
+
+	first.Borrow("container1")
+	path, err := cache.Promote(first)
+	require.NoError(t, err, "could not promote image")
+	require.Equal(t, filepath.Join(cacheDir, first.ID), path)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "could not read cached image")
+	require.Equal(t, "image #1", string(data))
+
+	_, err = cache.Promote(second)
+	require.NoError(t, err, "could not promote image")
+	_, err = cache.Promote(third)
+	require.NoError(t, err, "could not promote image")
+	require.Equal(t, path, cache.Path(first.ID), "used image is evicted")
+	require.Empty(t, cache.Path(second.ID), "least recently used image is kept")
+	require.NotEmpty(t, cache.Path(third.ID), "promoted image is not cached")
+
+	third.Borrow("container3")
+	_, err = cache.Promote(second)
+	require.Equal(t, ErrCacheFull, err)
+	third.Return("container3")
+
+	require.NoError(t, cache.Evict(first.ID), "could not evict image")
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "evicted image is not removed")
+
+	restarted, err := NewCache(cacheDir, 20)
+	require.NoError(t, err, "could not create cache")
+	n, used := restarted.Usage()
+	require.Equal(t, 1, n)
+	require.Equal(t, uint64(len("image #3")), used)
+	require.NotEmpty(t, restarted.Path(third.ID), "cached image is not reused after restart")
+
+	corrupt := newImage("image #4")
+	corrupt.Sha256 = strings.Repeat("0", IDLen)
+	_, err = restarted.Promote(corrupt)
+	require.Error(t, err, "corrupt image is promoted")
+	require.Empty(t, restarted.Path(corrupt.ID), "corrupt image is cached")
+	n, _ = restarted.Usage()
+	require.Equal(t, 1, n)
+
+	local, err := ParseRef("local.file/tmp/busybox.sif")
+	require.NoError(t, err, "could not parse reference")
+	path, err = restarted.Promote(&Info{ID: "local", Path: "/tmp/busybox.sif", Ref: local})
+	require.NoError(t, err, "could not promote local image")
+	require.Equal(t, "/tmp/busybox.sif", path)
+
+	// copies left by previous run are verified on first promotion
+	cached := filepath.Join(cacheDir, third.ID)
+	before, err := os.Stat(cached)
+	require.NoError(t, err, "could not stat cached image")
+	path, err = restarted.Promote(third)
+	require.NoError(t, err, "could not promote image")
+	require.Equal(t, cached, path)
+	after, err := os.Stat(cached)
+	require.NoError(t, err, "could not stat cached image")
+	require.True(t, os.SameFile(before, after), "valid cached image is copied again")
+
+	require.NoError(t, ioutil.WriteFile(cached, []byte("image #0"), 0644), "could not corrupt cached image")
+	restarted, err = NewCache(cacheDir, 20)
+	require.NoError(t, err, "could not create cache")
+	path, err = restarted.Promote(third)
+	require.NoError(t, err, "could not promote image")
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err, "could not read cached image")
+	require.Equal(t, "image #3", string(data), "corrupt cached image is reused")
+	n, used = restarted.Usage()
+	require.Equal(t, 1, n)
+	require.Equal(t, uint64(len("image #3")), used)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const (
+	// credentialHelperPrefix is a prefix of docker credential helper executables.
+	credentialHelperPrefix = "docker-credential-"
+	// dockerIndexServer is a server address docker uses for docker.io credentials.
+	dockerIndexServer = "https://index.docker.io/v1/"
+	// identityTokenUser is a username credential helpers report
+	// when secret is an identity token rather than a password.
+	identityTokenUser = "<token>"
+)
+
+// CredentialResolver looks up registry credentials for pulls that come
+// without them, e.g. from crictl or image preload. Zero value resolves nothing.
+type CredentialResolver struct {
+	// ConfigFiles lists docker config.json files that are consulted in order.
+	ConfigFiles []string
+	// RegistryConfigFiles holds docker config.json files keyed by registry
+	// domain. They are consulted before ConfigFiles for that registry.
+	RegistryConfigFiles map[string]string
+	// TokenFiles holds paths to files with library access tokens
+	// keyed by library domain. They are used as the last resort.
+	TokenFiles map[string]string
+}
+
+// dockerConfig is a part of docker config.json that holds credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+	CredsStore  string                `json:"credsStore"`
+}
+
+// dockerAuth is a single credentials entry of docker config.json.
+type dockerAuth struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// helperCredentials is an output of credential helper get command.
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// Resolve returns credentials that should be used to pull image referenced by
+// ref. Explicitly passed credentials take precedence, otherwise docker config
+// files are searched for the image registry, including credential helpers they
+// refer to, and library token files are checked after that. When nothing is
+// found passed auth is returned as is. Passed auth is never modified.
+func (r *CredentialResolver) Resolve(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*k8s.AuthConfig, error) {
+	if r == nil || hasCredentials(auth) {
+		return auth, nil
+	}
+	host := ref.Registry()
+	if host == "" {
+		return auth, nil
+	}
+
+	resolved := &k8s.AuthConfig{}
+	if auth != nil {
+		*resolved = *auth
+	}
+
+	var files []string
+	if file, ok := r.RegistryConfigFiles[host]; ok {
+		files = append(files, file)
+	}
+	files = append(files, r.ConfigFiles...)
+	for _, file := range files {
+		found, err := resolveFromConfig(ctx, file, host, resolved)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			glog.V(4).Infof("Using %s credentials from %s", host, file)
+			return resolved, nil
+		}
+	}
+
+	if file, ok := r.TokenFiles[host]; ok && ref.URI() == singularity.LibraryDomain {
+		token, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read library token: %v", err)
+		}
+		resolved.Password = strings.TrimSpace(string(token))
+		return resolved, nil
+	}
+	return auth, nil
+}
+
+// resolveFromConfig fills auth with credentials for registry host found in docker
+// config file. It returns false if file does not exist or has no such credentials.
+func resolveFromConfig(ctx context.Context, file, host string, auth *k8s.AuthConfig) (bool, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		glog.V(4).Infof("Docker config file %s does not exist, skipping", file)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read docker config: %v", err)
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return false, fmt.Errorf("could not decode docker config %s: %v", file, err)
+	}
+
+	for server, helper := range config.CredHelpers {
+		if normalizeRegistry(server) == host {
+			return runCredentialHelper(ctx, helper, host, auth)
+		}
+	}
+	for server, entry := range config.Auths {
+		if normalizeRegistry(server) != host {
+			continue
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return false, fmt.Errorf("could not decode %s auth in %s: %v", server, file, err)
+			}
+			creds := strings.SplitN(string(decoded), ":", 2)
+			if len(creds) != 2 {
+				return false, fmt.Errorf("malformed %s auth in %s", server, file)
+			}
+			entry.Username, entry.Password = creds[0], creds[1]
+		}
+		auth.Username = entry.Username
+		auth.Password = entry.Password
+		auth.IdentityToken = entry.IdentityToken
+		auth.RegistryToken = entry.RegistryToken
+		return true, nil
+	}
+	if config.CredsStore != "" {
+		return runCredentialHelper(ctx, config.CredsStore, host, auth)
+	}
+	return false, nil
+}
+
+// runCredentialHelper gets credentials for registry host from docker credential
+// helper according to docker credential helper protocol. It returns false
+// if helper has no credentials for that host.
+func runCredentialHelper(ctx context.Context, helper, host string, auth *k8s.AuthConfig) (bool, error) {
+	server := host
+	if host == singularity.DockerDomain {
+		server = dockerIndexServer
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(strings.ToLower(stdout.String()), "credentials not found") {
+			glog.V(4).Infof("Credential helper %s has no credentials for %s", helper, host)
+			return false, nil
+		}
+		return false, fmt.Errorf("could not run credential helper %s: %v: %s", helper, err, &stderr)
+	}
+
+	var creds helperCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return false, fmt.Errorf("could not decode credential helper %s output: %v", helper, err)
+	}
+	if creds.Username == identityTokenUser {
+		auth.IdentityToken = creds.Secret
+		return true, nil
+	}
+	auth.Username = creds.Username
+	auth.Password = creds.Secret
+	return true, nil
+}
+
+// normalizeRegistry returns registry domain of docker config key,
+// which may be a full server URL, e.g. https://index.docker.io/v1/.
+func normalizeRegistry(server string) string {
+	if i := strings.Index(server, "://"); i != -1 {
+		server = server[i+len("://"):]
+	}
+	server = strings.SplitN(server, "/", 2)[0]
+	switch server {
+	case "index.docker.io", "registry-1.docker.io":
+		return singularity.DockerDomain
+	}
+	return server
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const testCredentialHelper = `#!/bin/sh
+read server
+case "$server" in
+https://index.docker.io/v1/)
+	echo '{"ServerURL":"'$server'","Username":"helper","Secret":"helper-pass"}' ;;
+gcr.io)
+	echo '{"ServerURL":"gcr.io","Username":"<token>","Secret":"identity"}' ;;
+*)
+	echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+
+func TestCredentialResolver_Resolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	helper := filepath.Join(dir, credentialHelperPrefix+"test")
+	require.NoError(t, ioutil.WriteFile(helper, []byte(testCredentialHelper), 0755), "could not write helper")
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600), "could not write %s", name)
+		return path
+	}
+	global := writeFile("config.json", `{
+		"auths": {
+			"https://quay.io/v1/": {"auth": "dXNlcjpwYXNz"},
+			"registry.example.com": {"username": "global", "password": "global-pass"}
+		},
+		"credHelpers": {"gcr.io": "test"},
+		"credsStore": "test"
+	}`)
+	perRegistry := writeFile("example.json", `{
+		"auths": {"registry.example.com": {"username": "scoped", "password": "scoped-pass"}}
+	}`)
+	token := writeFile("token", "library-token\n")
+
+	resolver := &CredentialResolver{
+		ConfigFiles:         []string{filepath.Join(dir, "missing.json"), global},
+		RegistryConfigFiles: map[string]string{"registry.example.com": perRegistry},
+		TokenFiles:          map[string]string{"library.example.com": token},
+	}
+
+	tt := []struct {
+		name   string
+		ref    string
+		auth   *k8s.AuthConfig
+		expect *k8s.AuthConfig
+	}{
+		{
+			name:   "explicit credentials",
+			ref:    "quay.io/sylabs/busybox",
+			auth:   &k8s.AuthConfig{Username: "kubelet", Password: "kubelet-pass"},
+			expect: &k8s.AuthConfig{Username: "kubelet", Password: "kubelet-pass"},
+		},
+		{
+			name:   "encoded auth",
+			ref:    "quay.io/sylabs/busybox",
+			expect: &k8s.AuthConfig{Username: "user", Password: "pass"},
+		},
+		{
+			name:   "per registry config",
+			ref:    "registry.example.com/busybox",
+			auth:   &k8s.AuthConfig{ServerAddress: "registry.example.com"},
+			expect: &k8s.AuthConfig{ServerAddress: "registry.example.com", Username: "scoped", Password: "scoped-pass"},
+		},
+		{
+			name:   "credential helper identity token",
+			ref:    "gcr.io/google-containers/pause",
+			expect: &k8s.AuthConfig{IdentityToken: "identity"},
+		},
+		{
+			name:   "credentials store",
+			ref:    "busybox",
+			expect: &k8s.AuthConfig{Username: "helper", Password: "helper-pass"},
+		},
+		{
+			name:   "credentials store without credentials",
+			ref:    "ghcr.io/sylabs/busybox",
+			expect: nil,
+		},
+		{
+			name:   "library token",
+			ref:    "library://library.example.com/sylabs/tests/busybox:1.0.0",
+			expect: &k8s.AuthConfig{Password: "library-token"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err, "could not parse reference")
+			auth, err := resolver.Resolve(context.Background(), ref, tc.auth)
+			require.NoError(t, err, "could not resolve credentials")
+			require.Equal(t, tc.expect, auth)
+		})
+	}
+
+	t.Run("nil resolver", func(t *testing.T) {
+		ref, err := ParseRef("busybox")
+		require.NoError(t, err, "could not parse reference")
+		var resolver *CredentialResolver
+		auth, err := resolver.Resolve(context.Background(), ref, nil)
+		require.NoError(t, err)
+		require.Nil(t, auth)
+	})
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity/pkg/image"
+)
+
+// DecryptionKey holds a key that is used to open encrypted SIF images
+// matching Scope for containers of pods in Namespace. Exactly one of
+// PEMFile and PassphraseFile should be set.
+type DecryptionKey struct {
+	// Namespace is a Kubernetes namespace key is restricted to.
+	// Empty namespace matches all namespaces.
+	Namespace string
+	// Scope is either a registry domain, e.g. cloud.sylabs.io, or
+	// an image reference prefix, e.g. cloud.sylabs.io/sylabs/tests.
+	// Empty scope matches all images.
+	Scope string
+	// PEMFile is a path to RSA private key in PEM format. The key is used
+	// to decrypt passphrase that is stored in the image itself.
+	PEMFile string
+	// PassphraseFile is a path to a file holding plaintext passphrase.
+	// Trailing newline, if any, is not considered a part of passphrase.
+	PassphraseFile string
+}
+
+// String returns a short key description that is safe to log.
+func (k DecryptionKey) String() string {
+	if k.PEMFile != "" {
+		return fmt.Sprintf("PEM key %s", k.PEMFile)
+	}
+	return fmt.Sprintf("passphrase %s", k.PassphraseFile)
+}
+
+// Matches returns true if key may be used to decrypt image referenced
+// by ref for containers of pods in the passed namespace. Scope is matched
+// against all image tags and digests, since containers are created with
+// image ID or any of them, not necessarily with the first one.
+func (k DecryptionKey) Matches(namespace string, ref *Reference) bool {
+	if k.Namespace != "" && k.Namespace != namespace {
+		return false
+	}
+	for _, tag := range ref.Tags() {
+		if scopeMatches(k.Scope, &Reference{uri: ref.URI(), tags: []string{tag}}) {
+			return true
+		}
+	}
+	for _, digest := range ref.Digests() {
+		if scopeMatches(k.Scope, &Reference{uri: ref.URI(), digests: []string{digest}}) {
+			return true
+		}
+	}
+	return scopeMatches(k.Scope, ref)
+}
+
+// Plaintext returns passphrase encrypted root filesystem of
+// SIF image located at imgPath may be opened with.
+func (k DecryptionKey) Plaintext(imgPath string) ([]byte, error) {
+	if k.PEMFile == "" {
+		passphrase, err := ioutil.ReadFile(k.PassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase: %v", err)
+		}
+		return bytes.TrimSuffix(passphrase, []byte("\n")), nil
+	}
+
+	privateKey, err := loadPEMPrivateKey(k.PEMFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load private key: %v", err)
+	}
+	message, err := cryptoMessage(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, message, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt passphrase: %v", err)
+	}
+	return passphrase, nil
+}
+
+// SelectDecryptionKeys returns keys that match ref and namespace. Keys
+// that are restricted to a namespace go first, keys with longer scopes
+// go before less specific ones, otherwise the configured order is kept.
+func SelectDecryptionKeys(keys []DecryptionKey, namespace string, ref *Reference) []DecryptionKey {
+	var selected []DecryptionKey
+	for _, k := range keys {
+		if k.Matches(namespace, ref) {
+			selected = append(selected, k)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		if (selected[i].Namespace != "") != (selected[j].Namespace != "") {
+			return selected[i].Namespace != ""
+		}
+		return len(selected[i].Scope) > len(selected[j].Scope)
+	})
+	return selected
+}
+
+// isEncrypted returns true if root filesystem of SIF
+// image located at imgPath is an encrypted squashfs.
+func isEncrypted(imgPath string) (bool, error) {
+	img, err := image.Init(imgPath, false)
+	if err != nil {
+		return false, fmt.Errorf("failed to load SIF image %s: %v", imgPath, err)
+	}
+	defer img.File.Close()
+
+	if !img.HasRootFs() {
+		return false, nil
+	}
+	return img.Partitions[0].Type == image.ENCRYPTSQUASHFS, nil
+}
+
+// cryptoMessage returns encrypted passphrase that is linked to
+// the primary system partition of SIF image located at imgPath.
+func cryptoMessage(imgPath string) ([]byte, error) {
+	fimg, err := sif.LoadContainer(imgPath, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not load SIF image: %v", err)
+	}
+	defer fimg.UnloadContainer()
+
+	part, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return nil, fmt.Errorf("could not find primary system partition: %v", err)
+	}
+	descrs, _, err := fimg.GetLinkedDescrsByType(part.ID, sif.DataCryptoMessage)
+	if err != nil {
+		return nil, fmt.Errorf("could not find encrypted passphrase: %v", err)
+	}
+	for _, d := range descrs {
+		format, err := d.GetFormatType()
+		if err != nil {
+			return nil, fmt.Errorf("could not get crypto message format: %v", err)
+		}
+		message, err := d.GetMessageType()
+		if err != nil {
+			return nil, fmt.Errorf("could not get crypto message type: %v", err)
+		}
+		if format != sif.FormatPEM || message != sif.MessageRSAOAEP {
+			continue
+		}
+		return decodePEMMessage(d.GetData(&fimg))
+	}
+	return nil, fmt.Errorf("no RSA-OAEP encrypted passphrase found")
+}
+
+func loadPEMPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func decodePEMMessage(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in crypto message")
+	}
+	var message []byte
+	if _, err := asn1.Unmarshal(block.Bytes, &message); err != nil {
+		return nil, fmt.Errorf("could not unmarshal crypto message: %v", err)
+	}
+	return message, nil
+}
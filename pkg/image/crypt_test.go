@@ -0,0 +1,219 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/sif/pkg/sif"
+)
+
+// createEncryptedSIF creates SIF with an encrypted primary partition at path.
+// When key is not nil, passphrase encrypted with it is stored in the image.
+func createEncryptedSIF(t *testing.T, path string, passphrase []byte, key *rsa.PublicKey) {
+	data := bytes.Repeat([]byte("luks"), 1024)
+	part := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Size:     int64(len(data)),
+		Data:     data,
+	}
+	err := part.SetPartExtra(sif.FsEncryptedSquashfs, sif.PartPrimSys, sif.GetSIFArch(runtime.GOARCH))
+	require.NoError(t, err, "could not set partition info")
+	input := []sif.DescriptorInput{part}
+
+	if key != nil {
+		ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, passphrase, nil)
+		require.NoError(t, err, "could not encrypt passphrase")
+		message, err := asn1.Marshal(ciphertext)
+		require.NoError(t, err, "could not marshal passphrase")
+		data := pem.EncodeToMemory(&pem.Block{Type: "MESSAGE", Bytes: message})
+		msg := sif.DescriptorInput{
+			Datatype: sif.DataCryptoMessage,
+			Groupid:  sif.DescrDefaultGroup,
+			Link:     1,
+			Size:     int64(len(data)),
+			Data:     data,
+		}
+		err = msg.SetCryptoMsgExtra(sif.FormatPEM, sif.MessageRSAOAEP)
+		require.NoError(t, err, "could not set crypto message info")
+		input = append(input, msg)
+	}
+
+	_, err = sif.CreateContainer(sif.CreateInfo{
+		Pathname:   path,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		InputDescr: input,
+	})
+	require.NoError(t, err, "could not create SIF")
+}
+
+func TestDecryptionKey_Plaintext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crypt-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "could not generate key")
+	pemFile := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	}), 0600)
+	require.NoError(t, err, "could not write private key")
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "could not generate key")
+	otherPEMFile := filepath.Join(dir, "other.pem")
+	err = ioutil.WriteFile(otherPEMFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(otherKey),
+	}), 0600)
+	require.NoError(t, err, "could not write private key")
+	passphraseFile := filepath.Join(dir, "passphrase")
+	require.NoError(t, ioutil.WriteFile(passphraseFile, []byte("secret\n"), 0600), "could not write passphrase")
+
+	withMessage := filepath.Join(dir, "pem.sif")
+	createEncryptedSIF(t, withMessage, []byte("pem secret"), &privateKey.PublicKey)
+	withoutMessage := filepath.Join(dir, "passphrase.sif")
+	createEncryptedSIF(t, withoutMessage, nil, nil)
+
+	tt := []struct {
+		name        string
+		key         DecryptionKey
+		path        string
+		expect      []byte
+		expectError bool
+	}{
+		{
+			name:   "pem key",
+			key:    DecryptionKey{PEMFile: pemFile},
+			path:   withMessage,
+			expect: []byte("pem secret"),
+		},
+		{
+			name:        "wrong pem key",
+			key:         DecryptionKey{PEMFile: otherPEMFile},
+			path:        withMessage,
+			expectError: true,
+		},
+		{
+			name:        "pem key without message",
+			key:         DecryptionKey{PEMFile: pemFile},
+			path:        withoutMessage,
+			expectError: true,
+		},
+		{
+			name:   "passphrase file",
+			key:    DecryptionKey{PassphraseFile: passphraseFile},
+			path:   withoutMessage,
+			expect: []byte("secret"),
+		},
+		{
+			name:        "missing passphrase file",
+			key:         DecryptionKey{PassphraseFile: filepath.Join(dir, "missing")},
+			path:        withoutMessage,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext, err := tc.key.Plaintext(tc.path)
+			require.Equal(t, tc.expectError, err != nil, "unexpected error: %v", err)
+			require.Equal(t, tc.expect, plaintext)
+		})
+	}
+
+	encrypted, err := isEncrypted(withMessage)
+	require.NoError(t, err, "could not check image")
+	require.True(t, encrypted)
+}
+
+func TestSelectDecryptionKeys(t *testing.T) {
+	keys := []DecryptionKey{
+		{PassphraseFile: "/any"},
+		{Scope: "registry.local", PassphraseFile: "/registry"},
+		{Scope: "registry.local/team/app", PassphraseFile: "/app"},
+		{Namespace: "team", PassphraseFile: "/team"},
+		{Namespace: "other", Scope: "registry.local", PassphraseFile: "/other"},
+	}
+
+	tt := []struct {
+		name      string
+		namespace string
+		ref       string
+		tags      []string
+		expect    []string
+	}{
+		{
+			name:      "namespace and scope",
+			namespace: "team",
+			ref:       "registry.local/team/app:1.0",
+			expect:    []string{"/team", "/app", "/registry", "/any"},
+		},
+		{
+			name:      "other namespace",
+			namespace: "other",
+			ref:       "registry.local/busybox:latest",
+			expect:    []string{"/other", "/registry", "/any"},
+		},
+		{
+			name:      "scope prefix is not a path prefix",
+			namespace: "default",
+			ref:       "registry.local/team/application:1.0",
+			expect:    []string{"/registry", "/any"},
+		},
+		{
+			name:      "scope of other tag",
+			namespace: "default",
+			ref:       "docker.io/library/busybox:latest",
+			tags:      []string{"registry.local/team/app:1.0"},
+			expect:    []string{"/app", "/registry", "/any"},
+		},
+		{
+			name:      "unscoped only",
+			namespace: "default",
+			ref:       "docker.io/library/busybox:latest",
+			expect:    []string{"/any"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err, "could not parse reference")
+			ref.AddTags(tc.tags)
+			var actual []string
+			for _, k := range SelectDecryptionKeys(keys, tc.namespace, ref) {
+				actual = append(actual, k.PassphraseFile)
+			}
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const (
+	// dockerManifestMediaType is a media type of docker image manifest v2, schema 2.
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	// dockerManifestListMediaType is a media type of docker multi-platform manifest list.
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// dockerHubRegistry is a registry API endpoint of docker.io images.
+	dockerHubRegistry = "registry-1.docker.io"
+	// maxManifestSize limits size of a manifest that is read from registry.
+	maxManifestSize = 4 << 20
+)
+
+// registryClient is a minimal OCI distribution client that is able to
+// resolve manifest digests and fetch SIF artifacts pushed with ORAS.
+type registryClient struct {
+	client  *http.Client
+	baseURL *url.URL
+	repo    string
+	auth    *k8s.AuthConfig
+	token   string
+}
+
+// newRegistryClient returns client of the repository repo hosted by host.
+// Registry is accessed over https unless auth holds server address
+// with explicit scheme, which also allows pulls over plain http.
+func newRegistryClient(host, repo string, auth *k8s.AuthConfig) *registryClient {
+	baseURL := &url.URL{
+		Scheme: "https",
+		Host:   host,
+	}
+	if u, err := url.Parse(auth.GetServerAddress()); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		baseURL = &url.URL{
+			Scheme: u.Scheme,
+			Host:   u.Host,
+		}
+	}
+	return &registryClient{
+		client:  http.DefaultClient,
+		baseURL: baseURL,
+		repo:    repo,
+		auth:    auth,
+	}
+}
+
+// DockerDigest resolves digest of the manifest docker image reference points
+// to without pulling image itself. Digest is returned as a reference, e.g.
+// busybox@sha256:<hex>, so that it may be used as one of image digests. When
+// reference points to manifest list, digest of the manifest built for the first
+// of preferred platforms is returned, since that is the manifest that is pulled.
+func DockerDigest(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, platforms ...Platform) (string, error) {
+	if ref.URI() != singularity.DockerDomain {
+		return "", fmt.Errorf("%s is not a docker image", ref)
+	}
+	if len(platforms) == 0 {
+		platforms = DefaultPlatforms()
+	}
+
+	registry, name, reference := dockerRegistry(ref, auth)
+	index, err := registry.index(ctx, reference)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve platforms: %v", err)
+	}
+	if index != nil {
+		desc, _ := selectPlatform(index.Manifests, platforms)
+		if desc == nil {
+			return "", fmt.Errorf("image %s is not available for any of %v", ref, platforms)
+		}
+		return name + "@" + desc.Digest.String(), nil
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		return name + "@" + reference, nil
+	}
+	digest, err := registry.digest(ctx, reference)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve manifest digest: %v", err)
+	}
+	return name + "@" + digest, nil
+}
+
+// dockerRegistry returns client of the registry build pulls docker image from
+// along with image name and tag or digest reference points to.
+func dockerRegistry(ref *Reference, auth *k8s.AuthConfig) (*registryClient, string, string) {
+	name, _, _, reference := parseDockerRef(ref.String())
+	_, host, repo, _ := parseDockerRef(dockerServerName(name, auth))
+	return newRegistryClient(host, repo, auth), name, reference
+}
+
+// dockerServerName returns name of docker image build pulls. When auth holds
+// server address, image is pulled from that server, so its host is prepended
+// to image name unless image is already hosted there. Docker Hub addresses,
+// e.g. https://index.docker.io/v1/, are default and are not prepended.
+func dockerServerName(name string, auth *k8s.AuthConfig) string {
+	address := auth.GetServerAddress()
+	if !strings.Contains(address, "://") {
+		address = "//" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return name
+	}
+	switch u.Host {
+	case singularity.DockerDomain, "index.docker.io", dockerHubRegistry:
+		return name
+	}
+	if host, _ := splitDomain(name); host == u.Host {
+		return name
+	}
+	return u.Host + "/" + name
+}
+
+// parseDockerRef splits normalized docker reference into image name,
+// registry host, repository and a tag or digest.
+func parseDockerRef(ref string) (string, string, string, string) {
+	ref = strings.TrimPrefix(ref, singularity.DockerDomain+"/")
+	name, reference := ref, "latest"
+	if i := strings.IndexByte(ref, '@'); i != -1 {
+		name, reference = ref[:i], ref[i+1:]
+	} else if i := strings.LastIndexByte(ref, ':'); i != -1 && strings.IndexByte(ref[i:], '/') == -1 {
+		name, reference = ref[:i], ref[i+1:]
+	}
+
+	host, repo := splitDomain(name)
+	if host == "" || host == singularity.DockerDomain {
+		host = dockerHubRegistry
+		if strings.IndexByte(repo, '/') == -1 {
+			repo = "library/" + repo
+		}
+	}
+	return name, host, repo, reference
+}
+
+// dockerPlatform resolves manifest list or image index docker reference points
+// to and returns digest of the manifest built for the first of preferred platforms
+// along with that platform. When reference points to a single manifest or when
+// registry cannot be queried, empty digest is returned and registry default
+// platform is pulled.
+func dockerPlatform(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, platforms []Platform) (*Platform, string, error) {
+	registry, _, reference := dockerRegistry(ref, auth)
+	index, err := registry.index(ctx, reference)
+	if err != nil {
+		glog.Warningf("Could not resolve %s platforms, pulling default one: %v", ref, err)
+		return nil, "", nil
+	}
+	if index == nil {
+		return nil, "", nil
+	}
+	desc, platform := selectPlatform(index.Manifests, platforms)
+	if desc == nil {
+		return nil, "", permanent(fmt.Errorf("image %s is not available for any of %v", ref, platforms))
+	}
+	glog.V(4).Infof("Selected %s manifest %s of %s", platform, desc.Digest, ref)
+	return platform, desc.Digest.String(), nil
+}
+
+// index fetches manifest list or image index referenced by tag or digest.
+// If reference points to a single manifest nil is returned.
+func (r *registryClient) index(ctx context.Context, reference string) (*specs.Index, error) {
+	req, err := r.request(http.MethodGet, "manifests/"+reference)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		specs.MediaTypeImageIndex,
+		specs.MediaTypeImageManifest,
+		dockerManifestListMediaType,
+		dockerManifestMediaType,
+	}, ", "))
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %v", err)
+	}
+	var index struct {
+		specs.Index
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("could not decode manifest: %v", err)
+	}
+	mediaType := index.MediaType
+	if mediaType == "" {
+		mediaType = strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	}
+	if mediaType != specs.MediaTypeImageIndex && mediaType != dockerManifestListMediaType {
+		return nil, nil
+	}
+	return &index.Index, nil
+}
+
+// digest resolves digest of the manifest or manifest list referenced by tag.
+// Digest reported by registry is preferred, otherwise manifest is fetched and hashed.
+func (r *registryClient) digest(ctx context.Context, tag string) (string, error) {
+	accept := strings.Join([]string{
+		specs.MediaTypeImageIndex,
+		specs.MediaTypeImageManifest,
+		dockerManifestListMediaType,
+		dockerManifestMediaType,
+	}, ", ")
+	req, err := r.request(http.MethodHead, "manifests/"+tag)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); strings.HasPrefix(digest, "sha256:") {
+		return digest, nil
+	}
+
+	req, err = r.request(http.MethodGet, "manifests/"+tag)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", accept)
+	resp, err = r.do(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(resp.Body, maxManifestSize)); err != nil {
+		return "", fmt.Errorf("could not read manifest: %v", err)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// manifest fetches manifest referenced by tag or digest
+// and returns it along with its digest.
+func (r *registryClient) manifest(ctx context.Context, reference string) (*specs.Manifest, string, error) {
+	req, err := r.request(http.MethodGet, "manifests/"+reference)
+	if err != nil {
+		return nil, "", permanent(err)
+	}
+	req.Header.Set("Accept", strings.Join([]string{specs.MediaTypeImageManifest, dockerManifestMediaType}, ", "))
+	resp, err := r.do(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read manifest: %v", err)
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	if strings.HasPrefix(reference, "sha256:") && reference != digest {
+		return nil, "", permanent(fmt.Errorf("manifest digest mismatch: expected %s, got %s", reference, digest))
+	}
+
+	var manifest specs.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, "", permanent(fmt.Errorf("could not decode manifest: %v", err))
+	}
+	return &manifest, digest, nil
+}
+
+// request creates request to the repository API endpoint, e.g. manifests/latest.
+// Authorization header is set if registry token is already known.
+func (r *registryClient) request(method, endpoint string) (*http.Request, error) {
+	u := r.baseURL.ResolveReference(&url.URL{
+		Path: fmt.Sprintf("/v2/%s/%s", r.repo, endpoint),
+	})
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	r.authorize(req)
+	return req, nil
+}
+
+// authorize sets Authorization header with either a bearer token
+// obtained earlier or basic credentials if they are known.
+func (r *registryClient) authorize(req *http.Request) {
+	switch {
+	case r.token != "":
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	case r.auth.GetUsername() != "":
+		req.SetBasicAuth(r.auth.GetUsername(), r.auth.GetPassword())
+	}
+}
+
+// do performs request. When registry requires bearer token authentication,
+// token is requested and request is repeated once. Responses with status
+// other than 200 are returned as errors.
+func (r *registryClient) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && r.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			return nil, permanent(&statusError{code: http.StatusUnauthorized})
+		}
+		if err := r.fetchToken(ctx, challenge); err != nil {
+			return nil, err
+		}
+		r.authorize(req)
+		resp, err = r.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &statusError{
+			code: resp.StatusCode,
+			msg:  strings.TrimSpace(string(msg)),
+		}
+	}
+	return resp, nil
+}
+
+// fetchToken requests bearer token from authorization server
+// specified in WWW-Authenticate challenge.
+func (r *registryClient) fetchToken(ctx context.Context, challenge string) error {
+	params := parseChallenge(challenge[len("bearer "):])
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return permanent(fmt.Errorf("invalid authentication realm %q", params["realm"]))
+	}
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", r.repo)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return permanent(fmt.Errorf("could not create token request: %v", err))
+	}
+	if r.auth.GetUsername() != "" {
+		req.SetBasicAuth(r.auth.GetUsername(), r.auth.GetPassword())
+	}
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{code: resp.StatusCode}
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("could not decode token: %v", err)
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return permanent(fmt.Errorf("authorization server returned empty token"))
+	}
+	return nil
+}
+
+// parseChallenge parses comma separated key="value" pairs of WWW-Authenticate header.
+func parseChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	for challenge != "" {
+		challenge = strings.TrimLeft(challenge, ", ")
+		i := strings.IndexByte(challenge, '=')
+		if i == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(challenge[:i]))
+		challenge = challenge[i+1:]
+
+		var value string
+		if strings.HasPrefix(challenge, `"`) {
+			end := strings.IndexByte(challenge[1:], '"')
+			if end == -1 {
+				value, challenge = challenge[1:], ""
+			} else {
+				value, challenge = challenge[1:end+1], challenge[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(challenge, ',')
+			if end == -1 {
+				end = len(challenge)
+			}
+			value, challenge = challenge[:end], challenge[end:]
+		}
+		params[key] = value
+	}
+	return params
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestDockerDigest(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2}`)
+	manifestDigest := digest.FromBytes(manifest)
+	amd64 := digest.FromString("amd64")
+	arm64 := digest.FromString("arm64")
+	list := []byte(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": %q,
+		"manifests": [
+			{"digest": %q, "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": %q, "platform": {"os": "linux", "architecture": "arm64"}}
+		]
+	}`, dockerManifestListMediaType, amd64, arm64))
+
+	tt := []struct {
+		name          string
+		ref           string
+		platforms     []Platform
+		sendDigest    bool
+		expectDigest  string
+		expectError   string
+		expectRequest bool
+	}{
+		{
+			name:          "digest header",
+			ref:           "%s/sylabs/busybox:1.0.0",
+			sendDigest:    true,
+			expectDigest:  "%s/sylabs/busybox@" + manifestDigest.String(),
+			expectRequest: true,
+		},
+		{
+			name:          "hashed manifest",
+			ref:           "%s/sylabs/busybox",
+			expectDigest:  "%s/sylabs/busybox@" + manifestDigest.String(),
+			expectRequest: true,
+		},
+		{
+			name:          "digest reference",
+			ref:           "%s/sylabs/busybox@" + manifestDigest.String(),
+			expectDigest:  "%s/sylabs/busybox@" + manifestDigest.String(),
+			expectRequest: true,
+		},
+		{
+			name:          "manifest list",
+			ref:           "%s/sylabs/busybox:list",
+			platforms:     []Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}},
+			expectDigest:  "%s/sylabs/busybox@" + arm64.String(),
+			expectRequest: true,
+		},
+		{
+			name:          "manifest list without platform",
+			ref:           "%s/sylabs/busybox:list",
+			platforms:     []Platform{{OS: "linux", Architecture: "ppc64le"}},
+			expectError:   "is not available for any of",
+			expectRequest: true,
+		},
+		{
+			name:          "unknown tag",
+			ref:           "%s/sylabs/busybox:2.0.0",
+			expectError:   "unexpected http status code 404",
+			expectRequest: true,
+		},
+		{
+			name:        "not docker",
+			ref:         "library://sylabs/tests/busybox:1.0.0",
+			expectError: "is not a docker image",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var requested bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = true
+				if !strings.Contains(r.Header.Get("Accept"), dockerManifestListMediaType) {
+					http.Error(w, "manifest list is not accepted", http.StatusBadRequest)
+					return
+				}
+				switch r.URL.Path {
+				case "/v2/sylabs/busybox/manifests/list":
+					w.Write(list)
+				case "/v2/sylabs/busybox/manifests/1.0.0",
+					"/v2/sylabs/busybox/manifests/latest",
+					"/v2/sylabs/busybox/manifests/" + manifestDigest.String():
+					if tc.sendDigest {
+						w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+					}
+					w.Write(manifest)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+			host := strings.TrimPrefix(server.URL, "http://")
+
+			imgRef := tc.ref
+			if strings.Contains(imgRef, "%s") {
+				imgRef = fmt.Sprintf(imgRef, host)
+			}
+			ref, err := ParseRef(imgRef)
+			require.NoError(t, err, "could not parse reference")
+
+			actual, err := DockerDigest(context.Background(), ref, &k8s.AuthConfig{ServerAddress: server.URL}, tc.platforms...)
+			require.Equal(t, tc.expectRequest, requested, "unexpected registry request")
+			if tc.expectError != "" {
+				require.Error(t, err, "expected error, but got nil")
+				require.Contains(t, err.Error(), tc.expectError, "unexpected error")
+				return
+			}
+			require.NoError(t, err, "could not resolve digest")
+			require.Equal(t, fmt.Sprintf(tc.expectDigest, host), actual)
+		})
+	}
+}
+
+func TestDockerServerName(t *testing.T) {
+	tt := []struct {
+		name    string
+		image   string
+		address string
+		expect  string
+	}{
+		{
+			name:   "no server address",
+			image:  "sylabs/busybox:1.0.0",
+			expect: "sylabs/busybox:1.0.0",
+		},
+		{
+			name:    "server address without scheme",
+			image:   "sylabs/busybox:1.0.0",
+			address: "registry.example.com:5000",
+			expect:  "registry.example.com:5000/sylabs/busybox:1.0.0",
+		},
+		{
+			name:    "server address with scheme",
+			image:   "sylabs/busybox:1.0.0",
+			address: "https://registry.example.com/",
+			expect:  "registry.example.com/sylabs/busybox:1.0.0",
+		},
+		{
+			name:    "image hosted on server",
+			image:   "registry.example.com/sylabs/busybox:1.0.0",
+			address: "registry.example.com",
+			expect:  "registry.example.com/sylabs/busybox:1.0.0",
+		},
+		{
+			name:    "docker hub",
+			image:   "busybox:1.0.0",
+			address: "https://index.docker.io/v1/",
+			expect:  "busybox:1.0.0",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := dockerServerName(tc.image, &k8s.AuthConfig{ServerAddress: tc.address})
+			require.Equal(t, tc.expect, actual)
+		})
+	}
+}
+
+func TestParseDockerRef(t *testing.T) {
+	tt := []struct {
+		ref             string
+		expectName      string
+		expectHost      string
+		expectRepo      string
+		expectReference string
+	}{
+		{
+			ref:             "docker.io/busybox:1.28",
+			expectName:      "busybox",
+			expectHost:      dockerHubRegistry,
+			expectRepo:      "library/busybox",
+			expectReference: "1.28",
+		},
+		{
+			ref:             "sylabsio/test:latest",
+			expectName:      "sylabsio/test",
+			expectHost:      dockerHubRegistry,
+			expectRepo:      "sylabsio/test",
+			expectReference: "latest",
+		},
+		{
+			ref:             "gcr.io/cri-tools/test-image-tags:1",
+			expectName:      "gcr.io/cri-tools/test-image-tags",
+			expectHost:      "gcr.io",
+			expectRepo:      "cri-tools/test-image-tags",
+			expectReference: "1",
+		},
+		{
+			ref:             "localhost:5000/busybox",
+			expectName:      "localhost:5000/busybox",
+			expectHost:      "localhost:5000",
+			expectRepo:      "busybox",
+			expectReference: "latest",
+		},
+		{
+			ref:             "nginx@sha256:31b8e90a349d1fce7621f5a5a08e4fc519b634f7d3feb09d53fac9b12aa4d991",
+			expectName:      "nginx",
+			expectHost:      dockerHubRegistry,
+			expectRepo:      "library/nginx",
+			expectReference: "sha256:31b8e90a349d1fce7621f5a5a08e4fc519b634f7d3feb09d53fac9b12aa4d991",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.ref, func(t *testing.T) {
+			name, host, repo, reference := parseDockerRef(tc.ref)
+			require.Equal(t, tc.expectName, name)
+			require.Equal(t, tc.expectHost, host)
+			require.Equal(t, tc.expectRepo, repo)
+			require.Equal(t, tc.expectReference, reference)
+		})
+	}
+}
+
+func TestDockerPlatform(t *testing.T) {
+	amd64 := digest.FromString("amd64")
+	armv7 := digest.FromString("arm/v7")
+	arm64 := digest.FromString("arm64/v8")
+	list := []byte(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": %q,
+		"manifests": [
+			{"digest": %q, "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": %q, "platform": {"os": "linux", "architecture": "arm", "variant": "v7"}},
+			{"digest": %q, "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}}
+		]
+	}`, dockerManifestListMediaType, amd64, armv7, arm64))
+	manifest := []byte(`{"schemaVersion": 2}`)
+
+	tt := []struct {
+		name           string
+		tag            string
+		platforms      []Platform
+		expectPlatform *Platform
+		expectDigest   string
+		expectError    string
+	}{
+		{
+			name:           "first preferred platform",
+			tag:            "list",
+			platforms:      []Platform{{OS: "linux", Architecture: "arm64"}, {OS: "linux", Architecture: "amd64"}},
+			expectPlatform: &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			expectDigest:   arm64.String(),
+		},
+		{
+			name:           "fallback platform",
+			tag:            "list",
+			platforms:      []Platform{{OS: "linux", Architecture: "arm", Variant: "v6"}, {OS: "linux", Architecture: "amd64"}},
+			expectPlatform: &Platform{OS: "linux", Architecture: "amd64"},
+			expectDigest:   amd64.String(),
+		},
+		{
+			name:        "no matching platform",
+			tag:         "list",
+			platforms:   []Platform{{OS: "linux", Architecture: "s390x"}},
+			expectError: "is not available for any of [linux/s390x]",
+		},
+		{
+			name:      "single manifest",
+			tag:       "single",
+			platforms: []Platform{{OS: "linux", Architecture: "s390x"}},
+		},
+		{
+			name:      "registry failure",
+			tag:       "unknown",
+			platforms: []Platform{{OS: "linux", Architecture: "s390x"}},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/sylabs/busybox/manifests/list":
+			w.Write(list)
+		case "/v2/sylabs/busybox/manifests/single":
+			w.Header().Set("Content-Type", dockerManifestMediaType)
+			w.Write(manifest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseRef(host + "/sylabs/busybox:" + tc.tag)
+			require.NoError(t, err, "could not parse reference")
+
+			platform, digest, err := dockerPlatform(context.Background(), ref,
+				&k8s.AuthConfig{ServerAddress: server.URL}, tc.platforms)
+			if tc.expectError != "" {
+				require.Error(t, err, "expected error, but got nil")
+				require.Contains(t, err.Error(), tc.expectError, "unexpected error")
+				require.False(t, isRetriable(err), "unexpected retriable error")
+				return
+			}
+			require.NoError(t, err, "could not resolve platform")
+			require.Equal(t, tc.expectPlatform, platform, "unexpected platform")
+			require.Equal(t, tc.expectDigest, digest, "unexpected digest")
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// statusError is returned when remote server responds with unexpected HTTP status.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	if e.msg == "" {
+		return fmt.Sprintf("unexpected http status code: %d", e.code)
+	}
+	return fmt.Sprintf("unexpected http status code %d: %s", e.code, e.msg)
+}
+
+// retriable returns true if request that resulted in this error may
+// succeed if repeated later, e.g. server was temporary unavailable.
+func (e *statusError) retriable() bool {
+	return e.code >= http.StatusInternalServerError ||
+		e.code == http.StatusTooManyRequests ||
+		e.code == http.StatusRequestTimeout
+}
+
+// resumeDownload performs req and writes response body to the file located at path.
+// If file already contains some data, only the missing part is requested using HTTP
+// range request. When server doesn't support ranges the whole file is downloaded again.
+// Response headers are returned on success.
+func resumeDownload(ctx context.Context, cli *http.Client, req *http.Request, path string) (http.Header, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("could not open file to pull image: %v", err))
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("could not seek pull file: %v", err))
+	}
+	if offset > 0 {
+		glog.V(4).Infof("Resuming download of %s from byte %d", req.URL, offset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if offset > 0 {
+			glog.V(4).Infof("Server does not support range requests, restarting download of %s", req.URL)
+			if err := f.Truncate(0); err != nil {
+				return nil, permanent(fmt.Errorf("could not truncate pull file: %v", err))
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, permanent(fmt.Errorf("could not seek pull file: %v", err))
+			}
+		}
+	case http.StatusPartialContent:
+		if start := rangeStart(resp.Header.Get("Content-Range")); start != offset {
+			// truncate what we have so that next attempt starts from scratch
+			_ = f.Truncate(0)
+			return nil, fmt.Errorf("unexpected content range %q, expected start at %d",
+				resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset > 0 {
+			// we have already downloaded everything there is
+			return resp.Header, nil
+		}
+		fallthrough
+	default:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, &statusError{
+			code: resp.StatusCode,
+			msg:  strings.TrimSpace(string(msg)),
+		}
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not download image: %v", err)
+	}
+	return resp.Header, nil
+}
+
+// rangeStart parses Content-Range header value in form 'bytes start-end/size'
+// and returns start. If header is malformed -1 is returned.
+func rangeStart(contentRange string) int64 {
+	var start, end int64
+	var size string
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &size)
+	if err != nil {
+		return -1
+	}
+	return start
+}
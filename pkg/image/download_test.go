@@ -0,0 +1,246 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// libraryStandIn serves content as a library image file. First failures
+// requests are responded with failStatus, range requests are supported
+// unless noRanges is set.
+type libraryStandIn struct {
+	content    []byte
+	failures   int32
+	failStatus int
+	noRanges   bool
+
+	requests int32
+	ranges   []string
+}
+
+func (l *libraryStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&l.requests, 1)
+	if r.URL.Path != "/v1/imagefile/sylabs/tests/busybox:1.0.0" {
+		http.NotFound(w, r)
+		return
+	}
+	if n <= l.failures {
+		w.WriteHeader(l.failStatus)
+		return
+	}
+	l.ranges = append(l.ranges, r.Header.Get("Range"))
+	if l.noRanges {
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, "image.sif", time.Time{}, bytes.NewReader(l.content))
+}
+
+func TestPull_Library(t *testing.T) {
+	content := bytes.Repeat([]byte("singularity"), 1024)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	tt := []struct {
+		name         string
+		library      *libraryStandIn
+		image        string
+		opts         []PullOption
+		expectError  string
+		expectErrIs  error
+		expectRanges []string
+		expectTries  int32
+	}{
+		{
+			name:         "all ok",
+			library:      &libraryStandIn{content: content},
+			image:        "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			expectRanges: []string{""},
+			expectTries:  1,
+		},
+		{
+			name:        "not found is not retried",
+			library:     &libraryStandIn{content: content},
+			image:       "cloud.sylabs.io/sylabs/tests/not-found:1.0.0",
+			opts:        []PullOption{WithRetries(3, time.Millisecond, 0)},
+			expectError: "unexpected http status code 404",
+			expectTries: 1,
+		},
+		{
+			name: "temporary failure is retried",
+			library: &libraryStandIn{
+				content:    content,
+				failures:   2,
+				failStatus: http.StatusServiceUnavailable,
+			},
+			image:        "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			opts:         []PullOption{WithRetries(3, time.Millisecond, 2*time.Millisecond)},
+			expectRanges: []string{""},
+			expectTries:  3,
+		},
+		{
+			name: "too many temporary failures",
+			library: &libraryStandIn{
+				content:    content,
+				failures:   5,
+				failStatus: http.StatusBadGateway,
+			},
+			image:       "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			opts:        []PullOption{WithRetries(2, time.Millisecond, 0)},
+			expectError: "unexpected http status code: 502",
+			expectTries: 3,
+		},
+		{
+			name:         "expected checksum",
+			library:      &libraryStandIn{content: content},
+			image:        "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			opts:         []PullOption{WithChecksum(checksum)},
+			expectRanges: []string{""},
+			expectTries:  1,
+		},
+		{
+			name:        "checksum mismatch",
+			library:     &libraryStandIn{content: content},
+			image:       "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			opts:        []PullOption{WithChecksum(fmt.Sprintf("%x", sha256.Sum256(nil)))},
+			expectError: ErrChecksumMismatch.Error(),
+			expectErrIs: ErrChecksumMismatch,
+			expectTries: 1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.library)
+			defer server.Close()
+
+			dir, err := ioutil.TempDir("", "pull-test-")
+			require.NoError(t, err, "could not create temp directory")
+			defer os.RemoveAll(dir)
+
+			ref, err := ParseRef(tc.image)
+			require.NoError(t, err, "could not parse reference")
+			require.Equal(t, singularity.LibraryDomain, ref.URI())
+
+			auth := &k8s.AuthConfig{ServerAddress: server.URL}
+			info, err := Pull(context.Background(), dir, ref, auth, tc.opts...)
+			require.Equal(t, tc.expectTries, atomic.LoadInt32(&tc.library.requests), "unexpected number of requests")
+			if tc.expectError != "" {
+				require.Error(t, err, "expected error, but got nil")
+				require.Contains(t, err.Error(), tc.expectError, "unexpected pull error")
+				if tc.expectErrIs != nil {
+					require.ErrorIs(t, err, tc.expectErrIs, "unexpected pull error")
+				}
+				return
+			}
+			require.NoError(t, err, "unexpected pull error")
+			require.Equal(t, tc.expectRanges, tc.library.ranges, "unexpected range requests")
+			require.Equal(t, checksum, info.Sha256, "unexpected image checksum")
+			require.Equal(t, filepath.Join(dir, checksum), info.Path, "unexpected image path")
+		})
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("singularity"), 1024)
+
+	tt := []struct {
+		name         string
+		library      *libraryStandIn
+		partial      int
+		expectRanges []string
+	}{
+		{
+			name:         "no partial download",
+			library:      &libraryStandIn{content: content},
+			expectRanges: []string{""},
+		},
+		{
+			name:         "resume partial download",
+			library:      &libraryStandIn{content: content},
+			partial:      1000,
+			expectRanges: []string{"bytes=1000-"},
+		},
+		{
+			name:         "partial download without range support",
+			library:      &libraryStandIn{content: content, noRanges: true},
+			partial:      1000,
+			expectRanges: []string{"bytes=1000-"},
+		},
+		{
+			name:         "partial download is complete",
+			library:      &libraryStandIn{content: content},
+			partial:      len(content),
+			expectRanges: []string{fmt.Sprintf("bytes=%d-", len(content))},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.library)
+			defer server.Close()
+
+			f, err := ioutil.TempFile("", "partial-")
+			require.NoError(t, err, "could not create temp file")
+			defer os.Remove(f.Name())
+			_, err = f.Write(content[:tc.partial])
+			require.NoError(t, err, "could not write partial content")
+			require.NoError(t, f.Close(), "could not close partial file")
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/imagefile/sylabs/tests/busybox:1.0.0", nil)
+			require.NoError(t, err, "could not create request")
+			_, err = resumeDownload(context.Background(), server.Client(), req, f.Name())
+			require.NoError(t, err, "could not download")
+			require.Equal(t, tc.expectRanges, tc.library.ranges, "unexpected range requests")
+
+			actual, err := ioutil.ReadFile(f.Name())
+			require.NoError(t, err, "could not read downloaded file")
+			require.Equal(t, content, actual, "downloaded content mismatch")
+		})
+	}
+}
+
+func TestRemoveStalePulls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stale-pulls-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	stale := filepath.Join(dir, pullFilePrefix+"9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343")
+	image := filepath.Join(dir, "9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343")
+	hidden := filepath.Join(dir, ".hidden")
+	for _, f := range []string{stale, image, hidden} {
+		require.NoError(t, ioutil.WriteFile(f, []byte("content"), 0644), "could not create file")
+	}
+
+	require.NoError(t, RemoveStalePulls(dir), "could not remove stale pulls")
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err), "stale pull file is not removed")
+	require.FileExists(t, image)
+	require.FileExists(t, hidden)
+}
@@ -15,19 +15,20 @@
 package image
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
@@ -36,13 +37,15 @@ import (
 	"github.com/sylabs/singularity-cri/pkg/singularity"
 	"github.com/sylabs/singularity-cri/pkg/slice"
 	"github.com/sylabs/singularity/pkg/image"
-	"github.com/sylabs/singularity/pkg/signing"
 	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
 )
 
 const (
 	// IDLen reflects number of symbols in image unique ID.
 	IDLen = 64
+
+	// pullFilePrefix is a prefix of temporary files images are pulled into.
+	pullFilePrefix = "."
 )
 
 var (
@@ -53,6 +56,9 @@ var (
 	// ErrNotLibrary is used when user tried to get library image metadata but
 	// provided non library image reference.
 	ErrNotLibrary = fmt.Errorf("not library image")
+	// ErrChecksumMismatch is returned when image file content does not
+	// match the expected sha256 checksum.
+	ErrChecksumMismatch = fmt.Errorf("image checksum mismatch")
 )
 
 // Info represents image stored on the host filesystem.
@@ -63,9 +69,70 @@ type Info struct {
 	Path      string             `json:"path"`
 	Ref       *Reference         `json:"ref"`
 	OciConfig *specs.ImageConfig `json:"ociConfig,omitempty"`
+	Signers   []Signer           `json:"signers,omitempty"`
+	// Platform is a platform image was pulled for, if known, e.g.
+	// a platform of the manifest selected from docker manifest list.
+	Platform *Platform `json:"platform,omitempty"`
+	// Encrypted is true when image root filesystem is encrypted and
+	// should be decrypted with a matching key before it is used.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// LastModified and ETag are kept for images downloaded from HTTP(S)
+	// URLs or imported from local archives to make repeated pulls conditional.
+	LastModified string `json:"lastModified,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+	// Lazy is true while lazily pulled image file is incomplete, see WithLazy.
+	// Such images cannot be used after restart, since their sources are not kept.
+	Lazy bool `json:"lazy,omitempty"`
+
+	mu       sync.RWMutex
+	lazy     *lazyFile
+	usedBy   []string
+	lastUsed time.Time
+	pinned   bool
+	deleted  bool
+}
+
+// MarshalJSON marshals Info into a valid JSON.
+func (i *Info) MarshalJSON() ([]byte, error) {
+	type plainInfo Info
 
-	mu     sync.RWMutex
-	usedBy []string
+	i.mu.RLock()
+	var lastUsed *time.Time
+	if !i.lastUsed.IsZero() {
+		t := i.lastUsed
+		lastUsed = &t
+	}
+	deleted := i.deleted
+	defer i.mu.RUnlock()
+
+	return json.Marshal(struct {
+		*plainInfo
+		LastUsed        *time.Time `json:"lastUsed,omitempty"`
+		PendingDeletion bool       `json:"pendingDeletion,omitempty"`
+	}{
+		plainInfo:       (*plainInfo)(i),
+		LastUsed:        lastUsed,
+		PendingDeletion: deleted,
+	})
+}
+
+// UnmarshalJSON unmarshals a valid Info JSON into an object.
+func (i *Info) UnmarshalJSON(data []byte) error {
+	type plainInfo Info
+
+	jsonInfo := struct {
+		*plainInfo
+		LastUsed        *time.Time `json:"lastUsed,omitempty"`
+		PendingDeletion bool       `json:"pendingDeletion,omitempty"`
+	}{
+		plainInfo: (*plainInfo)(i),
+	}
+	err := json.Unmarshal(data, &jsonInfo)
+	if jsonInfo.LastUsed != nil {
+		i.lastUsed = *jsonInfo.LastUsed
+	}
+	i.deleted = jsonInfo.PendingDeletion
+	return err
 }
 
 // Borrow notifies that image is used by some container and should
@@ -76,16 +143,77 @@ func (i *Info) Borrow(who string) {
 	defer i.mu.Unlock()
 
 	i.usedBy = slice.MergeString(i.usedBy, who)
+	i.lastUsed = time.Now()
 }
 
 // Return notifies that image is no longer used by a container and
-// may be safely removed if no one else needs it anymore.
+// may be safely removed if no one else needs it anymore. If image is
+// marked for deletion and this was the last user, image file is removed.
 // This method is thread-safe to use.
 func (i *Info) Return(who string) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
 	i.usedBy = slice.RemoveFromString(i.usedBy, who)
+	i.lastUsed = time.Now()
+	if i.deleted && len(i.usedBy) == 0 {
+		i.deleted = false
+		glog.V(2).Infof("Removing image %s marked for deletion", i.ID)
+		if err := os.Remove(i.Path); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Could not remove image %s marked for deletion: %v", i.ID, err)
+		}
+	}
+}
+
+// LastUsed returns time image was last borrowed or returned.
+// For images that were never used zero time is returned.
+func (i *Info) LastUsed() time.Time {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.lastUsed
+}
+
+// Pin marks image as pinned so that it is never removed by garbage collection.
+func (i *Info) Pin() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.pinned = true
+}
+
+// Unpin removes pinned mark from image so that it may be garbage collected again.
+func (i *Info) Unpin() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.pinned = false
+}
+
+// Pinned returns true if image is pinned.
+func (i *Info) Pinned() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.pinned
+}
+
+// MarkedForDeletion returns true if image file is going to
+// be removed once image is no longer used by any container.
+func (i *Info) MarkedForDeletion() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.deleted
+}
+
+// CancelDeletion unmarks image marked for deletion, e.g. when the
+// same image is pulled again, so that its file is kept.
+func (i *Info) CancelDeletion() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.deleted = false
 }
 
 // UsedBy returns list of container ids that use this image.
@@ -99,7 +227,20 @@ func (i *Info) UsedBy() []string {
 }
 
 // Pull pulls image referenced by ref and saves it to the passed location.
-func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthConfig) (*Info, error) {
+// Failed pulls are retried according to passed options. Partially downloaded
+// library images are resumed from where previous attempt has stopped.
+// Local OCI and docker archives are converted to SIF. For conditional pulls
+// of HTTP(S) images and local archives ErrNotModified is returned when
+// the original file has not changed, see IfModified.
+func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthConfig, opts ...PullOption) (*Info, error) {
+	var o pullOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(o.platforms) == 0 {
+		o.platforms = DefaultPlatforms()
+	}
+
 	if ref.URI() == singularity.LocalFileDomain {
 		info, err := sifInfo(strings.TrimPrefix(ref.tags[0], singularity.LocalFileDomain))
 		if err != nil {
@@ -109,7 +250,23 @@ func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthCo
 		return info, nil
 	}
 
-	pullPath := filepath.Join(location, "."+rand.GenerateID(64))
+	if o.lazy && canPullLazily(location, ref, &o) {
+		var info *Info
+		err := o.retry(ctx, func(ctx context.Context) error {
+			var err error
+			info, err = pullLazy(ctx, location, ref, auth, &o)
+			return err
+		})
+		if err == nil {
+			return info, nil
+		}
+		if err, ok := err.(*permanentError); !ok || err.err != errNoRanges {
+			return nil, fmt.Errorf("could not pull image lazily: %v", err)
+		}
+		glog.V(2).Infof("Pulling %s in full: %v", ref, err)
+	}
+
+	pullPath := filepath.Join(location, pullFilePrefix+rand.GenerateID(IDLen))
 	glog.V(5).Infof("Pulling %s to temporary file %s", ref, pullPath)
 	cleanup := func() {
 		if err := os.Remove(pullPath); err != nil && !os.IsNotExist(err) {
@@ -117,7 +274,32 @@ func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthCo
 		}
 	}
 
-	err := pullImage(ctx, ref, auth, pullPath)
+	var validators urlValidators
+	var platform *Platform
+	if IsLocalImport(ref) {
+		modTime, err := localImportModTime(ref)
+		if err != nil {
+			return nil, fmt.Errorf("could not stat local image: %v", err)
+		}
+		if o.prev != nil && o.prev.LastModified == modTime {
+			return nil, ErrNotModified
+		}
+		validators.lastModified = modTime
+	}
+	err := o.retry(ctx, func(ctx context.Context) error {
+		if isURL(ref) {
+			var err error
+			validators, err = pullURLImage(ctx, ref, auth, pullPath, o.prev)
+			return err
+		}
+		var err error
+		platform, err = pullImage(ctx, ref, auth, pullPath, o.platforms, o.build)
+		return err
+	})
+	if err == ErrNotModified {
+		cleanup()
+		return nil, err
+	}
 	if err != nil {
 		cleanup()
 		return nil, fmt.Errorf("could not pull image: %v", err)
@@ -127,29 +309,55 @@ func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthCo
 		cleanup()
 		return nil, fmt.Errorf("could not fetch SIF info: %v", err)
 	}
+	if o.checksum != "" && info.Sha256 != o.checksum {
+		cleanup()
+		return nil, fmt.Errorf("%w: expected sha256 %s, got %s", ErrChecksumMismatch, o.checksum, info.Sha256)
+	}
 
 	path := filepath.Join(location, info.Sha256)
-	glog.V(5).Infof("Renaming %s to %s", pullPath, path)
-	err = os.Rename(pullPath, path)
+	move := func() error {
+		glog.V(5).Infof("Renaming %s to %s", pullPath, path)
+		return os.Rename(pullPath, path)
+	}
+	if o.save != nil {
+		err = o.save(info.Sha256, move)
+	} else {
+		err = move()
+	}
 	if err != nil {
 		cleanup()
 		return nil, fmt.Errorf("could not save pulled image: %v", err)
 	}
 
+	if IsLocalImport(ref) {
+		// singularity build may not keep image config, so
+		// prefer the one embedded into the original image
+		img, err := localImageInfo(ref, o.platforms)
+		if err != nil {
+			glog.Warningf("Could not read image config of %s: %v", ref, err)
+		} else if img.config != nil {
+			info.OciConfig = img.config
+			platform = img.platform
+		}
+	}
 	info.Path = path
 	info.Ref = ref
+	info.Platform = platform
+	info.LastModified = validators.lastModified
+	info.ETag = validators.etag
 	return info, nil
 }
 
-// LibraryInfo queries remote library to get info about the image.
-// If image is not found returns ErrNotFound. For references other than
-// library returns ErrNotLibrary.
-func LibraryInfo(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*Info, error) {
+// LibraryInfo queries remote library to get info about the image built for the
+// first of preferred platforms it is available for, by default for the host
+// architecture. If image is not found returns ErrNotFound. For references
+// other than library returns ErrNotLibrary.
+func LibraryInfo(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, platforms ...Platform) (*Info, error) {
 	if ref.URI() != singularity.LibraryDomain {
 		return nil, ErrNotLibrary
 	}
 
-	pullURL := strings.TrimPrefix(ref.String(), ref.URI()+"/")
+	_, pullURL := splitDomain(ref.String())
 	config := &library.Config{
 		BaseURL:   auth.GetServerAddress(),
 		AuthToken: auth.GetPassword(),
@@ -158,7 +366,7 @@ func LibraryInfo(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*In
 	if err != nil {
 		return nil, fmt.Errorf("could not create library client: %v", err)
 	}
-	img, err := client.GetImage(ctx, runtime.GOARCH, pullURL)
+	img, platform, err := libraryImage(ctx, client, pullURL, platforms)
 	if err == library.ErrNotFound {
 		return nil, ErrNotFound
 	}
@@ -170,13 +378,44 @@ func LibraryInfo(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*In
 	// we need to trim it before it can be used
 	id := strings.TrimPrefix(img.Hash, "sha256.")
 	return &Info{
-		ID:     id,
-		Sha256: id,
-		Size:   uint64(img.Size),
-		Ref:    ref,
+		ID:       id,
+		Sha256:   id,
+		Size:     uint64(img.Size),
+		Ref:      ref,
+		Platform: platform,
 	}, nil
 }
 
+// LocalInfo returns info of the SIF image located at path that is referenced
+// by tag, e.g. registry.local/busybox:latest, rather than by local.file path.
+// Just like other local SIF images it is never removed from disk, see Remove.
+func LocalInfo(path, tag string) (*Info, error) {
+	info, err := sifInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch local SIF info: %v", err)
+	}
+	info.Ref = &Reference{
+		uri:  singularity.LocalFileDomain,
+		tags: []string{NormalizedImageRef(tag)},
+	}
+	return info, nil
+}
+
+// Adopt returns info of an untagged image located at path, e.g. image that
+// was pulled earlier but whose record was lost. Pulled images are named after
+// their sha256 checksum, so file that is named otherwise is not adopted.
+func Adopt(path string) (*Info, error) {
+	info, err := sifInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch SIF info: %v", err)
+	}
+	if info.Sha256 != filepath.Base(path) {
+		return nil, fmt.Errorf("checksum mismatch: file name is not %s", info.Sha256)
+	}
+	info.Ref = &Reference{}
+	return info, nil
+}
+
 // Remove removes image from the host filesystem. It makes sure
 // no one relies on image file and if this check fails it returns ErrIsUsed error.
 // Local SIF images that were not pulled by CRI are never actually removed.
@@ -199,21 +438,26 @@ func (i *Info) Remove() error {
 	return nil
 }
 
-// Verify verifies image signatures.
-func (i *Info) Verify() error {
-	if i.Ref.URI() == singularity.DockerDomain {
-		return nil
+// RemoveWhenUnused removes image from the host filesystem if no one relies
+// on image file. Otherwise image is marked for deletion and its file is removed
+// when the last user returns image. It returns true if file is removed right away.
+func (i *Info) RemoveWhenUnused() (bool, error) {
+	if i.Ref.URI() == singularity.LocalFileDomain {
+		return true, nil
 	}
 
-	_, _, err := signing.Verify(i.Path, singularity.KeysServer, 0, false, "", false, true)
-	noSignatures := err != nil && strings.Contains(err.Error(), "no signatures found")
-	if noSignatures {
-		glog.V(2).Infof("Image %s is not signed", i.Ref)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.usedBy) > 0 {
+		i.deleted = true
+		return false, nil
 	}
-	if err != nil && !noSignatures {
-		return fmt.Errorf("SIF verification failed: %v", err)
+	err := os.Remove(i.Path)
+	if err != nil {
+		return false, fmt.Errorf("could not remove image: %v", err)
 	}
-	return nil
+	return true, nil
 }
 
 // Matches tests image against passed filter and returns true if it matches.
@@ -238,55 +482,187 @@ func (i *Info) Matches(filter *k8s.ImageFilter) bool {
 	return false
 }
 
-func pullImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) error {
-	pullURL := strings.TrimPrefix(ref.String(), ref.URI()+"/")
+func pullImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string, platforms []Platform, build *BuildConfig) (*Platform, error) {
 	switch ref.URI() {
 	case singularity.LibraryDomain:
+		_, pullURL := splitDomain(ref.String())
 		config := &library.Config{
 			BaseURL:   auth.GetServerAddress(),
 			AuthToken: auth.GetPassword(),
 		}
 		client, err := library.NewClient(config)
 		if err != nil {
-			return fmt.Errorf("could not create library client: %v", err)
+			return nil, permanent(fmt.Errorf("could not create library client: %v", err))
 		}
-		w, err := os.Create(pullPath)
-		if err != nil {
-			return fmt.Errorf("could not create file to pull image: %v", err)
+		// with a single preferred architecture there is nothing
+		// to choose from, so image is downloaded right away
+		arches := architectures(platforms)
+		platform := &Platform{OS: "linux", Architecture: arches[0]}
+		if len(arches) > 1 {
+			_, platform, err = libraryImage(ctx, client, pullURL, platforms)
+			if err == library.ErrNotFound {
+				return nil, permanent(fmt.Errorf("could not pull library image: %v", ErrNotFound))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not pull library image: %v", err)
+			}
 		}
 		parts := strings.Split(pullURL, ":")
 		// don't check index out of range since we add :latest by default when parsing ref
-		err = client.DownloadImage(ctx, w, runtime.GOARCH, parts[0], parts[1], nil)
-		_ = w.Close()
+		err = downloadLibraryImage(ctx, client, pullPath, platform.Architecture, parts[0], parts[1])
 		if err != nil {
-			return fmt.Errorf("could not pull library image: %v", err)
+			if !isRetriable(err) {
+				return nil, permanent(fmt.Errorf("could not pull library image: %v", err))
+			}
+			return nil, fmt.Errorf("could not pull library image: %v", err)
 		}
+		return platform, nil
 	case singularity.DockerDomain:
-		var errMsg bytes.Buffer
-		if auth.GetServerAddress() != "" {
-			pullURL = fmt.Sprintf("%s/%s", auth.GetServerAddress(), pullURL)
+		pullURL := strings.TrimPrefix(ref.String(), ref.URI()+"/")
+		platform, manifestDigest, err := dockerPlatform(ctx, ref, auth, platforms)
+		if err != nil {
+			return nil, err
+		}
+		if manifestDigest != "" {
+			name, _, _, _ := parseDockerRef(ref.String())
+			pullURL = name + "@" + manifestDigest
 		}
+		pullURL = dockerServerName(pullURL, auth)
 		remote := fmt.Sprintf("%s://%s", singularity.DockerProtocol, pullURL)
-		buildCmd := exec.CommandContext(ctx, singularity.RuntimeName, "build", "-F", pullPath, remote)
-		buildCmd.Env = []string{
-			fmt.Sprintf("PATH=%s", os.Getenv("PATH")),
-			// assume auth.Auth is not needed b/c k8s decodes it into username and password,
-			// see https://github.com/kubernetes/kubernetes/blob/master/pkg/credentialprovider/config.go#L284
-			fmt.Sprintf("%s=%s", singularity.EnvDockerUsername, auth.GetUsername()),
-			fmt.Sprintf("%s=%s", singularity.EnvDockerPassword, auth.GetPassword()),
+		return platform, buildImage(ctx, pullPath, remote, auth, build)
+	case singularity.OrasProtocol:
+		return nil, pullOrasImage(ctx, ref, auth, pullPath)
+	case singularity.LocalOCIArchiveDomain, singularity.LocalDockerArchiveDomain, singularity.LocalOCIDirDomain:
+		return nil, buildLocalImage(ctx, ref, pullPath, platforms, build)
+	default:
+		return nil, permanent(fmt.Errorf("unknown image registry: %s", ref.URI()))
+	}
+}
+
+// libraryImage requests metadata of library image built for the first of
+// preferred platforms it is available for. Only architecture is taken into
+// account since library images are not tagged with variants. If image is not
+// available for any of the platforms library.ErrNotFound is returned.
+func libraryImage(ctx context.Context, client *library.Client, pullURL string, platforms []Platform) (*library.Image, *Platform, error) {
+	for _, arch := range architectures(platforms) {
+		img, err := client.GetImage(ctx, arch, pullURL)
+		if err == library.ErrNotFound {
+			glog.V(4).Infof("Library image %s is not available for %s", pullURL, arch)
+			continue
 		}
-		buildCmd.Stderr = &errMsg
-		buildCmd.Stdout = ioutil.Discard
-		err := buildCmd.Run()
 		if err != nil {
-			return fmt.Errorf("could not build image: %s", &errMsg)
+			return nil, nil, err
+		}
+		return img, &Platform{OS: "linux", Architecture: arch}, nil
+	}
+	return nil, nil, library.ErrNotFound
+}
+
+// architectures returns distinct architectures of platforms in order of
+// preference. When no platforms are passed host architecture is returned.
+func architectures(platforms []Platform) []string {
+	if len(platforms) == 0 {
+		platforms = DefaultPlatforms()
+	}
+	var arches []string
+	seen := make(map[string]bool)
+	for _, p := range platforms {
+		if !seen[p.Architecture] {
+			seen[p.Architecture] = true
+			arches = append(arches, p.Architecture)
+		}
+	}
+	return arches
+}
+
+// downloadLibraryImage downloads library image into pullPath. If pullPath
+// already contains partially downloaded image, download is resumed.
+func downloadLibraryImage(ctx context.Context, client *library.Client, pullPath, arch, path, tag string) error {
+	if strings.Contains(path, ":") {
+		return permanent(fmt.Errorf("malformed image path: %s", path))
+	}
+
+	req, err := libraryImageRequest(client, arch, path, tag)
+	if err != nil {
+		return permanent(err)
+	}
+	_, err = resumeDownload(ctx, client.HTTPClient, req, pullPath)
+	return err
+}
+
+// libraryImageRequest returns request that downloads library image file.
+func libraryImageRequest(client *library.Client, arch, path, tag string) (*http.Request, error) {
+	u := client.BaseURL.ResolveReference(&url.URL{
+		Path:     fmt.Sprintf("/v1/imagefile/%s:%s", path, tag),
+		RawQuery: url.Values{"arch": []string{arch}}.Encode(),
+	})
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	if client.AuthToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("BEARER %s", client.AuthToken))
+	}
+	if client.UserAgent != "" {
+		req.Header.Set("User-Agent", client.UserAgent)
+	}
+	return req, nil
+}
+
+// isPermanentBuildError checks singularity build output and returns true
+// if build has failed due to a reason that will not go away with time.
+// Generic messages, e.g. "not found", are not matched, since helpers
+// and proxies report transient failures with them too.
+func isPermanentBuildError(output string) bool {
+	output = strings.ToLower(output)
+	for _, reason := range []string{
+		"unauthorized",
+		"authentication required",
+		"denied",
+		"manifest unknown",
+		"manifest not found",
+		"name unknown",
+		"repository name not known",
+		"repository not found",
+		"repository does not exist",
+	} {
+		if strings.Contains(output, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveStalePulls removes temporary files left in location by pulls that were
+// interrupted, e.g. due to a crash. It should be called before any pull is started.
+func RemoveStalePulls(location string) error {
+	fii, err := ioutil.ReadDir(location)
+	if err != nil {
+		return fmt.Errorf("could not read directory: %v", err)
+	}
+	for _, fi := range fii {
+		if !isPullFile(fi.Name()) {
+			continue
+		}
+		path := filepath.Join(location, fi.Name())
+		glog.V(2).Infof("Removing stale pull file %s", path)
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("could not remove stale pull file: %v", err)
 		}
-	default:
-		return fmt.Errorf("unknown image registry: %s", ref.URI())
 	}
 	return nil
 }
 
+// isPullFile returns true if file with the passed name
+// may be a temporary pull file created by Pull.
+func isPullFile(name string) bool {
+	if !strings.HasPrefix(name, pullFilePrefix) || len(name) != len(pullFilePrefix)+IDLen {
+		return false
+	}
+	_, err := hex.DecodeString(strings.TrimPrefix(name, pullFilePrefix))
+	return err == nil
+}
+
 func sifInfo(sifPath string) (*Info, error) {
 	sif, err := os.Open(sifPath)
 	if err != nil {
@@ -314,6 +690,10 @@ func sifInfo(sifPath string) (*Info, error) {
 	if err != nil {
 		glog.Errorf("Could not fetch OCI config for image %s: %v", sifPath, err)
 	}
+	encrypted, err := isEncrypted(sifPath)
+	if err != nil {
+		glog.Errorf("Could not check if image %s is encrypted: %v", sifPath, err)
+	}
 
 	return &Info{
 		ID:        checksum,
@@ -321,6 +701,7 @@ func sifInfo(sifPath string) (*Info, error) {
 		Size:      uint64(fi.Size()),
 		Path:      sifPath,
 		OciConfig: ociConfig,
+		Encrypted: encrypted,
 	}, nil
 }
 
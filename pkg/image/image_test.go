@@ -22,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/require"
@@ -350,7 +351,7 @@ func TestInfo_Verify(t *testing.T) {
 				}()
 			}
 
-			err = img.Verify()
+			err = img.Verify(VerifyPolicy{Mode: VerifyWarn})
 			if tc.expectError == "" {
 				require.NoError(t, err, "unexpected error")
 			} else {
@@ -361,6 +362,46 @@ func TestInfo_Verify(t *testing.T) {
 	}
 }
 
+func TestIsPermanentBuildError(t *testing.T) {
+	tt := []struct {
+		output    string
+		permanent bool
+	}{
+		{
+			output:    "FATAL: reading manifest latest in docker.io/library/nope: manifest unknown: manifest unknown",
+			permanent: true,
+		},
+		{
+			output:    "errors:\ndenied: requested access to the resource is denied\nunauthorized: authentication required",
+			permanent: true,
+		},
+		{
+			output:    "FATAL: while pulling example/nope: repository does not exist or may require authorization",
+			permanent: true,
+		},
+		{
+			output:    "NAME_UNKNOWN: repository name not known to registry",
+			permanent: true,
+		},
+		{
+			output:    "/usr/local/libexec/singularity/bin/helper: mksquashfs: command not found",
+			permanent: false,
+		},
+		{
+			output:    "pinging docker registry returned: dial tcp: lookup registry.example.com: host not found",
+			permanent: false,
+		},
+		{
+			output:    "net/http: TLS handshake timeout",
+			permanent: false,
+		},
+	}
+
+	for _, tc := range tt {
+		require.Equal(t, tc.permanent, isPermanentBuildError(tc.output), "unexpected result for %q", tc.output)
+	}
+}
+
 func TestInfo_BorrowReturn(t *testing.T) {
 	tt := []struct {
 		name         string
@@ -453,6 +494,43 @@ func TestInfo_Remove(t *testing.T) {
 	}
 }
 
+func TestInfo_RemoveWhenUnused(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.NoError(t, err, "could not create temp image file")
+	require.NoError(t, f.Close())
+	defer os.Remove(f.Name())
+
+	info := &Info{
+		ID:   "0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+		Path: f.Name(),
+		Ref: &Reference{
+			uri:  singularity.DockerDomain,
+			tags: []string{"busybox:1.28"},
+		},
+	}
+	info.Borrow("first")
+	info.Borrow("second")
+
+	removed, err := info.RemoveWhenUnused()
+	require.NoError(t, err, "could not remove image")
+	require.False(t, removed, "used image is removed")
+	require.True(t, info.MarkedForDeletion(), "image is not marked for deletion")
+
+	data, err := json.Marshal(info)
+	require.NoError(t, err, "could not marshal image")
+	var restored *Info
+	require.NoError(t, json.Unmarshal(data, &restored), "could not unmarshal image")
+	require.True(t, restored.MarkedForDeletion(), "deletion mark is not restored")
+
+	info.Return("first")
+	_, err = os.Stat(f.Name())
+	require.NoError(t, err, "image file is removed while still used")
+	info.Return("second")
+	_, err = os.Stat(f.Name())
+	require.True(t, os.IsNotExist(err), "image file is not removed after last return")
+	require.False(t, info.MarkedForDeletion(), "removed image is still marked for deletion")
+}
+
 func TestInfo_Matches(t *testing.T) {
 	tt := []struct {
 		name   string
@@ -627,6 +705,33 @@ func TestInfo_UnmarshalJSON(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "with last used time",
+			input: `
+				{
+					"id":"0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+					"sha256":"0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+					"size":741376,
+					"path":"/var/lib/singularity/0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+					"ref":{
+						"uri":"docker.io",
+						"tags":["busybox:1.28"],
+						"digests":null
+					},
+					"lastUsed":"2019-03-12T15:04:05Z"
+				}`,
+			expect: &Info{
+				ID:     "0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+				Sha256: "0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+				Size:   741376,
+				Path:   "/var/lib/singularity/0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+				Ref: &Reference{
+					uri:  singularity.DockerDomain,
+					tags: []string{"busybox:1.28"},
+				},
+				lastUsed: time.Date(2019, 3, 12, 15, 4, 5, 0, time.UTC),
+			},
+		},
 	}
 
 	for _, tc := range tt {
@@ -707,6 +812,33 @@ func TestInfo_MarshalJSON(t *testing.T) {
 					}
 				}`,
 		},
+		{
+			name: "with last used time",
+			input: &Info{
+				ID:     "0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+				Sha256: "0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+				Size:   741376,
+				Path:   "/var/lib/singularity/0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+				Ref: &Reference{
+					uri:  singularity.DockerDomain,
+					tags: []string{"busybox:1.28"},
+				},
+				lastUsed: time.Date(2019, 3, 12, 15, 4, 5, 0, time.UTC),
+			},
+			expect: `
+				{
+					"id":"0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+					"sha256":"0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+					"size":741376,
+					"path":"/var/lib/singularity/0d408f32cc56b16509f30ae3dfa56ffb01269b2100036991d49af645a7b717a0",
+					"ref":{
+						"uri":"docker.io",
+						"tags":["busybox:1.28"],
+						"digests":null
+					},
+					"lastUsed":"2019-03-12T15:04:05Z"
+				}`,
+		},
 	}
 
 	for _, tc := range tt {
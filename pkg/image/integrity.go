@@ -0,0 +1,84 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sylabs/sif/pkg/sif"
+)
+
+// WithChecksum makes Pull verify that sha256 checksum of the pulled image
+// matches checksum, e.g. the one reported by library. Image that does
+// not match is removed and error wrapping ErrChecksumMismatch is returned.
+func WithChecksum(checksum string) PullOption {
+	return func(o *pullOptions) {
+		o.checksum = checksum
+	}
+}
+
+// CheckIntegrity performs a fast integrity check of image file without reading
+// image data: file size should match the recorded one and all SIF descriptors
+// should point to data within the file. Use VerifyChecksum for a full check.
+func (i *Info) CheckIntegrity() error {
+	fi, err := os.Stat(i.Path)
+	if err != nil {
+		return fmt.Errorf("could not stat image: %v", err)
+	}
+	if uint64(fi.Size()) != i.Size {
+		return fmt.Errorf("image size is %d, expected %d", fi.Size(), i.Size)
+	}
+
+	fimg, err := sif.LoadContainer(i.Path, true)
+	if err != nil {
+		return fmt.Errorf("could not load SIF image: %v", err)
+	}
+	defer fimg.UnloadContainer()
+
+	for _, d := range fimg.DescrArr {
+		if !d.Used {
+			continue
+		}
+		if d.Fileoff < 0 || d.Filelen < 0 || d.Fileoff+d.Filelen > fi.Size() {
+			return fmt.Errorf("SIF descriptor %d points outside of image file", d.ID)
+		}
+	}
+	if _, _, err := fimg.GetPartPrimSys(); err != nil {
+		return fmt.Errorf("could not find primary system partition: %v", err)
+	}
+	return nil
+}
+
+// VerifyChecksum rehashes image file and compares the result with
+// the recorded sha256 checksum. On mismatch ErrChecksumMismatch is returned.
+func (i *Info) VerifyChecksum() error {
+	f, err := os.Open(i.Path)
+	if err != nil {
+		return fmt.Errorf("could not open image: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("could not read image: %v", err)
+	}
+	if fmt.Sprintf("%x", h.Sum(nil)) != i.Sha256 {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfo_CheckIntegrity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "integrity-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.sif")
+	createSIF(t, valid, bytes.Repeat([]byte("squashfs"), 512))
+	validInfo, err := sifInfo(valid)
+	require.NoError(t, err, "could not get image info")
+
+	content, err := ioutil.ReadFile(valid)
+	require.NoError(t, err, "could not read image")
+	truncated := filepath.Join(dir, "truncated.sif")
+	require.NoError(t, ioutil.WriteFile(truncated, content[:len(content)-100], 0644), "could not write image")
+	notSIF := filepath.Join(dir, "plain.sif")
+	require.NoError(t, ioutil.WriteFile(notSIF, content[len(content)-100:], 0644), "could not write image")
+
+	tt := []struct {
+		name        string
+		info        *Info
+		expectError string
+	}{
+		{
+			name: "valid image",
+			info: validInfo,
+		},
+		{
+			name:        "size mismatch",
+			info:        &Info{Path: valid, Size: validInfo.Size + 1},
+			expectError: "image size is",
+		},
+		{
+			name:        "truncated image",
+			info:        &Info{Path: truncated, Size: validInfo.Size - 100},
+			expectError: "points outside of image file",
+		},
+		{
+			name:        "not a SIF",
+			info:        &Info{Path: notSIF, Size: 100},
+			expectError: "could not load SIF image",
+		},
+		{
+			name:        "missing file",
+			info:        &Info{Path: filepath.Join(dir, "missing.sif")},
+			expectError: "could not stat image",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.info.CheckIntegrity()
+			if tc.expectError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectError)
+		})
+	}
+}
+
+func TestInfo_VerifyChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "integrity-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "image.sif")
+	createSIF(t, path, bytes.Repeat([]byte("squashfs"), 512))
+	info, err := sifInfo(path)
+	require.NoError(t, err, "could not get image info")
+	require.NoError(t, info.VerifyChecksum())
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "could not read image")
+	content[len(content)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, content, 0644), "could not corrupt image")
+	require.Equal(t, ErrChecksumMismatch, info.VerifyChecksum())
+}
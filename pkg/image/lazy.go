@@ -0,0 +1,548 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	library "github.com/sylabs/scs-library-client/client"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const (
+	// lazyChunkSize is a size of ranges lazily pulled images are fetched by.
+	lazyChunkSize = 4 << 20
+	// lazyFetchRetries is a number of times failed range request is retried.
+	lazyFetchRetries = 3
+	// lazyFetchBackoff is a delay before range request is retried.
+	lazyFetchBackoff = time.Second
+	// lazyReadTimeout limits how long a read of lazily pulled image waits
+	// for missing ranges, so that reads fail instead of hanging forever.
+	lazyReadTimeout = 2 * time.Minute
+)
+
+// errNoRanges is returned when image server does not support
+// range requests, so image cannot be pulled lazily.
+var errNoRanges = fmt.Errorf("server does not support range requests")
+
+// WithLazy makes library and HTTP(S) images whose checksum is known in advance,
+// see WithChecksum, to be pulled lazily: only SIF header, descriptors and data
+// objects other than root filesystem partition are downloaded by Pull. The rest
+// is fetched on demand through Info.LazyReader and completed with Info.Prefetch.
+// Missing ranges are fetched by the calling process, so readers break once it
+// exits. Other images, as well as images served without range support, are pulled in full.
+func WithLazy() PullOption {
+	return func(o *pullOptions) {
+		o.lazy = true
+	}
+}
+
+type chunkState int
+
+const (
+	chunkMissing chunkState = iota
+	chunkFetching
+	chunkPresent
+)
+
+// lazyFile is a sparse local copy of remote image file
+// that is filled with range requests on demand.
+type lazyFile struct {
+	client *http.Client
+	req    *http.Request
+	path   string
+	size   int64
+
+	// fmu guards f, which is closed and set to nil once file is complete.
+	fmu sync.RWMutex
+	f   *os.File
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks []chunkState
+}
+
+// LazyReader returns reader of lazily pulled image file that fetches missing
+// ranges on demand, see WithLazy. Once image file is complete nil is returned
+// and image file may be used directly.
+func (i *Info) LazyReader() io.ReaderAt {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if i.lazy == nil {
+		return nil
+	}
+	return i.lazy
+}
+
+// Prefetch downloads ranges of lazily pulled image that are still missing and
+// checks image checksum. After it succeeds image file is complete. For images
+// that were pulled in full it does nothing. When checksum does not match
+// ErrChecksumMismatch is returned.
+func (i *Info) Prefetch(ctx context.Context) error {
+	i.mu.RLock()
+	l := i.lazy
+	i.mu.RUnlock()
+	if l == nil {
+		return nil
+	}
+
+	for chunk := range l.chunks {
+		if err := l.fetchChunk(ctx, chunk); err != nil {
+			return fmt.Errorf("could not fetch image: %v", err)
+		}
+	}
+	if err := l.sync(); err != nil {
+		return fmt.Errorf("could not sync image: %v", err)
+	}
+	checksum, err := fileChecksum(i.Path)
+	if err != nil {
+		return err
+	}
+	if checksum != i.Sha256 {
+		return ErrChecksumMismatch
+	}
+
+	i.mu.Lock()
+	i.lazy = nil
+	i.Lazy = false
+	i.mu.Unlock()
+	if err := l.close(); err != nil {
+		glog.Errorf("Could not close image %s: %v", i.Path, err)
+	}
+	return nil
+}
+
+// lazyChecksum returns checksum of image referenced by ref if it may be pulled
+// lazily. Images with unknown checksum cannot be pulled lazily, since their
+// ID is not known until the whole file is downloaded.
+func lazyChecksum(ref *Reference, o *pullOptions) string {
+	if ref.URI() == singularity.LibraryDomain {
+		return o.checksum
+	}
+	if !isURL(ref) {
+		return ""
+	}
+	_, checksum, err := parseURLRef(ref.String())
+	if err != nil || checksum == "" {
+		return o.checksum
+	}
+	return checksum
+}
+
+// canPullLazily returns true if image referenced by ref may be pulled lazily
+// into location. Image file that already exists is never pulled lazily, since
+// it may be in use and lazy pull writes directly into the final location.
+func canPullLazily(location string, ref *Reference, o *pullOptions) bool {
+	checksum := lazyChecksum(ref, o)
+	if checksum == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(location, checksum))
+	return os.IsNotExist(err)
+}
+
+// pullLazy creates a sparse image file in location and downloads SIF header,
+// descriptors and data objects other than primary partition into it.
+func pullLazy(ctx context.Context, location string, ref *Reference, auth *k8s.AuthConfig, o *pullOptions) (*Info, error) {
+	client, req, platform, err := lazyRequest(ctx, ref, auth, o)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := lazyChecksum(ref, o)
+	path := filepath.Join(location, checksum)
+	l := &lazyFile{
+		client: client,
+		req:    req,
+		path:   path,
+	}
+	l.cond = sync.NewCond(&l.mu)
+	if err := l.open(ctx, path); err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		l.f.Close()
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Could not remove %s: %v", path, err)
+		}
+	}
+
+	if err := l.fetchMetadata(ctx); err != nil {
+		cleanup()
+		return nil, err
+	}
+	ociConfig, err := fetchOCIConfig(path)
+	if err != nil {
+		glog.Errorf("Could not fetch OCI config for image %s: %v", path, err)
+	}
+	encrypted, err := isEncrypted(path)
+	if err != nil {
+		glog.Errorf("Could not check if image %s is encrypted: %v", path, err)
+	}
+	glog.V(2).Infof("Pulled %s lazily, %d bytes are fetched on demand", ref, l.missing())
+	return &Info{
+		ID:        checksum,
+		Sha256:    checksum,
+		Size:      uint64(l.size),
+		Path:      path,
+		Ref:       ref,
+		OciConfig: ociConfig,
+		Platform:  platform,
+		Encrypted: encrypted,
+		Lazy:      true,
+		lazy:      l,
+	}, nil
+}
+
+// lazyRequest returns HTTP client and request image file referenced by ref
+// should be downloaded with along with platform image is pulled for.
+func lazyRequest(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, o *pullOptions) (*http.Client, *http.Request, *Platform, error) {
+	if isURL(ref) {
+		u, _, err := parseURLRef(ref.String())
+		if err != nil {
+			return nil, nil, nil, permanent(err)
+		}
+		req, err := urlRequest(u, auth)
+		if err != nil {
+			return nil, nil, nil, permanent(err)
+		}
+		return http.DefaultClient, req, nil, nil
+	}
+
+	_, pullURL := splitDomain(ref.String())
+	client, err := library.NewClient(&library.Config{
+		BaseURL:   auth.GetServerAddress(),
+		AuthToken: auth.GetPassword(),
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not create library client: %v", err)
+	}
+	arches := architectures(o.platforms)
+	platform := &Platform{OS: "linux", Architecture: arches[0]}
+	if len(arches) > 1 {
+		_, platform, err = libraryImage(ctx, client, pullURL, o.platforms)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not get library image: %v", err)
+		}
+	}
+	parts := strings.Split(pullURL, ":")
+	req, err := libraryImageRequest(client, platform.Architecture, parts[0], parts[1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient, req, platform, nil
+}
+
+// open requests the first chunk of remote file to learn its size and
+// creates sparse local file located at path that holds that chunk.
+func (l *lazyFile) open(ctx context.Context, path string) error {
+	data, size, err := l.download(ctx, 0, lazyChunkSize-1)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create image file: %v", err)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return fmt.Errorf("could not allocate image file: %v", err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write image file: %v", err)
+	}
+	l.f = f
+	l.size = size
+	l.chunks = make([]chunkState, (size+lazyChunkSize-1)/lazyChunkSize)
+	l.chunks[0] = chunkPresent
+	return nil
+}
+
+// fetchMetadata makes sure SIF header, descriptors and data objects
+// other than primary system partition are present in local file.
+func (l *lazyFile) fetchMetadata(ctx context.Context) error {
+	var header sif.Header
+	headerSize := int64(binary.Size(header))
+	if err := l.ensure(ctx, 0, headerSize); err != nil {
+		return fmt.Errorf("could not fetch SIF header: %v", err)
+	}
+	err := binary.Read(bytes.NewReader(l.head(headerSize)), binary.LittleEndian, &header)
+	if err != nil {
+		return fmt.Errorf("could not read SIF header: %v", err)
+	}
+	dataStart := header.Dataoff
+	if dataStart <= 0 || dataStart > l.size {
+		return fmt.Errorf("invalid SIF data offset %d", dataStart)
+	}
+	if err := l.ensure(ctx, 0, dataStart); err != nil {
+		return fmt.Errorf("could not fetch SIF descriptors: %v", err)
+	}
+	fimg, err := sif.LoadContainerReader(bytes.NewReader(l.head(dataStart)))
+	if err != nil {
+		return fmt.Errorf("could not load SIF descriptors: %v", err)
+	}
+	part, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return fmt.Errorf("could not find primary system partition: %v", err)
+	}
+	for _, d := range fimg.DescrArr {
+		if !d.Used || d.ID == part.ID {
+			continue
+		}
+		if d.Fileoff < 0 || d.Filelen < 0 || d.Fileoff+d.Filelen > l.size {
+			return fmt.Errorf("SIF descriptor %d points outside of image file", d.ID)
+		}
+		if err := l.ensure(ctx, d.Fileoff, d.Fileoff+d.Filelen); err != nil {
+			return fmt.Errorf("could not fetch SIF data object %d: %v", d.ID, err)
+		}
+	}
+	return nil
+}
+
+// head returns the first n bytes of local file, they should be present.
+func (l *lazyFile) head(n int64) []byte {
+	buf := make([]byte, n)
+	read, _ := l.readAt(buf, 0)
+	return buf[:read]
+}
+
+// readAt reads local file. Once file is complete and closed, it is
+// reopened for each read, since readers, e.g. network block devices
+// of running containers, may outlive lazy pull.
+func (l *lazyFile) readAt(p []byte, off int64) (int, error) {
+	l.fmu.RLock()
+	defer l.fmu.RUnlock()
+
+	if l.f != nil {
+		return l.f.ReadAt(p, off)
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, off)
+}
+
+// writeAt writes fetched range to local file. Local file is only closed
+// once all its ranges are fetched, so writing after that is an error.
+func (l *lazyFile) writeAt(p []byte, off int64) (int, error) {
+	l.fmu.RLock()
+	defer l.fmu.RUnlock()
+
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	return l.f.WriteAt(p, off)
+}
+
+// sync commits fetched ranges of local file to storage.
+func (l *lazyFile) sync() error {
+	l.fmu.RLock()
+	defer l.fmu.RUnlock()
+
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Sync()
+}
+
+// close closes local file once all its ranges are fetched.
+func (l *lazyFile) close() error {
+	l.fmu.Lock()
+	defer l.fmu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// missing returns number of bytes that are not fetched yet.
+func (l *lazyFile) missing() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var missing int64
+	for i, state := range l.chunks {
+		if state == chunkPresent {
+			continue
+		}
+		size := int64(lazyChunkSize)
+		if i == len(l.chunks)-1 {
+			size = l.size - int64(i)*lazyChunkSize
+		}
+		missing += size
+	}
+	return missing
+}
+
+// ReadAt implements io.ReaderAt. Missing ranges are fetched before read.
+func (l *lazyFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if off >= l.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > l.size {
+		p = p[:l.size-off]
+		eof = io.EOF
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lazyReadTimeout)
+	defer cancel()
+	if err := l.ensure(ctx, off, off+int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := l.readAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	return n, eof
+}
+
+// ensure makes sure byte range [start, end) is present in local file.
+func (l *lazyFile) ensure(ctx context.Context, start, end int64) error {
+	for chunk := start / lazyChunkSize; chunk*lazyChunkSize < end; chunk++ {
+		if err := l.fetchChunk(ctx, int(chunk)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchChunk downloads chunk unless it is already present. Concurrent
+// requests for the same chunk wait for a single download.
+func (l *lazyFile) fetchChunk(ctx context.Context, chunk int) error {
+	l.mu.Lock()
+	for l.chunks[chunk] == chunkFetching {
+		l.cond.Wait()
+	}
+	if l.chunks[chunk] == chunkPresent {
+		l.mu.Unlock()
+		return nil
+	}
+	l.chunks[chunk] = chunkFetching
+	l.mu.Unlock()
+
+	start := int64(chunk) * lazyChunkSize
+	end := start + lazyChunkSize - 1
+	if end >= l.size {
+		end = l.size - 1
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		var data []byte
+		data, _, err = l.download(ctx, start, end)
+		if err == nil {
+			_, err = l.writeAt(data, start)
+			break
+		}
+		if attempt >= lazyFetchRetries || !isRetriable(err) {
+			break
+		}
+		glog.V(4).Infof("Could not fetch bytes %d-%d of %s, retrying: %v", start, end, l.req.URL, err)
+		select {
+		case <-time.After(lazyFetchBackoff):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.chunks[chunk] = chunkPresent
+	if err != nil {
+		l.chunks[chunk] = chunkMissing
+	}
+	l.cond.Broadcast()
+	return err
+}
+
+// download requests bytes from start to end inclusive of remote file.
+// It returns received data and total size of remote file.
+func (l *lazyFile) download(ctx context.Context, start, end int64) ([]byte, int64, error) {
+	req := l.req.Clone(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, 0, permanent(errNoRanges)
+	default:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, &statusError{
+			code: resp.StatusCode,
+			msg:  strings.TrimSpace(string(msg)),
+		}
+	}
+
+	contentRange := resp.Header.Get("Content-Range")
+	size := rangeSize(contentRange)
+	if rangeStart(contentRange) != start || size < 0 {
+		return nil, 0, permanent(fmt.Errorf("unexpected content range %q", contentRange))
+	}
+	if end >= size {
+		end = size - 1
+	}
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, 0, fmt.Errorf("could not read range: %v", err)
+	}
+	return data, size, nil
+}
+
+// rangeSize parses Content-Range header value in form 'bytes start-end/size'
+// and returns size. If header is malformed or size is unknown -1 is returned.
+func rangeSize(contentRange string) int64 {
+	var start, end, size int64
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size)
+	if err != nil {
+		return -1
+	}
+	return size
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/sif/pkg/sif"
+)
+
+func TestPull_Lazy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazy-test-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	sifPath := filepath.Join(dir, "source.sif")
+	data := bytes.Repeat([]byte("squashfs"), 3*lazyChunkSize/8)
+	createSIF(t, sifPath, data)
+	content, err := ioutil.ReadFile(sifPath)
+	require.NoError(t, err, "could not read SIF")
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+	fimg, err := sif.LoadContainer(sifPath, true)
+	require.NoError(t, err, "could not load SIF")
+	part, _, err := fimg.GetPartPrimSys()
+	require.NoError(t, err, "could not find partition")
+	partOffset := part.Fileoff
+	fimg.UnloadContainer()
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/plain.sif" {
+			w.Write(content)
+			return
+		}
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "image.sif", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	t.Run("on demand", func(t *testing.T) {
+		storage := filepath.Join(dir, "on-demand")
+		require.NoError(t, os.Mkdir(storage, 0755), "could not create storage")
+		ref, err := ParseRef(server.URL + "/image.sif@sha256:" + checksum)
+		require.NoError(t, err, "could not parse reference")
+
+		info, err := Pull(context.Background(), storage, ref, nil, WithLazy())
+		require.NoError(t, err, "could not pull image")
+		require.True(t, info.Lazy)
+		require.Equal(t, checksum, info.ID)
+		require.Equal(t, uint64(len(content)), info.Size)
+		require.NoError(t, info.CheckIntegrity(), "lazy image is not a valid SIF")
+		lazy := info.LazyReader()
+		require.NotNil(t, lazy)
+		require.NotZero(t, info.lazy.missing(), "image is fetched in full")
+		for _, r := range ranges {
+			require.True(t, strings.HasPrefix(r, "bytes="), "image is requested without range")
+		}
+
+		// read the last bytes of partition that are never fetched on pull
+		end := partOffset + int64(len(data))
+		buf := make([]byte, 16)
+		_, err = lazy.ReadAt(buf, end-16)
+		require.NoError(t, err, "could not read lazy image")
+		require.Equal(t, content[end-16:end], buf)
+
+		require.NoError(t, info.Prefetch(context.Background()), "could not prefetch image")
+		require.False(t, info.Lazy)
+		require.Nil(t, info.LazyReader())
+		require.NoError(t, info.VerifyChecksum(), "prefetched image is corrupted")
+
+		require.Nil(t, lazy.(*lazyFile).f, "complete image file is kept open")
+		_, err = lazy.ReadAt(buf, 0)
+		require.NoError(t, err, "could not read complete image through lazy reader")
+		require.Equal(t, content[:16], buf)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		storage := filepath.Join(dir, "mismatch")
+		require.NoError(t, os.Mkdir(storage, 0755), "could not create storage")
+		wrong := strings.Repeat("a", IDLen)
+		ref, err := ParseRef(server.URL + "/image.sif?sha256=" + wrong)
+		require.NoError(t, err, "could not parse reference")
+
+		info, err := Pull(context.Background(), storage, ref, nil, WithLazy())
+		require.NoError(t, err, "could not pull image")
+		require.Equal(t, ErrChecksumMismatch, info.Prefetch(context.Background()))
+		require.NotNil(t, info.LazyReader(), "corrupted image is considered complete")
+	})
+
+	t.Run("no range support", func(t *testing.T) {
+		storage := filepath.Join(dir, "plain")
+		require.NoError(t, os.Mkdir(storage, 0755), "could not create storage")
+		ref, err := ParseRef(server.URL + "/plain.sif@sha256:" + checksum)
+		require.NoError(t, err, "could not parse reference")
+
+		info, err := Pull(context.Background(), storage, ref, nil, WithLazy())
+		require.NoError(t, err, "could not pull image")
+		require.False(t, info.Lazy)
+		require.Nil(t, info.LazyReader())
+		require.NoError(t, info.VerifyChecksum(), "pulled image is corrupted")
+	})
+
+	t.Run("unknown checksum", func(t *testing.T) {
+		storage := filepath.Join(dir, "unknown")
+		require.NoError(t, os.Mkdir(storage, 0755), "could not create storage")
+		ref, err := ParseRef(server.URL + "/image.sif")
+		require.NoError(t, err, "could not parse reference")
+
+		info, err := Pull(context.Background(), storage, ref, nil, WithLazy())
+		require.NoError(t, err, "could not pull image")
+		require.Nil(t, info.LazyReader(), "image with unknown checksum is pulled lazily")
+	})
+}
+
+func TestRangeSize(t *testing.T) {
+	require.Equal(t, int64(1024), rangeSize("bytes 0-511/1024"))
+	require.Equal(t, int64(-1), rangeSize("bytes 0-511/*"))
+	require.Equal(t, int64(-1), rangeSize("invalid"))
+}
+
+func TestLazyFile_FetchChunk(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "lazy-test-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+	f, err := ioutil.TempFile(dir, "image-")
+	require.NoError(t, err, "could not create image file")
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/image.sif", nil)
+	require.NoError(t, err, "could not create request")
+
+	l := &lazyFile{
+		client: server.Client(),
+		req:    req,
+		path:   f.Name(),
+		size:   2 * lazyChunkSize,
+		f:      f,
+		chunks: make([]chunkState, 2),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	defer l.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), lazyFetchBackoff/10)
+	defer cancel()
+	start := time.Now()
+	err = l.fetchChunk(ctx, 1)
+	require.Equal(t, context.DeadlineExceeded, err, "unexpected fetch error")
+	require.True(t, time.Since(start) < lazyFetchBackoff, "retry backoff ignores context")
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests), "range is requested after context is done")
+	require.Equal(t, chunkMissing, l.chunks[1], "chunk is not released")
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+const (
+	// maxArchiveMetadataSize limits total size of manifests and
+	// configs read from a single local archive.
+	maxArchiveMetadataSize = 4 * maxManifestSize
+	// maxIndexDepth limits nesting of OCI image indexes.
+	maxIndexDepth = 4
+)
+
+// localImportSources maps local import domains to
+// singularity build sources they are converted from.
+var localImportSources = map[string]string{
+	singularity.LocalOCIArchiveDomain:    "oci-archive",
+	singularity.LocalDockerArchiveDomain: "docker-archive",
+	singularity.LocalOCIDirDomain:        "oci",
+}
+
+// IsLocalImport returns true if ref points to a local OCI archive, docker
+// archive or OCI layout directory that is converted to SIF on pull.
+// Such images are identified by their original path, so importing
+// the same path again may reuse previously converted image.
+func IsLocalImport(ref *Reference) bool {
+	_, ok := localImportSources[ref.URI()]
+	return ok
+}
+
+// localImportDomain returns local import domain imgRef starts with,
+// or an empty string if imgRef is not a local import reference.
+func localImportDomain(imgRef string) string {
+	for domain := range localImportSources {
+		if strings.HasPrefix(imgRef, domain+"/") {
+			return domain
+		}
+	}
+	return ""
+}
+
+// localImportPath returns path to the archive or directory ref points to.
+func localImportPath(ref *Reference) string {
+	return strings.TrimPrefix(ref.tags[0], ref.URI())
+}
+
+// buildLocalImage converts local archive or directory referenced by ref into
+// SIF located at pullPath. When OCI layout index lists several images, the one
+// built for the first of preferred platforms is passed to build by its ref name.
+func buildLocalImage(ctx context.Context, ref *Reference, pullPath string, platforms []Platform, build *BuildConfig) error {
+	source := fmt.Sprintf("%s:%s", localImportSources[ref.URI()], localImportPath(ref))
+	img, err := localImageInfo(ref, platforms)
+	if err != nil {
+		glog.Warningf("Could not read image metadata of %s: %v", ref, err)
+	} else if img.name != "" {
+		source += ":" + img.name
+	}
+	return buildImage(ctx, pullPath, source, nil, build)
+}
+
+// localImportModTime returns modification time of local archive or, for
+// OCI layout directories, of its index formatted as HTTP Last-Modified header.
+func localImportModTime(ref *Reference) (string, error) {
+	source := localImportPath(ref)
+	if ref.URI() == singularity.LocalOCIDirDomain {
+		source = filepath.Join(source, "index.json")
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return "", err
+	}
+	return fi.ModTime().UTC().Format(http.TimeFormat), nil
+}
+
+// localImage describes image of local archive or directory that is imported.
+type localImage struct {
+	// name selects image among several ones listed in OCI layout
+	// index, it is the value of image ref name annotation.
+	name string
+	// config and platform are set only when build is known to convert
+	// the same image, e.g. they are nil when build picks image on its own.
+	config   *specs.ImageConfig
+	platform *Platform
+}
+
+// localImageInfo reads metadata of image stored in local archive or directory
+// referenced by ref. For OCI layouts that list several manifests the one built
+// for the first of preferred platforms is selected the same way docker images are.
+func localImageInfo(ref *Reference, platforms []Platform) (*localImage, error) {
+	source := localImportPath(ref)
+	switch ref.URI() {
+	case singularity.LocalOCIDirDomain:
+		return ociLayoutImage(func(name string) ([]byte, error) {
+			return ioutil.ReadFile(filepath.Join(source, filepath.FromSlash(name)))
+		}, platforms)
+	case singularity.LocalOCIArchiveDomain:
+		files := &archiveFiles{path: source}
+		return ociLayoutImage(files.read, platforms)
+	case singularity.LocalDockerArchiveDomain:
+		files := &archiveFiles{path: source}
+		config, err := dockerArchiveConfig(files.read)
+		if err != nil {
+			return nil, err
+		}
+		return &localImage{config: config}, nil
+	default:
+		return nil, fmt.Errorf("%s is not a local import reference", ref)
+	}
+}
+
+// ociLayoutImage selects image of an OCI image layout and resolves its config.
+// Build is only able to select image listed in the top level index by its ref
+// name, so when some index has to be resolved otherwise, config and platform
+// of the selected image are not returned.
+func ociLayoutImage(read func(name string) ([]byte, error), platforms []Platform) (*localImage, error) {
+	data, err := read("index.json")
+	if err != nil {
+		return nil, fmt.Errorf("could not read index: %v", err)
+	}
+	img := &localImage{}
+	exact := true
+	for level := 0; ; level++ {
+		if level > maxIndexDepth {
+			return nil, fmt.Errorf("image indexes are nested too deep")
+		}
+		var index specs.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("could not decode index: %v", err)
+		}
+		desc, selected := selectManifest(index.Manifests, platforms)
+		if desc == nil {
+			return nil, fmt.Errorf("image index has no manifests")
+		}
+		if selected != nil {
+			img.platform = selected
+		}
+		if len(index.Manifests) > 1 {
+			if level == 0 {
+				img.name = desc.Annotations[specs.AnnotationRefName]
+			}
+			exact = exact && img.name != "" && level == 0
+		}
+		data, err = read(blobPath(desc.Digest.String()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read manifest %s: %v", desc.Digest, err)
+		}
+		if desc.MediaType != specs.MediaTypeImageIndex {
+			break
+		}
+	}
+	if !exact {
+		img.platform = nil
+		return img, nil
+	}
+
+	var manifest specs.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("could not decode manifest: %v", err)
+	}
+	data, err = read(blobPath(manifest.Config.Digest.String()))
+	if err != nil {
+		return nil, fmt.Errorf("could not read image config %s: %v", manifest.Config.Digest, err)
+	}
+	var image specs.Image
+	if err := json.Unmarshal(data, &image); err != nil {
+		return nil, fmt.Errorf("could not decode image config: %v", err)
+	}
+	img.config = &image.Config
+	return img, nil
+}
+
+// selectManifest returns descriptor built for the first of preferred platforms
+// along with that platform, or the first descriptor and nil platform if none of
+// them match.
+func selectManifest(descs []specs.Descriptor, platforms []Platform) (*specs.Descriptor, *Platform) {
+	if len(descs) == 0 {
+		return nil, nil
+	}
+	if desc, platform := selectPlatform(descs, platforms); desc != nil {
+		return desc, platform
+	}
+	return &descs[0], nil
+}
+
+// blobPath returns path of the blob with the passed digest relative to OCI layout root.
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// dockerArchiveConfig reads image config of the first image stored in docker save tarball.
+func dockerArchiveConfig(read func(name string) ([]byte, error)) (*specs.ImageConfig, error) {
+	data, err := read("manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %v", err)
+	}
+	var manifest []struct {
+		Config string `json:"Config"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("could not decode manifest: %v", err)
+	}
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("archive manifest has no images")
+	}
+	data, err = read(manifest[0].Config)
+	if err != nil {
+		return nil, fmt.Errorf("could not read image config %s: %v", manifest[0].Config, err)
+	}
+	var image specs.Image
+	if err := json.Unmarshal(data, &image); err != nil {
+		return nil, fmt.Errorf("could not decode image config: %v", err)
+	}
+	return &image.Config, nil
+}
+
+// archiveFiles reads small files of tar archive located at path, such as
+// manifests and configs. Archive is scanned anew for each file, so that
+// layers are never buffered, and total size of read files is limited.
+type archiveFiles struct {
+	path  string
+	total int64
+}
+
+func (f *archiveFiles) read(name string) ([]byte, error) {
+	archive, err := os.Open(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open archive: %v", err)
+	}
+	defer archive.Close()
+
+	clean := cleanArchiveName(name)
+	r := tar.NewReader(archive)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s is not found in archive", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || cleanArchiveName(hdr.Name) != clean {
+			continue
+		}
+		if hdr.Size > maxManifestSize {
+			return nil, fmt.Errorf("%s is too large", name)
+		}
+		if f.total+hdr.Size > maxArchiveMetadataSize {
+			return nil, fmt.Errorf("archive metadata exceeds %d bytes", maxArchiveMetadataSize)
+		}
+		f.total += hdr.Size
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", name, err)
+		}
+		return data, nil
+	}
+}
+
+func cleanArchiveName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
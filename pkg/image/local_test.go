@@ -0,0 +1,318 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+var testImageConfig = specs.ImageConfig{
+	Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+	Cmd:        []string{"sh"},
+	WorkingDir: "/home",
+}
+
+// ociLayoutFiles returns files of OCI image layout with a single image
+// that has testImageConfig, referenced via nested image index.
+func ociLayoutFiles(t *testing.T) map[string][]byte {
+	files := make(map[string][]byte)
+	addBlob := func(v interface{}) specs.Descriptor {
+		data, err := json.Marshal(v)
+		require.NoError(t, err, "could not marshal blob")
+		d := digest.FromBytes(data)
+		files[blobPath(d.String())] = data
+		return specs.Descriptor{
+			Digest: d,
+			Size:   int64(len(data)),
+		}
+	}
+
+	config := addBlob(specs.Image{Config: testImageConfig})
+	config.MediaType = specs.MediaTypeImageConfig
+	manifest := addBlob(specs.Manifest{Config: config})
+	manifest.MediaType = specs.MediaTypeImageManifest
+	manifest.Platform = &specs.Platform{OS: "plan9", Architecture: "mips"}
+	nested := addBlob(specs.Index{Manifests: []specs.Descriptor{manifest}})
+	nested.MediaType = specs.MediaTypeImageIndex
+
+	index, err := json.Marshal(specs.Index{Manifests: []specs.Descriptor{nested}})
+	require.NoError(t, err, "could not marshal index")
+	files["index.json"] = index
+	files["oci-layout"] = []byte(`{"imageLayoutVersion": "1.0.0"}`)
+	return files
+}
+
+// dockerArchiveFiles returns files of docker save tarball with
+// a single image that has testImageConfig.
+func dockerArchiveFiles(t *testing.T) map[string][]byte {
+	config, err := json.Marshal(specs.Image{Config: testImageConfig})
+	require.NoError(t, err, "could not marshal config")
+	configName := digest.FromBytes(config).Hex() + ".json"
+	manifest, err := json.Marshal([]map[string]interface{}{
+		{
+			"Config":   configName,
+			"RepoTags": []string{"busybox:latest"},
+			"Layers":   []string{"layer/layer.tar"},
+		},
+	})
+	require.NoError(t, err, "could not marshal manifest")
+	return map[string][]byte{
+		"manifest.json": manifest,
+		configName:      config,
+	}
+}
+
+func writeDir(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755), "could not create directory")
+		require.NoError(t, ioutil.WriteFile(path, data, 0644), "could not write file")
+	}
+}
+
+func writeTar(t *testing.T, path string, files map[string][]byte) {
+	f, err := os.Create(path)
+	require.NoError(t, err, "could not create archive")
+	defer f.Close()
+
+	w := tar.NewWriter(f)
+	for name, data := range files {
+		err := w.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "./" + name,
+			Mode:     0644,
+			Size:     int64(len(data)),
+		})
+		require.NoError(t, err, "could not write header")
+		_, err = w.Write(data)
+		require.NoError(t, err, "could not write file")
+	}
+	require.NoError(t, w.Close(), "could not close archive")
+}
+
+func TestLocalImageConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-import-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	writeDir(t, filepath.Join(dir, "layout"), ociLayoutFiles(t))
+	writeTar(t, filepath.Join(dir, "oci.tar"), ociLayoutFiles(t))
+	writeTar(t, filepath.Join(dir, "docker.tar"), dockerArchiveFiles(t))
+	writeTar(t, filepath.Join(dir, "empty.tar"), nil)
+
+	tt := []struct {
+		name        string
+		ref         string
+		expectError string
+	}{
+		{
+			name: "OCI layout",
+			ref:  "local.oci-dir" + filepath.Join(dir, "layout"),
+		},
+		{
+			name: "OCI archive",
+			ref:  "local.oci-archive" + filepath.Join(dir, "oci.tar"),
+		},
+		{
+			name: "docker archive",
+			ref:  "local.docker-archive" + filepath.Join(dir, "docker.tar"),
+		},
+		{
+			name:        "docker archive without manifest",
+			ref:         "local.docker-archive" + filepath.Join(dir, "empty.tar"),
+			expectError: "manifest.json is not found in archive",
+		},
+		{
+			name:        "OCI layout without index",
+			ref:         "local.oci-dir" + dir,
+			expectError: "could not read index",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err, "could not parse reference")
+			require.True(t, IsLocalImport(ref), "reference is not a local import")
+
+			img, err := localImageInfo(ref, DefaultPlatforms())
+			if tc.expectError != "" {
+				require.Error(t, err, "expected error, but got nil")
+				require.Contains(t, err.Error(), tc.expectError, "unexpected error")
+				return
+			}
+			require.NoError(t, err, "could not read image config")
+			require.Empty(t, img.name, "unexpected image name")
+			require.Equal(t, &testImageConfig, img.config, "unexpected image config")
+		})
+	}
+}
+
+func TestOCILayoutImage_Platforms(t *testing.T) {
+	files := make(map[string][]byte)
+	addBlob := func(v interface{}, mediaType string) specs.Descriptor {
+		data, err := json.Marshal(v)
+		require.NoError(t, err, "could not marshal blob")
+		d := digest.FromBytes(data)
+		files[blobPath(d.String())] = data
+		return specs.Descriptor{
+			MediaType: mediaType,
+			Digest:    d,
+			Size:      int64(len(data)),
+		}
+	}
+	addManifest := func(platform specs.Platform, config specs.ImageConfig, name string) specs.Descriptor {
+		configDesc := addBlob(specs.Image{Config: config}, specs.MediaTypeImageConfig)
+		desc := addBlob(specs.Manifest{Config: configDesc}, specs.MediaTypeImageManifest)
+		desc.Platform = &platform
+		if name != "" {
+			desc.Annotations = map[string]string{specs.AnnotationRefName: name}
+		}
+		return desc
+	}
+	amd64Config := specs.ImageConfig{Cmd: []string{"amd64"}}
+	arm64Config := specs.ImageConfig{Cmd: []string{"arm64"}}
+	amd64 := specs.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := specs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+
+	// layout that lists named images directly in index.json
+	named, err := json.Marshal(specs.Index{Manifests: []specs.Descriptor{
+		addManifest(amd64, amd64Config, "1.0-amd64"),
+		addManifest(arm64, arm64Config, "1.0-arm64"),
+	}})
+	require.NoError(t, err, "could not marshal index")
+	// layout that lists multi-platform index, build selects image on its own
+	nestedIndex := addBlob(specs.Index{Manifests: []specs.Descriptor{
+		addManifest(amd64, amd64Config, ""),
+		addManifest(arm64, arm64Config, ""),
+	}}, specs.MediaTypeImageIndex)
+	nested, err := json.Marshal(specs.Index{Manifests: []specs.Descriptor{nestedIndex}})
+	require.NoError(t, err, "could not marshal index")
+
+	reader := func(index []byte) func(name string) ([]byte, error) {
+		return func(name string) ([]byte, error) {
+			if name == "index.json" {
+				return index, nil
+			}
+			data, ok := files[name]
+			if !ok {
+				return nil, fmt.Errorf("%s is not found", name)
+			}
+			return data, nil
+		}
+	}
+
+	tt := []struct {
+		name      string
+		index     []byte
+		platforms []Platform
+		expect    *localImage
+	}{
+		{
+			name:      "first platform available",
+			index:     named,
+			platforms: []Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}},
+			expect: &localImage{
+				name:     "1.0-amd64",
+				config:   &amd64Config,
+				platform: &Platform{OS: "linux", Architecture: "amd64"},
+			},
+		},
+		{
+			name:      "fallback platform",
+			index:     named,
+			platforms: []Platform{{OS: "linux", Architecture: "s390x"}, {OS: "linux", Architecture: "arm64"}},
+			expect: &localImage{
+				name:     "1.0-arm64",
+				config:   &arm64Config,
+				platform: &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+			},
+		},
+		{
+			name:      "no platform available",
+			index:     named,
+			platforms: []Platform{{OS: "linux", Architecture: "s390x"}},
+			expect: &localImage{
+				name:   "1.0-amd64",
+				config: &amd64Config,
+			},
+		},
+		{
+			name:      "nested multi-platform index",
+			index:     nested,
+			platforms: []Platform{{OS: "linux", Architecture: "arm64"}},
+			expect:    &localImage{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			img, err := ociLayoutImage(reader(tc.index), tc.platforms)
+			require.NoError(t, err, "could not read image metadata")
+			require.Equal(t, tc.expect, img, "unexpected image")
+		})
+	}
+}
+
+func TestArchiveFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-import-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "oci.tar")
+	files := ociLayoutFiles(t)
+	writeTar(t, archive, files)
+
+	f := &archiveFiles{path: archive}
+	data, err := f.read("index.json")
+	require.NoError(t, err, "could not read index")
+	require.Equal(t, files["index.json"], data, "unexpected index")
+	require.Equal(t, int64(len(data)), f.total, "read size is not counted")
+
+	_, err = f.read("blobs/sha256/missing")
+	require.EqualError(t, err, "blobs/sha256/missing is not found in archive")
+
+	f.total = maxArchiveMetadataSize - 1
+	_, err = f.read("index.json")
+	require.Error(t, err, "metadata size limit is not enforced")
+	require.Contains(t, err.Error(), "archive metadata exceeds", "unexpected error")
+}
+
+func TestPull_LocalNotModified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-import-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "docker.tar")
+	writeTar(t, archive, dockerArchiveFiles(t))
+	ref, err := ParseRef("local.docker-archive" + archive + ":latest")
+	require.NoError(t, err, "could not parse reference")
+
+	modTime, err := localImportModTime(ref)
+	require.NoError(t, err, "could not get archive modification time")
+	_, err = Pull(context.Background(), dir, ref, nil, IfModified(&Info{LastModified: modTime}))
+	require.Equal(t, ErrNotModified, err, "unexpected conditional pull error")
+}
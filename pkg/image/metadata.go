@@ -0,0 +1,245 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+// buildDateLabel is a label singularity build records build time in.
+const buildDateLabel = "org.label-schema.build-date"
+
+// Metadata holds SIF image details that are useful for debugging.
+type Metadata struct {
+	Descriptors  []Descriptor       `json:"descriptors"`
+	Definition   string             `json:"definition,omitempty"`
+	Labels       map[string]string  `json:"labels,omitempty"`
+	HasRunscript bool               `json:"hasRunscript"`
+	Runscript    string             `json:"runscript,omitempty"`
+	Signatures   []Signature        `json:"signatures,omitempty"`
+	BuildDate    string             `json:"buildDate,omitempty"`
+	OciConfig    *specs.ImageConfig `json:"ociConfig,omitempty"`
+}
+
+// Descriptor describes a single SIF data object.
+type Descriptor struct {
+	ID       uint32 `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name,omitempty"`
+	Group    uint32 `json:"group,omitempty"`
+	Link     uint32 `json:"link,omitempty"`
+	Size     int64  `json:"size"`
+	FsType   string `json:"fsType,omitempty"`
+	PartType string `json:"partType,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+}
+
+// Signature describes a signature data object found in SIF. Identity
+// is only known for signers that were verified on pull, see Info.Verify.
+type Signature struct {
+	ID          uint32 `json:"id"`
+	Link        uint32 `json:"link"`
+	HashType    string `json:"hashType"`
+	Fingerprint string `json:"fingerprint"`
+	Identity    string `json:"identity,omitempty"`
+	Verified    bool   `json:"verified"`
+}
+
+// Metadata reads image metadata from SIF descriptors. Labels and runscript
+// that are kept inside root filesystem are read with singularity inspect,
+// unless image is encrypted; failure to inspect image is only logged.
+func (i *Info) Metadata(ctx context.Context) (*Metadata, error) {
+	fimg, err := sif.LoadContainer(i.Path, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not load SIF image: %v", err)
+	}
+	defer fimg.UnloadContainer()
+
+	meta := &Metadata{
+		OciConfig: i.OciConfig,
+	}
+	for _, d := range fimg.DescrArr {
+		if !d.Used {
+			continue
+		}
+		meta.Descriptors = append(meta.Descriptors, describe(d))
+		switch d.Datatype {
+		case sif.DataDeffile:
+			meta.Definition = string(d.GetData(&fimg))
+		case sif.DataLabels:
+			if err := json.Unmarshal(d.GetData(&fimg), &meta.Labels); err != nil {
+				glog.Warningf("Could not decode labels of image %s: %v", i.ID, err)
+			}
+		case sif.DataSignature:
+			meta.Signatures = append(meta.Signatures, i.signature(d))
+		}
+	}
+
+	// labels and runscript are inside root filesystem, which
+	// is either encrypted or not fetched yet for lazy images
+	if !i.Encrypted && i.LazyReader() == nil {
+		labels, runscript, err := inspect(ctx, i.Path)
+		if err != nil {
+			glog.Warningf("Could not inspect image %s: %v", i.ID, err)
+		}
+		for k, v := range labels {
+			if meta.Labels == nil {
+				meta.Labels = make(map[string]string)
+			}
+			if _, ok := meta.Labels[k]; !ok {
+				meta.Labels[k] = v
+			}
+		}
+		meta.Runscript = runscript
+		meta.HasRunscript = runscript != ""
+	}
+
+	meta.BuildDate = meta.Labels[buildDateLabel]
+	if meta.BuildDate == "" && fimg.Header.Ctime != 0 {
+		meta.BuildDate = time.Unix(fimg.Header.Ctime, 0).UTC().Format(time.RFC3339)
+	}
+	return meta, nil
+}
+
+// signature describes signature data object d. Signature is only reported
+// as verified when d itself is checked on pull, fingerprint stored in d is
+// set by whoever built image and is not matched against verified signers.
+func (i *Info) signature(d sif.Descriptor) Signature {
+	sig := Signature{
+		ID:   d.ID,
+		Link: d.Link,
+	}
+	if ht, err := d.GetHashType(); err == nil {
+		sig.HashType = hashTypes[ht]
+	}
+	if fingerprint, err := d.GetEntityString(); err == nil {
+		sig.Fingerprint = fingerprint
+	}
+	for _, s := range i.Signers {
+		for _, id := range s.Signatures {
+			if id == d.ID {
+				sig.Identity = s.Identity
+				sig.Verified = true
+			}
+		}
+	}
+	return sig
+}
+
+var (
+	dataTypes = map[sif.Datatype]string{
+		sif.DataDeffile:       "Def.FILE",
+		sif.DataEnvVar:        "Env.Vars",
+		sif.DataLabels:        "JSON.Labels",
+		sif.DataPartition:     "FS",
+		sif.DataSignature:     "Signature",
+		sif.DataGenericJSON:   "JSON.Generic",
+		sif.DataGeneric:       "Generic/Raw",
+		sif.DataCryptoMessage: "Cryptographic Message",
+	}
+	fsTypes = map[sif.Fstype]string{
+		sif.FsSquash:            "Squashfs",
+		sif.FsExt3:              "Ext3",
+		sif.FsImmuObj:           "Archive",
+		sif.FsRaw:               "Raw",
+		sif.FsEncryptedSquashfs: "Encrypted squashfs",
+	}
+	partTypes = map[sif.Parttype]string{
+		sif.PartSystem:  "System",
+		sif.PartPrimSys: "Primary system",
+		sif.PartData:    "Data",
+		sif.PartOverlay: "Overlay",
+	}
+	hashTypes = map[sif.Hashtype]string{
+		sif.HashSHA256:  "SHA256",
+		sif.HashSHA384:  "SHA384",
+		sif.HashSHA512:  "SHA512",
+		sif.HashBLAKE2S: "BLAKE2S",
+		sif.HashBLAKE2B: "BLAKE2B",
+	}
+)
+
+// describe returns description of SIF data object d. Type names
+// are the same siftool uses, unknown types are reported as is.
+func describe(d sif.Descriptor) Descriptor {
+	desc := Descriptor{
+		ID:    d.ID,
+		Type:  dataTypes[d.Datatype],
+		Name:  d.GetName(),
+		Group: d.Groupid &^ sif.DescrGroupMask,
+		Link:  d.Link,
+		Size:  d.Filelen,
+	}
+	if desc.Name == "." {
+		// objects added without a file name are named after filepath.Base("")
+		desc.Name = ""
+	}
+	if desc.Type == "" {
+		desc.Type = fmt.Sprintf("0x%x", int32(d.Datatype))
+	}
+	if d.Datatype != sif.DataPartition {
+		return desc
+	}
+	if fs, err := d.GetFsType(); err == nil {
+		desc.FsType = fsTypes[fs]
+	}
+	if part, err := d.GetPartType(); err == nil {
+		desc.PartType = partTypes[part]
+	}
+	if arch, err := d.GetArch(); err == nil {
+		desc.Arch = sif.GetGoArch(strings.TrimRight(string(arch[:]), "\x00"))
+	}
+	return desc
+}
+
+// inspect returns labels and runscript of image located at path
+// that are read from its root filesystem by singularity inspect.
+func inspect(ctx context.Context, path string) (map[string]string, string, error) {
+	out, err := exec.CommandContext(ctx, singularity.RuntimeName,
+		"inspect", "--json", "--labels", "--runscript", path).Output()
+	if err != nil {
+		return nil, "", fmt.Errorf("could not run %s inspect: %v", singularity.RuntimeName, err)
+	}
+
+	type attributes struct {
+		Labels    map[string]string `json:"labels"`
+		Runscript string            `json:"runscript"`
+	}
+	// newer singularity versions wrap attributes into data object
+	var inspected struct {
+		Attributes attributes `json:"attributes"`
+		Data       struct {
+			Attributes attributes `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(out, &inspected); err != nil {
+		return nil, "", fmt.Errorf("could not decode inspect output: %v", err)
+	}
+	attrs := inspected.Attributes
+	if attrs.Labels == nil && attrs.Runscript == "" {
+		attrs = inspected.Data.Attributes
+	}
+	return attrs.Labels, attrs.Runscript, nil
+}
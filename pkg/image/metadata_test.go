@@ -0,0 +1,128 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/sif/pkg/sif"
+)
+
+func TestInfo_Metadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	const definition = "Bootstrap: docker\nFrom: busybox\n"
+	const labels = `{"org.label-schema.build-date":"Monday_7_October_2019_12:0:0_UTC","maintainer":"sylabs"}`
+	fingerprint := strings.Repeat("8883491F", 5)
+
+	def := sif.DescriptorInput{
+		Datatype: sif.DataDeffile,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Size:     int64(len(definition)),
+		Data:     []byte(definition),
+	}
+	lab := sif.DescriptorInput{
+		Datatype: sif.DataLabels,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Size:     int64(len(labels)),
+		Data:     []byte(labels),
+	}
+	data := bytes.Repeat([]byte("squashfs"), 512)
+	part := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Size:     int64(len(data)),
+		Data:     data,
+	}
+	err = part.SetPartExtra(sif.FsSquash, sif.PartPrimSys, sif.GetSIFArch(runtime.GOARCH))
+	require.NoError(t, err, "could not set partition info")
+	sig := sif.DescriptorInput{
+		Datatype: sif.DataSignature,
+		Groupid:  sif.DescrUnusedGroup,
+		Link:     3,
+		Size:     int64(len("signature")),
+		Data:     []byte("signature"),
+	}
+	err = sig.SetSignExtra(sif.HashSHA384, strings.ToLower(fingerprint))
+	require.NoError(t, err, "could not set signature info")
+	// claims the same key, but is not checked on pull
+	forged := sif.DescriptorInput{
+		Datatype: sif.DataSignature,
+		Groupid:  sif.DescrUnusedGroup,
+		Link:     3,
+		Size:     int64(len("forged")),
+		Data:     []byte("forged"),
+	}
+	err = forged.SetSignExtra(sif.HashSHA384, fingerprint)
+	require.NoError(t, err, "could not set signature info")
+
+	path := filepath.Join(dir, "image.sif")
+	_, err = sif.CreateContainer(sif.CreateInfo{
+		Pathname:   path,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		InputDescr: []sif.DescriptorInput{def, lab, part, sig, forged},
+	})
+	require.NoError(t, err, "could not create SIF")
+
+	ociConfig := &specs.ImageConfig{Cmd: []string{"sh"}}
+	info := &Info{
+		ID:        "image",
+		Path:      path,
+		OciConfig: ociConfig,
+		Signers: []Signer{
+			{Fingerprint: fingerprint, Identity: "Sylabs <admin@sylabs.io>", Signatures: []uint32{4}},
+		},
+		Encrypted: true, // prevents singularity inspect from being run
+	}
+	meta, err := info.Metadata(context.Background())
+	require.NoError(t, err, "could not read metadata")
+
+	require.Equal(t, definition, meta.Definition)
+	require.Equal(t, map[string]string{
+		"org.label-schema.build-date": "Monday_7_October_2019_12:0:0_UTC",
+		"maintainer":                  "sylabs",
+	}, meta.Labels)
+	require.Equal(t, "Monday_7_October_2019_12:0:0_UTC", meta.BuildDate)
+	require.False(t, meta.HasRunscript)
+	require.Equal(t, ociConfig, meta.OciConfig)
+	require.Equal(t, []Descriptor{
+		{ID: 1, Type: "Def.FILE", Group: 1, Size: int64(len(definition))},
+		{ID: 2, Type: "JSON.Labels", Group: 1, Size: int64(len(labels))},
+		{ID: 3, Type: "FS", Group: 1, Size: int64(len(data)),
+			FsType: "Squashfs", PartType: "Primary system", Arch: runtime.GOARCH},
+		{ID: 4, Type: "Signature", Link: 3, Size: int64(len("signature"))},
+		{ID: 5, Type: "Signature", Link: 3, Size: int64(len("forged"))},
+	}, meta.Descriptors)
+	require.Equal(t, []Signature{
+		{ID: 4, Link: 3, HashType: "SHA384", Fingerprint: fingerprint,
+			Identity: "Sylabs <admin@sylabs.io>", Verified: true},
+		{ID: 5, Link: 3, HashType: "SHA384", Fingerprint: fingerprint},
+	}, meta.Signatures)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const (
+	// orasSifLayerMediaType is a media type of a layer holding SIF file.
+	orasSifLayerMediaType = "application/vnd.sylabs.sif.layer.v1.sif"
+	// orasSifLayerMediaTypeLegacy is a media type of a layer holding SIF file
+	// pushed by singularity 3.x releases, misspelled the same way they write it.
+	orasSifLayerMediaTypeLegacy = "appliciation/vnd.sylabs.sif.layer.tar"
+)
+
+// pullOrasImage downloads SIF layer of the artifact referenced by ref into pullPath
+// and checks its digest. Manifest digest is added to reference digests. Partially
+// downloaded layers are resumed.
+func pullOrasImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) error {
+	host, repo, reference, err := parseOrasRef(ref.String())
+	if err != nil {
+		return permanent(err)
+	}
+	registry := newRegistryClient(host, repo, auth)
+
+	manifest, manifestDigest, err := registry.manifest(ctx, reference)
+	if err != nil {
+		if !isRetriable(err) {
+			return permanent(fmt.Errorf("could not fetch manifest: %v", err))
+		}
+		return fmt.Errorf("could not fetch manifest: %v", err)
+	}
+	var layer *specs.Descriptor
+	for i, l := range manifest.Layers {
+		if l.MediaType == orasSifLayerMediaType || l.MediaType == orasSifLayerMediaTypeLegacy {
+			layer = &manifest.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return permanent(fmt.Errorf("artifact %s has no SIF layer", ref))
+	}
+	if layer.Digest.Algorithm() != "sha256" {
+		return permanent(fmt.Errorf("unsupported layer digest %s", layer.Digest))
+	}
+
+	glog.V(4).Infof("Downloading SIF layer %s of %s", layer.Digest, ref)
+	req, err := registry.request(http.MethodGet, "blobs/"+layer.Digest.String())
+	if err != nil {
+		return permanent(err)
+	}
+	if _, err := resumeDownload(ctx, registry.client, req, pullPath); err != nil {
+		return err
+	}
+
+	checksum, err := fileChecksum(pullPath)
+	if err != nil {
+		return permanent(err)
+	}
+	if checksum != layer.Digest.Hex() {
+		if err := os.Remove(pullPath); err != nil {
+			glog.Errorf("Could not remove %s: %v", pullPath, err)
+		}
+		return fmt.Errorf("layer digest mismatch: expected %s, got sha256:%s", layer.Digest, checksum)
+	}
+
+	ref.AddDigests([]string{fmt.Sprintf("%s://%s/%s@%s", singularity.OrasProtocol, host, repo, manifestDigest)})
+	return nil
+}
+
+// parseOrasRef splits oras reference into registry host, repository
+// and a tag or digest.
+func parseOrasRef(ref string) (string, string, string, error) {
+	name := strings.TrimPrefix(ref, singularity.OrasProtocol+"://")
+	i := strings.IndexByte(name, '/')
+	if i == -1 {
+		return "", "", "", fmt.Errorf("malformed oras reference %s: no registry", ref)
+	}
+	host, name := name[:i], name[i+1:]
+
+	if i := strings.IndexByte(name, '@'); i != -1 {
+		return host, name[:i], name[i+1:], nil
+	}
+	i = strings.LastIndexByte(name, ':')
+	if i == -1 || strings.IndexByte(name[i:], '/') != -1 {
+		return host, name, "latest", nil
+	}
+	return host, name[:i], name[i+1:], nil
+}
+
+// fileChecksum returns hex encoded sha256 checksum of the file located at path.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open file: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("could not read file: %v", err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
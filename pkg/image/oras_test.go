@@ -0,0 +1,215 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// orasStandIn serves a single SIF artifact from sylabs/busybox repository.
+// Requests are authorized with a bearer token issued by /token endpoint.
+type orasStandIn struct {
+	manifest []byte
+	blobs    map[string][]byte
+}
+
+func (o *orasStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if r.URL.Query().Get("scope") != "repository:sylabs/busybox:pull" {
+			http.Error(w, "unexpected scope", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token": "secret"}`)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/v2/sylabs/busybox/manifests/1.0.0":
+		w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+		w.Write(o.manifest)
+	case strings.HasPrefix(r.URL.Path, "/v2/sylabs/busybox/blobs/"):
+		blob, ok := o.blobs[strings.TrimPrefix(r.URL.Path, "/v2/sylabs/busybox/blobs/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(blob))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newOrasStandIn(t *testing.T, layerMediaType string, layer, served []byte) *orasStandIn {
+	layerDigest := digest.FromBytes(layer)
+	config := []byte("{}")
+	manifest, err := json.Marshal(specs.Manifest{
+		Config: specs.Descriptor{
+			MediaType: "application/vnd.sylabs.sif.config.v1+json",
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []specs.Descriptor{
+			{
+				MediaType: layerMediaType,
+				Digest:    layerDigest,
+				Size:      int64(len(layer)),
+			},
+		},
+	})
+	require.NoError(t, err, "could not marshal manifest")
+	return &orasStandIn{
+		manifest: manifest,
+		blobs: map[string][]byte{
+			layerDigest.String():              served,
+			digest.FromBytes(config).String(): config,
+		},
+	}
+}
+
+func TestPull_Oras(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oras-test-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	sifPath := filepath.Join(dir, "busybox.sif")
+	createSIF(t, sifPath, bytes.Repeat([]byte("squashfs"), 512))
+	content, err := ioutil.ReadFile(sifPath)
+	require.NoError(t, err, "could not read SIF")
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	tt := []struct {
+		name        string
+		registry    *orasStandIn
+		expectError string
+	}{
+		{
+			name:     "all ok",
+			registry: newOrasStandIn(t, "application/vnd.sylabs.sif.layer.v1.sif", content, content),
+		},
+		{
+			name:     "singularity 3.x media type",
+			registry: newOrasStandIn(t, "appliciation/vnd.sylabs.sif.layer.tar", content, content),
+		},
+		{
+			name:        "no SIF layer",
+			registry:    newOrasStandIn(t, specs.MediaTypeImageLayerGzip, content, content),
+			expectError: "has no SIF layer",
+		},
+		{
+			name:        "corrupted layer",
+			registry:    newOrasStandIn(t, orasSifLayerMediaType, content, content[:len(content)-1]),
+			expectError: "layer digest mismatch",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.registry)
+			defer server.Close()
+
+			host := strings.TrimPrefix(server.URL, "http://")
+			ref, err := ParseRef(fmt.Sprintf("oras://%s/sylabs/busybox:1.0.0", host))
+			require.NoError(t, err, "could not parse reference")
+			require.Equal(t, singularity.OrasProtocol, ref.URI())
+			require.Equal(t, host, ref.Registry())
+
+			auth := &k8s.AuthConfig{ServerAddress: server.URL}
+			info, err := Pull(context.Background(), dir, ref, auth)
+			if tc.expectError != "" {
+				require.Error(t, err, "expected error, but got nil")
+				require.Contains(t, err.Error(), tc.expectError, "unexpected pull error")
+				return
+			}
+			require.NoError(t, err, "unexpected pull error")
+			defer os.Remove(info.Path)
+			require.Equal(t, checksum, info.Sha256, "unexpected image checksum")
+			require.Equal(t, filepath.Join(dir, checksum), info.Path, "unexpected image path")
+
+			manifestDigest := digest.FromBytes(tc.registry.manifest)
+			expectDigests := []string{fmt.Sprintf("oras://%s/sylabs/busybox@%s", host, manifestDigest)}
+			require.Equal(t, expectDigests, info.Ref.Digests(), "unexpected reference digests")
+		})
+	}
+}
+
+func TestParseOrasRef(t *testing.T) {
+	tt := []struct {
+		ref             string
+		expectHost      string
+		expectRepo      string
+		expectReference string
+		expectError     string
+	}{
+		{
+			ref:             "oras://registry.example.com/sylabs/busybox:1.0.0",
+			expectHost:      "registry.example.com",
+			expectRepo:      "sylabs/busybox",
+			expectReference: "1.0.0",
+		},
+		{
+			ref:             "oras://localhost:5000/busybox",
+			expectHost:      "localhost:5000",
+			expectRepo:      "busybox",
+			expectReference: "latest",
+		},
+		{
+			ref:             "oras://localhost:5000/busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expectHost:      "localhost:5000",
+			expectRepo:      "busybox",
+			expectReference: "sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+		},
+		{
+			ref:         "oras://busybox",
+			expectError: "no registry",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.ref, func(t *testing.T) {
+			host, repo, reference, err := parseOrasRef(tc.ref)
+			if tc.expectError != "" {
+				require.Error(t, err, "expected error, but got nil")
+				require.Contains(t, err.Error(), tc.expectError)
+				return
+			}
+			require.NoError(t, err, "unexpected error")
+			require.Equal(t, tc.expectHost, host)
+			require.Equal(t, tc.expectRepo, repo)
+			require.Equal(t, tc.expectReference, reference)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// archAliases maps alternative architecture names to the ones used in image manifests.
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armhf":   "arm",
+	"i386":    "386",
+}
+
+// Platform describes operating system and CPU architecture image is built for.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String returns platform in os/arch[/variant] form, e.g. linux/arm/v7.
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ParsePlatform parses platform specified either as os/arch[/variant]
+// or as a sole architecture, in which case linux is assumed.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) == 1 {
+		parts = []string{"linux", parts[0]}
+	}
+	if len(parts) > 3 {
+		return Platform{}, fmt.Errorf("malformed platform %q", s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return Platform{}, fmt.Errorf("malformed platform %q", s)
+		}
+	}
+
+	p := Platform{
+		OS:           strings.ToLower(parts[0]),
+		Architecture: strings.ToLower(parts[1]),
+	}
+	if alias, ok := archAliases[p.Architecture]; ok {
+		p.Architecture = alias
+	}
+	if len(parts) == 3 {
+		p.Variant = strings.ToLower(parts[2])
+	}
+	return p, nil
+}
+
+// WithPlatforms sets platforms images are pulled for in order of preference.
+// Docker manifest lists are resolved to the first matching manifest and library
+// images are requested for preferred architectures in turn. When no platforms
+// are set DefaultPlatforms is used.
+func WithPlatforms(platforms ...Platform) PullOption {
+	return func(o *pullOptions) {
+		o.platforms = platforms
+	}
+}
+
+// DefaultPlatforms returns platforms images are pulled for when no preference
+// is set, that is operating system and architecture of the host.
+func DefaultPlatforms() []Platform {
+	return []Platform{
+		{
+			OS:           runtime.GOOS,
+			Architecture: runtime.GOARCH,
+		},
+	}
+}
+
+// matches returns true if manifest built for the passed platform satisfies p.
+// Variant is only checked when p specifies one.
+func (p Platform) matches(platform *specs.Platform) bool {
+	if platform == nil {
+		return false
+	}
+	if platform.OS != p.OS || platform.Architecture != p.Architecture {
+		return false
+	}
+	return p.Variant == "" || platform.Variant == p.Variant
+}
+
+// selectPlatform returns the first descriptor satisfying preferred platforms,
+// which are tried in order, along with the platform it satisfies.
+func selectPlatform(descs []specs.Descriptor, platforms []Platform) (*specs.Descriptor, *Platform) {
+	for _, p := range platforms {
+		for i, desc := range descs {
+			if p.matches(desc.Platform) {
+				selected := Platform{
+					OS:           desc.Platform.OS,
+					Architecture: desc.Platform.Architecture,
+					Variant:      desc.Platform.Variant,
+				}
+				return &descs[i], &selected
+			}
+		}
+	}
+	return nil, nil
+}
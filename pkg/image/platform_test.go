@@ -0,0 +1,110 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"testing"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tt := []struct {
+		name        string
+		platform    string
+		expect      Platform
+		expectError error
+	}{
+		{
+			name:     "os and architecture",
+			platform: "linux/amd64",
+			expect:   Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			name:     "variant",
+			platform: "linux/arm/v7",
+			expect:   Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+		{
+			name:     "sole architecture alias",
+			platform: "aarch64",
+			expect:   Platform{OS: "linux", Architecture: "arm64"},
+		},
+		{
+			name:        "empty architecture",
+			platform:    "linux//v7",
+			expectError: fmt.Errorf("malformed platform \"linux//v7\""),
+		},
+		{
+			name:        "too many parts",
+			platform:    "linux/arm/v7/extra",
+			expectError: fmt.Errorf("malformed platform \"linux/arm/v7/extra\""),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := ParsePlatform(tc.platform)
+			require.Equal(t, tc.expectError, err, "unexpected error")
+			require.Equal(t, tc.expect, actual, "unexpected platform")
+		})
+	}
+}
+
+func TestSelectPlatform(t *testing.T) {
+	descs := []specs.Descriptor{
+		{Digest: "sha256:amd64", Platform: &specs.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:unknown"},
+		{Digest: "sha256:armv7", Platform: &specs.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+	}
+
+	tt := []struct {
+		name           string
+		platforms      []Platform
+		expectDigest   string
+		expectPlatform *Platform
+	}{
+		{
+			name:           "any variant",
+			platforms:      []Platform{{OS: "linux", Architecture: "arm"}},
+			expectDigest:   "sha256:armv7",
+			expectPlatform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+		{
+			name:           "preference order",
+			platforms:      []Platform{{OS: "linux", Architecture: "arm", Variant: "v6"}, {OS: "linux", Architecture: "amd64"}},
+			expectDigest:   "sha256:amd64",
+			expectPlatform: &Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			name:      "no match",
+			platforms: []Platform{{OS: "windows", Architecture: "amd64"}},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			desc, platform := selectPlatform(descs, tc.platforms)
+			require.Equal(t, tc.expectPlatform, platform, "unexpected platform")
+			if tc.expectDigest == "" {
+				require.Nil(t, desc, "unexpected descriptor")
+				return
+			}
+			require.Equal(t, tc.expectDigest, desc.Digest.String(), "unexpected descriptor")
+		})
+	}
+}
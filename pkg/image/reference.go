@@ -16,6 +16,7 @@ package image
 
 import (
 	"encoding/json"
+	"net/url"
 	"strings"
 	"sync"
 
@@ -33,12 +34,17 @@ type Reference struct {
 }
 
 // String returns first tag or digest found with origin domain as a prefix.
+// For references without tags and digests, e.g. of adopted images, an empty
+// string is returned.
 func (r *Reference) String() string {
 	var ref string
-	if len(r.tags) > 0 {
+	switch {
+	case len(r.tags) > 0:
 		ref = r.tags[0]
-	} else {
+	case len(r.digests) > 0:
 		ref = r.digests[0]
+	default:
+		return ""
 	}
 	if r.uri == singularity.DockerDomain {
 		ref = singularity.DockerDomain + "/" + ref
@@ -74,8 +80,10 @@ func (r *Reference) UnmarshalJSON(data []byte) error {
 	return err
 }
 
-// ParseRef constructs image reference based on imgRef.
+// ParseRef constructs image reference based on imgRef. Library images are
+// references either starting with library:// or with default library domain.
 func ParseRef(imgRef string) (*Reference, error) {
+	isLibrary := strings.HasPrefix(imgRef, singularity.LibraryProtocol+"://")
 	imgRef = NormalizedImageRef(imgRef)
 	if strings.HasPrefix(imgRef, singularity.LocalFileDomain) {
 		return &Reference{
@@ -83,9 +91,35 @@ func ParseRef(imgRef string) (*Reference, error) {
 			tags: []string{imgRef},
 		}, nil
 	}
+	if domain := localImportDomain(imgRef); domain != "" {
+		return &Reference{
+			uri:  domain,
+			tags: []string{imgRef},
+		}, nil
+	}
+
+	for _, protocol := range []string{singularity.HTTPProtocol, singularity.HTTPSProtocol} {
+		if strings.HasPrefix(imgRef, protocol+"://") {
+			return &Reference{
+				uri:  protocol,
+				tags: []string{imgRef},
+			}, nil
+		}
+	}
+	if strings.HasPrefix(imgRef, singularity.OrasProtocol+"://") {
+		ref := Reference{
+			uri: singularity.OrasProtocol,
+		}
+		if strings.IndexByte(imgRef, '@') != -1 {
+			ref.digests = []string{imgRef}
+		} else {
+			ref.tags = []string{imgRef}
+		}
+		return &ref, nil
+	}
 
 	uri := singularity.DockerDomain
-	if strings.HasPrefix(imgRef, singularity.LibraryDomain) {
+	if isLibrary || strings.HasPrefix(imgRef, singularity.LibraryDomain) {
 		uri = singularity.LibraryDomain
 	}
 
@@ -119,6 +153,51 @@ func (r *Reference) URI() string {
 	return r.uri
 }
 
+// Registry returns domain of a registry image is pulled from. Unlike URI
+// it takes into account registry domain specified in docker and library
+// references, e.g. for gcr.io/cri-tools/test-image-tags:1 gcr.io is returned.
+func (r *Reference) Registry() string {
+	switch r.URI() {
+	case singularity.DockerDomain:
+		domain, _ := splitDomain(strings.TrimPrefix(r.String(), singularity.DockerDomain+"/"))
+		if domain == "" {
+			return singularity.DockerDomain
+		}
+		return domain
+	case singularity.LibraryDomain:
+		domain, _ := splitDomain(r.String())
+		if domain == "" {
+			return singularity.LibraryDomain
+		}
+		return domain
+	case singularity.OrasProtocol:
+		domain, _ := splitDomain(strings.TrimPrefix(r.String(), singularity.OrasProtocol+"://"))
+		return domain
+	case singularity.HTTPProtocol, singularity.HTTPSProtocol:
+		u, err := url.Parse(r.String())
+		if err != nil {
+			return ""
+		}
+		return u.Host
+	default:
+		return r.URI()
+	}
+}
+
+// splitDomain splits name into registry domain and a remainder. If name
+// does not start with a domain, empty domain and unchanged name are returned.
+func splitDomain(name string) (string, string) {
+	i := strings.IndexByte(name, '/')
+	if i == -1 {
+		return "", name
+	}
+	domain := name[:i]
+	if !strings.ContainsAny(domain, ".:") && domain != "localhost" {
+		return "", name
+	}
+	return domain, name[i+1:]
+}
+
 // Digests returns all digests referencing the image.
 func (r *Reference) Digests() []string {
 	digestsCopy := make([]string, len(r.digests))
@@ -163,18 +242,40 @@ func (r *Reference) RemoveTag(tag string) {
 
 // NormalizedImageRef appends tag 'latest' if the passed ref
 // does not have any tag or digest already. It also trims
-// default docker domain prefix if present.
+// default docker domain prefix if present. References starting
+// with library:// are converted into library domain prefixed form,
+// e.g. library://sylabs/tests/busybox becomes cloud.sylabs.io/sylabs/tests/busybox:latest.
+// ORAS references are kept with oras:// prefix, HTTP(S) URLs are never changed.
 func NormalizedImageRef(imgRef string) string {
+	if strings.HasPrefix(imgRef, singularity.LibraryProtocol+"://") {
+		imgRef = strings.TrimPrefix(imgRef, singularity.LibraryProtocol+"://")
+		imgRef = strings.TrimPrefix(imgRef, "/")
+		if domain, _ := splitDomain(imgRef); domain == "" {
+			imgRef = singularity.LibraryDomain + "/" + imgRef
+		}
+	}
+	if strings.HasPrefix(imgRef, singularity.HTTPProtocol+"://") ||
+		strings.HasPrefix(imgRef, singularity.HTTPSProtocol+"://") {
+		return imgRef
+	}
+	if strings.HasPrefix(imgRef, singularity.OrasProtocol+"://") {
+		name := imgRef[strings.LastIndexByte(imgRef, '/')+1:]
+		if strings.ContainsAny(name, ":@") {
+			return imgRef
+		}
+		return imgRef + ":latest"
+	}
 	imgRef = strings.TrimPrefix(imgRef, singularity.DockerDomain+"/")
 	i := strings.LastIndexByte(imgRef, ':')
-	if strings.HasPrefix(imgRef, singularity.LocalFileDomain) {
+	if strings.HasPrefix(imgRef, singularity.LocalFileDomain) || localImportDomain(imgRef) != "" {
 		if i == -1 {
 			return imgRef
 		}
 		// kubernetes will add :latest tag, so we need to trim it for the file
 		return imgRef[:i]
 	}
-	if i == -1 {
+	// colon before the last slash separates registry port, not a tag
+	if i == -1 || strings.IndexByte(imgRef[i:], '/') != -1 {
 		return imgRef + ":latest"
 	}
 	return imgRef
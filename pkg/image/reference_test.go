@@ -58,6 +58,26 @@ func TestParseImageRef(t *testing.T) {
 			},
 			expectError: nil,
 		},
+		{
+			name: "library protocol without domain",
+			ref:  "library://sylabs/tests/busybox:1.0.0",
+			expect: &Reference{
+				uri:     singularity.LibraryDomain,
+				tags:    []string{"cloud.sylabs.io/sylabs/tests/busybox:1.0.0"},
+				digests: nil,
+			},
+			expectError: nil,
+		},
+		{
+			name: "library protocol with custom domain",
+			ref:  "library://library.example.com/sylabs/tests/busybox",
+			expect: &Reference{
+				uri:     singularity.LibraryDomain,
+				tags:    []string{"library.example.com/sylabs/tests/busybox:latest"},
+				digests: nil,
+			},
+			expectError: nil,
+		},
 		{
 			name: "docker without tag",
 			ref:  "gcr.io/cri-tools/test-image-tags",
@@ -88,6 +108,24 @@ func TestParseImageRef(t *testing.T) {
 			},
 			expectError: nil,
 		},
+		{
+			name: "oras without tag",
+			ref:  "oras://registry.example.com/sylabs/busybox",
+			expect: &Reference{
+				uri:  singularity.OrasProtocol,
+				tags: []string{"oras://registry.example.com/sylabs/busybox:latest"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "oras with digest",
+			ref:  "oras://localhost:5000/busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: &Reference{
+				uri:     singularity.OrasProtocol,
+				digests: []string{"oras://localhost:5000/busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"},
+			},
+			expectError: nil,
+		},
 		{
 			name: "local SIF",
 			ref:  "local.file/home/sasha/my.sif",
@@ -97,6 +135,24 @@ func TestParseImageRef(t *testing.T) {
 			},
 			expectError: nil,
 		},
+		{
+			name: "local docker archive",
+			ref:  "local.docker-archive/var/lib/images/busybox.tar:latest",
+			expect: &Reference{
+				uri:  singularity.LocalDockerArchiveDomain,
+				tags: []string{"local.docker-archive/var/lib/images/busybox.tar"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "local OCI layout",
+			ref:  "local.oci-dir/var/lib/images/busybox",
+			expect: &Reference{
+				uri:  singularity.LocalOCIDirDomain,
+				tags: []string{"local.oci-dir/var/lib/images/busybox"},
+			},
+			expectError: nil,
+		},
 	}
 
 	for _, tc := range tt {
@@ -149,6 +205,21 @@ func TestNormalizedImageRef(t *testing.T) {
 			ref:    "cloud.sylabs.io/sashayakovtseva/test/image-server:sha256.9327532a05078d7efd5a0ef9ace1ee5cd278653d8df53590e2fb7a4a34cb0bb8",
 			expect: "cloud.sylabs.io/sashayakovtseva/test/image-server:sha256.9327532a05078d7efd5a0ef9ace1ee5cd278653d8df53590e2fb7a4a34cb0bb8",
 		},
+		{
+			name:   "library protocol image",
+			ref:    "library://sashayakovtseva/test/image-server",
+			expect: "cloud.sylabs.io/sashayakovtseva/test/image-server:latest",
+		},
+		{
+			name:   "library protocol image with empty domain",
+			ref:    "library:///sashayakovtseva/test/image-server:1",
+			expect: "cloud.sylabs.io/sashayakovtseva/test/image-server:1",
+		},
+		{
+			name:   "library protocol image with custom domain",
+			ref:    "library://library.example.com/sashayakovtseva/test/image-server:1",
+			expect: "library.example.com/sashayakovtseva/test/image-server:1",
+		},
 		{
 			name:   "local SIF without tag",
 			ref:    "local.file/home/sasha/my.sif",
@@ -159,6 +230,16 @@ func TestNormalizedImageRef(t *testing.T) {
 			ref:    "local.file/home/sasha/my.sif:latest",
 			expect: "local.file/home/sasha/my.sif",
 		},
+		{
+			name:   "registry with port without tag",
+			ref:    "localhost:5000/sylabs/busybox",
+			expect: "localhost:5000/sylabs/busybox:latest",
+		},
+		{
+			name:   "local OCI archive with tag",
+			ref:    "local.oci-archive/var/lib/images/busybox.tar:latest",
+			expect: "local.oci-archive/var/lib/images/busybox.tar",
+		},
 	}
 
 	for _, tc := range tt {
@@ -229,5 +310,77 @@ func TestReferenceTags(t *testing.T) {
 		"new-tag",
 		"new-tag-2",
 	}, ref.Tags())
+}
+
+func TestReferenceString(t *testing.T) {
+	ref := &Reference{
+		uri:     singularity.DockerDomain,
+		tags:    []string{"busybox:1.29"},
+		digests: []string{"busybox@sha256:165768770ca428e9e6d8290d5672652773edf1f80d442252a0ec737ed2cc312c"},
+	}
+	require.Equal(t, "docker.io/busybox:1.29", ref.String())
+
+	ref.RemoveTag("busybox:1.29")
+	require.Equal(t, "docker.io/busybox@sha256:165768770ca428e9e6d8290d5672652773edf1f80d442252a0ec737ed2cc312c", ref.String())
+
+	ref.RemoveDigest("busybox@sha256:165768770ca428e9e6d8290d5672652773edf1f80d442252a0ec737ed2cc312c")
+	require.Equal(t, "", ref.String())
+	require.False(t, scopeMatches("docker.io/busybox", ref), "untagged image matches scope")
+}
+
+func TestReferenceRegistry(t *testing.T) {
+	tt := []struct {
+		name   string
+		ref    string
+		expect string
+	}{
+		{
+			name:   "docker hub image",
+			ref:    "busybox:1.31",
+			expect: singularity.DockerDomain,
+		},
+		{
+			name:   "docker hub image with namespace",
+			ref:    "docker.io/sylabs/test:latest",
+			expect: singularity.DockerDomain,
+		},
+		{
+			name:   "custom docker registry",
+			ref:    "gcr.io/cri-tools/test-image-tags:1",
+			expect: "gcr.io",
+		},
+		{
+			name:   "custom docker registry with port",
+			ref:    "localhost:5000/test-image@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: "localhost:5000",
+		},
+		{
+			name:   "library image",
+			ref:    "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			expect: singularity.LibraryDomain,
+		},
+		{
+			name:   "custom library",
+			ref:    "library://library.example.com/sylabs/tests/busybox:1.0.0",
+			expect: "library.example.com",
+		},
+		{
+			name:   "library image without domain",
+			ref:    "library://sylabs/tests/busybox:1.0.0",
+			expect: singularity.LibraryDomain,
+		},
+		{
+			name:   "local SIF",
+			ref:    "local.file/home/sasha/my.sif",
+			expect: singularity.LocalFileDomain,
+		},
+	}
 
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err, "could not parse reference")
+			require.Equal(t, tc.expect, ref.Registry())
+		})
+	}
 }
@@ -0,0 +1,130 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PullOption is used to tune image pull behaviour.
+type PullOption func(o *pullOptions)
+
+type pullOptions struct {
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	prev       *Info
+	platforms  []Platform
+	checksum   string
+	build      *BuildConfig
+	lazy       bool
+	save       func(id string, move func() error) error
+}
+
+// WithTimeout limits duration of a single pull attempt. Zero
+// timeout means pull attempt may take as long as needed.
+func WithTimeout(timeout time.Duration) PullOption {
+	return func(o *pullOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithRetries makes failed pull to be retried up to retries times in case
+// error is considered temporary. Delay between attempts starts with backoff
+// and is doubled after each attempt, but never exceeds maxBackoff unless
+// maxBackoff is zero.
+func WithRetries(retries int, backoff, maxBackoff time.Duration) PullOption {
+	return func(o *pullOptions) {
+		o.retries = retries
+		o.backoff = backoff
+		o.maxBackoff = maxBackoff
+	}
+}
+
+// WithSaveHook makes Pull call save with id of the pulled image instead of moving
+// image file into location directly. Save should call move and return its error,
+// e.g. to serialize the move with removals of image with the same id.
+func WithSaveHook(save func(id string, move func() error) error) PullOption {
+	return func(o *pullOptions) {
+		o.save = save
+	}
+}
+
+// permanentError wraps errors that will not go away if pull is retried,
+// e.g. image is not found or access is denied.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// permanent marks err as permanent so that no more pull attempts are made.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// isRetriable returns true if operation that resulted in err may succeed when retried.
+func isRetriable(err error) bool {
+	if err == ErrNotModified {
+		return false
+	}
+	switch e := err.(type) {
+	case *permanentError:
+		return false
+	case *statusError:
+		return e.retriable()
+	}
+	return err != context.Canceled
+}
+
+// retry calls do until it succeeds, returns permanent error or number of retries
+// is exceeded. Each call of do receives its own context limited by timeout.
+func (o *pullOptions) retry(ctx context.Context, do func(ctx context.Context) error) error {
+	backoff := o.backoff
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if o.timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, o.timeout)
+		}
+		err := do(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= o.retries || !isRetriable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		glog.Warningf("Pull attempt %d failed, retrying in %s: %v", attempt+1, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if o.maxBackoff > 0 && backoff > o.maxBackoff {
+			backoff = o.maxBackoff
+		}
+	}
+}
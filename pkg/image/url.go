@@ -0,0 +1,144 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// ErrNotModified is returned by Pull when original image has not changed
+// since the previous pull, see IfModified.
+var ErrNotModified = fmt.Errorf("image is not modified")
+
+// urlValidators holds response headers that identify version of a remote file.
+type urlValidators struct {
+	lastModified string
+	etag         string
+}
+
+// IfModified makes pulls of images referenced by HTTP(S) URLs or local archives
+// conditional. When original file has not changed since prev was pulled,
+// Pull returns ErrNotModified.
+func IfModified(prev *Info) PullOption {
+	return func(o *pullOptions) {
+		o.prev = prev
+	}
+}
+
+// isURL returns true if ref is a plain HTTP(S) URL reference.
+func isURL(ref *Reference) bool {
+	return ref.URI() == singularity.HTTPProtocol || ref.URI() == singularity.HTTPSProtocol
+}
+
+// parseURLRef returns URL image should be downloaded from and its expected
+// sha256 checksum, if specified either as sha256 query parameter
+// or as @sha256:<hex> suffix. Checksum parameter is not sent to the server.
+func parseURLRef(ref string) (*url.URL, string, error) {
+	var checksum string
+	if i := strings.LastIndex(ref, "@sha256:"); i != -1 {
+		ref, checksum = ref[:i], ref[i+len("@sha256:"):]
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed image URL: %v", err)
+	}
+	query := u.Query()
+	if sum := query.Get("sha256"); sum != "" {
+		checksum = sum
+		query.Del("sha256")
+		u.RawQuery = query.Encode()
+	}
+	if checksum != "" {
+		checksum = strings.ToLower(checksum)
+		if b, err := hex.DecodeString(checksum); err != nil || len(b) != 32 {
+			return nil, "", fmt.Errorf("malformed sha256 checksum %q", checksum)
+		}
+	}
+	return u, checksum, nil
+}
+
+// pullURLImage downloads image referenced by HTTP(S) URL into pullPath and checks
+// its checksum if one is set in reference. If prev is not nil, request is made
+// conditional and ErrNotModified is returned when remote file has not changed.
+func pullURLImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string, prev *Info) (urlValidators, error) {
+	var validators urlValidators
+	u, checksum, err := parseURLRef(ref.String())
+	if err != nil {
+		return validators, permanent(err)
+	}
+
+	req, err := urlRequest(u, auth)
+	if err != nil {
+		return validators, permanent(err)
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	header, err := resumeDownload(ctx, http.DefaultClient, req, pullPath)
+	if e, ok := err.(*statusError); ok && e.code == http.StatusNotModified {
+		return validators, ErrNotModified
+	}
+	if err != nil {
+		return validators, err
+	}
+	validators.lastModified = header.Get("Last-Modified")
+	validators.etag = header.Get("ETag")
+
+	if checksum == "" {
+		return validators, nil
+	}
+	actual, err := fileChecksum(pullPath)
+	if err != nil {
+		return validators, permanent(err)
+	}
+	if actual != checksum {
+		if err := os.Remove(pullPath); err != nil {
+			glog.Errorf("Could not remove %s: %v", pullPath, err)
+		}
+		return validators, permanent(fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, actual))
+	}
+	return validators, nil
+}
+
+// urlRequest returns request that downloads image file from u.
+func urlRequest(u *url.URL, auth *k8s.AuthConfig) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	switch {
+	case auth.GetUsername() != "":
+		req.SetBasicAuth(auth.GetUsername(), auth.GetPassword())
+	case auth.GetRegistryToken() != "":
+		req.Header.Set("Authorization", "Bearer "+auth.GetRegistryToken())
+	}
+	return req, nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+func TestPull_URL(t *testing.T) {
+	content := bytes.Repeat([]byte("singularity"), 1024)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+	modTime := time.Date(2019, time.October, 1, 12, 0, 0, 0, time.UTC)
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/busybox.sif" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("sha256") != "" {
+			http.Error(w, "checksum is sent to server", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "busybox.sif", modTime, bytes.NewReader(content))
+		if w.Header().Get("Content-Length") != "" {
+			atomic.AddInt32(&downloads, 1)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "url-test-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	imageURL := server.URL + "/images/busybox.sif"
+	tt := []struct {
+		name        string
+		ref         string
+		expectError string
+	}{
+		{
+			name: "no checksum",
+			ref:  imageURL,
+		},
+		{
+			name: "checksum query",
+			ref:  imageURL + "?sha256=" + checksum,
+		},
+		{
+			name: "checksum suffix",
+			ref:  imageURL + "@sha256:" + checksum,
+		},
+		{
+			name:        "checksum mismatch",
+			ref:         imageURL + "@sha256:" + checksum[1:] + "0",
+			expectError: "checksum mismatch",
+		},
+		{
+			name:        "malformed checksum",
+			ref:         imageURL + "?sha256=abc",
+			expectError: "malformed sha256 checksum",
+		},
+		{
+			name:        "not found",
+			ref:         server.URL + "/images/missing.sif",
+			expectError: "unexpected http status code 404",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err, "could not parse reference")
+			require.Equal(t, singularity.HTTPProtocol, ref.URI())
+			require.Equal(t, server.Listener.Addr().String(), ref.Registry())
+
+			info, err := Pull(context.Background(), dir, ref, nil)
+			if tc.expectError != "" {
+				require.Error(t, err, "expected error, but got nil")
+				require.Contains(t, err.Error(), tc.expectError, "unexpected pull error")
+				return
+			}
+			require.NoError(t, err, "unexpected pull error")
+			require.Equal(t, checksum, info.Sha256, "unexpected image checksum")
+			require.Equal(t, `"v1"`, info.ETag, "unexpected ETag")
+			require.Equal(t, modTime.Format(http.TimeFormat), info.LastModified, "unexpected Last-Modified")
+		})
+	}
+
+	ref, err := ParseRef(imageURL)
+	require.NoError(t, err, "could not parse reference")
+	before := atomic.LoadInt32(&downloads)
+	_, err = Pull(context.Background(), dir, ref, nil, IfModified(&Info{ETag: `"v1"`}))
+	require.Equal(t, ErrNotModified, err, "unexpected conditional pull error")
+	_, err = Pull(context.Background(), dir, ref, nil, IfModified(&Info{LastModified: modTime.Format(http.TimeFormat)}))
+	require.Equal(t, ErrNotModified, err, "unexpected conditional pull error")
+	require.Equal(t, before, atomic.LoadInt32(&downloads), "image is downloaded again")
+
+	info, err := Pull(context.Background(), dir, ref, nil, IfModified(&Info{ETag: `"v0"`}))
+	require.NoError(t, err, "unexpected pull error")
+	require.Equal(t, checksum, info.Sha256, "unexpected image checksum")
+	require.Equal(t, before+1, atomic.LoadInt32(&downloads), "modified image is not downloaded")
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	"github.com/sylabs/singularity/pkg/sypgp"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+)
+
+// VerifyMode defines what happens to images that fail signature verification.
+type VerifyMode string
+
+const (
+	// VerifyIgnore disables signature verification.
+	VerifyIgnore VerifyMode = "ignore"
+	// VerifyWarn logs verification failures and lets unsigned images and images
+	// signed by untrusted or unknown keys through. Images whose signature is
+	// invalid or whose signed data does not match signature are still rejected.
+	VerifyWarn VerifyMode = "warn"
+	// VerifyRequire rejects images that are not signed by a trusted key.
+	VerifyRequire VerifyMode = "require"
+)
+
+// VerifyPolicy defines how signatures of images matching Scope are verified.
+type VerifyPolicy struct {
+	// Scope is either a registry domain, e.g. cloud.sylabs.io, or
+	// an image reference prefix, e.g. cloud.sylabs.io/sylabs/tests.
+	// Empty scope matches all images.
+	Scope string
+	// Mode defines what happens to images that fail verification.
+	// Empty mode is treated as VerifyWarn.
+	Mode VerifyMode
+	// TrustedFingerprints restricts keys images may be signed with. When
+	// empty any key found in keyring or on key server is trusted.
+	TrustedFingerprints []string
+	// Keyring is a path to a public keyring file, either binary or ASCII armored.
+	// When set signing keys are looked up in it only, so verification works offline.
+	Keyring string
+	// KeyServer is a URL of a key server to fetch signing keys from when no
+	// keyring is set. If empty, singularity.KeysServer is used.
+	KeyServer string
+}
+
+// Signer holds information about a key image is signed with.
+type Signer struct {
+	Fingerprint string `json:"fingerprint"`
+	Identity    string `json:"identity,omitempty"`
+	// Signatures holds IDs of SIF signature descriptors
+	// that are verified to be made with the key.
+	Signatures []uint32 `json:"signatures,omitempty"`
+}
+
+// String returns signer identity followed by key fingerprint.
+func (s Signer) String() string {
+	if s.Identity == "" {
+		return s.Fingerprint
+	}
+	return fmt.Sprintf("%s (%s)", s.Identity, s.Fingerprint)
+}
+
+// Matches returns true if policy applies to image referenced by ref.
+func (p VerifyPolicy) Matches(ref *Reference) bool {
+	return scopeMatches(p.Scope, ref)
+}
+
+// scopeMatches returns true if ref belongs to scope, which is either
+// a registry domain or an image reference prefix. Empty scope matches all.
+func scopeMatches(scope string, ref *Reference) bool {
+	if scope == "" || scope == ref.Registry() {
+		return true
+	}
+	for _, name := range []string{ref.String(), strings.TrimPrefix(ref.String(), singularity.DockerDomain+"/")} {
+		if !strings.HasPrefix(name, scope) {
+			continue
+		}
+		rest := name[len(scope):]
+		if rest == "" || strings.HasSuffix(scope, "/") || strings.ContainsAny(rest[:1], "/:@") {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectVerifyPolicy returns the most specific policy that matches ref, i.e.
+// the one with the longest scope. If no policy matches, a policy that only
+// warns about verification failures is returned.
+func SelectVerifyPolicy(policies []VerifyPolicy, ref *Reference) VerifyPolicy {
+	selected := VerifyPolicy{Mode: VerifyWarn}
+	found := false
+	for _, p := range policies {
+		if !p.Matches(ref) {
+			continue
+		}
+		if !found || len(p.Scope) > len(selected.Scope) {
+			selected = p
+			found = true
+		}
+	}
+	return selected
+}
+
+// Verify verifies image signatures according to the passed policy. Signers whose
+// keys were successfully verified are recorded in image info.
+func (i *Info) Verify(policy VerifyPolicy) error {
+	if policy.Mode == VerifyIgnore {
+		return nil
+	}
+
+	signers, err := verifySignatures(i.Path, policy)
+	i.Signers = signers
+	if err == nil {
+		glog.V(2).Infof("Image %s is signed by %v", i.Ref, signers)
+		return nil
+	}
+	if _, ok := err.(invalidImageError); ok || policy.Mode == VerifyRequire {
+		return fmt.Errorf("SIF verification failed: %v", err)
+	}
+	glog.Warningf("Image %s is not verified: %v", i.Ref, err)
+	return nil
+}
+
+// invalidImageError is returned when image cannot be read, its signature is
+// cryptographically invalid or its signed data does not match the image.
+// Such images are rejected regardless of verification mode.
+type invalidImageError struct {
+	error
+}
+
+// verifySignatures checks signatures of the primary partition of SIF located at path
+// and returns signers with trusted keys. Error is returned unless image is signed with
+// at least one trusted key.
+func verifySignatures(path string, policy VerifyPolicy) ([]Signer, error) {
+	fimg, err := sif.LoadContainer(path, true)
+	if err != nil {
+		return nil, invalidImageError{fmt.Errorf("could not load SIF: %v", err)}
+	}
+	defer fimg.UnloadContainer()
+
+	part, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return nil, fmt.Errorf("could not find primary partition: %v", err)
+	}
+	signatures, _, err := fimg.GetLinkedDescrsByType(part.ID, sif.DataSignature)
+	if err != nil || len(signatures) == 0 {
+		return nil, fmt.Errorf("image is not signed")
+	}
+
+	var keyring openpgp.EntityList
+	if policy.Keyring != "" {
+		keyring, err = loadKeyring(policy.Keyring)
+		if err != nil {
+			return nil, fmt.Errorf("could not load keyring: %v", err)
+		}
+	}
+
+	hash := sha512.New384()
+	hash.Write(part.GetData(&fimg))
+	sifHash := fmt.Sprintf("SIFHASH:\n%x", hash.Sum(nil))
+
+	var signers []Signer
+	var errs []string
+	for _, sig := range signatures {
+		fingerprint, err := sig.GetEntityString()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("could not get signing entity: %v", err))
+			continue
+		}
+
+		block, _ := clearsign.Decode(sig.GetData(&fimg))
+		if block == nil {
+			return nil, invalidImageError{fmt.Errorf("signature of key %s is corrupted", fingerprint)}
+		}
+		if !bytes.Equal(bytes.TrimRight(block.Plaintext, "\n"), []byte(sifHash)) {
+			return nil, invalidImageError{fmt.Errorf("partition hash differs from the one signed by key %s", fingerprint)}
+		}
+
+		keys := keyring
+		if policy.Keyring == "" {
+			// untrusted keys are not even fetched
+			if !isTrusted(fingerprint, policy.TrustedFingerprints) {
+				errs = append(errs, fmt.Sprintf("key %s is not trusted", fingerprint))
+				continue
+			}
+			keyServer := policy.KeyServer
+			if keyServer == "" {
+				keyServer = singularity.KeysServer
+			}
+			keys, err = sypgp.FetchPubkey(fingerprint, keyServer, "", true)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("could not fetch key %s: %v", fingerprint, err))
+				continue
+			}
+		}
+		signer, err := openpgp.CheckDetachedSignature(keys, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+		if err == pgperrors.ErrUnknownIssuer {
+			errs = append(errs, fmt.Sprintf("key %s is not found", fingerprint))
+			continue
+		}
+		if err != nil {
+			return nil, invalidImageError{fmt.Errorf("signature of key %s is invalid: %v", fingerprint, err)}
+		}
+		// fingerprint in descriptor is set by whoever built image,
+		// so only the key that actually made signature is trusted
+		verified := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint[:])
+		if verified != fingerprint {
+			return nil, invalidImageError{fmt.Errorf("signature of key %s is made by key %s", fingerprint, verified)}
+		}
+		if !isTrusted(verified, policy.TrustedFingerprints) {
+			errs = append(errs, fmt.Sprintf("key %s is not trusted", verified))
+			continue
+		}
+		if i := findSigner(signers, verified); i != -1 {
+			signers[i].Signatures = append(signers[i].Signatures, sig.ID)
+			continue
+		}
+		s := Signer{
+			Fingerprint: verified,
+			Signatures:  []uint32{sig.ID},
+		}
+		for _, id := range signer.Identities {
+			s.Identity = id.Name
+			break
+		}
+		signers = append(signers, s)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return signers, nil
+}
+
+// findSigner returns index of signer with the passed fingerprint or -1.
+func findSigner(signers []Signer, fingerprint string) int {
+	for i, s := range signers {
+		if s.Fingerprint == fingerprint {
+			return i
+		}
+	}
+	return -1
+}
+
+// isTrusted checks whether key with the passed fingerprint is trusted. When
+// no trusted fingerprints are set any key is trusted. Trusted fingerprints
+// may be shortened to key ID, i.e. last 16 hex digits of a fingerprint.
+func isTrusted(fingerprint string, trusted []string) bool {
+	if len(trusted) == 0 {
+		return true
+	}
+	for _, t := range trusted {
+		t = strings.ToUpper(strings.Replace(t, " ", "", -1))
+		if (len(t) == 16 || len(t) == 40) && strings.HasSuffix(fingerprint, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadKeyring reads public keys from a binary or ASCII armored keyring file.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys, err := openpgp.ReadKeyRing(f)
+	if err == nil {
+		return keys, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return openpgp.ReadArmoredKeyRing(f)
+}
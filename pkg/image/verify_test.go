@@ -0,0 +1,316 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// createSIF creates SIF with a primary partition holding data at path.
+// Partition is signed with each of passed signers.
+func createSIF(t *testing.T, path string, data []byte, signers ...*openpgp.Entity) {
+	part := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Size:     int64(len(data)),
+		Data:     data,
+	}
+	err := part.SetPartExtra(sif.FsSquash, sif.PartPrimSys, sif.GetSIFArch(runtime.GOARCH))
+	require.NoError(t, err, "could not set partition info")
+	fimg, err := sif.CreateContainer(sif.CreateInfo{
+		Pathname:   path,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		InputDescr: []sif.DescriptorInput{part},
+	})
+	require.NoError(t, err, "could not create SIF")
+
+	if len(signers) == 0 {
+		return
+	}
+	loaded, err := sif.LoadContainer(path, false)
+	require.NoError(t, err, "could not load SIF")
+	defer loaded.UnloadContainer()
+
+	sum := sha512.Sum384(data)
+	for _, e := range signers {
+		var signed bytes.Buffer
+		w, err := clearsign.Encode(&signed, e.PrivateKey, nil)
+		require.NoError(t, err, "could not create signature")
+		_, err = fmt.Fprintf(w, "SIFHASH:\n%x", sum)
+		require.NoError(t, err, "could not write signed data")
+		require.NoError(t, w.Close(), "could not sign data")
+
+		sig := sif.DescriptorInput{
+			Datatype: sif.DataSignature,
+			Groupid:  sif.DescrUnusedGroup,
+			Link:     fimg.DescrArr[0].ID,
+			Size:     int64(signed.Len()),
+			Data:     signed.Bytes(),
+		}
+		err = sig.SetSignExtra(sif.HashSHA384, hex.EncodeToString(e.PrimaryKey.Fingerprint[:]))
+		require.NoError(t, err, "could not set signature info")
+		require.NoError(t, loaded.AddObject(sig), "could not add signature")
+	}
+}
+
+func fingerprint(e *openpgp.Entity) string {
+	return strings.ToUpper(hex.EncodeToString(e.PrimaryKey.Fingerprint[:]))
+}
+
+func TestInfo_VerifyOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	trusted, err := openpgp.NewEntity("Trusted Signer", "", "trusted@example.com", nil)
+	require.NoError(t, err, "could not generate key")
+	unknown, err := openpgp.NewEntity("Unknown Signer", "", "unknown@example.com", nil)
+	require.NoError(t, err, "could not generate key")
+
+	keyring := filepath.Join(dir, "pubring.gpg")
+	f, err := os.Create(keyring)
+	require.NoError(t, err, "could not create keyring")
+	require.NoError(t, trusted.Serialize(f), "could not write keyring")
+	require.NoError(t, f.Close(), "could not close keyring")
+
+	data := bytes.Repeat([]byte("squashfs"), 512)
+	unsigned := filepath.Join(dir, "unsigned.sif")
+	createSIF(t, unsigned, data)
+	signed := filepath.Join(dir, "signed.sif")
+	createSIF(t, signed, data, trusted)
+	signedByUnknown := filepath.Join(dir, "unknown.sif")
+	createSIF(t, signedByUnknown, data, unknown)
+	corrupted := filepath.Join(dir, "corrupted.sif")
+	createSIF(t, corrupted, data, trusted)
+	// flip a byte of partition data, right after SIF header and descriptors
+	content, err := ioutil.ReadFile(corrupted)
+	require.NoError(t, err, "could not read SIF")
+	content[sif.DataStartOffset] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(corrupted, content, 0644), "could not corrupt SIF")
+	// sign other data, then replace both partition data and
+	// signed hash, so that only signature itself does not match
+	forged := filepath.Join(dir, "forged.sif")
+	other := bytes.Repeat([]byte("squashfz"), 512)
+	createSIF(t, forged, other, trusted)
+	content, err = ioutil.ReadFile(forged)
+	require.NoError(t, err, "could not read SIF")
+	sum, otherSum := sha512.Sum384(data), sha512.Sum384(other)
+	content = bytes.Replace(content, other, data, 1)
+	content = bytes.Replace(content, []byte(hex.EncodeToString(otherSum[:])), []byte(hex.EncodeToString(sum[:])), 1)
+	require.NoError(t, ioutil.WriteFile(forged, content, 0644), "could not forge SIF")
+	// sign with a key that is in keyring, but is not trusted, and
+	// claim trusted key fingerprint in signature descriptor
+	untrusted, err := openpgp.NewEntity("Untrusted Signer", "", "untrusted@example.com", nil)
+	require.NoError(t, err, "could not generate key")
+	bothKeyring := filepath.Join(dir, "both.gpg")
+	f, err = os.Create(bothKeyring)
+	require.NoError(t, err, "could not create keyring")
+	require.NoError(t, trusted.Serialize(f), "could not write keyring")
+	require.NoError(t, untrusted.Serialize(f), "could not write keyring")
+	require.NoError(t, f.Close(), "could not close keyring")
+	signedByUntrusted := filepath.Join(dir, "untrusted.sif")
+	createSIF(t, signedByUntrusted, data, untrusted)
+	impostor := filepath.Join(dir, "impostor.sif")
+	createSIF(t, impostor, data, untrusted)
+	content, err = ioutil.ReadFile(impostor)
+	require.NoError(t, err, "could not read SIF")
+	require.Equal(t, 1, bytes.Count(content, untrusted.PrimaryKey.Fingerprint[:]), "unexpected descriptor layout")
+	content = bytes.Replace(content, untrusted.PrimaryKey.Fingerprint[:], trusted.PrimaryKey.Fingerprint[:], 1)
+	require.NoError(t, ioutil.WriteFile(impostor, content, 0644), "could not forge SIF")
+
+	tt := []struct {
+		name          string
+		path          string
+		policy        VerifyPolicy
+		expectSigners []Signer
+		expectError   string
+	}{
+		{
+			name:   "unsigned image with warn policy",
+			path:   unsigned,
+			policy: VerifyPolicy{Mode: VerifyWarn, Keyring: keyring},
+		},
+		{
+			name:        "unsigned image with require policy",
+			path:        unsigned,
+			policy:      VerifyPolicy{Mode: VerifyRequire, Keyring: keyring},
+			expectError: "image is not signed",
+		},
+		{
+			name:   "corrupted image with ignore policy",
+			path:   corrupted,
+			policy: VerifyPolicy{Mode: VerifyIgnore},
+		},
+		{
+			name:        "corrupted image with warn policy",
+			path:        corrupted,
+			policy:      VerifyPolicy{Mode: VerifyWarn, Keyring: keyring},
+			expectError: "partition hash differs",
+		},
+		{
+			name:        "forged signature with warn policy",
+			path:        forged,
+			policy:      VerifyPolicy{Mode: VerifyWarn, Keyring: keyring},
+			expectError: "signature of key " + fingerprint(trusted) + " is invalid",
+		},
+		{
+			name: "signed by untrusted key claiming trusted fingerprint",
+			path: impostor,
+			policy: VerifyPolicy{
+				Mode:                VerifyRequire,
+				Keyring:             bothKeyring,
+				TrustedFingerprints: []string{fingerprint(trusted)},
+			},
+			expectError: "signature of key " + fingerprint(trusted) + " is made by key " + fingerprint(untrusted),
+		},
+		{
+			name: "signed by untrusted key in keyring",
+			path: signedByUntrusted,
+			policy: VerifyPolicy{
+				Mode:                VerifyRequire,
+				Keyring:             bothKeyring,
+				TrustedFingerprints: []string{fingerprint(trusted)},
+			},
+			expectError: "key " + fingerprint(untrusted) + " is not trusted",
+		},
+		{
+			name:   "signed image",
+			path:   signed,
+			policy: VerifyPolicy{Mode: VerifyRequire, Keyring: keyring},
+			expectSigners: []Signer{
+				{
+					Fingerprint: fingerprint(trusted),
+					Identity:    "Trusted Signer <trusted@example.com>",
+					Signatures:  []uint32{2},
+				},
+			},
+		},
+		{
+			name: "signed image with trusted key id",
+			path: signed,
+			policy: VerifyPolicy{
+				Mode:                VerifyRequire,
+				Keyring:             keyring,
+				TrustedFingerprints: []string{fingerprint(trusted)[24:]},
+			},
+			expectSigners: []Signer{
+				{
+					Fingerprint: fingerprint(trusted),
+					Identity:    "Trusted Signer <trusted@example.com>",
+					Signatures:  []uint32{2},
+				},
+			},
+		},
+		{
+			name: "signed image with untrusted key",
+			path: signed,
+			policy: VerifyPolicy{
+				Mode:                VerifyRequire,
+				Keyring:             keyring,
+				TrustedFingerprints: []string{fingerprint(unknown)},
+			},
+			expectError: "is not trusted",
+		},
+		{
+			name:        "key is missing in keyring",
+			path:        signedByUnknown,
+			policy:      VerifyPolicy{Mode: VerifyRequire, Keyring: keyring},
+			expectError: "is not found",
+		},
+		{
+			name:   "key is missing in keyring with warn policy",
+			path:   signedByUnknown,
+			policy: VerifyPolicy{Mode: VerifyWarn, Keyring: keyring},
+		},
+		{
+			name:        "missing image",
+			path:        filepath.Join(dir, "missing.sif"),
+			policy:      VerifyPolicy{Mode: VerifyWarn, Keyring: keyring},
+			expectError: "no such file or directory",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			info := &Info{
+				Path: tc.path,
+				Ref: &Reference{
+					uri:  singularity.LibraryDomain,
+					tags: []string{"cloud.sylabs.io/sylabs/tests/verify:1.0.0"},
+				},
+			}
+			err := info.Verify(tc.policy)
+			if tc.expectError != "" {
+				require.Error(t, err, "expected error, but got nil")
+				require.Contains(t, err.Error(), tc.expectError, "unexpected verify error")
+				return
+			}
+			require.NoError(t, err, "unexpected verify error")
+			require.Equal(t, tc.expectSigners, info.Signers, "unexpected signers")
+		})
+	}
+}
+
+func TestSelectVerifyPolicy(t *testing.T) {
+	policies := []VerifyPolicy{
+		{Scope: "", Mode: VerifyWarn},
+		{Scope: singularity.LibraryDomain, Mode: VerifyRequire},
+		{Scope: "cloud.sylabs.io/sylabs/tests", Mode: VerifyIgnore},
+		{Scope: "gcr.io", Mode: VerifyRequire},
+		{Scope: "docker.io/library", Mode: VerifyIgnore},
+	}
+
+	tt := []struct {
+		ref        string
+		expectMode VerifyMode
+	}{
+		{ref: "cloud.sylabs.io/sylabs/tests/busybox:1.0.0", expectMode: VerifyIgnore},
+		{ref: "cloud.sylabs.io/sylabs/testsuite/busybox:1.0.0", expectMode: VerifyRequire},
+		{ref: "cloud.sylabs.io/sylabs/examples/lolcow:latest", expectMode: VerifyRequire},
+		{ref: "gcr.io/cri-tools/test-image-tags:1", expectMode: VerifyRequire},
+		{ref: "library/busybox", expectMode: VerifyIgnore},
+		{ref: "busybox", expectMode: VerifyWarn},
+		{ref: "local.file/tmp/image.sif", expectMode: VerifyWarn},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.ref, func(t *testing.T) {
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err, "could not parse reference")
+			require.Equal(t, tc.expectMode, SelectVerifyPolicy(policies, ref).Mode)
+		})
+	}
+
+	ref, err := ParseRef("busybox")
+	require.NoError(t, err, "could not parse reference")
+	require.Equal(t, VerifyWarn, SelectVerifyPolicy(nil, ref).Mode)
+}
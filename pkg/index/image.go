@@ -82,6 +82,19 @@ func (i *ImageIndex) Remove(id string) error {
 	return nil
 }
 
+// RemoveTag removes tag from the image it references, if any.
+// The image itself is kept in index even if it has no tags left.
+func (i *ImageIndex) RemoveTag(tag string) {
+	id := i.readRef(tag)
+	if id == "" {
+		return
+	}
+	if info, err := i.find(id); err == nil {
+		info.Ref.RemoveTag(tag)
+	}
+	i.removeRefs(tag)
+}
+
 // Iterate calls handler func on each pod registered in index.
 func (i *ImageIndex) Iterate(handler func(image *image.Info)) {
 	innerIterate := func(key string, item interface{}) {
@@ -127,16 +140,18 @@ func (i *ImageIndex) merge(oldImage, image *image.Info) error {
 		oldID := i.readRef(tag)
 		i.setRef(tag, image.ID)
 		if oldID != "" && oldID != image.ID {
-			oldInfo, _ := i.Find(image.ID)
-			oldInfo.Ref.RemoveTag(tag)
+			if oldInfo, err := i.find(oldID); err == nil {
+				oldInfo.Ref.RemoveTag(tag)
+			}
 		}
 	}
 	for _, digest := range image.Ref.Digests() {
 		oldID := i.readRef(digest)
 		i.setRef(digest, image.ID)
-		if oldID != "" && oldID == image.ID {
-			oldInfo, _ := i.Find(image.ID)
-			oldInfo.Ref.RemoveDigest(digest)
+		if oldID != "" && oldID != image.ID {
+			if oldInfo, err := i.find(oldID); err == nil {
+				oldInfo.Ref.RemoveDigest(digest)
+			}
 		}
 	}
 	return nil
@@ -199,4 +199,71 @@ func AdvancedTestImageIndex(t *testing.T) {
 		})
 		require.Equal(t, 2, count)
 	})
+
+}
+
+func TestImageIndex_MoveRefs(t *testing.T) {
+	indx := NewImageIndex()
+
+	ref, err := image.ParseRef("busybox:1.29")
+	require.NoError(t, err, "could not parse busybox ref")
+	ref.AddDigests([]string{"busybox@sha256:165768770ca428e9e6d8290d5672652773edf1f80d442252a0ec737ed2cc312c"})
+	oldBusybox := &image.Info{
+		ID:  "a1",
+		Ref: ref,
+	}
+	ref, err = image.ParseRef("busybox:latest")
+	require.NoError(t, err, "could not parse busybox ref")
+	newBusybox := &image.Info{
+		ID:  "b2",
+		Ref: ref,
+	}
+	require.NoError(t, indx.Add(oldBusybox))
+	require.NoError(t, indx.Add(newBusybox))
+
+	ref, err = image.ParseRef("busybox:1.29")
+	require.NoError(t, err, "could not parse busybox ref")
+	ref.AddDigests(oldBusybox.Ref.Digests())
+	err = indx.Add(&image.Info{
+		ID:  newBusybox.ID,
+		Ref: ref,
+	})
+	require.NoError(t, err)
+
+	found, err := indx.Find("busybox:1.29")
+	require.NoError(t, err, "index returned unexpected error")
+	require.Equal(t, newBusybox.ID, found.ID, "tag is not moved")
+	require.ElementsMatch(t, []string{"busybox:1.29", "busybox:latest"}, found.Ref.Tags(), "index returned wrong image tags")
+	require.ElementsMatch(t, ref.Digests(), found.Ref.Digests(), "index returned wrong image digests")
+
+	found, err = indx.Find(oldBusybox.ID)
+	require.NoError(t, err, "index returned unexpected error")
+	require.Empty(t, found.Ref.Tags(), "moved tag is kept by previous image")
+	require.Empty(t, found.Ref.Digests(), "moved digest is kept by previous image")
+}
+
+func TestImageIndex_RemoveTag(t *testing.T) {
+	indx := NewImageIndex()
+
+	ref, err := image.ParseRef("busybox:1.29")
+	require.NoError(t, err, "could not parse busybox ref")
+	ref.AddTags([]string{"busybox:latest"})
+	busybox := &image.Info{
+		ID:  "a1",
+		Ref: ref,
+	}
+	require.NoError(t, indx.Add(busybox))
+
+	indx.RemoveTag("busybox:latest")
+	indx.RemoveTag("alpine:latest")
+	_, err = indx.Find("busybox:latest")
+	require.Equal(t, ErrNotFound, err, "removed tag is found")
+	found, err := indx.Find("busybox:1.29")
+	require.NoError(t, err, "index returned unexpected error")
+	require.Equal(t, []string{"busybox:1.29"}, found.Ref.Tags(), "index returned wrong image tags")
+
+	indx.RemoveTag("busybox:1.29")
+	found, err = indx.Find(busybox.ID)
+	require.NoError(t, err, "image without tags is removed")
+	require.Empty(t, found.Ref.Tags(), "removed tag is kept by image")
 }
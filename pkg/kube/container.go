@@ -26,6 +26,7 @@ import (
 	"github.com/apptainer/apptainer/pkg/util/unix"
 	"github.com/golang/glog"
 	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/nbd"
 	"github.com/sylabs/singularity-cri/pkg/rand"
 	"github.com/sylabs/singularity-cri/pkg/singularity"
 	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
@@ -58,6 +59,13 @@ type Container struct {
 	logPath      string
 	execEnvs     []string
 
+	decryptionKeys []image.DecryptionKey
+	lazyDevice     *nbd.Device
+	imgCache       *image.Cache
+	imgPath        string // image file bundle is created from
+	imgMounts      *ImageMounts
+	sharedMount    bool // root filesystem is on top of imgMounts mount
+
 	isStopped bool
 	isRemoved bool
 
@@ -257,6 +265,7 @@ func (c *Container) Create(baseDir string) error {
 		return fmt.Errorf("could not create log directory: %v", err)
 	}
 	c.imgInfo.Borrow(c.id)
+	c.promoteImage()
 	err = c.spawnOCIContainer()
 	if err != nil {
 		return fmt.Errorf("could not spawn container: %v", err)
@@ -0,0 +1,156 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/apptainer/apptainer/pkg/ocibundle/tools"
+	"github.com/golang/glog"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity-cri/pkg/nbd"
+)
+
+// needsBlockBundle returns true if container root filesystem cannot be mounted by
+// ocibundle SIF driver, i.e. when image is encrypted or is being pulled lazily.
+func (c *Container) needsBlockBundle() bool {
+	return c.imgInfo.Encrypted || c.imgInfo.LazyReader() != nil
+}
+
+// addBlockBundle creates OCI bundle the same way ocibundle SIF driver does, except
+// that root filesystem partition of lazily pulled images is served with a network
+// block device that fetches missing data on demand, and encrypted partitions
+// are opened with cryptsetup before mount.
+func (c *Container) addBlockBundle() (err error) {
+	offset, size, err := rootfsPartition(c.imgPath)
+	if err != nil {
+		return err
+	}
+
+	g, err := tools.GenerateBundleConfig(c.bundlePath(), nil)
+	if err != nil {
+		return fmt.Errorf("could not generate bundle config: %v", err)
+	}
+	var cleanups []func()
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}()
+	cleanups = append(cleanups, func() {
+		if err := tools.DeleteBundle(c.bundlePath()); err != nil {
+			glog.Errorf("Could not delete bundle %s: %v", c.bundlePath(), err)
+		}
+	})
+
+	var device string
+	if lazy := c.imgInfo.LazyReader(); lazy != nil {
+		r := io.NewSectionReader(lazy, int64(offset), int64(size))
+		c.lazyDevice, err = nbd.Attach(r, int64(size))
+		if err != nil {
+			return fmt.Errorf("could not attach lazy image: %v", err)
+		}
+		cleanups = append(cleanups, c.detachLazyDevice)
+		device = c.lazyDevice.Path
+		glog.V(4).Infof("Serving lazy image %s for container %s at %s", c.imgInfo.ID, c.id, device)
+	} else {
+		img, err := os.Open(c.imgPath)
+		if err != nil {
+			return fmt.Errorf("could not open image: %v", err)
+		}
+		defer img.Close()
+		device, err = tools.CreateLoop(img, offset, size)
+		if err != nil {
+			return fmt.Errorf("could not attach loop device: %v", err)
+		}
+	}
+
+	if c.imgInfo.Encrypted {
+		if err = c.openCryptDevice(device); err != nil {
+			return err
+		}
+		cleanups = append(cleanups, func() {
+			if err := c.closeCryptDevice(); err != nil {
+				glog.Errorf("Could not close crypt device: %v", err)
+			}
+		})
+		device = filepath.Join("/dev/mapper", c.cryptDeviceName())
+	}
+
+	rootfs := tools.RootFs(c.bundlePath()).Path()
+	err = syscall.Mount(device, rootfs, "squashfs", syscall.MS_RDONLY, "errors=remount-ro")
+	if err != nil {
+		return fmt.Errorf("could not mount root filesystem: %v", err)
+	}
+	cleanups = append(cleanups, func() {
+		if err := syscall.Unmount(rootfs, syscall.MNT_DETACH); err != nil {
+			glog.Errorf("Could not unmount %s: %v", rootfs, err)
+		}
+	})
+
+	if err = tools.SaveBundleConfig(c.bundlePath(), g); err != nil {
+		return fmt.Errorf("could not save bundle config: %v", err)
+	}
+	if err = tools.CreateOverlay(c.bundlePath()); err != nil {
+		return fmt.Errorf("could not create overlay: %v", err)
+	}
+	return nil
+}
+
+// cleanupBlockBundle releases devices root filesystem of
+// container created with addBlockBundle was mounted from.
+func (c *Container) cleanupBlockBundle() error {
+	if c.imgInfo.Encrypted {
+		if err := c.closeCryptDevice(); err != nil {
+			return fmt.Errorf("could not close decrypted root filesystem: %v", err)
+		}
+	}
+	c.detachLazyDevice()
+	return nil
+}
+
+// detachLazyDevice stops serving lazily pulled image to container, if it is served.
+func (c *Container) detachLazyDevice() {
+	if c.lazyDevice == nil {
+		return
+	}
+	if err := c.lazyDevice.Detach(); err != nil {
+		glog.Errorf("Could not detach lazy image: %v", err)
+	}
+	c.lazyDevice = nil
+}
+
+// rootfsPartition returns offset and size of primary
+// system partition of SIF image located at imgPath.
+func rootfsPartition(imgPath string) (uint64, uint64, error) {
+	fimg, err := sif.LoadContainer(imgPath, true)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not load SIF image: %v", err)
+	}
+	defer fimg.UnloadContainer()
+
+	part, _, err := fimg.GetPartPrimSys()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not find primary system partition: %v", err)
+	}
+	return uint64(part.Fileoff), uint64(part.Filelen), nil
+}
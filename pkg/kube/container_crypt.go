@@ -0,0 +1,93 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+const (
+	cryptsetupName    = "cryptsetup"
+	cryptDevicePrefix = "sycri-"
+)
+
+// SetDecryptionKeys sets keys encrypted container image may be opened with.
+// Keys are tried in the passed order until one of them succeeds.
+func (c *Container) SetDecryptionKeys(keys []image.DecryptionKey) {
+	c.decryptionKeys = keys
+}
+
+// cryptDeviceName returns name of device mapper target
+// decrypted container root filesystem is available at.
+func (c *Container) cryptDeviceName() string {
+	return cryptDevicePrefix + c.id
+}
+
+// openCryptDevice opens encrypted root filesystem attached to loop
+// with the first decryption key that fits.
+func (c *Container) openCryptDevice(loop string) error {
+	if len(c.decryptionKeys) == 0 {
+		return fmt.Errorf("no decryption key matches encrypted image %s", c.imgInfo.ID)
+	}
+	cryptsetup, err := exec.LookPath(cryptsetupName)
+	if err != nil {
+		return fmt.Errorf("could not find %s on this machine: %v", cryptsetupName, err)
+	}
+
+	var failures []string
+	for _, key := range c.decryptionKeys {
+		passphrase, err := key.Plaintext(c.imgPath)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		cmd := exec.Command(cryptsetup, "open", "--batch-mode", "--type", "luks2",
+			"--key-file", "-", loop, c.cryptDeviceName())
+		cmd.Stdin = bytes.NewReader(passphrase)
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			glog.V(4).Infof("Opened encrypted image %s for container %s with %s", c.imgInfo.ID, c.id, key)
+			return nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v: %s", key, err, bytes.TrimSpace(out)))
+	}
+	return fmt.Errorf("could not decrypt image %s: %s", c.imgInfo.ID, strings.Join(failures, "; "))
+}
+
+// closeCryptDevice closes device mapper target that was
+// opened for container root filesystem, if any.
+func (c *Container) closeCryptDevice() error {
+	device := filepath.Join("/dev/mapper", c.cryptDeviceName())
+	if _, err := os.Stat(device); os.IsNotExist(err) {
+		return nil
+	}
+	cryptsetup, err := exec.LookPath(cryptsetupName)
+	if err != nil {
+		return fmt.Errorf("could not find %s on this machine: %v", cryptsetupName, err)
+	}
+	out, err := exec.Command(cryptsetup, "close", c.cryptDeviceName()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not close %s: %v: %s", device, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
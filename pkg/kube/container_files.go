@@ -23,6 +23,7 @@ import (
 
 	ocibundle "github.com/apptainer/apptainer/pkg/ocibundle/sif"
 	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
 )
 
 const (
@@ -73,14 +74,45 @@ func (c *Container) addLogDirectory() error {
 	return nil
 }
 
-func (c *Container) addOCIBundle() error {
-	glog.V(5).Infof("Creating SIF bundle at %s", c.bundlePath())
-	d, err := ocibundle.FromSif(c.imgInfo.Path, c.bundlePath(), true)
+// SetImageCache sets local cache tier container image is copied to
+// before bundle is created, so that bundle is created from the copy.
+func (c *Container) SetImageCache(cache *image.Cache) {
+	c.imgCache = cache
+}
+
+// promoteImage copies container image to local cache tier. Failure
+// is only logged and bundle is created from image storage instead.
+func (c *Container) promoteImage() {
+	c.imgPath = c.imgInfo.Path
+	if c.imgCache == nil {
+		return
+	}
+	path, err := c.imgCache.Promote(c.imgInfo)
 	if err != nil {
-		return fmt.Errorf("could not create SIF bundle driver: %v", err)
+		glog.Warningf("Could not promote image %s to cache, using image storage: %v", c.imgInfo.ID, err)
+		return
 	}
-	if err := d.Create(nil); err != nil {
-		return fmt.Errorf("could not create SIF bundle: %v", err)
+	c.imgPath = path
+}
+
+func (c *Container) addOCIBundle() error {
+	glog.V(5).Infof("Creating SIF bundle at %s", c.bundlePath())
+	if c.needsBlockBundle() {
+		if err := c.addBlockBundle(); err != nil {
+			return fmt.Errorf("could not create SIF bundle: %v", err)
+		}
+	} else if c.imgMounts != nil {
+		if err := c.addSharedBundle(); err != nil {
+			return fmt.Errorf("could not create SIF bundle: %v", err)
+		}
+	} else {
+		d, err := ocibundle.FromSif(c.imgPath, c.bundlePath(), true)
+		if err != nil {
+			return fmt.Errorf("could not create SIF bundle driver: %v", err)
+		}
+		if err := d.Create(nil); err != nil {
+			return fmt.Errorf("could not create SIF bundle: %v", err)
+		}
 	}
 
 	glog.V(5).Infof("Generating OCI config for container %s", c.id)
@@ -102,7 +134,9 @@ func (c *Container) addOCIBundle() error {
 
 func (c *Container) cleanupFiles(silent bool) error {
 	glog.V(5).Infof("Removing bundle at %s", c.bundlePath())
-	d, err := ocibundle.FromSif("", c.bundlePath(), true)
+	// bundles on top of shared image mounts are laid out the same way,
+	// except that read-only root filesystem has no overlay
+	d, err := ocibundle.FromSif("", c.bundlePath(), !c.readOnlyRootfs())
 	if err != nil {
 		if !silent {
 			return fmt.Errorf("could not create SIF bundle driver: %v", err)
@@ -115,6 +149,13 @@ func (c *Container) cleanupFiles(silent bool) error {
 		}
 		glog.Errorf("Could not delete SIF bundle: %v", err)
 	}
+	c.releaseImageMount()
+	if err := c.cleanupBlockBundle(); err != nil {
+		if !silent {
+			return err
+		}
+		glog.Errorf("Could not clean up root filesystem devices: %v", err)
+	}
 	glog.V(5).Infof("Removing container base directory %s", c.baseDir)
 	err = os.RemoveAll(c.baseDir)
 	if err != nil {
@@ -0,0 +1,105 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/apptainer/apptainer/pkg/ocibundle/tools"
+	"github.com/golang/glog"
+)
+
+// SetImageMounts sets cache of image root filesystem mounts container
+// bundle is created from, so that containers of the same image share
+// a single mount. Encrypted and lazily pulled images are not shared.
+func (c *Container) SetImageMounts(mounts *ImageMounts) {
+	c.imgMounts = mounts
+}
+
+// readOnlyRootfs returns true if container root filesystem is a read-only
+// bind of shared image mount without writable overlay on top of it.
+func (c *Container) readOnlyRootfs() bool {
+	return c.sharedMount && c.GetLinux().GetSecurityContext().GetReadonlyRootfs()
+}
+
+// addSharedBundle creates OCI bundle with root filesystem on top of shared image
+// mount. Container gets its own writable overlay upper layer, unless its root
+// filesystem is read-only, in which case shared mount is only bound to bundle.
+// Resulting bundle is laid out the same way as one created by ocibundle SIF driver.
+func (c *Container) addSharedBundle() (err error) {
+	lower, err := c.imgMounts.Acquire(c.imgInfo.ID, c.imgPath, c.id)
+	if err != nil {
+		return fmt.Errorf("could not mount image: %v", err)
+	}
+	c.sharedMount = true
+	defer func() {
+		if err != nil {
+			c.releaseImageMount()
+		}
+	}()
+
+	g, err := tools.GenerateBundleConfig(c.bundlePath(), nil)
+	if err != nil {
+		return fmt.Errorf("could not generate bundle config: %v", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := tools.DeleteBundle(c.bundlePath()); err != nil {
+			glog.Errorf("Could not delete bundle %s: %v", c.bundlePath(), err)
+		}
+	}()
+
+	rootfs := tools.RootFs(c.bundlePath()).Path()
+	if err = syscall.Mount(lower, rootfs, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("could not bind image root filesystem: %v", err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := syscall.Unmount(rootfs, syscall.MNT_DETACH); err != nil {
+			glog.Errorf("Could not unmount %s: %v", rootfs, err)
+		}
+	}()
+	err = syscall.Mount("", rootfs, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, "")
+	if err != nil {
+		return fmt.Errorf("could not remount image root filesystem read-only: %v", err)
+	}
+
+	if err = tools.SaveBundleConfig(c.bundlePath(), g); err != nil {
+		return fmt.Errorf("could not save bundle config: %v", err)
+	}
+	if c.readOnlyRootfs() {
+		glog.V(4).Infof("Skipping overlay for container %s with read-only root filesystem", c.id)
+		return nil
+	}
+	if err = tools.CreateOverlay(c.bundlePath()); err != nil {
+		return fmt.Errorf("could not create overlay: %v", err)
+	}
+	return nil
+}
+
+// releaseImageMount notifies shared image mount cache that
+// container no longer uses image root filesystem mount.
+func (c *Container) releaseImageMount() {
+	if !c.sharedMount {
+		return
+	}
+	c.imgMounts.Release(c.imgInfo.ID, c.id)
+	c.sharedMount = false
+}
@@ -30,7 +30,7 @@ func writeResolvConf(path string, config *k8s.DNSConfig) error {
 	}
 
 	glog.V(5).Infof("Creating resolv.conf file %s", path)
-	resolv, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	resolv, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("could not create %s: %v", podResolvConfPath, err)
 	}
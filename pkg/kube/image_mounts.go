@@ -0,0 +1,217 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apptainer/apptainer/pkg/ocibundle/tools"
+	"github.com/golang/glog"
+)
+
+// DefaultImageMountLinger is the default time unused image root
+// filesystem mount is kept, e.g. for a crashlooping container.
+const DefaultImageMountLinger = time.Minute
+
+// ImageMounts is a reference counted cache of read-only image root filesystem
+// mounts keyed by image id. Containers created from the same image share one
+// mount and only get their own writable overlay upper layer on top of it.
+// Mounts that are no longer used are kept for a while, so that restarted
+// containers do not mount image again. ImageMounts is thread safe to use.
+type ImageMounts struct {
+	dir    string
+	linger time.Duration
+
+	mu     sync.Mutex
+	mounts map[string]*imageMount // keyed by image id
+
+	// mount and unmount are replaced in tests
+	mount   func(imgPath, target string) error
+	unmount func(target string) error
+}
+
+type imageMount struct {
+	path  string
+	users map[string]bool // ids of containers using the mount
+	timer *time.Timer     // unmounts unused mount once linger expires
+}
+
+// NewImageMounts returns image mounts cache that creates mounts within
+// dir and keeps unused mounts for linger. Dir is created on demand. Mounts left by previous runs
+// are detached, containers that still use them are not affected.
+func NewImageMounts(dir string, linger time.Duration) (*ImageMounts, error) {
+	fii, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read image mounts directory: %v", err)
+	}
+	for _, fi := range fii {
+		path := filepath.Join(dir, fi.Name())
+		glog.V(4).Infof("Removing stale image mount %s", path)
+		if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+			return nil, fmt.Errorf("could not unmount stale image mount %s: %v", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("could not remove stale image mount %s: %v", path, err)
+		}
+	}
+	return &ImageMounts{
+		dir:     dir,
+		linger:  linger,
+		mounts:  make(map[string]*imageMount),
+		mount:   mountRootfs,
+		unmount: unmountRootfs,
+	}, nil
+}
+
+// Acquire returns path of read-only root filesystem mount of image with the passed
+// id that is located at imgPath, mounting it if needed, on behalf of container.
+func (m *ImageMounts) Acquire(id, imgPath, container string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mnt, ok := m.mounts[id]
+	if !ok {
+		path := filepath.Join(m.dir, id)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return "", fmt.Errorf("could not create mount point: %v", err)
+		}
+		glog.V(4).Infof("Mounting image %s root filesystem at %s", id, path)
+		if err := m.mount(imgPath, path); err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		mnt = &imageMount{
+			path:  path,
+			users: make(map[string]bool),
+		}
+		m.mounts[id] = mnt
+	}
+	if mnt.timer != nil {
+		mnt.timer.Stop()
+		mnt.timer = nil
+	}
+	mnt.users[container] = true
+	return mnt.path, nil
+}
+
+// Release notifies that container no longer uses root filesystem mount of
+// image with the passed id. Mount is removed once it is not used for linger.
+func (m *ImageMounts) Release(id, container string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mnt, ok := m.mounts[id]
+	if !ok || !mnt.users[container] {
+		return
+	}
+	delete(mnt.users, container)
+	if len(mnt.users) != 0 {
+		return
+	}
+	if m.linger <= 0 {
+		m.remove(id, mnt)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(m.linger, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// timer may fire right before it is stopped by Acquire
+		if mnt.timer == timer {
+			m.remove(id, mnt)
+		}
+	})
+	mnt.timer = timer
+}
+
+// Close removes mounts that are no longer used without waiting for linger.
+func (m *ImageMounts) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, mnt := range m.mounts {
+		if len(mnt.users) != 0 {
+			continue
+		}
+		if mnt.timer != nil {
+			mnt.timer.Stop()
+			mnt.timer = nil
+		}
+		m.remove(id, mnt)
+	}
+}
+
+// Users returns number of containers that use root
+// filesystem mount of image with the passed id.
+func (m *ImageMounts) Users(id string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if mnt, ok := m.mounts[id]; ok {
+		return len(mnt.users)
+	}
+	return 0
+}
+
+// remove unmounts unused image mount. It should be called with m.mu held.
+func (m *ImageMounts) remove(id string, mnt *imageMount) {
+	glog.V(4).Infof("Unmounting image %s root filesystem from %s", id, mnt.path)
+	if err := m.unmount(mnt.path); err != nil {
+		glog.Errorf("Could not unmount image %s: %v", id, err)
+		return
+	}
+	if err := os.Remove(mnt.path); err != nil {
+		glog.Errorf("Could not remove image %s mount point: %v", id, err)
+	}
+	delete(m.mounts, id)
+}
+
+// mountRootfs mounts root filesystem partition of SIF image
+// located at imgPath to target in read-only mode.
+func mountRootfs(imgPath, target string) error {
+	offset, size, err := rootfsPartition(imgPath)
+	if err != nil {
+		return err
+	}
+	img, err := os.Open(imgPath)
+	if err != nil {
+		return fmt.Errorf("could not open image: %v", err)
+	}
+	defer img.Close()
+	device, err := tools.CreateLoop(img, offset, size)
+	if err != nil {
+		return fmt.Errorf("could not attach loop device: %v", err)
+	}
+	err = syscall.Mount(device, target, "squashfs", syscall.MS_RDONLY, "errors=remount-ro")
+	if err != nil {
+		return fmt.Errorf("could not mount root filesystem: %v", err)
+	}
+	return nil
+}
+
+// unmountRootfs detaches root filesystem mount, loop
+// device is released once the last container exits.
+func unmountRootfs(target string) error {
+	if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("could not unmount %s: %v", target, err)
+	}
+	return nil
+}
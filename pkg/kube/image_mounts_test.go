@@ -0,0 +1,123 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeMounter struct {
+	mu      sync.Mutex
+	mounted map[string]string
+	mounts  int
+}
+
+func (f *fakeMounter) mount(imgPath, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mounted[target] = imgPath
+	f.mounts++
+	return nil
+}
+
+func (f *fakeMounter) unmount(target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.mounted, target)
+	return nil
+}
+
+func (f *fakeMounter) state() (map[string]string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mounted := make(map[string]string, len(f.mounted))
+	for k, v := range f.mounted {
+		mounted[k] = v
+	}
+	return mounted, f.mounts
+}
+
+func TestImageMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-mounts-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	tt := []struct {
+		name   string
+		linger time.Duration
+	}{
+		{name: "no linger"},
+		{name: "linger", linger: 50 * time.Millisecond},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			mountsDir := filepath.Join(dir, tc.name)
+			mounts, err := NewImageMounts(mountsDir, tc.linger)
+			require.NoError(t, err, "could not create image mounts")
+			fake := &fakeMounter{mounted: make(map[string]string)}
+			mounts.mount = fake.mount
+			mounts.unmount = fake.unmount
+
+			path, err := mounts.Acquire("busybox", "/images/busybox.sif", "container1")
+			require.NoError(t, err, "could not acquire mount")
+			require.Equal(t, filepath.Join(mountsDir, "busybox"), path)
+			same, err := mounts.Acquire("busybox", "/cache/busybox.sif", "container2")
+			require.NoError(t, err, "could not acquire mount")
+			require.Equal(t, path, same, "image is mounted twice")
+			_, err = mounts.Acquire("alpine", "/images/alpine.sif", "container3")
+			require.NoError(t, err, "could not acquire mount")
+
+			mounted, n := fake.state()
+			require.Equal(t, 2, n)
+			require.Equal(t, "/images/busybox.sif", mounted[path])
+			require.Equal(t, 2, mounts.Users("busybox"))
+
+			mounts.Release("busybox", "container1")
+			mounts.Release("busybox", "container1")
+			require.Equal(t, 1, mounts.Users("busybox"), "release is not idempotent")
+			mounts.Release("busybox", "container2")
+			if tc.linger != 0 {
+				mounted, _ = fake.state()
+				require.Contains(t, mounted, path, "unused mount is removed before linger expires")
+
+				_, err = mounts.Acquire("busybox", "/images/busybox.sif", "container4")
+				require.NoError(t, err, "could not acquire mount")
+				time.Sleep(2 * tc.linger)
+				mounted, n = fake.state()
+				require.Contains(t, mounted, path, "used mount is removed")
+				require.Equal(t, 2, n, "lingering mount is not reused")
+
+				mounts.Release("busybox", "container4")
+				time.Sleep(2 * tc.linger)
+			}
+			mounted, _ = fake.state()
+			require.NotContains(t, mounted, path, "unused mount is kept")
+			_, err = os.Stat(path)
+			require.True(t, os.IsNotExist(err), "mount point is kept")
+
+			mounts.Release("alpine", "container3")
+			mounts.Close()
+			mounted, _ = fake.state()
+			require.Empty(t, mounted, "mounts are kept after close")
+		})
+	}
+}
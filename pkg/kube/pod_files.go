@@ -104,7 +104,7 @@ func (p *Pod) prepareFiles() error {
 
 func (p *Pod) addHostname() error {
 	glog.V(5).Infof("Creating hostname file %s", p.hostnameFilePath())
-	host, err := os.OpenFile(p.hostnameFilePath(), os.O_RDWR|os.O_CREATE, 0644)
+	host, err := os.OpenFile(p.hostnameFilePath(), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("could not create %s: %v", podHostnamePath, err)
 	}
@@ -0,0 +1,348 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sylabs/singularity-cri/pkg/namespace"
+	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
+	"golang.org/x/sys/unix"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// poolRetryInterval is a delay before pool is refilled
+// again after pooled pod could not be created.
+const poolRetryInterval = 10 * time.Second
+
+// PoolRules decide which pods may be run in pre-created pod sandboxes.
+// Only pods with default security context, i.e. non-privileged pods that
+// share network and IPC namespaces but not PID one, are ever eligible.
+type PoolRules struct {
+	// Namespaces lists Kubernetes namespaces whose pods are eligible.
+	// Empty list matches all namespaces.
+	Namespaces []string
+	// Sysctls lists namespaced sysctls that are applied to claimed pods,
+	// a trailing * matches any suffix, e.g. net.ipv4.*. Pods that
+	// request other sysctls are not eligible.
+	Sysctls []string
+}
+
+// Eligible returns true if pod with passed config may be run in a pooled
+// pod sandbox, i.e. it differs from one only in what is set up on claim.
+func (r PoolRules) Eligible(config *k8s.PodSandboxConfig) bool {
+	if len(r.Namespaces) != 0 && !hasString(r.Namespaces, config.GetMetadata().GetNamespace()) {
+		return false
+	}
+
+	security := config.GetLinux().GetSecurityContext()
+	nsOptions := security.GetNamespaceOptions()
+	if nsOptions.GetNetwork() != k8s.NamespaceMode_POD ||
+		nsOptions.GetIpc() != k8s.NamespaceMode_POD ||
+		nsOptions.GetPid() != k8s.NamespaceMode_CONTAINER {
+		return false
+	}
+	if security.GetPrivileged() || security.GetReadonlyRootfs() ||
+		security.GetSelinuxOptions() != nil ||
+		security.GetRunAsUser() != nil || security.GetRunAsGroup() != nil ||
+		len(security.GetSupplementalGroups()) != 0 {
+		return false
+	}
+	// pooled pods are run without seccomp profile
+	profile, err := prepareSeccompPath(security.GetSeccompProfilePath())
+	if err != nil || (profile != "" && profile != unconfinedSeccompProfile) {
+		return false
+	}
+
+	for sysctl := range config.GetLinux().GetSysctls() {
+		if sysctlNamespace(sysctl) == "" || !r.allowsSysctl(sysctl) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r PoolRules) allowsSysctl(sysctl string) bool {
+	for _, pattern := range r.Sysctls {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(sysctl, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			continue
+		}
+		if sysctl == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// PodPool keeps a number of empty pods, i.e. pods with unshared namespaces
+// and running pod process, ready to be claimed, so that pods may be run
+// without waiting for all that. PodPool is thread safe to use.
+type PodPool struct {
+	baseDir string
+	size    int
+	rules   PoolRules
+
+	mu     sync.Mutex
+	ready  []*Pod
+	closed bool
+
+	refill chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// spawn, claim and remove are replaced in tests
+	spawn  func(pod *Pod) error
+	claim  func(pod *Pod, config *k8s.PodSandboxConfig) error
+	remove func(pod *Pod) error
+}
+
+// NewPodPool returns pool of size pods that are located in baseDir, the same
+// directory pods that are run on demand are located in. Pods are created in
+// background once Start is called.
+func NewPodPool(baseDir string, size int, rules PoolRules) *PodPool {
+	return &PodPool{
+		baseDir: baseDir,
+		size:    size,
+		rules:   rules,
+		refill:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		spawn: func(pod *Pod) error {
+			return pod.Run(filepath.Join(baseDir, pod.ID()))
+		},
+		claim: func(pod *Pod, config *k8s.PodSandboxConfig) error {
+			return pod.customize(config)
+		},
+		remove: func(pod *Pod) error {
+			return pod.Remove()
+		},
+	}
+}
+
+// Start starts filling pool in background.
+func (pp *PodPool) Start() {
+	pp.wg.Add(1)
+	go pp.fill()
+}
+
+// Claim returns a pooled pod customised according to config. If config is
+// not eligible according to pool rules or there is no pod ready, nil is
+// returned and pod should be run as usual. Claimed pod is replaced in background.
+func (pp *PodPool) Claim(config *k8s.PodSandboxConfig) *Pod {
+	if !pp.rules.Eligible(config) {
+		return nil
+	}
+	for {
+		pod := pp.take()
+		if pod == nil {
+			glog.V(4).Infof("No pooled pod is ready for %s/%s", config.GetMetadata().GetNamespace(), config.GetMetadata().GetName())
+			return nil
+		}
+		if err := pp.claim(pod, config); err != nil {
+			glog.Warningf("Could not claim pooled pod %s: %v", pod.ID(), err)
+			if err := pp.remove(pod); err != nil {
+				glog.Errorf("Could not remove pooled pod %s: %v", pod.ID(), err)
+			}
+			continue
+		}
+		glog.V(3).Infof("Claimed pooled pod %s for %s/%s", pod.ID(), config.GetMetadata().GetNamespace(), config.GetMetadata().GetName())
+		return pod
+	}
+}
+
+// Ready returns number of pods that are ready to be claimed.
+func (pp *PodPool) Ready() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return len(pp.ready)
+}
+
+// Close stops filling pool and removes all pods that were not claimed.
+func (pp *PodPool) Close() {
+	pp.mu.Lock()
+	if pp.closed {
+		pp.mu.Unlock()
+		return
+	}
+	pp.closed = true
+	ready := pp.ready
+	pp.ready = nil
+	pp.mu.Unlock()
+
+	close(pp.done)
+	pp.wg.Wait()
+	for _, pod := range ready {
+		if err := pp.remove(pod); err != nil {
+			glog.Errorf("Could not remove pooled pod %s: %v", pod.ID(), err)
+		}
+	}
+}
+
+func (pp *PodPool) take() *Pod {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if len(pp.ready) == 0 {
+		return nil
+	}
+	pod := pp.ready[0]
+	pp.ready = pp.ready[1:]
+	select {
+	case pp.refill <- struct{}{}:
+	default:
+	}
+	return pod
+}
+
+// put adds pod to pool and returns false if pool is either full or closed.
+func (pp *PodPool) put(pod *Pod) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.closed || len(pp.ready) >= pp.size {
+		return false
+	}
+	pp.ready = append(pp.ready, pod)
+	return true
+}
+
+func (pp *PodPool) missing() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.size - len(pp.ready)
+}
+
+func (pp *PodPool) fill() {
+	defer pp.wg.Done()
+	for {
+		wait := pp.refill
+		var retry <-chan time.Time
+		for pp.missing() > 0 {
+			pod := NewPod(poolPodConfig())
+			if err := pp.spawn(pod); err != nil {
+				glog.Errorf("Could not create pooled pod: %v", err)
+				retry = time.After(poolRetryInterval)
+				wait = nil
+				break
+			}
+			if !pp.put(pod) {
+				if err := pp.remove(pod); err != nil {
+					glog.Errorf("Could not remove pooled pod %s: %v", pod.ID(), err)
+				}
+				break
+			}
+			glog.V(4).Infof("Pooled pod %s is ready", pod.ID())
+		}
+
+		select {
+		case <-wait:
+		case <-retry:
+		case <-pp.done:
+			return
+		}
+	}
+}
+
+// poolPodConfig returns config of pods that are kept in pool. It matches
+// default pod config kubelet sends, except for what is set up on claim.
+func poolPodConfig() *k8s.PodSandboxConfig {
+	return &k8s.PodSandboxConfig{
+		Metadata: &k8s.PodSandboxMetadata{
+			Name: "pooled",
+		},
+		Linux: &k8s.LinuxPodSandboxConfig{
+			SecurityContext: &k8s.LinuxSandboxSecurityContext{
+				NamespaceOptions: &k8s.NamespaceOption{
+					Network: k8s.NamespaceMode_POD,
+					Pid:     k8s.NamespaceMode_CONTAINER,
+					Ipc:     k8s.NamespaceMode_POD,
+				},
+			},
+		},
+	}
+}
+
+// customize makes running pooled pod look as if it was run with passed
+// config: hostname, DNS config and sysctls are set up in its namespaces.
+// Network interface is brought up by SetUpNetwork as usual.
+func (p *Pod) customize(config *k8s.PodSandboxConfig) error {
+	if err := p.UpdateState(); err != nil {
+		return err
+	}
+	if p.runtimeState != runtime.StateRunning {
+		return fmt.Errorf("unexpected pod state: %v", p.runtimeState)
+	}
+
+	p.PodSandboxConfig = config
+	if err := p.validateConfig(); err != nil {
+		return fmt.Errorf("invalid pod config: %v", err)
+	}
+	if err := p.prepareFiles(); err != nil {
+		return fmt.Errorf("could not update pod files: %v", err)
+	}
+
+	uts := specs.LinuxNamespace{
+		Type: specs.UTSNamespace,
+		Path: p.namespacePath(specs.UTSNamespace),
+	}
+	err := namespace.Enter(uts, func() error {
+		return unix.Sethostname([]byte(p.GetHostname()))
+	})
+	if err != nil {
+		return fmt.Errorf("could not set hostname: %v", err)
+	}
+
+	for sysctl, value := range p.GetLinux().GetSysctls() {
+		ns := specs.LinuxNamespace{
+			Type: sysctlNamespace(sysctl),
+		}
+		ns.Path = p.namespacePath(ns.Type)
+		err := namespace.Enter(ns, func() error {
+			path := filepath.Join("/proc/sys", strings.Replace(sysctl, ".", "/", -1))
+			return ioutil.WriteFile(path, []byte(value), 0644)
+		})
+		if err != nil {
+			return fmt.Errorf("could not set sysctl %s: %v", sysctl, err)
+		}
+	}
+	return nil
+}
+
+// sysctlNamespace returns type of namespace sysctl is isolated by, or an
+// empty string if sysctl is not namespaced.
+func sysctlNamespace(sysctl string) specs.LinuxNamespaceType {
+	for prefix, nsType := range sysctlToNs {
+		if strings.HasPrefix(sysctl, prefix) {
+			return nsType
+		}
+	}
+	return ""
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func defaultPodConfig(namespace string, sysctls map[string]string) *k8s.PodSandboxConfig {
+	config := poolPodConfig()
+	config.Metadata = &k8s.PodSandboxMetadata{
+		Name:      "batch",
+		Namespace: namespace,
+	}
+	config.Hostname = "batch"
+	config.Linux.Sysctls = sysctls
+	return config
+}
+
+func TestPoolRules_Eligible(t *testing.T) {
+	rules := PoolRules{
+		Namespaces: []string{"batch", "default"},
+		Sysctls:    []string{"net.ipv4.*", "kernel.shm_rmid_forced", "kernel.panic"},
+	}
+
+	tt := []struct {
+		name     string
+		config   func() *k8s.PodSandboxConfig
+		eligible bool
+	}{
+		{
+			name: "default pod",
+			config: func() *k8s.PodSandboxConfig {
+				return defaultPodConfig("batch", nil)
+			},
+			eligible: true,
+		},
+		{
+			name: "allowed sysctls",
+			config: func() *k8s.PodSandboxConfig {
+				return defaultPodConfig("default", map[string]string{
+					"net.ipv4.ip_forward":    "1",
+					"kernel.shm_rmid_forced": "1",
+				})
+			},
+			eligible: true,
+		},
+		{
+			name: "runtime default seccomp",
+			config: func() *k8s.PodSandboxConfig {
+				config := defaultPodConfig("batch", nil)
+				config.Linux.SecurityContext.SeccompProfilePath = "runtime/default"
+				return config
+			},
+			eligible: true,
+		},
+		{
+			name: "other namespace",
+			config: func() *k8s.PodSandboxConfig {
+				return defaultPodConfig("kube-system", nil)
+			},
+		},
+		{
+			name: "sysctl not allowed",
+			config: func() *k8s.PodSandboxConfig {
+				return defaultPodConfig("batch", map[string]string{"net.core.somaxconn": "1024"})
+			},
+		},
+		{
+			name: "sysctl not namespaced",
+			config: func() *k8s.PodSandboxConfig {
+				return defaultPodConfig("batch", map[string]string{"kernel.panic": "10"})
+			},
+		},
+		{
+			name: "host network",
+			config: func() *k8s.PodSandboxConfig {
+				config := defaultPodConfig("batch", nil)
+				config.Linux.SecurityContext.NamespaceOptions.Network = k8s.NamespaceMode_NODE
+				return config
+			},
+		},
+		{
+			name: "shared PID namespace",
+			config: func() *k8s.PodSandboxConfig {
+				config := defaultPodConfig("batch", nil)
+				config.Linux.SecurityContext.NamespaceOptions.Pid = k8s.NamespaceMode_POD
+				return config
+			},
+		},
+		{
+			name: "no namespace options",
+			config: func() *k8s.PodSandboxConfig {
+				config := defaultPodConfig("batch", nil)
+				config.Linux.SecurityContext = nil
+				return config
+			},
+		},
+		{
+			name: "privileged",
+			config: func() *k8s.PodSandboxConfig {
+				config := defaultPodConfig("batch", nil)
+				config.Linux.SecurityContext.Privileged = true
+				return config
+			},
+		},
+		{
+			name: "run as user",
+			config: func() *k8s.PodSandboxConfig {
+				config := defaultPodConfig("batch", nil)
+				config.Linux.SecurityContext.RunAsUser = &k8s.Int64Value{Value: 1000}
+				return config
+			},
+		},
+		{
+			name: "custom seccomp",
+			config: func() *k8s.PodSandboxConfig {
+				config := defaultPodConfig("batch", nil)
+				config.Linux.SecurityContext.SeccompProfilePath = "localhost/profile.json"
+				return config
+			},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.eligible, rules.Eligible(tc.config()))
+		})
+	}
+
+	require.True(t, PoolRules{}.Eligible(defaultPodConfig("kube-system", nil)), "empty rules should match all namespaces")
+}
+
+type fakePodRuntime struct {
+	mu      sync.Mutex
+	spawned int
+	failing bool
+	removed []string
+}
+
+func (f *fakePodRuntime) spawn(pod *Pod) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return fmt.Errorf("spawn failed")
+	}
+	f.spawned++
+	return nil
+}
+
+func (f *fakePodRuntime) claim(pod *Pod, config *k8s.PodSandboxConfig) error {
+	pod.PodSandboxConfig = config
+	return nil
+}
+
+func (f *fakePodRuntime) remove(pod *Pod) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = append(f.removed, pod.ID())
+	return nil
+}
+
+func (f *fakePodRuntime) state() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.spawned, append([]string(nil), f.removed...)
+}
+
+func TestPodPool(t *testing.T) {
+	pool := NewPodPool("/var/run/singularity/pods", 2, PoolRules{Namespaces: []string{"batch"}})
+	fake := &fakePodRuntime{}
+	pool.spawn = fake.spawn
+	pool.claim = fake.claim
+	pool.remove = fake.remove
+	pool.Start()
+
+	ready := func(n int) func() bool {
+		return func() bool { return pool.Ready() == n }
+	}
+	require.Eventually(t, ready(2), time.Second, time.Millisecond, "pool should be filled")
+
+	require.Nil(t, pool.Claim(defaultPodConfig("default", nil)), "pod of other namespace should not be served")
+	require.Equal(t, 2, pool.Ready())
+
+	config := defaultPodConfig("batch", nil)
+	pod := pool.Claim(config)
+	require.NotNil(t, pod, "pooled pod should be claimed")
+	require.Equal(t, config, pod.PodSandboxConfig)
+	require.Eventually(t, ready(2), time.Second, time.Millisecond, "claimed pod should be replaced")
+	spawned, _ := fake.state()
+	require.Equal(t, 3, spawned)
+
+	fake.mu.Lock()
+	fake.failing = true
+	fake.mu.Unlock()
+	require.NotNil(t, pool.Claim(config))
+	require.NotNil(t, pool.Claim(config))
+	require.Nil(t, pool.Claim(config), "empty pool should not serve pods")
+
+	pool.Close()
+	pool.Close()
+	spawned, removed := fake.state()
+	require.Equal(t, 3, spawned, "pool should not be refilled while pods cannot be created")
+	require.Empty(t, removed)
+
+	pool = NewPodPool("/var/run/singularity/pods", 2, PoolRules{})
+	fake = &fakePodRuntime{}
+	pool.spawn = fake.spawn
+	pool.remove = fake.remove
+	pool.Start()
+	require.Eventually(t, ready(2), time.Second, time.Millisecond, "pool should be filled")
+	pool.Close()
+	spawned, removed = fake.state()
+	require.Equal(t, 2, spawned)
+	require.Len(t, removed, 2, "pods that were not claimed should be removed on close")
+	require.Zero(t, pool.Ready())
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"runtime"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
@@ -126,3 +127,27 @@ func Bind(pid int, ns specs.LinuxNamespace) error {
 	}
 	return nil
 }
+
+// Enter runs fn on a dedicated thread that has joined namespace at ns.Path.
+// Only namespaces that a multithreaded process may join, i.e. UTS, IPC and
+// network ones, are supported. Thread is never returned to the scheduler,
+// so it is terminated once fn returns.
+func Enter(ns specs.LinuxNamespace, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		f, err := os.Open(ns.Path)
+		if err != nil {
+			errCh <- fmt.Errorf("could not open %s: %v", ns.Path, err)
+			return
+		}
+		defer f.Close()
+		if err := unix.Setns(int(f.Fd()), nsToInfo[ns.Type].cloneFlag); err != nil {
+			errCh <- fmt.Errorf("could not join %s namespace: %v", ns.Type, err)
+			return
+		}
+		errCh <- fn()
+	}()
+	return <-errCh
+}
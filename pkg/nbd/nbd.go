@@ -0,0 +1,273 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// ioctl requests of Linux network block device driver, see linux/nbd.h.
+const (
+	nbdSetSock       = 0xab00
+	nbdSetBlockSize  = 0xab01
+	nbdSetSize       = 0xab02
+	nbdDoIt          = 0xab03
+	nbdClearSock     = 0xab04
+	nbdClearQueue    = 0xab05
+	nbdDisconnect    = 0xab08
+	nbdSetFlags      = 0xab0a
+	nbdFlagHasFlags  = 1 << 0
+	nbdFlagReadOnly  = 1 << 1
+	nbdBlockSize     = 512
+	nbdReadyTimeout  = 5 * time.Second
+	nbdReadyInterval = 10 * time.Millisecond
+)
+
+// network block device protocol constants, see linux/nbd.h.
+const (
+	requestMagic = 0x25609513
+	replyMagic   = 0x67446698
+	requestSize  = 28
+
+	cmdRead       = 0
+	cmdWrite      = 1
+	cmdDisconnect = 2
+	cmdFlush      = 3
+	cmdMask       = 0xffff
+
+	errPerm = uint32(unix.EPERM)
+	errIO   = uint32(unix.EIO)
+	errInvl = uint32(unix.EINVAL)
+)
+
+const sysBlockDir = "/sys/block"
+
+// Device is a read-only network block device whose
+// content is served from io.ReaderAt by this process.
+type Device struct {
+	// Path is a path to block device node, e.g. /dev/nbd0.
+	Path string
+
+	f    *os.File
+	conn *os.File
+	done chan struct{}
+}
+
+// Attach attaches size bytes of r to a free network block device. Reads are
+// served in background by the calling process until device is detached, so
+// device fails all reads once the process exits. Nbd kernel module should be loaded.
+func Attach(r io.ReaderAt, size int64) (*Device, error) {
+	path, err := freeDevice()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not create socket pair: %v", err)
+	}
+	kernel := os.NewFile(uintptr(fds[0]), "nbd-kernel")
+	conn := os.NewFile(uintptr(fds[1]), "nbd-server")
+
+	fd := int(f.Fd())
+	for _, ioctl := range []struct {
+		req   uint
+		value int
+	}{
+		{req: nbdSetBlockSize, value: nbdBlockSize},
+		{req: nbdSetSize, value: int(size)},
+		{req: nbdSetFlags, value: nbdFlagHasFlags | nbdFlagReadOnly},
+		{req: nbdSetSock, value: fds[0]},
+	} {
+		if err := unix.IoctlSetInt(fd, ioctl.req, ioctl.value); err != nil {
+			kernel.Close()
+			conn.Close()
+			f.Close()
+			return nil, fmt.Errorf("could not set up %s: ioctl %#x: %v", path, ioctl.req, err)
+		}
+	}
+
+	d := &Device{
+		Path: path,
+		f:    f,
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(d.done)
+		defer kernel.Close()
+		// NBD_DO_IT blocks until device is disconnected
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), nbdDoIt, 0)
+		if errno != 0 {
+			glog.V(4).Infof("Device %s is disconnected: %v", path, errno)
+		}
+		unix.IoctlSetInt(fd, nbdClearQueue, 0)
+		unix.IoctlSetInt(fd, nbdClearSock, 0)
+	}()
+	go func() {
+		if err := serve(conn, r); err != nil {
+			glog.Errorf("Could not serve %s: %v", path, err)
+		}
+	}()
+
+	if err := waitReady(path); err != nil {
+		d.Detach()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Detach disconnects network block device and stops serving it.
+func (d *Device) Detach() error {
+	err := unix.IoctlSetInt(int(d.f.Fd()), nbdDisconnect, 0)
+	if err != nil {
+		err = fmt.Errorf("could not disconnect %s: %v", d.Path, err)
+	}
+	<-d.done
+	d.conn.Close()
+	d.f.Close()
+	return err
+}
+
+// freeDevice returns path to the first network block device
+// that has no process serving it.
+func freeDevice() (string, error) {
+	devices, err := filepath.Glob(filepath.Join(sysBlockDir, "nbd*"))
+	if err != nil {
+		return "", fmt.Errorf("could not list network block devices: %v", err)
+	}
+	if len(devices) == 0 {
+		return "", fmt.Errorf("no network block devices found, nbd kernel module is not loaded")
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return len(devices[i]) < len(devices[j]) ||
+			len(devices[i]) == len(devices[j]) && devices[i] < devices[j]
+	})
+	for _, dev := range devices {
+		if _, err := os.Stat(filepath.Join(dev, "pid")); os.IsNotExist(err) {
+			return filepath.Join("/dev", filepath.Base(dev)), nil
+		}
+	}
+	return "", fmt.Errorf("all %d network block devices are busy", len(devices))
+}
+
+// waitReady waits until kernel starts using network block device located at path.
+func waitReady(path string) error {
+	pidFile := filepath.Join(sysBlockDir, filepath.Base(path), "pid")
+	deadline := time.Now().Add(nbdReadyTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(pidFile); err == nil {
+			return nil
+		}
+		time.Sleep(nbdReadyInterval)
+	}
+	return fmt.Errorf("device %s is not ready after %s", path, nbdReadyTimeout)
+}
+
+// request is a network block device request sent by kernel.
+type request struct {
+	Magic  uint32
+	Type   uint32
+	Handle uint64
+	From   uint64
+	Len    uint32
+}
+
+// reply is a network block device reply header. Data read follows it.
+type reply struct {
+	Magic  uint32
+	Error  uint32
+	Handle uint64
+}
+
+// serve handles requests read from conn until disconnect request is
+// received or conn is closed. Reads are served concurrently from r,
+// other requests except flush are rejected since device is read-only.
+func serve(conn io.ReadWriter, r io.ReaderAt) error {
+	var mu sync.Mutex // serializes replies
+	send := func(handle uint64, errno uint32, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		err := binary.Write(conn, binary.BigEndian, reply{Magic: replyMagic, Error: errno, Handle: handle})
+		if err == nil && errno == 0 && len(data) != 0 {
+			_, err = conn.Write(data)
+		}
+		return err
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		var req request
+		if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return fmt.Errorf("could not read request: %v", err)
+		}
+		if req.Magic != requestMagic {
+			return fmt.Errorf("invalid request magic %#x", req.Magic)
+		}
+
+		switch req.Type & cmdMask {
+		case cmdRead:
+			wg.Add(1)
+			go func(req request) {
+				defer wg.Done()
+				data := make([]byte, req.Len)
+				errno := uint32(0)
+				n, err := r.ReadAt(data, int64(req.From))
+				if n < len(data) {
+					glog.Errorf("Could not read %d bytes at %d: %v", req.Len, req.From, err)
+					errno = errIO
+				}
+				if err := send(req.Handle, errno, data); err != nil {
+					glog.Errorf("Could not send reply: %v", err)
+				}
+			}(req)
+		case cmdWrite:
+			if _, err := io.CopyN(io.Discard, conn, int64(req.Len)); err != nil {
+				return fmt.Errorf("could not skip write data: %v", err)
+			}
+			if err := send(req.Handle, errPerm, nil); err != nil {
+				return fmt.Errorf("could not send reply: %v", err)
+			}
+		case cmdFlush:
+			if err := send(req.Handle, 0, nil); err != nil {
+				return fmt.Errorf("could not send reply: %v", err)
+			}
+		case cmdDisconnect:
+			return nil
+		default:
+			if err := send(req.Handle, errInvl, nil); err != nil {
+				return fmt.Errorf("could not send reply: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServe(t *testing.T) {
+	content := bytes.Repeat([]byte("squashfs"), 1024)
+	kernel, server := net.Pipe()
+	defer kernel.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(server, bytes.NewReader(content))
+		server.Close()
+	}()
+
+	send := func(req request, data []byte) {
+		req.Magic = requestMagic
+		require.NoError(t, binary.Write(kernel, binary.BigEndian, req), "could not send request")
+		if len(data) != 0 {
+			_, err := kernel.Write(data)
+			require.NoError(t, err, "could not send data")
+		}
+	}
+	receive := func(handle uint64, expectError uint32, n int) []byte {
+		var rep reply
+		require.NoError(t, binary.Read(kernel, binary.BigEndian, &rep), "could not read reply")
+		require.Equal(t, uint32(replyMagic), rep.Magic)
+		require.Equal(t, handle, rep.Handle)
+		require.Equal(t, expectError, rep.Error)
+		data := make([]byte, n)
+		_, err := io.ReadFull(kernel, data)
+		require.NoError(t, err, "could not read data")
+		return data
+	}
+
+	send(request{Type: cmdRead, Handle: 1, From: 8, Len: 16}, nil)
+	require.Equal(t, content[8:24], receive(1, 0, 16))
+
+	send(request{Type: cmdRead, Handle: 2, From: uint64(len(content)), Len: 16}, nil)
+	receive(2, errIO, 0)
+
+	send(request{Type: cmdWrite, Handle: 3, From: 0, Len: 4}, []byte("data"))
+	receive(3, errPerm, 0)
+
+	send(request{Type: cmdFlush, Handle: 4}, nil)
+	receive(4, 0, 0)
+
+	send(request{Type: cmdDisconnect, Handle: 5}, nil)
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,412 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+const (
+	// ImportDir is a directory within storage bundles handed to
+	// a running registry are spooled to before they are imported.
+	ImportDir = "import"
+
+	// bundleImagesDir is a directory within bundle image files are stored in.
+	bundleImagesDir = "images"
+
+	// bundleExt is an extension of bundles spooled to import directory.
+	bundleExt = ".tar"
+
+	// maxBundleInfoSize limits size of registry info file read from bundle.
+	maxBundleInfoSize = 64 << 20
+)
+
+// ExportBundle writes images kept in storage along with their metadata, i.e.
+// tags, digests and OCI config, into a single tar stream. Images are selected
+// by tags, digests or IDs passed as refs, all images are exported when refs are
+// empty. Images may be exported while registry that owns storage is running.
+func ExportBundle(storage string, w io.Writer, refs ...string) error {
+	data, err := ioutil.ReadFile(filepath.Join(storage, registryInfoFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read registry info file: %v", err)
+	}
+	records, err := decodeRegistryInfo(data)
+	if err != nil {
+		return fmt.Errorf("could not decode registry info file: %v", err)
+	}
+	images := index.NewImageIndex()
+	for _, info := range decodeImageRecords(records) {
+		if info.MarkedForDeletion() || info.Lazy || info.Ref.URI() == singularity.LocalFileDomain {
+			continue
+		}
+		if err := images.Add(info); err != nil {
+			return fmt.Errorf("could not index image %s: %v", info.ID, err)
+		}
+	}
+
+	selected := make(map[string]*image.Info)
+	if len(refs) == 0 {
+		images.Iterate(func(info *image.Info) {
+			selected[info.ID] = info
+		})
+	}
+	for _, ref := range refs {
+		info, err := images.Find(ref)
+		if err != nil {
+			return fmt.Errorf("could not find image %s: %v", ref, err)
+		}
+		selected[info.ID] = info
+	}
+	infos := make([]*image.Info, 0, len(selected))
+	for _, info := range selected {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	bundleInfo := registryInfo{
+		Version: registryInfoVersion,
+		Images:  make([]json.RawMessage, 0, len(infos)),
+	}
+	for _, info := range infos {
+		record, err := json.Marshal(info)
+		if err != nil {
+			return fmt.Errorf("could not encode image %s: %v", info.ID, err)
+		}
+		bundleInfo.Images = append(bundleInfo.Images, record)
+	}
+	data, err = json.Marshal(bundleInfo)
+	if err != nil {
+		return fmt.Errorf("could not encode registry info: %v", err)
+	}
+
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     registryInfoFile,
+		Mode:     0644,
+		Size:     int64(len(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("could not write registry info header: %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("could not write registry info: %v", err)
+	}
+	for _, info := range infos {
+		if err := writeBundleImage(tw, info); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("could not finish bundle: %v", err)
+	}
+	return nil
+}
+
+func writeBundleImage(tw *tar.Writer, info *image.Info) error {
+	f, err := os.Open(info.Path)
+	if err != nil {
+		return fmt.Errorf("could not open image %s: %v", info.ID, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat image %s: %v", info.ID, err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(bundleImagesDir, info.ID),
+		Mode:     0644,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not write image %s header: %v", info.ID, err)
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("could not write image %s: %v", info.ID, err)
+	}
+	return nil
+}
+
+// ImportBundle restores images of bundle read from r into storage. Images that
+// are already present only get tags and digests of the bundle. ImportBundle must
+// only be used while registry that owns storage is not running, SpoolBundle should
+// be used otherwise. It returns number of images found in bundle.
+func ImportBundle(storage string, r io.Reader) (int, error) {
+	storage, err := filepath.Abs(storage)
+	if err != nil {
+		return 0, fmt.Errorf("could not get absolute storage directory path: %v", err)
+	}
+	if err := os.MkdirAll(storage, 0755); err != nil {
+		return 0, fmt.Errorf("could not create storage directory: %v", err)
+	}
+	registry := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(),
+	}
+	if err := registry.loadInfo(); err != nil {
+		return 0, err
+	}
+	return registry.importBundle(r)
+}
+
+// SpoolBundle hands bundle read from r to a running registry that owns storage
+// by saving it into import directory. Registry imports spooled bundle shortly
+// and removes it afterwards. It returns path of the spooled bundle.
+func SpoolBundle(storage string, r io.Reader) (string, error) {
+	dir := filepath.Join(storage, ImportDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("could not create import directory: %v", err)
+	}
+	f, err := ioutil.TempFile(dir, "bundle-*"+fs.TempSuffix)
+	if err != nil {
+		return "", fmt.Errorf("could not create bundle file: %v", err)
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("could not write bundle file: %v", err)
+	}
+	bundle := strings.TrimSuffix(f.Name(), fs.TempSuffix) + bundleExt
+	if err := os.Rename(f.Name(), bundle); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("could not spool bundle file: %v", err)
+	}
+	return bundle, nil
+}
+
+// startImportDir imports bundles that are already spooled to import
+// directory and starts watching it for new bundles until ctx is done.
+func (s *SingularityRegistry) startImportDir(ctx context.Context) error {
+	dir := filepath.Join(s.storage, ImportDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create import directory: %v", err)
+	}
+	watcher, err := fs.NewWatcher(dir)
+	if err != nil {
+		return fmt.Errorf("could not watch import directory: %v", err)
+	}
+
+	fii, err := ioutil.ReadDir(dir)
+	if err != nil {
+		watcher.Close()
+		return fmt.Errorf("could not read import directory: %v", err)
+	}
+	for _, fi := range fii {
+		path := filepath.Join(dir, fi.Name())
+		switch filepath.Ext(path) {
+		case bundleExt:
+			s.importSpooledBundle(path)
+		case fs.TempSuffix:
+			glog.V(2).Infof("Removing stale import file %s", path)
+			if err := os.Remove(path); err != nil {
+				glog.Errorf("Could not remove stale import file: %v", err)
+			}
+		}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer watcher.Close()
+		for event := range watcher.Watch(ctx) {
+			if event.Op == fs.OpCreate && filepath.Ext(event.Path) == bundleExt {
+				s.importSpooledBundle(event.Path)
+			}
+		}
+	}()
+	return nil
+}
+
+// importSpooledBundle imports bundle located at path and removes it. Bundles
+// that cannot be imported are kept with .corrupt suffix for inspection.
+func (s *SingularityRegistry) importSpooledBundle(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		glog.Errorf("Could not open bundle %s: %v", path, err)
+		return
+	}
+	n, err := s.importBundle(f)
+	f.Close()
+	if err != nil {
+		glog.Errorf("Could not import bundle %s, moving it to %s: %v", path, path+corruptSuffix, err)
+		if err := os.Rename(path, path+corruptSuffix); err != nil {
+			glog.Errorf("Could not move corrupt bundle: %v", err)
+		}
+		return
+	}
+	glog.Infof("Imported %d images from bundle %s", n, path)
+	if err := os.Remove(path); err != nil {
+		glog.Errorf("Could not remove imported bundle: %v", err)
+	}
+}
+
+// importBundle adds images of bundle read from r to storage and index. Bundle
+// starts with registry info file followed by image files named after image IDs.
+// Image files are verified against their checksums before they are added.
+func (s *SingularityRegistry) importBundle(r io.Reader) (int, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return 0, fmt.Errorf("could not read bundle: %v", err)
+	}
+	if hdr.Name != registryInfoFile {
+		return 0, fmt.Errorf("bundle does not start with %s", registryInfoFile)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(tr, maxBundleInfoSize))
+	if err != nil {
+		return 0, fmt.Errorf("could not read registry info: %v", err)
+	}
+	records, err := decodeRegistryInfo(data)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode registry info: %v", err)
+	}
+	bundled := make(map[string]*image.Info)
+	for _, info := range decodeImageRecords(records) {
+		// image id is used as a file name, so it should be a checksum
+		if b, err := hex.DecodeString(info.ID); err != nil || len(b)*2 != image.IDLen {
+			glog.Warningf("Skipping bundled image with malformed id %q", info.ID)
+			continue
+		}
+		// otherwise bundled file would be checked against one checksum
+		// while it is indexed and stored under another image id
+		if info.ID != info.Sha256 {
+			glog.Warningf("Skipping bundled image %s with checksum %s", info.ID, info.Sha256)
+			continue
+		}
+		bundled[info.ID] = info
+	}
+
+	var imported int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("could not read bundle: %v", err)
+		}
+		id := path.Base(hdr.Name)
+		info, ok := bundled[id]
+		if !ok || path.Dir(hdr.Name) != bundleImagesDir {
+			glog.Warningf("Skipping unknown bundle file %s", hdr.Name)
+			continue
+		}
+		delete(bundled, id)
+
+		info.Path = filepath.Join(s.storage, id)
+		if err := s.restoreImage(tr, info); err != nil {
+			return imported, err
+		}
+		if err := s.images.Add(info); err != nil {
+			return imported, fmt.Errorf("could not index image %s: %v", id, err)
+		}
+		imported++
+	}
+	for id := range bundled {
+		glog.Warningf("Image %s file is missing from bundle, skipping it", id)
+	}
+
+	s.updatePins()
+	if err := s.dumpInfo(); err != nil {
+		return imported, fmt.Errorf("could not dump registry info: %v", err)
+	}
+	s.triggerGC()
+	return imported, nil
+}
+
+// restoreImage saves image file read from r to info.Path unless it is already
+// present. File is written to import directory first and is only moved to
+// storage once its checksum matches the one kept in image metadata. Bundled
+// file of present image is still checked, so that bundle cannot tag present
+// image without holding its content. Deletion of previously removed image
+// with the same id is cancelled, see saveImage.
+func (s *SingularityRegistry) restoreImage(r io.Reader, info *image.Info) error {
+	s.m.Lock()
+	s.cancelDeletion(info.ID)
+	_, err := os.Stat(info.Path)
+	s.m.Unlock()
+	if err == nil {
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return fmt.Errorf("could not read image %s: %v", info.ID, err)
+		}
+		if checksum := hex.EncodeToString(h.Sum(nil)); checksum != info.Sha256 {
+			return fmt.Errorf("image %s checksum mismatch: expected %s, got %s", info.ID, info.Sha256, checksum)
+		}
+		glog.V(4).Infof("Image %s is already present, skipping its file", info.ID)
+		return nil
+	}
+
+	dir := filepath.Join(s.storage, ImportDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create import directory: %v", err)
+	}
+	f, err := ioutil.TempFile(dir, info.ID+"-*"+fs.TempSuffix)
+	if err != nil {
+		return fmt.Errorf("could not create image %s file: %v", info.ID, err)
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write image %s: %v", info.ID, err)
+	}
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != info.Sha256 {
+		return fmt.Errorf("image %s checksum mismatch: expected %s, got %s", info.ID, info.Sha256, checksum)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("could not set image %s permissions: %v", info.ID, err)
+	}
+	move := func() error {
+		return os.Rename(f.Name(), info.Path)
+	}
+	if err := s.saveImage(info.ID, move); err != nil {
+		return fmt.Errorf("could not move image %s to storage: %v", info.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+)
+
+func TestBundle(t *testing.T) {
+	src, err := ioutil.TempDir("", "bundle-src-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(src)
+
+	source := &SingularityRegistry{
+		storage: src,
+		images:  index.NewImageIndex(),
+	}
+	addImage := func(content string, digests ...string) *image.Info {
+		id := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+		path := filepath.Join(src, id)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644), "could not write image")
+		ref, err := image.ParseRef("busybox:" + content)
+		require.NoError(t, err, "could not parse reference")
+		ref.AddDigests(digests)
+		info := &image.Info{
+			ID:     id,
+			Sha256: id,
+			Size:   uint64(len(content)),
+			Path:   path,
+			Ref:    ref,
+		}
+		require.NoError(t, source.images.Add(info), "could not add image")
+		return info
+	}
+	addImage("1.28", "busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343")
+	busybox129 := addImage("1.29")
+	busybox130 := addImage("1.30")
+	require.NoError(t, source.dumpInfo(), "could not dump registry info")
+
+	var bundle bytes.Buffer
+	err = ExportBundle(src, &bundle, "busybox:1.28", "busybox:1.29")
+	require.NoError(t, err, "could not export images")
+	err = ExportBundle(src, ioutil.Discard, "busybox:2.0")
+	require.Error(t, err, "unknown image is exported")
+
+	checkImported := func(t *testing.T, registry *SingularityRegistry) {
+		info, err := registry.images.Find("busybox:1.28")
+		require.NoError(t, err, "image is not imported")
+		require.Equal(t, []string{"busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"},
+			info.Ref.Digests(), "image digests are not imported")
+		require.Equal(t, filepath.Join(registry.storage, info.ID), info.Path, "unexpected image path")
+		content, err := ioutil.ReadFile(info.Path)
+		require.NoError(t, err, "could not read imported image")
+		require.Equal(t, "1.28", string(content), "unexpected image content")
+
+		_, err = registry.images.Find("busybox:1.29")
+		require.NoError(t, err, "image is not imported")
+		_, err = registry.images.Find("busybox:1.30")
+		require.Equal(t, index.ErrNotFound, err, "image that is not exported is imported")
+	}
+
+	t.Run("offline import", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "bundle-dst-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(dst)
+
+		n, err := ImportBundle(dst, bytes.NewReader(bundle.Bytes()))
+		require.NoError(t, err, "could not import bundle")
+		require.Equal(t, 2, n, "unexpected number of imported images")
+
+		registry := &SingularityRegistry{
+			storage: dst,
+			images:  index.NewImageIndex(),
+		}
+		require.NoError(t, registry.loadInfo(), "could not load registry info")
+		checkImported(t, registry)
+	})
+
+	t.Run("spooled import", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "bundle-dst-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(dst)
+
+		path, err := SpoolBundle(dst, bytes.NewReader(bundle.Bytes()))
+		require.NoError(t, err, "could not spool bundle")
+		require.Equal(t, filepath.Join(dst, ImportDir), filepath.Dir(path), "unexpected spooled bundle location")
+
+		registry := &SingularityRegistry{
+			storage: dst,
+			images:  index.NewImageIndex(),
+		}
+		registry.importSpooledBundle(path)
+		checkImported(t, registry)
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err), "imported bundle is not removed")
+	})
+
+	t.Run("corrupt image", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "bundle-dst-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(dst)
+
+		corrupt := bytes.Replace(bundle.Bytes(), []byte("1.29\x00"), []byte("1.99\x00"), 1)
+		require.NotEqual(t, bundle.Bytes(), corrupt, "could not corrupt bundle")
+		_, err = ImportBundle(dst, bytes.NewReader(corrupt))
+		require.Error(t, err, "corrupt image is imported")
+		require.Contains(t, err.Error(), "checksum mismatch", "unexpected import error")
+	})
+
+	t.Run("corrupt present image", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "bundle-dst-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(dst)
+		err = ioutil.WriteFile(filepath.Join(dst, busybox129.ID), []byte("1.29"), 0644)
+		require.NoError(t, err, "could not write present image")
+
+		corrupt := bytes.Replace(bundle.Bytes(), []byte("1.29\x00"), []byte("1.99\x00"), 1)
+		_, err = ImportBundle(dst, bytes.NewReader(corrupt))
+		require.Error(t, err, "corrupt image is imported")
+		require.Contains(t, err.Error(), "checksum mismatch", "unexpected import error")
+	})
+
+	t.Run("id not matching checksum", func(t *testing.T) {
+		dst, err := ioutil.TempDir("", "bundle-dst-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(dst)
+		err = ioutil.WriteFile(filepath.Join(dst, busybox130.ID), []byte("1.30"), 0644)
+		require.NoError(t, err, "could not write present image")
+
+		forged, err := ioutil.TempDir("", "bundle-src-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(forged)
+		path := filepath.Join(forged, busybox130.ID)
+		require.NoError(t, ioutil.WriteFile(path, []byte("evil"), 0644), "could not write image")
+		ref, err := image.ParseRef("busybox:evil")
+		require.NoError(t, err, "could not parse reference")
+		registry := &SingularityRegistry{
+			storage: forged,
+			images:  index.NewImageIndex(),
+		}
+		err = registry.images.Add(&image.Info{
+			ID:     busybox130.ID,
+			Sha256: fmt.Sprintf("%x", sha256.Sum256([]byte("evil"))),
+			Size:   4,
+			Path:   path,
+			Ref:    ref,
+		})
+		require.NoError(t, err, "could not add image")
+		require.NoError(t, registry.dumpInfo(), "could not dump registry info")
+		var bundle bytes.Buffer
+		require.NoError(t, ExportBundle(forged, &bundle), "could not export images")
+
+		n, err := ImportBundle(dst, &bundle)
+		require.NoError(t, err, "could not import bundle")
+		require.Equal(t, 0, n, "forged image is imported")
+		registry = &SingularityRegistry{
+			storage: dst,
+			images:  index.NewImageIndex(),
+		}
+		require.NoError(t, registry.loadInfo(), "could not load registry info")
+		_, err = registry.images.Find("busybox:evil")
+		require.Equal(t, index.ErrNotFound, err, "present image is tagged by forged image")
+	})
+}
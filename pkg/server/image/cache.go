@@ -0,0 +1,56 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+// WithLocalCache sets local cache tier that sits in front of storage directory,
+// e.g. on a fast SSD. Images are pulled into storage directory and copied to the
+// cache by runtime when containers are created from them. Copies of removed
+// images are evicted right away. Cache usage is reported by FsStatus.
+func WithLocalCache(cache *image.Cache) Option {
+	return func(s *SingularityRegistry) {
+		s.cache = cache
+	}
+}
+
+// evictCached removes copy of the image with the passed
+// id from local cache tier, if any. Failure is only logged.
+func (s *SingularityRegistry) evictCached(id string) {
+	if s.cache == nil {
+		return
+	}
+	if err := s.cache.Evict(id); err != nil {
+		glog.Errorf("Could not evict image %s from cache: %v", id, err)
+	}
+}
+
+// cacheFsInfo returns info of local cache tier filesystem with
+// usage of cached copies. If there is no cache nil is returned.
+func (s *SingularityRegistry) cacheFsInfo() (*FsInfo, error) {
+	if s.cache == nil {
+		return nil, nil
+	}
+	info, err := dirFsInfo(s.cache.Dir())
+	if err != nil {
+		return nil, fmt.Errorf("could not get image cache filesystem info: %v", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestLocalCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local-cache-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+	storage := filepath.Join(dir, "storage")
+	require.NoError(t, os.Mkdir(storage, 0755), "could not create storage directory")
+
+	cache, err := image.NewCache(filepath.Join(dir, "cache"), 1<<20)
+	require.NoError(t, err, "could not create cache")
+	registry := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(),
+	}
+	WithLocalCache(cache)(registry)
+
+	sum := sha256.Sum256([]byte("busybox"))
+	id := hex.EncodeToString(sum[:])
+	path := filepath.Join(storage, id)
+	require.NoError(t, ioutil.WriteFile(path, []byte("busybox"), 0644), "could not write image")
+	ref, err := image.ParseRef("busybox:1.28")
+	require.NoError(t, err, "could not parse reference")
+	busybox := &image.Info{
+		ID:     id,
+		Sha256: id,
+		Path:   path,
+		Ref:    ref,
+	}
+	require.NoError(t, registry.images.Add(busybox), "could not add image")
+
+	cached, err := cache.Promote(busybox)
+	require.NoError(t, err, "could not promote image")
+
+	resp, err := registry.ImageFsInfo(context.Background(), &k8s.ImageFsInfoRequest{})
+	require.NoError(t, err, "could not get fs info")
+	require.Len(t, resp.ImageFilesystems, 1, "cache tier is reported as image filesystem")
+	fsStatus, ok := registry.FsStatus().(map[string]*FsInfo)
+	require.True(t, ok, "unexpected fs status type")
+	require.Contains(t, fsStatus, "imageCache", "cache tier is not reported")
+
+	status, err := registry.ImageStatus(context.Background(), &k8s.ImageStatusRequest{
+		Image:   &k8s.ImageSpec{Image: "busybox:1.28"},
+		Verbose: true,
+	})
+	require.NoError(t, err, "could not get image status")
+	require.Contains(t, status.Info["info"], cached, "cached copy is not reported")
+
+	_, err = registry.RemoveImage(context.Background(), &k8s.RemoveImageRequest{
+		Image: &k8s.ImageSpec{Image: "busybox:1.28"},
+	})
+	require.NoError(t, err, "could not remove image")
+	_, err = os.Stat(cached)
+	require.True(t, os.IsNotExist(err), "cached copy of removed image is kept")
+	require.Empty(t, cache.Path(id), "removed image is cached")
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+const (
+	// DefaultDropDirInterval is the default period of drop directory rescans.
+	DefaultDropDirInterval = time.Minute
+
+	// dropSettleTime is how long a file in drop directory should stay
+	// unmodified before it is imported, so that files that are still
+	// being copied are not hashed.
+	dropSettleTime = 5 * time.Second
+
+	// sifExt is an extension of SIF files that are imported from drop directory.
+	sifExt = ".sif"
+)
+
+// dropDir imports SIF images that are copied into a watched directory
+// and unregisters them once files are removed.
+type dropDir struct {
+	path      string
+	tagPrefix string
+	interval  time.Duration
+
+	mu       sync.Mutex
+	imported map[string]dropFile
+}
+
+// dropFile describes an imported file of drop directory.
+type dropFile struct {
+	id      string
+	tag     string
+	size    int64
+	modTime time.Time
+}
+
+// WithDropDir enables import of SIF images from the directory located at path.
+// Images are tagged with tagPrefix followed by a file name without .sif extension,
+// e.g. registry.local/busybox:1.0 for busybox:1.0.sif. When tagPrefix is empty
+// images are tagged with their local.file references. Directory is rescanned
+// on changes and every interval. If interval is zero DefaultDropDirInterval is used.
+func WithDropDir(path, tagPrefix string, interval time.Duration) Option {
+	return func(s *SingularityRegistry) {
+		if interval == 0 {
+			interval = DefaultDropDirInterval
+		}
+		s.drop = &dropDir{
+			path:      filepath.Clean(path),
+			tagPrefix: strings.TrimSuffix(tagPrefix, "/"),
+			interval:  interval,
+			imported:  make(map[string]dropFile),
+		}
+	}
+}
+
+// startDropDir imports images that are already present in drop directory
+// and starts watching it for changes until ctx is done.
+func (s *SingularityRegistry) startDropDir(ctx context.Context) error {
+	watcher, err := fs.NewWatcher(s.drop.path)
+	if err != nil {
+		return fmt.Errorf("could not watch drop directory: %v", err)
+	}
+	pending, err := s.scanDropDir()
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer watcher.Close()
+		s.runDropDir(ctx, watcher.Watch(ctx), pending)
+	}()
+	return nil
+}
+
+// runDropDir rescans drop directory periodically and shortly after
+// its content changes. It returns when ctx is done.
+func (s *SingularityRegistry) runDropDir(ctx context.Context, events <-chan fs.WatchEvent, pending bool) {
+	ticker := time.NewTicker(s.drop.interval)
+	defer ticker.Stop()
+
+	var settle <-chan time.Time
+	if pending {
+		settle = time.After(dropSettleTime)
+	}
+	for {
+		select {
+		case event := <-events:
+			if filepath.Ext(event.Path) != sifExt {
+				continue
+			}
+			glog.V(4).Infof("Drop directory file %s changed", event.Path)
+			if settle == nil {
+				settle = time.After(dropSettleTime)
+			}
+			continue
+		case <-settle:
+			settle = nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		pending, err := s.scanDropDir()
+		if err != nil {
+			glog.Errorf("Could not scan drop directory: %v", err)
+		}
+		if pending && settle == nil {
+			settle = time.After(dropSettleTime)
+		}
+	}
+}
+
+// scanDropDir imports new and modified SIF files of drop directory and
+// unregisters images whose files were removed, unless they are used.
+// It returns true if some files were modified too recently to be imported.
+func (s *SingularityRegistry) scanDropDir() (bool, error) {
+	files, err := ioutil.ReadDir(s.drop.path)
+	if err != nil {
+		return false, fmt.Errorf("could not read drop directory: %v", err)
+	}
+
+	s.drop.mu.Lock()
+	defer s.drop.mu.Unlock()
+
+	var pending bool
+	present := make(map[string]bool)
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != sifExt {
+			continue
+		}
+		path := filepath.Join(s.drop.path, fi.Name())
+		present[path] = true
+
+		old, ok := s.drop.imported[path]
+		if ok && old.size == fi.Size() && old.modTime.Equal(fi.ModTime()) {
+			continue
+		}
+		if time.Since(fi.ModTime()) < dropSettleTime {
+			pending = true
+			continue
+		}
+		if ok {
+			if !s.unregisterDropFile(old) {
+				continue
+			}
+			delete(s.drop.imported, path)
+		}
+
+		tag := s.dropTag(path)
+		info, err := image.LocalInfo(path, tag)
+		if err != nil {
+			glog.Errorf("Could not import %s: %v", path, err)
+			continue
+		}
+		if err := s.images.Add(info); err != nil {
+			glog.Errorf("Could not add %s to index: %v", path, err)
+			continue
+		}
+		glog.V(2).Infof("Imported %s from drop directory as %s", path, tag)
+		s.drop.imported[path] = dropFile{
+			id:      info.ID,
+			tag:     info.Ref.Tags()[0],
+			size:    fi.Size(),
+			modTime: fi.ModTime(),
+		}
+	}
+
+	for path, f := range s.drop.imported {
+		if present[path] {
+			continue
+		}
+		if s.unregisterDropFile(f) {
+			glog.V(2).Infof("Unregistered image %s of removed %s", f.id, path)
+			delete(s.drop.imported, path)
+		}
+	}
+	return pending, nil
+}
+
+// unregisterDropFile removes tag of image imported from drop directory. Image
+// itself is removed from index only if it is not referenced otherwise, e.g. when
+// the same image was also pulled. It returns false if image is used and cannot
+// be unregistered yet.
+func (s *SingularityRegistry) unregisterDropFile(f dropFile) bool {
+	info, err := s.images.Find(f.id)
+	if err == index.ErrNotFound {
+		return true
+	}
+	if err != nil {
+		glog.Errorf("Could not find image %s: %v", f.id, err)
+		return false
+	}
+	var tagged bool
+	var refs []string
+	for _, tag := range info.Ref.Tags() {
+		if tag == f.tag {
+			tagged = true
+			continue
+		}
+		refs = append(refs, tag)
+	}
+	refs = append(refs, info.Ref.Digests()...)
+	if len(refs) != 0 {
+		// the same image was pulled, it is not backed by drop directory file
+		if tagged {
+			glog.V(4).Infof("Image %s is also referenced as %v, removing tag %s only", f.id, refs, f.tag)
+			s.images.RemoveTag(f.tag)
+		}
+		return true
+	}
+	if len(info.UsedBy()) != 0 {
+		glog.V(4).Infof("Image %s is used, postponing unregister", f.id)
+		return false
+	}
+	if err := s.images.Remove(f.id); err != nil {
+		glog.Errorf("Could not remove image %s from index: %v", f.id, err)
+		return false
+	}
+	return true
+}
+
+// dropTag returns tag image imported from the file located at path is referenced with.
+func (s *SingularityRegistry) dropTag(path string) string {
+	if s.drop.tagPrefix == "" {
+		return singularity.LocalFileDomain + path
+	}
+	return s.drop.tagPrefix + "/" + strings.TrimSuffix(filepath.Base(path), sifExt)
+}
+
+// isDropImage returns true if image was imported from drop directory.
+func (s *SingularityRegistry) isDropImage(info *image.Info) bool {
+	return s.drop != nil &&
+		info.Ref.URI() == singularity.LocalFileDomain &&
+		filepath.Dir(info.Path) == s.drop.path
+}
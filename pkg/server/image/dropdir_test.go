@@ -0,0 +1,134 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+func TestScanDropDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drop-dir-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-time.Hour)
+	writeFile := func(name, content string, modTime time.Time) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644), "could not write file")
+		require.NoError(t, os.Chtimes(path, modTime, modTime), "could not set file time")
+		return path
+	}
+	busybox := writeFile("busybox:1.0.sif", "busybox", old)
+	alpine := writeFile("alpine.sif", "alpine", old)
+	writeFile("notes.txt", "not an image", old)
+	fresh := writeFile("fresh.sif", "still copying", time.Now())
+
+	t.Run("tag prefix", func(t *testing.T) {
+		registry := &SingularityRegistry{
+			images: index.NewImageIndex(),
+		}
+		WithDropDir(dir, "registry.local/", 0)(registry)
+
+		pending, err := registry.scanDropDir()
+		require.NoError(t, err, "could not scan drop directory")
+		require.True(t, pending, "recently modified file is not reported")
+
+		info, err := registry.images.Find("registry.local/busybox:1.0")
+		require.NoError(t, err, "image is not imported")
+		require.Equal(t, busybox, info.Path)
+		require.Equal(t, singularity.LocalFileDomain, info.Ref.URI())
+		require.True(t, registry.isDropImage(info), "image is not recognized as imported")
+		_, err = registry.images.Find("registry.local/alpine")
+		require.NoError(t, err, "image is not imported")
+		_, err = registry.images.Find("registry.local/fresh")
+		require.Equal(t, index.ErrNotFound, err, "recently modified file is imported")
+		_, err = registry.images.Find("registry.local/notes.txt")
+		require.Equal(t, index.ErrNotFound, err, "non-SIF file is imported")
+
+		info.Borrow("container")
+		require.NoError(t, os.Remove(busybox), "could not remove file")
+		_, err = registry.scanDropDir()
+		require.NoError(t, err, "could not scan drop directory")
+		_, err = registry.images.Find("registry.local/busybox:1.0")
+		require.NoError(t, err, "used image is unregistered")
+
+		info.Return("container")
+		_, err = registry.scanDropDir()
+		require.NoError(t, err, "could not scan drop directory")
+		_, err = registry.images.Find("registry.local/busybox:1.0")
+		require.Equal(t, index.ErrNotFound, err, "image of removed file is not unregistered")
+		writeFile("busybox:1.0.sif", "busybox", old)
+	})
+
+	t.Run("local file tags", func(t *testing.T) {
+		require.NoError(t, os.Remove(fresh), "could not remove file")
+
+		registry := &SingularityRegistry{
+			images: index.NewImageIndex(),
+		}
+		WithDropDir(dir, "", 0)(registry)
+
+		pending, err := registry.scanDropDir()
+		require.NoError(t, err, "could not scan drop directory")
+		require.False(t, pending, "unexpected pending files")
+
+		info, err := registry.images.Find(singularity.LocalFileDomain + alpine)
+		require.NoError(t, err, "image is not imported")
+		require.Equal(t, alpine, info.Path)
+
+		writeFile("alpine.sif", "alpine 3.9", old.Add(time.Minute))
+		_, err = registry.scanDropDir()
+		require.NoError(t, err, "could not scan drop directory")
+		updated, err := registry.images.Find(singularity.LocalFileDomain + alpine)
+		require.NoError(t, err, "modified image is not imported")
+		require.NotEqual(t, info.ID, updated.ID, "modified image is not reimported")
+		_, err = registry.images.Find(info.ID)
+		require.Equal(t, index.ErrNotFound, err, "previous image is not unregistered")
+	})
+
+	t.Run("pulled image", func(t *testing.T) {
+		registry := &SingularityRegistry{
+			images: index.NewImageIndex(),
+		}
+		WithDropDir(dir, "registry.local/", 0)(registry)
+
+		_, err := registry.scanDropDir()
+		require.NoError(t, err, "could not scan drop directory")
+		info, err := registry.images.Find("registry.local/alpine")
+		require.NoError(t, err, "image is not imported")
+
+		ref, err := image.ParseRef("alpine:3.9")
+		require.NoError(t, err, "could not parse reference")
+		require.NoError(t, registry.images.Add(&image.Info{ID: info.ID, Ref: ref}), "could not add pulled image")
+
+		require.NoError(t, os.Remove(alpine), "could not remove file")
+		_, err = registry.scanDropDir()
+		require.NoError(t, err, "could not scan drop directory")
+		_, err = registry.images.Find("registry.local/alpine")
+		require.Equal(t, index.ErrNotFound, err, "tag of removed file is kept")
+		pulled, err := registry.images.Find("alpine:3.9")
+		require.NoError(t, err, "pulled image is unregistered")
+		require.Equal(t, []string{"alpine:3.9"}, pulled.Ref.Tags(), "unexpected image tags")
+	})
+}
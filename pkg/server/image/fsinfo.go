@@ -0,0 +1,136 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// FsInfo holds usage and capacity of a filesystem.
+type FsInfo struct {
+	// MountPoint is the mount point of the filesystem.
+	MountPoint string `json:"mountPoint"`
+	// UsedBytes is space used by images or containers on the filesystem.
+	UsedBytes uint64 `json:"usedBytes"`
+	// UsedInodes is a number of inodes used by images or containers on the filesystem.
+	UsedInodes uint64 `json:"usedInodes"`
+	// CapacityBytes is the total size of the filesystem.
+	CapacityBytes uint64 `json:"capacityBytes"`
+	// AvailableBytes is the space left on the filesystem.
+	AvailableBytes uint64 `json:"availableBytes"`
+	// CapacityInodes is the total number of inodes on the filesystem.
+	CapacityInodes uint64 `json:"capacityInodes"`
+	// FreeInodes is the number of inodes left on the filesystem.
+	FreeInodes uint64 `json:"freeInodes"`
+}
+
+// WithContainerDir sets directory where container bundles and writable layers
+// are stored. When it resides on a filesystem other than image storage,
+// its usage is reported by FsStatus separately.
+func WithContainerDir(dir string) Option {
+	return func(s *SingularityRegistry) {
+		s.containerDir = dir
+	}
+}
+
+// FsStatus returns usage and capacity of image filesystem, local cache
+// tier filesystem and, if it differs, filesystem containers are stored on.
+// CRI v1alpha2 ImageFsInfo cannot carry this data, see ImageFsInfo.
+func (s *SingularityRegistry) FsStatus() interface{} {
+	imageFs, containerFs, err := s.fsInfo()
+	if err != nil {
+		glog.Errorf("Could not get filesystem info: %v", err)
+		return nil
+	}
+
+	status := map[string]*FsInfo{
+		"image": imageFs,
+	}
+	if containerFs != nil {
+		status["container"] = containerFs
+	}
+	cacheFs, err := s.cacheFsInfo()
+	if err != nil {
+		glog.Errorf("Could not get filesystem info: %v", err)
+	}
+	if cacheFs != nil {
+		status["imageCache"] = cacheFs
+	}
+	return status
+}
+
+// fsInfo returns image filesystem info. When containers are stored on a
+// different filesystem its info is returned as well, otherwise it is nil.
+func (s *SingularityRegistry) fsInfo() (*FsInfo, *FsInfo, error) {
+	imageFs, err := dirFsInfo(s.storage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get image filesystem info: %v", err)
+	}
+	if s.containerDir == "" {
+		return imageFs, nil, nil
+	}
+
+	containerFs, err := dirFsInfo(s.containerDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get container filesystem info: %v", err)
+	}
+	if containerFs.MountPoint == imageFs.MountPoint {
+		return imageFs, nil, nil
+	}
+	return imageFs, containerFs, nil
+}
+
+// dirFsInfo returns usage of dir together with capacity
+// of the filesystem dir is located on.
+func dirFsInfo(dir string) (*FsInfo, error) {
+	usage, err := fs.Usage(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not get fs usage: %v", err)
+	}
+	capacity, err := fs.Capacity(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not get fs capacity: %v", err)
+	}
+	return &FsInfo{
+		MountPoint:     usage.MountPoint,
+		UsedBytes:      uint64(usage.Bytes),
+		UsedInodes:     uint64(usage.Inodes),
+		CapacityBytes:  capacity.Bytes,
+		AvailableBytes: capacity.AvailableBytes,
+		CapacityInodes: capacity.Inodes,
+		FreeInodes:     capacity.FreeInodes,
+	}, nil
+}
+
+// filesystemUsage converts info into k8s filesystem usage.
+func filesystemUsage(info *FsInfo, timestamp time.Time) *k8s.FilesystemUsage {
+	return &k8s.FilesystemUsage{
+		Timestamp: timestamp.UnixNano(),
+		FsId: &k8s.FilesystemIdentifier{
+			Mountpoint: info.MountPoint,
+		},
+		UsedBytes: &k8s.UInt64Value{
+			Value: info.UsedBytes,
+		},
+		InodesUsed: &k8s.UInt64Value{
+			Value: info.UsedInodes,
+		},
+	}
+}
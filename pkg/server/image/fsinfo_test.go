@@ -0,0 +1,65 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestImageFsInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs-info-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	storage := filepath.Join(dir, "storage")
+	containers := filepath.Join(dir, "containers")
+	require.NoError(t, os.Mkdir(storage, 0755), "could not create storage")
+	require.NoError(t, os.Mkdir(containers, 0755), "could not create container directory")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(storage, "image"), []byte("busybox"), 0644), "could not write image")
+
+	registry := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(),
+	}
+	WithContainerDir(containers)(registry)
+
+	resp, err := registry.ImageFsInfo(context.Background(), &k8s.ImageFsInfoRequest{})
+	require.NoError(t, err, "could not get fs info")
+	// v1alpha2 has neither capacity fields nor container filesystem entries,
+	// kubelet learns image filesystem capacity from the mount point
+	require.Len(t, resp.ImageFilesystems, 1, "unexpected image filesystems")
+	imageFs := resp.ImageFilesystems[0]
+
+	fsStatus, ok := registry.FsStatus().(map[string]*FsInfo)
+	require.True(t, ok, "unexpected fs status type")
+	require.NotContains(t, fsStatus, "container", "container directory on image filesystem is reported separately")
+	status := fsStatus["image"]
+	require.NotNil(t, status, "image filesystem is not reported")
+	require.Equal(t, status.MountPoint, imageFs.FsId.Mountpoint, "unexpected image filesystem mount point")
+	require.Equal(t, status.UsedBytes, imageFs.UsedBytes.Value, "unexpected image filesystem usage")
+	require.Equal(t, status.UsedInodes, imageFs.InodesUsed.Value, "unexpected image filesystem inodes")
+	require.NotZero(t, status.UsedBytes, "image usage is not counted")
+	require.NotZero(t, status.CapacityBytes, "image filesystem capacity is not reported")
+	require.True(t, status.AvailableBytes <= status.CapacityBytes, "available space exceeds capacity")
+	require.True(t, status.FreeInodes <= status.CapacityInodes, "free inodes exceed capacity")
+}
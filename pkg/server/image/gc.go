@@ -0,0 +1,286 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+// DefaultGCInterval is the default period of image garbage collection checks.
+const DefaultGCInterval = 5 * time.Minute
+
+// GCStatus holds information about image garbage collection.
+type GCStatus struct {
+	// HighWatermark is storage usage in bytes that triggers garbage collection.
+	HighWatermark uint64 `json:"highWatermark"`
+	// LowWatermark is storage usage in bytes garbage collection tries to reach.
+	LowWatermark uint64 `json:"lowWatermark"`
+	// Runs is a number of garbage collections performed since startup.
+	Runs int `json:"runs"`
+	// LastRun is the time of the last garbage collection.
+	LastRun time.Time `json:"lastRun"`
+	// LastRemoved holds IDs of images removed during the last garbage collection.
+	LastRemoved []string `json:"lastRemoved,omitempty"`
+	// LastFreedBytes is a number of bytes freed during the last garbage collection.
+	LastFreedBytes uint64 `json:"lastFreedBytes"`
+	// TotalFreedBytes is a number of bytes freed since startup.
+	TotalFreedBytes uint64 `json:"totalFreedBytes"`
+	// LastError holds an error that happened during the last garbage collection, if any.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// imageGC removes unused images least recently used first when
+// storage usage crosses high watermark.
+type imageGC struct {
+	high     uint64
+	low      uint64
+	interval time.Duration
+	trigger  chan struct{}
+
+	mu     sync.Mutex
+	status GCStatus
+}
+
+// WithGC enables image garbage collection. Once image storage usage exceeds
+// high watermark unused images are removed least recently used first until
+// usage is below low watermark. Storage usage is checked every interval and
+// after each image pull. If interval is zero DefaultGCInterval is used.
+func WithGC(high, low uint64, interval time.Duration) Option {
+	return func(s *SingularityRegistry) {
+		if interval == 0 {
+			interval = DefaultGCInterval
+		}
+		s.gc = &imageGC{
+			high:     high,
+			low:      low,
+			interval: interval,
+			trigger:  make(chan struct{}, 1),
+			status: GCStatus{
+				HighWatermark: high,
+				LowWatermark:  low,
+			},
+		}
+	}
+}
+
+// GCStatus returns information about image garbage collection. If
+// garbage collection is disabled nil is returned.
+func (s *SingularityRegistry) GCStatus() interface{} {
+	if s.gc == nil {
+		return nil
+	}
+
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+
+	status := s.gc.status
+	status.LastRemoved = append([]string(nil), s.gc.status.LastRemoved...)
+	return status
+}
+
+// triggerGC schedules garbage collection check without waiting for it to complete.
+func (s *SingularityRegistry) triggerGC() {
+	if s.gc == nil {
+		return
+	}
+	select {
+	case s.gc.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// runGC checks storage usage periodically or when triggered
+// and collects garbage if needed. It returns when ctx is done.
+func (s *SingularityRegistry) runGC(ctx context.Context) {
+	ticker := time.NewTicker(s.gc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.gc.trigger:
+		case <-ctx.Done():
+			return
+		}
+		if err := s.collectGarbage(); err != nil {
+			glog.Errorf("Image garbage collection failed: %v", err)
+		}
+	}
+}
+
+// collectGarbage removes unused images least recently used first until
+// storage usage is below low watermark. It does nothing unless storage
+// usage exceeds high watermark.
+func (s *SingularityRegistry) collectGarbage() error {
+	usage, err := fs.Usage(s.storage)
+	if err != nil {
+		return fmt.Errorf("could not get storage usage: %v", err)
+	}
+	used := uint64(usage.Bytes)
+	if used <= s.gc.high {
+		glog.V(5).Infof("Image storage usage %d is below high watermark %d, skipping garbage collection", used, s.gc.high)
+		return nil
+	}
+
+	glog.Infof("Image storage usage %d exceeds high watermark %d, collecting garbage", used, s.gc.high)
+	var changed bool
+	var removed []string
+	var freed uint64
+	var gcErr error
+	for _, c := range s.gcCandidates() {
+		if used <= s.gc.low {
+			break
+		}
+		info := c.info
+		collected, err := s.collectImage(c)
+		if err == image.ErrIsUsed || err == errNotGarbage {
+			continue
+		}
+		if err != nil {
+			gcErr = fmt.Errorf("could not remove image %s: %v", info.ID, err)
+			glog.Errorf("Skipping image during garbage collection: %v", gcErr)
+			continue
+		}
+		changed = true
+		if !collected {
+			glog.V(2).Infof("Image %s became used by %v during garbage collection, marked it for deletion", info.ID, info.UsedBy())
+			continue
+		}
+		glog.V(2).Infof("Garbage collected image %s (%s), last used at %s", info.ID, info.Ref, c.lastUsed)
+		removed = append(removed, info.ID)
+		freed += info.Size
+		if info.Size > used {
+			used = 0
+		} else {
+			used -= info.Size
+		}
+	}
+	if changed {
+		if err := s.dumpInfo(); err != nil {
+			glog.Errorf("Could not dump registry info: %v", err)
+		}
+	}
+	if used > s.gc.low {
+		glog.Warningf("Image storage usage %d is still above low watermark %d after garbage collection", used, s.gc.low)
+	}
+	glog.Infof("Image garbage collection removed %d images and freed %d bytes", len(removed), freed)
+
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+	s.gc.status.Runs++
+	s.gc.status.LastRun = time.Now()
+	s.gc.status.LastRemoved = removed
+	s.gc.status.LastFreedBytes = freed
+	s.gc.status.TotalFreedBytes += freed
+	s.gc.status.LastError = ""
+	if gcErr != nil {
+		s.gc.status.LastError = gcErr.Error()
+	}
+	return gcErr
+}
+
+// errNotGarbage is returned by collectImage when image was pinned, removed
+// or pulled again after it had been selected for garbage collection.
+var errNotGarbage = fmt.Errorf("image is no longer garbage")
+
+// gcCandidate is an image selected for garbage collection.
+type gcCandidate struct {
+	info     *image.Info
+	lastUsed time.Time
+	modTime  time.Time
+}
+
+// collectImage removes image selected for garbage collection from index and local
+// cache tier under registry lock. Image file is removed right away unless a container
+// started to use image after it was selected, then file is removed once the last such
+// container is removed, just like with RemoveImage. Files of shared storage are only
+// removed once all nodes have synced, see WithSharedStorage. It returns true if image
+// is collected right away.
+func (s *SingularityRegistry) collectImage(c gcCandidate) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	info := c.info
+	if found, err := s.images.Find(info.ID); err != nil || found != info || info.Pinned() {
+		return false, errNotGarbage
+	}
+	// pulled image is moved into place under registry lock, see saveImage
+	if fi, err := os.Stat(info.Path); err != nil || !fi.ModTime().Equal(c.modTime) {
+		return false, errNotGarbage
+	}
+
+	if s.shared != nil {
+		if err := s.removeShared(info, false); err != nil {
+			return false, err
+		}
+		s.evictCached(info.ID)
+		return true, nil
+	}
+	removed, err := info.RemoveWhenUnused()
+	if err != nil {
+		return false, err
+	}
+	if err := s.images.Remove(info.ID); err != nil {
+		glog.Errorf("Could not remove image %s from index: %v", info.ID, err)
+	}
+	s.evictCached(info.ID)
+	if !removed {
+		s.deleteLater(info)
+	}
+	return removed, nil
+}
+
+// gcCandidates returns images that may be garbage collected
+// sorted by last usage time, least recently used first.
+func (s *SingularityRegistry) gcCandidates() []gcCandidate {
+	var candidates []gcCandidate
+	s.images.Iterate(func(info *image.Info) {
+		if info.Ref.URI() == singularity.LocalFileDomain {
+			return
+		}
+		if info.Pinned() || len(info.UsedBy()) != 0 {
+			return
+		}
+		fi, err := os.Stat(info.Path)
+		if err != nil {
+			return
+		}
+		c := gcCandidate{
+			info:     info,
+			lastUsed: info.LastUsed(),
+			modTime:  fi.ModTime(),
+		}
+		if c.lastUsed.IsZero() {
+			// images that were never used by any container
+			// are considered to be used when they were pulled
+			c.lastUsed = c.modTime
+		}
+		candidates = append(candidates, c)
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+	return candidates
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-gc-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+
+	const imageSize = 1000
+	now := time.Now()
+	addImage := func(name string, age time.Duration) *image.Info {
+		id := strings.Repeat(name, image.IDLen)
+		path := filepath.Join(dir, id)
+		err := ioutil.WriteFile(path, bytes.Repeat([]byte{'x'}, imageSize), 0644)
+		require.NoError(t, err, "could not create image file")
+		require.NoError(t, os.Chtimes(path, now.Add(-age), now.Add(-age)), "could not set image time")
+
+		ref, err := image.ParseRef("busybox:" + name)
+		require.NoError(t, err, "could not parse image reference")
+		info := &image.Info{
+			ID:     id,
+			Sha256: id,
+			Size:   imageSize,
+			Path:   path,
+			Ref:    ref,
+		}
+		require.NoError(t, registry.images.Add(info), "could not add image to index")
+		return info
+	}
+
+	oldest := addImage("a", 5*time.Hour)
+	older := addImage("b", 4*time.Hour)
+	newest := addImage("c", time.Hour)
+	pinned := addImage("d", 10*time.Hour)
+	pinned.Pin()
+	used := addImage("e", 10*time.Hour)
+	used.Borrow("container")
+
+	usage, err := fs.Usage(dir)
+	require.NoError(t, err, "could not get storage usage")
+
+	WithGC(uint64(usage.Bytes)-1, uint64(usage.Bytes)-imageSize*3/2, 0)(registry)
+	require.NoError(t, registry.collectGarbage(), "could not collect garbage")
+
+	for _, info := range []*image.Info{oldest, older} {
+		_, err := registry.images.Find(info.ID)
+		require.Equal(t, index.ErrNotFound, err, "image %s is not removed from index", info.ID)
+		_, err = os.Stat(info.Path)
+		require.True(t, os.IsNotExist(err), "image %s is not removed from disk", info.ID)
+	}
+	for _, info := range []*image.Info{newest, pinned, used} {
+		_, err := registry.images.Find(info.ID)
+		require.NoError(t, err, "image %s is removed from index", info.ID)
+		require.FileExists(t, info.Path)
+	}
+
+	status := registry.GCStatus().(GCStatus)
+	require.Equal(t, 1, status.Runs)
+	require.Equal(t, []string{oldest.ID, older.ID}, status.LastRemoved)
+	require.Equal(t, uint64(2*imageSize), status.LastFreedBytes)
+	require.Empty(t, status.LastError)
+
+	// usage is now below high watermark, nothing should be removed
+	require.NoError(t, registry.collectGarbage(), "could not collect garbage")
+	status = registry.GCStatus().(GCStatus)
+	require.Equal(t, 1, status.Runs)
+	_, err = registry.images.Find(newest.ID)
+	require.NoError(t, err, "image is removed from index")
+}
+
+func TestCollectImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-gc-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	addImage := func(name string) *image.Info {
+		id := strings.Repeat(name, image.IDLen)
+		path := filepath.Join(dir, id)
+		require.NoError(t, ioutil.WriteFile(path, []byte(name), 0644), "could not create image file")
+		ref, err := image.ParseRef("busybox:" + name)
+		require.NoError(t, err, "could not parse image reference")
+		info := &image.Info{
+			ID:     id,
+			Sha256: id,
+			Path:   path,
+			Ref:    ref,
+		}
+		require.NoError(t, registry.images.Add(info), "could not add image to index")
+		return info
+	}
+	candidate := func(info *image.Info) gcCandidate {
+		for _, c := range registry.gcCandidates() {
+			if c.info == info {
+				return c
+			}
+		}
+		t.Fatalf("image %s is not a candidate", info.ID)
+		return gcCandidate{}
+	}
+
+	pinned := addImage("a")
+	c := candidate(pinned)
+	pinned.Pin()
+	_, err = registry.collectImage(c)
+	require.Equal(t, errNotGarbage, err, "image pinned after selection is collected")
+
+	replaced := addImage("b")
+	c = candidate(replaced)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(replaced.Path, later, later), "could not set image time")
+	_, err = registry.collectImage(c)
+	require.Equal(t, errNotGarbage, err, "image pulled again after selection is collected")
+	require.FileExists(t, replaced.Path)
+
+	used := addImage("c")
+	c = candidate(used)
+	used.Borrow("container")
+	collected, err := registry.collectImage(c)
+	require.NoError(t, err, "could not collect image")
+	require.False(t, collected, "image used after selection is collected right away")
+	require.FileExists(t, used.Path)
+	_, err = registry.images.Find(used.ID)
+	require.Equal(t, index.ErrNotFound, err, "collected image is not removed from index")
+	used.Return("container")
+	_, err = os.Stat(used.Path)
+	require.True(t, os.IsNotExist(err), "image marked for deletion is not removed once unused")
+}
@@ -18,7 +18,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -28,7 +27,6 @@ import (
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/sylabs/singularity-cri/pkg/fs"
 	"github.com/sylabs/singularity-cri/pkg/image"
 	"github.com/sylabs/singularity-cri/pkg/index"
 	"github.com/sylabs/singularity-cri/pkg/singularity"
@@ -37,20 +35,111 @@ import (
 	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
 )
 
-const registryInfoFile = "registry.json"
+// digestTimeout limits time spent on resolving docker manifest digest.
+const digestTimeout = 30 * time.Second
 
 // SingularityRegistry implements k8s ImageService interface.
 type SingularityRegistry struct {
 	storage string // path to image storage without trailing slash
 	images  *index.ImageIndex
 
-	m        sync.Mutex
-	infoFile *os.File
+	pullTimeout      time.Duration
+	registryTimeouts map[string]time.Duration
+	pullRetries      int
+	pullBackoff      time.Duration
+	pullMaxBackoff   time.Duration
+
+	platforms      []image.Platform
+	verifyPolicies []image.VerifyPolicy
+	libraries      map[string]LibraryEndpoint
+	build          *image.BuildConfig
+	credentials    image.CredentialResolver
+	lazy           bool
+	cache          *image.Cache
+
+	containerDir string
+
+	gc    *imageGC
+	drop  *dropDir
+	scrub *scrubber
+
+	preload []string
+	pins    map[string]bool // references of preloaded images
+
+	shared *sharedStore
+
+	m        sync.Mutex             // serializes registry info file writes, guards deleting
+	deleting map[string]*image.Info // removed images that are still used by containers
+
+	ctx    context.Context // done on shutdown
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Option is run during SingularityRegistry initialization.
+// Predefined options may be used to tune image pull behaviour.
+type Option func(s *SingularityRegistry)
+
+// WithPullTimeout limits duration of a single pull attempt. Timeouts for
+// specific registry domains may be set with perRegistry, they override
+// the default timeout. Zero timeout means pull is not limited in time.
+func WithPullTimeout(timeout time.Duration, perRegistry map[string]time.Duration) Option {
+	return func(s *SingularityRegistry) {
+		s.pullTimeout = timeout
+		s.registryTimeouts = perRegistry
+	}
+}
+
+// WithPullRetries sets number of times failed pull is retried before
+// error is reported. Delay between attempts starts with backoff and
+// grows exponentially up to maxBackoff.
+func WithPullRetries(retries int, backoff, maxBackoff time.Duration) Option {
+	return func(s *SingularityRegistry) {
+		s.pullRetries = retries
+		s.pullBackoff = backoff
+		s.pullMaxBackoff = maxBackoff
+	}
+}
+
+// WithPlatforms sets platforms images are pulled for in order of preference,
+// e.g. to run images built for other architectures under emulation. By default
+// images built for the host platform are pulled.
+func WithPlatforms(platforms ...image.Platform) Option {
+	return func(s *SingularityRegistry) {
+		s.platforms = platforms
+	}
+}
+
+// WithVerifyPolicies sets policies pulled images are verified with. For each image
+// the policy with the most specific scope is used. Images not matched by any policy
+// are verified with a key server and only warnings are logged on failure.
+func WithVerifyPolicies(policies ...image.VerifyPolicy) Option {
+	return func(s *SingularityRegistry) {
+		s.verifyPolicies = policies
+	}
+}
+
+// WithBuildConfig sets parameters of singularity build that converts
+// docker images and local archives into SIF, e.g. cache location.
+func WithBuildConfig(config *image.BuildConfig) Option {
+	return func(s *SingularityRegistry) {
+		s.build = config
+	}
+}
+
+// WithDockerConfig sets docker config.json files registry credentials are
+// looked up in when kubelet supplies none. Files keyed by registry domain in
+// perRegistry are consulted before the rest for that registry.
+func WithDockerConfig(files []string, perRegistry map[string]string) Option {
+	return func(s *SingularityRegistry) {
+		s.credentials.ConfigFiles = files
+		s.credentials.RegistryConfigFiles = perRegistry
+	}
 }
 
 // NewSingularityRegistry initializes and returns SingularityRuntime.
 // Singularity must be installed on the host otherwise it will return an error.
-func NewSingularityRegistry(storePath string, index *index.ImageIndex) (*SingularityRegistry, error) {
+func NewSingularityRegistry(storePath string, index *index.ImageIndex, opts ...Option) (*SingularityRegistry, error) {
 	_, err := exec.LookPath(singularity.RuntimeName)
 	if err != nil {
 		return nil, fmt.Errorf("could not find %s on this machine: %v", singularity.RuntimeName, err)
@@ -65,41 +154,123 @@ func NewSingularityRegistry(storePath string, index *index.ImageIndex) (*Singula
 		storage: storePath,
 		images:  index,
 	}
+	for _, opt := range opts {
+		opt(&registry)
+	}
+
+	if registry.shared != nil && registry.lazy {
+		return nil, fmt.Errorf("lazy pulls cannot be used with shared storage")
+	}
 
 	if err := os.MkdirAll(storePath, 0755); err != nil {
 		return nil, fmt.Errorf("could not create storage directory: %v", err)
 	}
-	registry.infoFile, err = os.OpenFile(filepath.Join(storePath, registryInfoFile), os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("could not open registry backup file: %v", err)
+	if registry.shared != nil {
+		// pull files of shared storage may belong to other nodes
+		if err := registry.initShared(); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := image.RemoveStalePulls(storePath); err != nil {
+			return nil, fmt.Errorf("could not cleanup storage directory: %v", err)
+		}
+		if err := registry.loadInfo(); err != nil {
+			return nil, err
+		}
 	}
-	err = registry.loadInfo()
-	if err != nil {
+	if err := registry.checkStorage(); err != nil {
+		return nil, err
+	}
+	if err := registry.initPins(); err != nil {
 		return nil, err
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	registry.ctx = ctx
+	registry.cancel = cancel
+	if registry.shared != nil {
+		registry.wg.Add(1)
+		go func() {
+			defer registry.wg.Done()
+			registry.runShared(ctx)
+		}()
+	}
+	if registry.gc != nil {
+		registry.wg.Add(1)
+		go func() {
+			defer registry.wg.Done()
+			registry.runGC(ctx)
+		}()
+		registry.triggerGC()
+	}
+	if registry.scrub != nil {
+		registry.wg.Add(1)
+		go func() {
+			defer registry.wg.Done()
+			registry.runScrubber(ctx)
+		}()
+	}
+	if registry.drop != nil {
+		if err := registry.startDropDir(ctx); err != nil {
+			registry.Shutdown()
+			return nil, err
+		}
+	}
+	if err := registry.startImportDir(ctx); err != nil {
+		registry.Shutdown()
+		return nil, err
+	}
+	if len(registry.preload) != 0 {
+		registry.wg.Add(1)
+		go func() {
+			defer registry.wg.Done()
+			registry.runPreload(ctx)
+		}()
+	}
 	return &registry, nil
 }
 
 // Shutdown should be called whenever SingularityRegistry is no longer
 // used to make sure allocated resources are freed.
 func (s *SingularityRegistry) Shutdown() error {
-	s.m.Lock()
-	defer s.m.Unlock()
-
-	if err := s.infoFile.Close(); err != nil {
-		return fmt.Errorf("could not close infoFile: %v", err)
-	}
+	s.cancel()
+	s.wg.Wait()
 	return nil
 }
 
-// PullImage pulls an image with authentication config.
+// PullImage pulls an image with authentication config. When storage is
+// shared, image is not pulled if another node pulls it in the meantime.
 func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageRequest) (*k8s.PullImageResponse, error) {
-	ref, err := image.ParseRef(req.Image.Image)
+	ref, err := image.ParseRef(s.libraryRef(req.Image.Image))
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "could not parse image reference: %v", err)
 	}
+	found, err := s.images.Find(ref.String())
+	if err == nil && s.isDropImage(found) {
+		glog.V(2).Infof("Image %s is imported from drop directory, skipping pull", ref)
+		return &k8s.PullImageResponse{
+			ImageRef: found.ID,
+		}, nil
+	}
+	if s.shared != nil {
+		info, lock, err := s.pulledElsewhere(ctx, ref, found)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not coordinate pull with other nodes: %v", err)
+		}
+		defer lock.Unlock()
+		if info != nil {
+			glog.V(2).Infof("Image %s is pulled by another node, skipping pull", ref)
+			return &k8s.PullImageResponse{
+				ImageRef: info.ID,
+			}, nil
+		}
+	}
+	auth, err := s.resolveAuth(ctx, ref, req.GetAuth())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not get %s credentials: %v", ref, err)
+	}
 
-	info, err := image.LibraryInfo(ctx, ref, req.GetAuth())
+	info, err := image.LibraryInfo(ctx, ref, auth, s.platforms...)
 	if err == image.ErrNotFound {
 		return nil, status.Errorf(codes.NotFound, "image %s is not found", ref)
 	}
@@ -107,8 +278,9 @@ func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageR
 		return nil, status.Errorf(codes.Internal, "could not get %s image metadata: %v", ref, err)
 	}
 	if info != nil {
-		_, err := s.images.Find(info.Sha256)
-		if err == nil {
+		// image imported from drop directory is pulled, so that it is kept in storage
+		prev, err := s.images.Find(info.Sha256)
+		if err == nil && !s.isDropImage(prev) {
 			glog.V(2).Infof("Image %s is already present with the same checksum, skipping pull", ref)
 			return &k8s.PullImageResponse{
 				ImageRef: info.ID,
@@ -116,27 +288,78 @@ func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageR
 		}
 	}
 
-	info, err = image.Pull(ctx, s.storage, ref, req.GetAuth())
+	digest := s.dockerDigest(ctx, ref, auth)
+	if digest != "" {
+		if prev, err := s.images.Find(digest); err == nil {
+			glog.V(2).Infof("Image %s is already present with the same manifest digest, skipping pull", ref)
+			ref.AddDigests([]string{digest})
+			if err := s.images.Add(&image.Info{ID: prev.ID, Ref: ref}); err != nil {
+				return nil, status.Errorf(codes.Internal, "could not tag image: %v", err)
+			}
+			s.updatePins()
+			if err = s.dumpInfo(); err != nil {
+				glog.Errorf("Could not dump registry info: %v", err)
+			}
+			return &k8s.PullImageResponse{
+				ImageRef: prev.ID,
+			}, nil
+		}
+	}
+
+	pullOpts := s.pullOptions(ref)
+	if info != nil {
+		pullOpts = append(pullOpts, image.WithChecksum(info.Sha256))
+	}
+	policy := s.verifyPolicy(ref)
+	if s.lazy && policy.Mode != image.VerifyRequire {
+		pullOpts = append(pullOpts, image.WithLazy())
+	}
+	prev, err := s.images.Find(ref.String())
+	if err == nil && (prev.ETag != "" || prev.LastModified != "") {
+		pullOpts = append(pullOpts, image.IfModified(prev))
+	}
+	info, err = image.Pull(ctx, s.storage, ref, auth, pullOpts...)
+	if err == image.ErrNotModified {
+		glog.V(2).Infof("Image %s is not modified since previous pull, skipping pull", ref)
+		return &k8s.PullImageResponse{
+			ImageRef: prev.ID,
+		}, nil
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not pull image: %v", err)
 	}
-	if err := info.Verify(); err != nil {
-		info.Remove()
-		return nil, status.Errorf(codes.InvalidArgument, "could not verify image: %v", err)
+	if digest != "" {
+		info.Ref.AddDigests([]string{digest})
+	}
+	// lazily pulled images are verified once they are complete
+	if info.LazyReader() == nil {
+		if err := info.Verify(policy); err != nil {
+			info.Remove()
+			return nil, status.Errorf(codes.InvalidArgument, "could not verify image: %v", err)
+		}
 	}
-	if err = s.images.Add(info); err != nil {
+	if err = s.addPulled(info); err != nil {
 		info.Remove()
 		return nil, status.Errorf(codes.Internal, "could not index image: %v", err)
 	}
+	s.updatePins()
 	if err = s.dumpInfo(); err != nil {
 		glog.Errorf("Could not dump registry info: %v", err)
 	}
+	if info.LazyReader() != nil {
+		s.startPrefetch(info)
+	}
+	s.triggerGC()
 	return &k8s.PullImageResponse{
 		ImageRef: info.ID,
 	}, nil
 }
 
-// RemoveImage removes the image.
+// RemoveImage removes the image. Pinned images are only removed when
+// ForceRemoveKey metadata is set to true, e.g. by an operator's tool.
+// Images that are still used by containers disappear from index right away
+// and their files are removed once the last container is removed. Files of
+// shared storage are kept until containers of all nodes stop using them.
 // This call is idempotent, and does not return an error if the image has already been removed.
 func (s *SingularityRegistry) RemoveImage(ctx context.Context, req *k8s.RemoveImageRequest) (*k8s.RemoveImageResponse, error) {
 	info, err := s.images.Find(req.Image.Image)
@@ -146,16 +369,37 @@ func (s *SingularityRegistry) RemoveImage(ctx context.Context, req *k8s.RemoveIm
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "could not find image: %v", err)
 	}
-	err = info.Remove()
-	if err == image.ErrIsUsed {
-		return nil, status.Errorf(codes.FailedPrecondition, "unable to remove image: %v", err)
+	if info.Pinned() && !forceRemove(ctx) {
+		return nil, status.Errorf(codes.FailedPrecondition, "unable to remove image: image %s is pinned", info.ID)
 	}
+	s.m.Lock()
+	if s.shared != nil {
+		err := s.removeShared(info, true)
+		s.m.Unlock()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not remove image: %v", err)
+		}
+		s.evictCached(info.ID)
+		if err = s.dumpInfo(); err != nil {
+			glog.Errorf("Could not dump registry info: %v", err)
+		}
+		return &k8s.RemoveImageResponse{}, nil
+	}
+	removed, err := info.RemoveWhenUnused()
 	if err != nil {
+		s.m.Unlock()
 		return nil, status.Errorf(codes.Internal, "could not remove image: %v", err)
 	}
 	if err := s.images.Remove(info.ID); err != nil {
+		s.m.Unlock()
 		return nil, status.Errorf(codes.Internal, "could not remove image from index: %v", err)
 	}
+	if !removed {
+		glog.V(2).Infof("Image %s is used by %v, marked it for deletion", info.ID, info.UsedBy())
+		s.deleteLater(info)
+	}
+	s.m.Unlock()
+	s.evictCached(info.ID)
 	if err = s.dumpInfo(); err != nil {
 		glog.Errorf("Could not dump registry info: %v", err)
 	}
@@ -178,6 +422,19 @@ func (s *SingularityRegistry) ImageStatus(ctx context.Context, req *k8s.ImageSta
 		verboseInfo = map[string]string{
 			"usedBy": fmt.Sprintf("%v", info.UsedBy()),
 		}
+		if len(info.Signers) != 0 {
+			verboseInfo["signers"] = fmt.Sprintf("%v", info.Signers)
+		}
+		if info.Platform != nil {
+			verboseInfo["platform"] = info.Platform.String()
+		}
+		if info.Pinned() {
+			verboseInfo["pinned"] = "true"
+		}
+		if info.Encrypted {
+			verboseInfo["encrypted"] = "true"
+		}
+		verboseInfo["info"] = s.verboseInfo(ctx, info)
 	}
 
 	var uid *k8s.Int64Value
@@ -214,6 +471,127 @@ func (s *SingularityRegistry) ImageStatus(ctx context.Context, req *k8s.ImageSta
 	}, nil
 }
 
+// imageInfo is reported under "info" key of verbose image status as
+// a JSON object, so that crictl inspecti shows it in a structured way.
+type imageInfo struct {
+	ID        string          `json:"id"`
+	Path      string          `json:"path"`
+	UsedBy    []string        `json:"usedBy"`
+	Pinned    bool            `json:"pinned"`
+	Encrypted bool            `json:"encrypted"`
+	Lazy      bool            `json:"lazy,omitempty"`
+	CachePath string          `json:"cachePath,omitempty"`
+	Platform  string          `json:"platform,omitempty"`
+	Signers   []image.Signer  `json:"signers,omitempty"`
+	SIF       *image.Metadata `json:"sif,omitempty"`
+}
+
+// verboseInfo returns JSON encoded information about image
+// including SIF metadata, if it can be read.
+func (s *SingularityRegistry) verboseInfo(ctx context.Context, info *image.Info) string {
+	verbose := imageInfo{
+		ID:        info.ID,
+		Path:      info.Path,
+		UsedBy:    info.UsedBy(),
+		Pinned:    info.Pinned(),
+		Encrypted: info.Encrypted,
+		Lazy:      info.LazyReader() != nil,
+		Signers:   info.Signers,
+	}
+	if s.cache != nil {
+		verbose.CachePath = s.cache.Path(info.ID)
+	}
+	if info.Platform != nil {
+		verbose.Platform = info.Platform.String()
+	}
+	meta, err := info.Metadata(ctx)
+	if err != nil {
+		glog.Warningf("Could not read metadata of image %s: %v", info.ID, err)
+	}
+	verbose.SIF = meta
+
+	data, err := json.Marshal(verbose)
+	if err != nil {
+		glog.Errorf("Could not encode image %s info: %v", info.ID, err)
+		return ""
+	}
+	return string(data)
+}
+
+// deleteLater keeps track of removed image whose file is removed once the
+// last container that uses it is removed. It should be called with s.m held.
+func (s *SingularityRegistry) deleteLater(info *image.Info) {
+	if s.deleting == nil {
+		s.deleting = make(map[string]*image.Info)
+	}
+	s.deleting[info.ID] = info
+}
+
+// addPulled adds pulled image to index. When the same image was imported from
+// drop directory, pulled copy replaces it, so that image is backed by storage
+// and its record is saved, while drop directory tags are moved to pulled copy.
+// Containers that already use imported image keep using drop directory file.
+func (s *SingularityRegistry) addPulled(info *image.Info) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	prev, err := s.images.Find(info.ID)
+	if err == nil && prev != info && s.isDropImage(prev) {
+		glog.V(2).Infof("Image %s imported from %s is pulled, replacing it with %s", info.ID, prev.Path, info.Path)
+		info.Ref.AddTags(prev.Ref.Tags())
+		info.Ref.AddDigests(prev.Ref.Digests())
+		if err := s.images.Remove(prev.ID); err != nil {
+			return fmt.Errorf("could not remove imported image: %v", err)
+		}
+	}
+	return s.images.Add(info)
+}
+
+// saveImage moves pulled image with the passed id into storage under registry
+// lock, so that the move does not interleave with garbage collection. Deletion of
+// previously removed image with the same id is cancelled before the move, so that
+// its last container does not remove the new file, see image.Info.Return.
+func (s *SingularityRegistry) saveImage(id string, move func() error) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	cancelled := s.cancelDeletion(id)
+	if err := move(); err != nil {
+		if cancelled != nil {
+			s.deleteAgain(cancelled)
+		}
+		return err
+	}
+	return nil
+}
+
+// cancelDeletion keeps file of the image with the passed id if that image is
+// marked for deletion, e.g. when it is pulled again, and returns that image.
+// It should be called with s.m held.
+func (s *SingularityRegistry) cancelDeletion(id string) *image.Info {
+	info, ok := s.deleting[id]
+	if !ok {
+		return nil
+	}
+	glog.V(2).Infof("Image %s is pulled again, cancelling its deletion", id)
+	info.CancelDeletion()
+	delete(s.deleting, id)
+	return info
+}
+
+// deleteAgain marks image whose deletion was cancelled for deletion again,
+// e.g. when it failed to be pulled. It should be called with s.m held.
+func (s *SingularityRegistry) deleteAgain(info *image.Info) {
+	removed, err := info.RemoveWhenUnused()
+	if err != nil {
+		glog.Errorf("Could not remove image %s: %v", info.ID, err)
+		return
+	}
+	if !removed {
+		s.deleteLater(info)
+	}
+}
+
 // ListImages lists existing images.
 func (s *SingularityRegistry) ListImages(ctx context.Context, req *k8s.ListImagesRequest) (*k8s.ListImagesResponse, error) {
 	var imgs []*k8s.Image
@@ -234,79 +612,53 @@ func (s *SingularityRegistry) ListImages(ctx context.Context, req *k8s.ListImage
 }
 
 // ImageFsInfo returns information of the filesystem that is used to store images.
+// CRI v1alpha2 limits this response to used bytes and inodes of image filesystems:
+// FilesystemUsage has no capacity or available space fields and there is no separate
+// container filesystem entry. Kubelet takes capacity for its image filesystem eviction
+// thresholds from the filesystem mounted at the returned mount point instead. Since
+// every returned entry is treated as an image filesystem, capacity, available space
+// and usage of the container filesystem and of local cache tier are only reported
+// by FsStatus, i.e. in verbose runtime status, and kubelet thresholds ignore them.
 // Note that local SIF images that were not pulled by CRI are not counted in this stat.
 func (s *SingularityRegistry) ImageFsInfo(context.Context, *k8s.ImageFsInfoRequest) (*k8s.ImageFsInfoResponse, error) {
-	fsInfo, err := fs.Usage(s.storage)
+	imageFs, err := dirFsInfo(s.storage)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not get fs usage: %v", err)
 	}
-
-	fsUsage := &k8s.FilesystemUsage{
-		Timestamp: time.Now().UnixNano(),
-		FsId: &k8s.FilesystemIdentifier{
-			Mountpoint: fsInfo.MountPoint,
-		},
-		UsedBytes: &k8s.UInt64Value{
-			Value: uint64(fsInfo.Bytes),
-		},
-		InodesUsed: &k8s.UInt64Value{
-			Value: uint64(fsInfo.Inodes),
-		},
-	}
-
 	return &k8s.ImageFsInfoResponse{
-		ImageFilesystems: []*k8s.FilesystemUsage{fsUsage},
+		ImageFilesystems: []*k8s.FilesystemUsage{filesystemUsage(imageFs, time.Now())},
 	}, nil
 }
 
-// loadInfo reads backup file and restores registry according to it.
-func (s *SingularityRegistry) loadInfo() error {
-	s.m.Lock()
-	defer s.m.Unlock()
-
-	_, err := s.infoFile.Seek(0, io.SeekStart)
+// dockerDigest resolves manifest digest of docker image referenced by ref for
+// the platform it is pulled for, so that unchanged images are not rebuilt.
+// Resolution is best effort, empty string is returned for images of other
+// registries or if digest cannot be resolved.
+func (s *SingularityRegistry) dockerDigest(ctx context.Context, ref *image.Reference, auth *k8s.AuthConfig) string {
+	if ref.URI() != singularity.DockerDomain {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, digestTimeout)
+	defer cancel()
+	digest, err := image.DockerDigest(ctx, ref, auth, s.platforms...)
 	if err != nil {
-		return fmt.Errorf("could not seek registry info file: %v", err)
+		glog.Warningf("Could not resolve %s manifest digest: %v", ref, err)
+		return ""
 	}
-	dec := json.NewDecoder(s.infoFile)
-
-	// while the array contains values
-	for dec.More() {
-		var info *image.Info
-		// decode an array value (Message)
-		err := dec.Decode(&info)
-		if err != nil {
-			return fmt.Errorf("could not decode image: %v", err)
-		}
-		err = s.images.Add(info)
-		if err != nil {
-			return fmt.Errorf("could not add decoded image to index: %v", err)
-		}
-	}
-
-	return nil
+	return digest
 }
 
-// dumpInfo dumps registry into backup file.
-func (s *SingularityRegistry) dumpInfo() error {
-	s.m.Lock()
-	defer s.m.Unlock()
-
-	_, err := s.infoFile.Seek(0, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("could not seek registry info file: %v", err)
-	}
-	err = s.infoFile.Truncate(0)
-	if err != nil {
-		return fmt.Errorf("could not reset file: %v", err)
-	}
-	enc := json.NewEncoder(s.infoFile)
-	encodeToFile := func(info *image.Info) {
-		if info.Ref.URI() == singularity.LocalFileDomain {
-			return
-		}
-		_ = enc.Encode(info)
+// pullOptions returns options that should be used to pull image referenced by ref.
+func (s *SingularityRegistry) pullOptions(ref *image.Reference) []image.PullOption {
+	timeout, ok := s.registryTimeouts[ref.Registry()]
+	if !ok {
+		timeout = s.pullTimeout
+	}
+	return []image.PullOption{
+		image.WithTimeout(timeout),
+		image.WithRetries(s.pullRetries, s.pullBackoff, s.pullMaxBackoff),
+		image.WithPlatforms(s.platforms...),
+		image.WithBuildConfig(s.build),
+		image.WithSaveHook(s.saveImage),
 	}
-	s.images.Iterate(encodeToFile)
-	return nil
 }
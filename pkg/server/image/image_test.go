@@ -0,0 +1,306 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestPullImage_SameDigest(t *testing.T) {
+	const manifestDigest = "sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/sylabs/busybox/manifests/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", manifestDigest)
+		w.Write([]byte(`{"schemaVersion": 2}`))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "pull-image-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	ref, err := image.ParseRef(host + "/sylabs/busybox:1.0.0")
+	require.NoError(t, err, "could not parse reference")
+	ref.AddDigests([]string{host + "/sylabs/busybox@" + manifestDigest})
+	busybox := &image.Info{
+		ID:     strings.Repeat("a", image.IDLen),
+		Sha256: strings.Repeat("a", image.IDLen),
+		Path:   "/var/lib/singularity/busybox",
+		Ref:    ref,
+	}
+	require.NoError(t, registry.images.Add(busybox), "could not add image")
+
+	resp, err := registry.PullImage(context.Background(), &k8s.PullImageRequest{
+		Image: &k8s.ImageSpec{
+			Image: host + "/sylabs/busybox",
+		},
+		Auth: &k8s.AuthConfig{
+			ServerAddress: server.URL,
+		},
+	})
+	require.NoError(t, err, "unexpected pull error")
+	require.Equal(t, busybox.ID, resp.ImageRef, "image is pulled again")
+
+	registry = &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	require.NoError(t, registry.loadInfo(), "could not load registry info")
+	info, err := registry.images.Find(host + "/sylabs/busybox:latest")
+	require.NoError(t, err, "tag is not saved")
+	require.Equal(t, busybox.ID, info.ID, "tag points to wrong image")
+	info, err = registry.images.Find(host + "/sylabs/busybox@" + manifestDigest)
+	require.NoError(t, err, "digest is not saved")
+	require.Equal(t, busybox.ID, info.ID, "digest points to wrong image")
+}
+
+func TestRemoveImage_Used(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remove-image-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	id := strings.Repeat("a", image.IDLen)
+	path := filepath.Join(dir, id)
+	require.NoError(t, ioutil.WriteFile(path, []byte("busybox"), 0644), "could not write image")
+	ref, err := image.ParseRef("busybox:1.28")
+	require.NoError(t, err, "could not parse reference")
+	busybox := &image.Info{
+		ID:     id,
+		Sha256: id,
+		Path:   path,
+		Ref:    ref,
+	}
+	busybox.Borrow("container")
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	require.NoError(t, registry.images.Add(busybox), "could not add image")
+
+	_, err = registry.RemoveImage(context.Background(), &k8s.RemoveImageRequest{
+		Image: &k8s.ImageSpec{Image: "busybox:1.28"},
+	})
+	require.NoError(t, err, "could not remove used image")
+	list, err := registry.ListImages(context.Background(), &k8s.ListImagesRequest{})
+	require.NoError(t, err, "could not list images")
+	require.Empty(t, list.Images, "image marked for deletion is listed")
+	_, err = os.Stat(path)
+	require.NoError(t, err, "used image file is removed")
+
+	t.Run("restart", func(t *testing.T) {
+		restarted := &SingularityRegistry{
+			storage: dir,
+			images:  index.NewImageIndex(),
+		}
+		copyPath := path + ".copy"
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err, "could not read image")
+		require.NoError(t, ioutil.WriteFile(copyPath, data, 0644), "could not copy image")
+		defer os.Rename(copyPath, path)
+
+		require.NoError(t, restarted.loadInfo(), "could not load registry info")
+		_, err = restarted.images.Find(id)
+		require.Equal(t, index.ErrNotFound, err, "image marked for deletion is indexed")
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err), "image file marked for deletion is not removed on load")
+	})
+
+	busybox.Return("container")
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "image file is not removed after last container")
+	require.NoError(t, registry.dumpInfo(), "could not dump registry info")
+	require.Empty(t, registry.deleting, "removed image is still pending deletion")
+}
+
+func TestSaveImage_PendingDeletion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "save-image-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	id := strings.Repeat("a", image.IDLen)
+	path := filepath.Join(dir, id)
+	require.NoError(t, ioutil.WriteFile(path, []byte("busybox"), 0644), "could not write image")
+	ref, err := image.ParseRef("busybox:1.28")
+	require.NoError(t, err, "could not parse reference")
+	busybox := &image.Info{
+		ID:     id,
+		Sha256: id,
+		Path:   path,
+		Ref:    ref,
+	}
+	busybox.Borrow("container")
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	require.NoError(t, registry.images.Add(busybox), "could not add image")
+	_, err = registry.RemoveImage(context.Background(), &k8s.RemoveImageRequest{
+		Image: &k8s.ImageSpec{Image: "busybox:1.28"},
+	})
+	require.NoError(t, err, "could not remove used image")
+
+	err = registry.saveImage(id, func() error {
+		return fmt.Errorf("rename failed")
+	})
+	require.Error(t, err, "move error is not returned")
+	require.True(t, busybox.MarkedForDeletion(), "deletion is cancelled by failed pull")
+
+	pulled := filepath.Join(dir, "pulled")
+	require.NoError(t, ioutil.WriteFile(pulled, []byte("busybox"), 0644), "could not write image")
+	err = registry.saveImage(id, func() error {
+		return os.Rename(pulled, path)
+	})
+	require.NoError(t, err, "could not save image")
+	require.Empty(t, registry.deleting, "deletion of pulled image is not cancelled")
+
+	busybox.Return("container")
+	require.FileExists(t, path, "pulled image is removed by container of removed image")
+}
+
+func TestPullImage_DropImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alpine.sif" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "alpine")
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pull-image-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+	storage := filepath.Join(dir, "storage")
+	drop := filepath.Join(dir, "drop")
+	require.NoError(t, os.Mkdir(storage, 0755), "could not create storage")
+	require.NoError(t, os.Mkdir(drop, 0755), "could not create drop directory")
+	dropFile := filepath.Join(drop, "alpine.sif")
+	require.NoError(t, ioutil.WriteFile(dropFile, []byte("alpine"), 0644), "could not write image")
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(dropFile, old, old), "could not set file time")
+
+	registry := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(),
+	}
+	WithDropDir(drop, "registry.local/", 0)(registry)
+	WithVerifyPolicies(image.VerifyPolicy{Mode: image.VerifyIgnore})(registry)
+	_, err = registry.scanDropDir()
+	require.NoError(t, err, "could not scan drop directory")
+	imported, err := registry.images.Find("registry.local/alpine")
+	require.NoError(t, err, "image is not imported")
+	imported.Borrow("container")
+
+	resp, err := registry.PullImage(context.Background(), &k8s.PullImageRequest{
+		Image: &k8s.ImageSpec{Image: server.URL + "/alpine.sif"},
+	})
+	require.NoError(t, err, "could not pull image")
+	require.Equal(t, imported.ID, resp.ImageRef, "unexpected image")
+
+	pulled, err := registry.images.Find(imported.ID)
+	require.NoError(t, err, "pulled image is not found")
+	require.NotEqual(t, singularity.LocalFileDomain, pulled.Ref.URI(), "pulled image is kept as drop image")
+	require.Equal(t, filepath.Join(storage, imported.ID), pulled.Path, "pulled image is not backed by storage")
+	require.FileExists(t, pulled.Path, "pulled image file is missing")
+	require.Equal(t, dropFile, imported.Path, "image used by container is changed")
+	drop1, err := registry.images.Find("registry.local/alpine")
+	require.NoError(t, err, "drop tag is lost")
+	require.Equal(t, pulled, drop1, "drop tag points to imported image")
+
+	restarted := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(),
+	}
+	require.NoError(t, restarted.loadInfo(), "could not load registry info")
+	_, err = restarted.images.Find(server.URL + "/alpine.sif")
+	require.NoError(t, err, "pulled image is not saved")
+
+	require.NoError(t, os.Remove(dropFile), "could not remove file")
+	_, err = registry.scanDropDir()
+	require.NoError(t, err, "could not scan drop directory")
+	_, err = registry.images.Find("registry.local/alpine")
+	require.Equal(t, index.ErrNotFound, err, "tag of removed file is kept")
+	info, err := registry.images.Find(server.URL + "/alpine.sif")
+	require.NoError(t, err, "pulled image is unregistered")
+	require.FileExists(t, info.Path, "pulled tag points to missing file")
+}
+
+func TestImageStatus_Verbose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-status-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	id := strings.Repeat("a", image.IDLen)
+	path := filepath.Join(dir, id)
+	require.NoError(t, ioutil.WriteFile(path, []byte("busybox"), 0644), "could not write image")
+	ref, err := image.ParseRef("busybox:1.28")
+	require.NoError(t, err, "could not parse reference")
+	busybox := &image.Info{
+		ID:      id,
+		Sha256:  id,
+		Path:    path,
+		Ref:     ref,
+		Signers: []image.Signer{{Fingerprint: "8883491F4268F173C6E5DC49EDECE4F3F38D871E"}},
+	}
+	busybox.Borrow("container")
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	require.NoError(t, registry.images.Add(busybox), "could not add image")
+
+	resp, err := registry.ImageStatus(context.Background(), &k8s.ImageStatusRequest{
+		Image:   &k8s.ImageSpec{Image: "busybox:1.28"},
+		Verbose: true,
+	})
+	require.NoError(t, err, "could not get image status")
+	require.Equal(t, "[container]", resp.Info["usedBy"])
+
+	var info imageInfo
+	require.NoError(t, json.Unmarshal([]byte(resp.Info["info"]), &info), "info is not a valid JSON")
+	require.Equal(t, imageInfo{
+		ID:      id,
+		Path:    path,
+		UsedBy:  []string{"container"},
+		Signers: busybox.Signers,
+	}, info)
+}
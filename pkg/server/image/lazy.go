@@ -0,0 +1,102 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+const (
+	// prefetchBackoff and prefetchMaxBackoff bound delay between
+	// attempts to complete lazily pulled images.
+	prefetchBackoff    = 10 * time.Second
+	prefetchMaxBackoff = 5 * time.Minute
+)
+
+// WithLazyPull makes library and HTTP(S) images whose checksum is known in
+// advance to be pulled lazily, so containers may start before the whole image
+// is downloaded: root filesystem is fetched on demand and completed in background.
+// Images whose verification policy requires signatures are always pulled in full.
+// Missing data is fetched by this process, so containers of images that are not
+// complete yet get read errors if it restarts; such images are pulled again.
+func WithLazyPull() Option {
+	return func(s *SingularityRegistry) {
+		s.lazy = true
+	}
+}
+
+// startPrefetch completes lazily pulled image in background.
+func (s *SingularityRegistry) startPrefetch(info *image.Info) {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.prefetch(ctx, info)
+	}()
+}
+
+// prefetch downloads missing parts of lazily pulled image until it succeeds,
+// image is removed or ctx is done. Once image is complete its signatures are
+// verified. Images that do not match their checksum or fail verification
+// are quarantined.
+func (s *SingularityRegistry) prefetch(ctx context.Context, info *image.Info) {
+	backoff := prefetchBackoff
+	for {
+		err := info.Prefetch(ctx)
+		if err == nil {
+			err = info.Verify(s.verifyPolicy(info.Ref))
+		}
+		if err == nil {
+			glog.V(2).Infof("Lazily pulled image %s (%s) is complete", info.ID, info.Ref)
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if _, findErr := s.images.Find(info.ID); findErr != nil {
+			glog.V(4).Infof("Image %s was removed before it was complete", info.ID)
+			return
+		}
+		if errors.Is(err, image.ErrChecksumMismatch) || info.LazyReader() == nil {
+			glog.Errorf("Lazily pulled image %s (%s) is invalid, moving it to quarantine: %v", info.ID, info.Ref, err)
+			if err := s.quarantineImage(info); err != nil {
+				glog.Errorf("Could not quarantine image %s: %v", info.ID, err)
+			}
+			break
+		}
+
+		glog.Warningf("Could not complete lazily pulled image %s, retrying in %s: %v", info.ID, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > prefetchMaxBackoff {
+			backoff = prefetchMaxBackoff
+		}
+	}
+	if err := s.dumpInfo(); err != nil {
+		glog.Errorf("Could not dump registry info: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+)
+
+func TestLoadInfo_Lazy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazy-image-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	addImage := func(tag string, lazy bool) *image.Info {
+		id := strings.Repeat(tag[:1], image.IDLen)
+		path := filepath.Join(dir, id)
+		require.NoError(t, ioutil.WriteFile(path, []byte(tag), 0644), "could not write image")
+		ref, err := image.ParseRef("busybox:" + tag)
+		require.NoError(t, err, "could not parse reference")
+		info := &image.Info{
+			ID:     id,
+			Sha256: id,
+			Path:   path,
+			Ref:    ref,
+			Lazy:   lazy,
+		}
+		require.NoError(t, registry.images.Add(info), "could not add image")
+		return info
+	}
+	complete := addImage("complete", false)
+	incomplete := addImage("incomplete", true)
+	require.NoError(t, registry.dumpInfo(), "could not dump registry info")
+
+	restarted := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	require.NoError(t, restarted.loadInfo(), "could not load registry info")
+	_, err = restarted.images.Find(complete.ID)
+	require.NoError(t, err, "complete image is not indexed")
+	_, err = restarted.images.Find(incomplete.ID)
+	require.Equal(t, index.ErrNotFound, err, "incomplete lazy image is indexed")
+	_, err = os.Stat(incomplete.Path)
+	require.True(t, os.IsNotExist(err), "incomplete lazy image file is not removed")
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// LibraryEndpoint holds parameters of a library server images are pulled from.
+type LibraryEndpoint struct {
+	// Host is a domain library image references start with, e.g. for
+	// library://library.example.com/user/collection/image it is library.example.com.
+	Host string
+	// BaseURL is library server address. If empty, https://<Host> is used
+	// for custom libraries and library client default for cloud.sylabs.io.
+	BaseURL string
+	// TokenFile is a path to a file holding library access token. It is
+	// used when kubelet does not supply credentials for the pull.
+	TokenFile string
+	// KeyServer is a key server to verify library images with, unless
+	// verification policy sets one explicitly.
+	KeyServer string
+}
+
+// WithLibraries sets library endpoints images are pulled from. Image references
+// that start with one of endpoint hosts are considered library references even
+// without library:// prefix, so they may be passed by kubelet.
+func WithLibraries(endpoints ...LibraryEndpoint) Option {
+	return func(s *SingularityRegistry) {
+		s.libraries = make(map[string]LibraryEndpoint, len(endpoints))
+		s.credentials.TokenFiles = make(map[string]string)
+		for _, e := range endpoints {
+			s.libraries[e.Host] = e
+			if e.TokenFile != "" {
+				s.credentials.TokenFiles[e.Host] = e.TokenFile
+			}
+		}
+	}
+}
+
+// libraryRef adds library:// prefix to image references that start
+// with a host of one of configured library endpoints.
+func (s *SingularityRegistry) libraryRef(imgRef string) string {
+	i := strings.IndexByte(imgRef, '/')
+	if i == -1 {
+		return imgRef
+	}
+	if _, ok := s.libraries[imgRef[:i]]; !ok {
+		return imgRef
+	}
+	return singularity.LibraryProtocol + "://" + imgRef
+}
+
+// resolveAuth returns auth config that should be used to pull image referenced
+// by ref. Credentials kubelet supplied take precedence, otherwise they are looked
+// up in docker config files and library token files. For library images endpoint
+// base URL is set as server address.
+func (s *SingularityRegistry) resolveAuth(ctx context.Context, ref *image.Reference, auth *k8s.AuthConfig) (*k8s.AuthConfig, error) {
+	auth, err := s.credentials.Resolve(ctx, ref, auth)
+	if err != nil {
+		return nil, err
+	}
+	if ref.URI() != singularity.LibraryDomain {
+		return auth, nil
+	}
+
+	host := ref.Registry()
+	endpoint, ok := s.libraries[host]
+	if !ok && host == singularity.LibraryDomain {
+		return auth, nil
+	}
+
+	libAuth := &k8s.AuthConfig{}
+	if auth != nil {
+		*libAuth = *auth
+	}
+	switch {
+	case endpoint.BaseURL != "":
+		libAuth.ServerAddress = endpoint.BaseURL
+	case libAuth.ServerAddress == "" && host != singularity.LibraryDomain:
+		libAuth.ServerAddress = "https://" + host
+	}
+	return libAuth, nil
+}
+
+// verifyPolicy returns signature verification policy for image referenced by ref.
+// Key server of library endpoint is used unless policy sets one or uses a keyring.
+func (s *SingularityRegistry) verifyPolicy(ref *image.Reference) image.VerifyPolicy {
+	policy := image.SelectVerifyPolicy(s.verifyPolicies, ref)
+	if ref.URI() != singularity.LibraryDomain || policy.Keyring != "" || policy.KeyServer != "" {
+		return policy
+	}
+	policy.KeyServer = s.libraries[ref.Registry()].KeyServer
+	return policy
+}
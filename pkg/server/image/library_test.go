@@ -0,0 +1,123 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestLibraryAuth(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "library-token-")
+	require.NoError(t, err, "could not create token file")
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.WriteString("secret-token\n")
+	require.NoError(t, err, "could not write token")
+	require.NoError(t, tokenFile.Close(), "could not close token file")
+
+	registry := &SingularityRegistry{}
+	WithLibraries(
+		LibraryEndpoint{
+			Host:      "library.example.com",
+			BaseURL:   "https://library.example.com:8443",
+			TokenFile: tokenFile.Name(),
+			KeyServer: "https://keys.example.com",
+		},
+		LibraryEndpoint{
+			Host:      singularity.LibraryDomain,
+			TokenFile: tokenFile.Name(),
+		},
+	)(registry)
+
+	tt := []struct {
+		name            string
+		ref             string
+		auth            *k8s.AuthConfig
+		expectRef       string
+		expectAuth      *k8s.AuthConfig
+		expectKeyServer string
+	}{
+		{
+			name:      "configured library without protocol",
+			ref:       "library.example.com/sylabs/tests/busybox:1.0.0",
+			expectRef: "library.example.com/sylabs/tests/busybox:1.0.0",
+			expectAuth: &k8s.AuthConfig{
+				ServerAddress: "https://library.example.com:8443",
+				Password:      "secret-token",
+			},
+			expectKeyServer: "https://keys.example.com",
+		},
+		{
+			name: "configured library with kubelet credentials",
+			ref:  "library://library.example.com/sylabs/tests/busybox:1.0.0",
+			auth: &k8s.AuthConfig{
+				Password: "kubelet-token",
+			},
+			expectRef: "library.example.com/sylabs/tests/busybox:1.0.0",
+			expectAuth: &k8s.AuthConfig{
+				ServerAddress: "https://library.example.com:8443",
+				Password:      "kubelet-token",
+			},
+			expectKeyServer: "https://keys.example.com",
+		},
+		{
+			name:      "unknown library",
+			ref:       "library://other.example.com/sylabs/tests/busybox:1.0.0",
+			expectRef: "other.example.com/sylabs/tests/busybox:1.0.0",
+			expectAuth: &k8s.AuthConfig{
+				ServerAddress: "https://other.example.com",
+			},
+		},
+		{
+			name:      "default library",
+			ref:       "library://sylabs/tests/busybox:1.0.0",
+			expectRef: "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			expectAuth: &k8s.AuthConfig{
+				Password: "secret-token",
+			},
+		},
+		{
+			name: "docker image",
+			ref:  "gcr.io/cri-tools/test-image-tags:1",
+			auth: &k8s.AuthConfig{
+				Username: "user",
+			},
+			expectRef: "docker.io/gcr.io/cri-tools/test-image-tags:1",
+			expectAuth: &k8s.AuthConfig{
+				Username: "user",
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := image.ParseRef(registry.libraryRef(tc.ref))
+			require.NoError(t, err, "could not parse reference")
+			require.Equal(t, tc.expectRef, ref.String())
+
+			auth, err := registry.resolveAuth(context.Background(), ref, tc.auth)
+			require.NoError(t, err, "could not get auth config")
+			require.Equal(t, tc.expectAuth, auth)
+			require.Equal(t, tc.expectKeyServer, registry.verifyPolicy(ref).KeyServer)
+		})
+	}
+}
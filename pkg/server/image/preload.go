@@ -0,0 +1,142 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"google.golang.org/grpc/metadata"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const (
+	// ForceRemoveKey is a gRPC metadata key that allows RemoveImage
+	// to remove pinned images when set to true.
+	ForceRemoveKey = "sycri-force-remove"
+
+	// preloadBackoff and preloadMaxBackoff bound delay between
+	// attempts to pull images that failed to preload.
+	preloadBackoff    = 10 * time.Second
+	preloadMaxBackoff = 5 * time.Minute
+)
+
+// WithPreload sets images that are pulled in background on startup unless
+// they are already present. Such images are pinned: they are never garbage
+// collected and RemoveImage refuses to remove them unless forced.
+func WithPreload(refs ...string) Option {
+	return func(s *SingularityRegistry) {
+		s.preload = refs
+	}
+}
+
+// initPins resolves references of preloaded images and pins those
+// that are already present so that they are not garbage collected.
+func (s *SingularityRegistry) initPins() error {
+	s.pins = make(map[string]bool, len(s.preload))
+	for _, imgRef := range s.preload {
+		ref, err := image.ParseRef(s.libraryRef(imgRef))
+		if err != nil {
+			return fmt.Errorf("could not parse preloaded image reference %s: %v", imgRef, err)
+		}
+		for _, pin := range append(ref.Tags(), ref.Digests()...) {
+			s.pins[pin] = true
+		}
+	}
+	s.updatePins()
+	return nil
+}
+
+// updatePins pins images referenced by any of preloaded image references
+// and unpins the rest. It should be called whenever references move
+// between images, e.g. when a newer image is pulled for the same tag.
+func (s *SingularityRegistry) updatePins() {
+	if len(s.pins) == 0 {
+		return
+	}
+	s.images.Iterate(func(info *image.Info) {
+		for _, ref := range append(info.Ref.Tags(), info.Ref.Digests()...) {
+			if s.pins[ref] {
+				info.Pin()
+				return
+			}
+		}
+		info.Unpin()
+	})
+}
+
+// runPreload pulls preloaded images that are not present yet. Failed
+// pulls are retried with growing delay until they succeed or ctx is done.
+func (s *SingularityRegistry) runPreload(ctx context.Context) {
+	var pending []string
+	for _, imgRef := range s.preload {
+		ref, err := image.ParseRef(s.libraryRef(imgRef))
+		if err != nil {
+			continue
+		}
+		if _, err := s.images.Find(ref.String()); err == index.ErrNotFound {
+			pending = append(pending, imgRef)
+		}
+	}
+
+	backoff := preloadBackoff
+	for len(pending) != 0 {
+		var failed []string
+		for _, imgRef := range pending {
+			_, err := s.PullImage(ctx, &k8s.PullImageRequest{
+				Image: &k8s.ImageSpec{Image: imgRef},
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				glog.Errorf("Could not preload image %s: %v", imgRef, err)
+				failed = append(failed, imgRef)
+				continue
+			}
+			glog.V(2).Infof("Preloaded image %s", imgRef)
+		}
+		pending = failed
+		if len(pending) == 0 {
+			return
+		}
+
+		glog.V(4).Infof("Retrying preload of %d images in %s", len(pending), backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > preloadMaxBackoff {
+			backoff = preloadMaxBackoff
+		}
+	}
+}
+
+// forceRemove returns true if RemoveImage caller asked
+// to remove image even if it is pinned.
+func forceRemove(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	values := md.Get(ForceRemoveKey)
+	return len(values) != 0 && values[0] == "true"
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestUpdatePins(t *testing.T) {
+	newInfo := func(id string, tags ...string) *image.Info {
+		ref, err := image.ParseRef(tags[0])
+		require.NoError(t, err, "could not parse reference")
+		ref.AddTags(tags[1:])
+		return &image.Info{
+			ID:  strings.Repeat(id, image.IDLen),
+			Ref: ref,
+		}
+	}
+	pause := newInfo("a", "k8s.gcr.io/pause:3.1")
+	busybox := newInfo("b", "busybox:1.28", "busybox:latest")
+	alpine := newInfo("c", "alpine")
+
+	registry := &SingularityRegistry{
+		images:  index.NewImageIndex(),
+		preload: []string{"k8s.gcr.io/pause:3.1", "busybox"},
+	}
+	for _, info := range []*image.Info{pause, busybox, alpine} {
+		require.NoError(t, registry.images.Add(info), "could not add image")
+	}
+	require.NoError(t, registry.initPins(), "could not init pins")
+	require.True(t, pause.Pinned(), "preloaded image is not pinned")
+	require.True(t, busybox.Pinned(), "preloaded image is not pinned")
+	require.False(t, alpine.Pinned(), "unexpected pinned image")
+
+	newBusybox := newInfo("d", "busybox")
+	require.NoError(t, registry.images.Add(newBusybox), "could not add image")
+	registry.updatePins()
+	require.True(t, newBusybox.Pinned(), "pin does not follow tag")
+	require.False(t, busybox.Pinned(), "image is pinned after tag is moved")
+}
+
+func TestRemoveImage_Pinned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remove-image-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, strings.Repeat("a", image.IDLen))
+	require.NoError(t, ioutil.WriteFile(path, []byte("pause"), 0644), "could not write image")
+	ref, err := image.ParseRef("k8s.gcr.io/pause:3.1")
+	require.NoError(t, err, "could not parse reference")
+	pause := &image.Info{
+		ID:   strings.Repeat("a", image.IDLen),
+		Path: path,
+		Ref:  ref,
+	}
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+		preload: []string{"k8s.gcr.io/pause:3.1"},
+	}
+	require.NoError(t, registry.images.Add(pause), "could not add image")
+	require.NoError(t, registry.initPins(), "could not init pins")
+
+	req := &k8s.RemoveImageRequest{
+		Image: &k8s.ImageSpec{Image: "k8s.gcr.io/pause:3.1"},
+	}
+	_, err = registry.RemoveImage(context.Background(), req)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "pinned image is removed")
+	_, err = os.Stat(path)
+	require.NoError(t, err, "pinned image file is removed")
+
+	status, err := registry.ImageStatus(context.Background(), &k8s.ImageStatusRequest{
+		Image:   &k8s.ImageSpec{Image: "k8s.gcr.io/pause:3.1"},
+		Verbose: true,
+	})
+	require.NoError(t, err, "could not get image status")
+	require.Equal(t, "true", status.Info["pinned"], "image is not reported as pinned")
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(ForceRemoveKey, "true"))
+	_, err = registry.RemoveImage(ctx, req)
+	require.NoError(t, err, "could not force image removal")
+	_, err = registry.images.Find(pause.ID)
+	require.Equal(t, index.ErrNotFound, err, "image is not removed from index")
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "image file is not removed")
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+const (
+	// registryInfoFile is a name of the file in storage directory
+	// registry state is saved to.
+	registryInfoFile = "registry.json"
+	// registryInfoVersion is a current schema version of registry info file.
+	registryInfoVersion = 1
+	// corruptSuffix is appended to a name of registry info
+	// file that could not be decoded at all.
+	corruptSuffix = ".corrupt"
+	// quarantineDir is a directory within storage that unknown files
+	// which cannot be adopted and corrupted images are moved to.
+	quarantineDir = "quarantine"
+)
+
+// registryInfo is a content of registry info file. Images are kept raw
+// so that a corrupt record does not prevent others from being decoded.
+// Deleting is only written when storage is shared, see WithSharedStorage.
+type registryInfo struct {
+	Version  int                         `json:"version"`
+	Images   []json.RawMessage           `json:"images"`
+	Deleting map[string]*pendingDeletion `json:"deleting,omitempty"`
+}
+
+// loadInfo reads registry info file and restores index according to it.
+// Corrupt records are skipped. If file cannot be decoded at all, it is
+// kept with .corrupt suffix and index is rebuilt from storage, see checkStorage.
+func (s *SingularityRegistry) loadInfo() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	path := filepath.Join(s.storage, registryInfoFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read registry info file: %v", err)
+	}
+
+	records, err := decodeRegistryInfo(data)
+	if err != nil {
+		glog.Errorf("Could not decode registry info file, moving it to %s: %v", path+corruptSuffix, err)
+		if err := os.Rename(path, path+corruptSuffix); err != nil {
+			return fmt.Errorf("could not move corrupt registry info file: %v", err)
+		}
+	}
+	for _, info := range decodeImageRecords(records) {
+		if info.MarkedForDeletion() {
+			// containers are not tracked across restarts,
+			// so images marked for deletion are no longer used
+			glog.V(2).Infof("Removing image %s marked for deletion", info.ID)
+			if err := os.Remove(info.Path); err != nil && !os.IsNotExist(err) {
+				glog.Errorf("Could not remove image %s marked for deletion: %v", info.ID, err)
+			}
+			continue
+		}
+		if info.Lazy {
+			// sources of lazily pulled images are not kept, so
+			// incomplete ones are removed and pulled again on demand;
+			// devices containers read them through died with previous
+			// process anyway, so those containers cannot recover
+			glog.V(2).Infof("Removing incomplete lazily pulled image %s", info.ID)
+			if err := os.Remove(info.Path); err != nil && !os.IsNotExist(err) {
+				glog.Errorf("Could not remove incomplete image %s: %v", info.ID, err)
+			}
+			continue
+		}
+		if err := s.images.Add(info); err != nil {
+			glog.Warningf("Skipping image record of %s: could not add image to index: %v", info.ID, err)
+		}
+	}
+	return nil
+}
+
+// decodeImageRecords decodes raw image records of registry info file. Corrupt
+// records as well as records that lack image id or reference are skipped.
+func decodeImageRecords(records []json.RawMessage) []*image.Info {
+	infos := make([]*image.Info, 0, len(records))
+	for i, record := range records {
+		var info *image.Info
+		err := json.Unmarshal(record, &info)
+		if err == nil && (info == nil || info.ID == "" || info.Ref == nil) {
+			err = fmt.Errorf("id or reference is missing")
+		}
+		if err != nil {
+			glog.Warningf("Skipping corrupt image record #%d: %v", i, err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// decodeRegistryInfo returns raw image records of registry info file. Files
+// written by older releases hold a stream of image objects without a version;
+// when such stream is truncated records that precede damaged one are returned.
+func decodeRegistryInfo(data []byte) ([]json.RawMessage, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var first json.RawMessage
+	if err := dec.Decode(&first); err != nil {
+		return nil, err
+	}
+	var versioned struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(first, &versioned); err != nil {
+		return nil, err
+	}
+	if versioned.Version != nil {
+		if *versioned.Version > registryInfoVersion {
+			return nil, fmt.Errorf("unsupported registry info version %d", *versioned.Version)
+		}
+		var info registryInfo
+		if err := json.Unmarshal(first, &info); err != nil {
+			return nil, err
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("unexpected data after registry info")
+		}
+		return info.Images, nil
+	}
+
+	records := []json.RawMessage{first}
+	for {
+		var record json.RawMessage
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			glog.Warningf("Registry info file is truncated after %d records: %v", len(records), err)
+			return records, nil
+		}
+		records = append(records, record)
+	}
+}
+
+// dumpInfo saves registry state into registry info file. File is replaced
+// atomically, so a crash never leaves it partially written. Shared storage
+// is synced instead, so that images of other nodes are kept.
+func (s *SingularityRegistry) dumpInfo() error {
+	if s.shared != nil {
+		return s.syncShared(context.Background())
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	info := registryInfo{
+		Version: registryInfoVersion,
+		Images:  []json.RawMessage{},
+	}
+	var encodeErr error
+	s.images.Iterate(func(img *image.Info) {
+		if img.Ref.URI() == singularity.LocalFileDomain {
+			return
+		}
+		record, err := json.Marshal(img)
+		if err != nil {
+			encodeErr = fmt.Errorf("could not encode image %s: %v", img.ID, err)
+			return
+		}
+		info.Images = append(info.Images, record)
+	})
+	if encodeErr != nil {
+		return encodeErr
+	}
+	for id, img := range s.deleting {
+		if !img.MarkedForDeletion() {
+			delete(s.deleting, id)
+			continue
+		}
+		record, err := json.Marshal(img)
+		if err != nil {
+			return fmt.Errorf("could not encode image %s: %v", img.ID, err)
+		}
+		info.Images = append(info.Images, record)
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("could not encode registry info: %v", err)
+	}
+	if err := fs.WriteFileAtomic(filepath.Join(s.storage, registryInfoFile), data, 0644); err != nil {
+		return fmt.Errorf("could not write registry info file: %v", err)
+	}
+	return nil
+}
+
+// checkStorage makes index consistent with storage directory. Images whose
+// files are missing are dropped from index. Unknown files that are named after
+// checksum of their content are adopted as untagged images, other unknown files
+// are moved to quarantine directory. Unknown files of shared storage are left
+// alone. Registry info file is saved if anything changes.
+func (s *SingularityRegistry) checkStorage() error {
+	var changed bool
+	known := make(map[string]bool)
+	var missing []*image.Info
+	s.images.Iterate(func(info *image.Info) {
+		if info.Ref.URI() == singularity.LocalFileDomain {
+			return
+		}
+		if _, err := os.Stat(info.Path); os.IsNotExist(err) {
+			missing = append(missing, info)
+			return
+		}
+		known[info.Path] = true
+	})
+	for _, info := range missing {
+		glog.Warningf("Image %s (%s) file %s is missing, removing it from index", info.ID, info.Ref, info.Path)
+		if err := s.images.Remove(info.ID); err != nil {
+			return fmt.Errorf("could not remove image %s from index: %v", info.ID, err)
+		}
+		changed = true
+	}
+
+	var fii []os.FileInfo
+	// unknown files of shared storage may be pulls of other nodes in progress
+	if s.shared == nil {
+		var err error
+		fii, err = ioutil.ReadDir(s.storage)
+		if err != nil {
+			return fmt.Errorf("could not read storage directory: %v", err)
+		}
+	}
+	for _, fi := range fii {
+		path := filepath.Join(s.storage, fi.Name())
+		if !fi.Mode().IsRegular() || known[path] {
+			continue
+		}
+		switch fi.Name() {
+		case registryInfoFile, registryInfoFile + corruptSuffix:
+			continue
+		case registryInfoFile + fs.TempSuffix:
+			glog.V(2).Infof("Removing stale registry info file %s", path)
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("could not remove stale registry info file: %v", err)
+			}
+			continue
+		}
+
+		if b, err := hex.DecodeString(fi.Name()); err == nil && len(b)*2 == image.IDLen {
+			info, err := image.Adopt(path)
+			if err == nil {
+				if err := s.images.Add(info); err != nil {
+					return fmt.Errorf("could not add adopted image %s to index: %v", info.ID, err)
+				}
+				glog.Warningf("Adopted unknown image file %s as untagged image", path)
+				changed = true
+				continue
+			}
+			glog.Warningf("Could not adopt unknown image file %s: %v", path, err)
+		}
+		glog.Warningf("Moving unknown file %s to quarantine", path)
+		if err := s.quarantine(path); err != nil {
+			return err
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	if err := s.dumpInfo(); err != nil {
+		return fmt.Errorf("could not dump registry info: %v", err)
+	}
+	return nil
+}
+
+// quarantine moves file located at path to quarantine directory.
+func (s *SingularityRegistry) quarantine(path string) error {
+	dir := filepath.Join(s.storage, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create quarantine directory: %v", err)
+	}
+	dst := filepath.Join(dir, filepath.Base(path))
+	glog.V(4).Infof("Moving %s to %s", path, dst)
+	if err := os.Rename(path, dst); err != nil {
+		return fmt.Errorf("could not quarantine %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+)
+
+func TestRegistryInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-info-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	writeImage := func(content string) *image.Info {
+		id := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+		path := filepath.Join(dir, id)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644), "could not write image")
+		ref, err := image.ParseRef("busybox:" + content)
+		require.NoError(t, err, "could not parse reference")
+		return &image.Info{
+			ID:     id,
+			Sha256: id,
+			Size:   uint64(len(content)),
+			Path:   path,
+			Ref:    ref,
+		}
+	}
+	newRegistry := func() *SingularityRegistry {
+		return &SingularityRegistry{
+			storage: dir,
+			images:  index.NewImageIndex(),
+		}
+	}
+
+	kept := writeImage("kept")
+	lost := writeImage("lost")
+	registry := newRegistry()
+	require.NoError(t, registry.images.Add(kept), "could not add image")
+	require.NoError(t, registry.images.Add(lost), "could not add image")
+	require.NoError(t, registry.dumpInfo(), "could not dump registry info")
+
+	// simulate crash: image file is gone, another is not registered yet
+	require.NoError(t, os.Remove(lost.Path), "could not remove image")
+	unknown := writeImage("unknown")
+	mismatched := filepath.Join(dir, strings.Repeat("a", image.IDLen))
+	require.NoError(t, ioutil.WriteFile(mismatched, []byte("garbage"), 0644), "could not write file")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes"), []byte("garbage"), 0644), "could not write file")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, registryInfoFile+".tmp"), []byte("{"), 0644), "could not write file")
+
+	registry = newRegistry()
+	require.NoError(t, registry.loadInfo(), "could not load registry info")
+	require.NoError(t, registry.checkStorage(), "could not check storage")
+
+	info, err := registry.images.Find("busybox:kept")
+	require.NoError(t, err, "registered image is not loaded")
+	require.Equal(t, kept.ID, info.ID)
+	_, err = registry.images.Find(lost.ID)
+	require.Equal(t, index.ErrNotFound, err, "missing image is not dropped")
+	info, err = registry.images.Find(unknown.ID)
+	require.NoError(t, err, "unknown image is not adopted")
+	require.Empty(t, info.Ref.Tags(), "adopted image is tagged")
+	require.Empty(t, info.Ref.String(), "adopted image has reference")
+
+	for _, name := range []string{strings.Repeat("a", image.IDLen), "notes"} {
+		_, err = os.Stat(filepath.Join(dir, quarantineDir, name))
+		require.NoError(t, err, "unknown file is not quarantined")
+	}
+	_, err = os.Stat(filepath.Join(dir, registryInfoFile+".tmp"))
+	require.True(t, os.IsNotExist(err), "stale temporary file is not removed")
+
+	// consistency pass saves its changes
+	registry = newRegistry()
+	require.NoError(t, registry.loadInfo(), "could not load registry info")
+	_, err = registry.images.Find(unknown.ID)
+	require.NoError(t, err, "adopted image is not saved")
+}
+
+func TestLoadInfo(t *testing.T) {
+	const (
+		kept    = `{"id":"aaaa","sha256":"aaaa","size":1,"path":"/a","ref":{"uri":"docker.io","tags":["busybox:1"]}}`
+		another = `{"id":"bbbb","sha256":"bbbb","size":1,"path":"/b","ref":{"uri":"docker.io","tags":["busybox:2"]}}`
+	)
+
+	tt := []struct {
+		name          string
+		content       string
+		expectImages  []string
+		expectCorrupt bool
+	}{
+		{
+			name:         "versioned",
+			content:      `{"version":1,"images":[` + kept + `,` + another + `]}`,
+			expectImages: []string{"aaaa", "bbbb"},
+		},
+		{
+			name:         "corrupt record",
+			content:      `{"version":1,"images":[` + kept + `,{"id":42},{"size":1}]}`,
+			expectImages: []string{"aaaa"},
+		},
+		{
+			name:         "legacy stream",
+			content:      kept + "\n" + another + "\n",
+			expectImages: []string{"aaaa", "bbbb"},
+		},
+		{
+			name:         "truncated legacy stream",
+			content:      kept + "\n" + another[:20],
+			expectImages: []string{"aaaa"},
+		},
+		{
+			name:          "truncated",
+			content:       `{"version":1,"images":[` + kept,
+			expectCorrupt: true,
+		},
+		{
+			name:          "unsupported version",
+			content:       `{"version":2,"images":[]}`,
+			expectCorrupt: true,
+		},
+		{
+			name:    "empty",
+			content: "",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "registry-info-")
+			require.NoError(t, err, "could not create temp directory")
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, registryInfoFile)
+			require.NoError(t, ioutil.WriteFile(path, []byte(tc.content), 0644), "could not write registry info")
+
+			registry := &SingularityRegistry{
+				storage: dir,
+				images:  index.NewImageIndex(),
+			}
+			require.NoError(t, registry.loadInfo(), "could not load registry info")
+
+			var actual []string
+			registry.images.Iterate(func(info *image.Info) {
+				actual = append(actual, info.ID)
+			})
+			require.ElementsMatch(t, tc.expectImages, actual, "unexpected images")
+
+			_, err = os.Stat(path + corruptSuffix)
+			require.Equal(t, tc.expectCorrupt, err == nil, "unexpected corrupt file state")
+		})
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+// DefaultScrubInterval is the default period of stored images rehashing.
+const DefaultScrubInterval = 24 * time.Hour
+
+// ScrubStatus holds information about integrity checks of stored images.
+type ScrubStatus struct {
+	// Runs is a number of checks performed since startup.
+	Runs int `json:"runs"`
+	// LastRun is the time of the last check.
+	LastRun time.Time `json:"lastRun"`
+	// LastChecked is a number of images rehashed during the last check.
+	LastChecked int `json:"lastChecked"`
+	// Quarantined holds IDs of images moved to quarantine since startup.
+	Quarantined []string `json:"quarantined,omitempty"`
+	// LastError holds an error that happened during the last check, if any.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// scrubber periodically rehashes stored images and
+// quarantines those that no longer match their checksum.
+type scrubber struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	status ScrubStatus
+}
+
+// WithScrubber enables periodic integrity checks of pulled images. Every interval
+// each image file is rehashed and images that do not match their checksum are moved
+// to quarantine directory and removed from index, so they are pulled again on demand.
+// Local SIF images that were not pulled by CRI are not checked. If interval
+// is zero DefaultScrubInterval is used.
+func WithScrubber(interval time.Duration) Option {
+	return func(s *SingularityRegistry) {
+		if interval == 0 {
+			interval = DefaultScrubInterval
+		}
+		s.scrub = &scrubber{
+			interval: interval,
+		}
+	}
+}
+
+// ScrubStatus returns information about integrity checks of stored
+// images. If periodic checks are disabled nil is returned.
+func (s *SingularityRegistry) ScrubStatus() interface{} {
+	if s.scrub == nil {
+		return nil
+	}
+
+	s.scrub.mu.Lock()
+	defer s.scrub.mu.Unlock()
+
+	status := s.scrub.status
+	status.Quarantined = append([]string(nil), s.scrub.status.Quarantined...)
+	return status
+}
+
+// runScrubber checks stored images periodically. It returns when ctx is done.
+func (s *SingularityRegistry) runScrubber(ctx context.Context) {
+	ticker := time.NewTicker(s.scrub.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := s.scrubImages(ctx); err != nil {
+			glog.Errorf("Image integrity check failed: %v", err)
+		}
+	}
+}
+
+// scrubImages rehashes pulled images one by one and quarantines
+// corrupted ones. It stops early when ctx is done.
+func (s *SingularityRegistry) scrubImages(ctx context.Context) error {
+	var candidates []*image.Info
+	s.images.Iterate(func(info *image.Info) {
+		if info.Ref.URI() == singularity.LocalFileDomain || info.LazyReader() != nil {
+			return
+		}
+		candidates = append(candidates, info)
+	})
+
+	var checked int
+	var quarantined []string
+	var scrubErr error
+	for _, info := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		err := info.VerifyChecksum()
+		if err != nil && !errors.Is(err, image.ErrChecksumMismatch) {
+			if _, statErr := os.Stat(info.Path); os.IsNotExist(statErr) {
+				// image was removed while check was in progress
+				continue
+			}
+			scrubErr = fmt.Errorf("could not check image %s: %v", info.ID, err)
+			glog.Errorf("Skipping image during integrity check: %v", scrubErr)
+			continue
+		}
+		checked++
+		if err == nil {
+			continue
+		}
+
+		glog.Errorf("Image %s (%s) does not match its checksum, moving it to quarantine", info.ID, info.Ref)
+		if err := s.quarantineImage(info); err != nil {
+			scrubErr = fmt.Errorf("could not quarantine image %s: %v", info.ID, err)
+			glog.Errorf("Corrupted image is left in place: %v", scrubErr)
+			continue
+		}
+		quarantined = append(quarantined, info.ID)
+	}
+	if len(quarantined) != 0 {
+		if err := s.dumpInfo(); err != nil {
+			glog.Errorf("Could not dump registry info: %v", err)
+		}
+	}
+	glog.V(2).Infof("Image integrity check verified %d images, quarantined %d", checked, len(quarantined))
+
+	s.scrub.mu.Lock()
+	defer s.scrub.mu.Unlock()
+	s.scrub.status.Runs++
+	s.scrub.status.LastRun = time.Now()
+	s.scrub.status.LastChecked = checked
+	s.scrub.status.Quarantined = append(s.scrub.status.Quarantined, quarantined...)
+	s.scrub.status.LastError = ""
+	if scrubErr != nil {
+		s.scrub.status.LastError = scrubErr.Error()
+	}
+	return scrubErr
+}
+
+// quarantineImage moves image file to quarantine directory, where it is kept
+// for inspection, and removes image from index. Containers that already use
+// image are not affected, since their root filesystems stay mounted.
+func (s *SingularityRegistry) quarantineImage(info *image.Info) error {
+	if err := s.quarantine(info.Path); err != nil {
+		return err
+	}
+	if err := s.images.Remove(info.ID); err != nil {
+		return fmt.Errorf("could not remove image from index: %v", err)
+	}
+	s.evictCached(info.ID)
+	return nil
+}
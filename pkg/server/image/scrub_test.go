@@ -0,0 +1,84 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+)
+
+func TestScrubImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image-scrub-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	WithScrubber(0)(registry)
+
+	addImage := func(name, content string) *image.Info {
+		id := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+		path := filepath.Join(dir, id)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644), "could not create image file")
+
+		ref, err := image.ParseRef("busybox:" + name)
+		require.NoError(t, err, "could not parse image reference")
+		info := &image.Info{
+			ID:     id,
+			Sha256: id,
+			Size:   uint64(len(content)),
+			Path:   path,
+			Ref:    ref,
+		}
+		require.NoError(t, registry.images.Add(info), "could not add image to index")
+		return info
+	}
+
+	intact := addImage("intact", "intact")
+	corrupted := addImage("corrupted", "c0rrupted")
+	used := addImage("used", "u5ed")
+	used.Borrow("container")
+
+	err = registry.scrubImages(context.Background())
+	require.NoError(t, err, "could not scrub images")
+
+	_, err = registry.images.Find(intact.ID)
+	require.NoError(t, err, "intact image is removed from index")
+	require.FileExists(t, intact.Path)
+	for _, info := range []*image.Info{corrupted, used} {
+		_, err := registry.images.Find(info.ID)
+		require.Equal(t, index.ErrNotFound, err, "image %s is not removed from index", info.ID)
+		_, err = os.Stat(info.Path)
+		require.True(t, os.IsNotExist(err), "image %s is left in storage", info.ID)
+		require.FileExists(t, filepath.Join(dir, quarantineDir, info.ID))
+	}
+
+	status := registry.ScrubStatus().(ScrubStatus)
+	require.Equal(t, 1, status.Runs)
+	require.Equal(t, 3, status.LastChecked)
+	require.ElementsMatch(t, []string{corrupted.ID, used.ID}, status.Quarantined)
+	require.Empty(t, status.LastError)
+}
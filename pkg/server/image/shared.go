@@ -0,0 +1,444 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+// DefaultSharedSyncInterval is the default period of shared storage syncs.
+const DefaultSharedSyncInterval = 30 * time.Second
+
+const (
+	// sharedDir is a directory within shared storage that holds lock files
+	// and usage files of nodes. Image files are kept in storage directory itself.
+	sharedDir = "shared"
+	// registryLockFile is a file within sharedDir that is locked
+	// while registry info file is merged with local state.
+	registryLockFile = "registry.lock"
+	// pullLocksDir is a directory within sharedDir that holds per reference
+	// lock files, so that only one node pulls the same image at a time.
+	pullLocksDir = "pulls"
+	// usageDir is a directory within sharedDir each node reports
+	// images used by its containers to.
+	usageDir = "nodes"
+	// usageTTLFactor is a number of sync intervals after which usage
+	// file of a node is ignored, e.g. when that node is gone.
+	usageTTLFactor = 3
+)
+
+// sharedStore holds state of storage directory that is shared by several nodes.
+type sharedStore struct {
+	node     string
+	interval time.Duration
+
+	// known holds tags of images in registry info file as of last sync keyed by
+	// image id, so that images and tags removed by this node are told from images
+	// and tags added by others and the other way round
+	known map[string][]string
+	// deleting holds images removed by any node whose files are
+	// kept until none of the nodes uses them, keyed by image id
+	deleting map[string]*pendingDeletion
+}
+
+// pendingDeletion is a record of removed image whose file is still kept.
+type pendingDeletion struct {
+	Path  string    `json:"path"`
+	Since time.Time `json:"since"`
+
+	info *image.Info // set for images removed by this node
+}
+
+// nodeUsage is a content of a node usage file.
+type nodeUsage struct {
+	Node    string    `json:"node"`
+	Updated time.Time `json:"updated"`
+	Images  []string  `json:"images"`
+}
+
+// WithSharedStorage makes storage directory shared by several nodes, e.g. on
+// a parallel filesystem. Nodes are told apart by node name, which must be unique.
+// Pulls of the same image are serialized with advisory file locks, so an image
+// is pulled by one node only, and registry info file is merged with images of
+// other nodes every interval. Removed images are deleted from disk once no node
+// reports them to be used for two intervals. If interval is zero
+// DefaultSharedSyncInterval is used. Lazy pulls cannot be used with shared storage.
+func WithSharedStorage(node string, interval time.Duration) Option {
+	return func(s *SingularityRegistry) {
+		if interval == 0 {
+			interval = DefaultSharedSyncInterval
+		}
+		s.shared = &sharedStore{
+			node:     node,
+			interval: interval,
+			known:    make(map[string][]string),
+			deleting: make(map[string]*pendingDeletion),
+		}
+	}
+}
+
+// initShared prepares shared storage and restores index from it.
+func (s *SingularityRegistry) initShared() error {
+	for _, dir := range []string{pullLocksDir, usageDir} {
+		if err := os.MkdirAll(filepath.Join(s.storage, sharedDir, dir), 0755); err != nil {
+			return fmt.Errorf("could not create shared storage directory: %v", err)
+		}
+	}
+	return s.syncShared(context.Background())
+}
+
+// runShared syncs registry with shared storage every interval until ctx is done.
+func (s *SingularityRegistry) runShared(ctx context.Context) {
+	ticker := time.NewTicker(s.shared.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.syncShared(ctx); err != nil {
+				glog.Errorf("Could not sync shared image storage: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lockPull acquires lock of image referenced by ref, so that
+// other nodes do not pull it at the same time.
+func (s *SingularityRegistry) lockPull(ctx context.Context, ref *image.Reference) (*fs.Lock, error) {
+	sum := sha256.Sum256([]byte(ref.String()))
+	path := filepath.Join(s.storage, sharedDir, pullLocksDir, hex.EncodeToString(sum[:]))
+	return fs.LockFile(ctx, path)
+}
+
+// pulledElsewhere waits for other nodes to finish pulling image referenced by ref
+// and returns that image if it is pulled by another node since prev was found in
+// index. Returned lock should be released once pull is complete.
+func (s *SingularityRegistry) pulledElsewhere(ctx context.Context, ref *image.Reference, prev *image.Info) (*image.Info, *fs.Lock, error) {
+	lock, err := s.lockPull(ctx, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.syncShared(ctx); err != nil {
+		lock.Unlock()
+		return nil, nil, err
+	}
+	info, err := s.images.Find(ref.String())
+	if err != nil || (prev != nil && prev.ID == info.ID) {
+		return nil, lock, nil
+	}
+	return info, lock, nil
+}
+
+// removeShared removes image from index and keeps its file until no node uses it.
+// Unless force is set, images used by any node are not removed and ErrIsUsed is returned.
+// It should be called with s.m held.
+func (s *SingularityRegistry) removeShared(info *image.Info, force bool) error {
+	if !force && (len(info.UsedBy()) != 0 || len(s.usedElsewhere()[info.ID]) != 0) {
+		return image.ErrIsUsed
+	}
+	if err := s.images.Remove(info.ID); err != nil {
+		return fmt.Errorf("could not remove image from index: %v", err)
+	}
+	s.shared.deleting[info.ID] = &pendingDeletion{
+		Path:  info.Path,
+		Since: time.Now(),
+		info:  info,
+	}
+	return nil
+}
+
+// syncShared merges registry info file with local state under registry lock.
+// Images that are only found in file are pulled by other nodes and are added to
+// index, while images that disappeared from file since last sync are removed by
+// other nodes and are removed from index. Tags of images found in both are merged,
+// see mergeSharedTags. Images removed by any node are deleted from disk once
+// unused, then merged state and usage of this node are saved.
+func (s *SingularityRegistry) syncShared(ctx context.Context) error {
+	lock, err := fs.LockFile(ctx, filepath.Join(s.storage, sharedDir, registryLockFile))
+	if err != nil {
+		return fmt.Errorf("could not lock registry info: %v", err)
+	}
+	defer lock.Unlock()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	records, deleting, err := readSharedInfo(filepath.Join(s.storage, registryInfoFile))
+	if err != nil {
+		return err
+	}
+	inFile := make(map[string]bool)
+	for _, info := range decodeImageRecords(records) {
+		if info.MarkedForDeletion() {
+			// written by a node that did not run in shared mode
+			deleting[info.ID] = &pendingDeletion{Path: info.Path, Since: time.Now()}
+			continue
+		}
+		inFile[info.ID] = true
+		if local, err := s.images.Find(info.ID); err == nil {
+			s.mergeSharedTags(local, info)
+			continue
+		}
+		if _, ok := s.shared.known[info.ID]; ok {
+			continue
+		}
+		if _, ok := s.shared.deleting[info.ID]; ok {
+			continue
+		}
+		glog.V(2).Infof("Image %s (%s) is pulled by another node", info.ID, info.Ref)
+		if err := s.images.Add(info); err != nil {
+			glog.Warningf("Skipping image record of %s: could not add image to index: %v", info.ID, err)
+		}
+	}
+
+	var gone []*image.Info
+	s.images.Iterate(func(info *image.Info) {
+		if _, ok := s.shared.known[info.ID]; ok && info.Ref.URI() != singularity.LocalFileDomain && !inFile[info.ID] {
+			gone = append(gone, info)
+		}
+	})
+	for _, info := range gone {
+		glog.V(2).Infof("Image %s (%s) is removed by another node", info.ID, info.Ref)
+		if err := s.images.Remove(info.ID); err != nil {
+			glog.Errorf("Could not remove image %s from index: %v", info.ID, err)
+			continue
+		}
+		if len(info.UsedBy()) != 0 {
+			s.shared.deleting[info.ID] = &pendingDeletion{Path: info.Path, Since: time.Now(), info: info}
+		}
+		s.evictCached(info.ID)
+	}
+
+	s.updatePins()
+
+	for id, d := range deleting {
+		if _, ok := s.shared.deleting[id]; !ok {
+			s.shared.deleting[id] = d
+		}
+	}
+	s.reclaimShared(inFile)
+
+	if err := s.writeUsage(); err != nil {
+		return err
+	}
+	return s.writeSharedInfo()
+}
+
+// mergeSharedTags applies changes other nodes made to tags of image record since
+// last sync to local image. Tags found in record that this node did not save are
+// added by other nodes, while saved tags that are missing in record are removed or
+// moved to other images by other nodes, so they are removed from local image too.
+// Tags this node added or removed since last sync are kept as is. Digests are only
+// added, since they identify image content. It should be called with s.m held.
+func (s *SingularityRegistry) mergeSharedTags(local, record *image.Info) {
+	saved := make(map[string]bool)
+	for _, tag := range s.shared.known[local.ID] {
+		saved[tag] = true
+	}
+	inRecord := make(map[string]bool)
+	for _, tag := range record.Ref.Tags() {
+		inRecord[tag] = true
+		if !saved[tag] {
+			glog.V(2).Infof("Image %s is tagged %s by another node", local.ID, tag)
+			local.Ref.AddTags([]string{tag})
+		}
+	}
+	for _, tag := range local.Ref.Tags() {
+		if saved[tag] && !inRecord[tag] {
+			glog.V(2).Infof("Tag %s of image %s is removed by another node", tag, local.ID)
+			s.images.RemoveTag(tag)
+		}
+	}
+	local.Ref.AddDigests(record.Ref.Digests())
+	// re-adding image points its new tags and digests to it
+	if err := s.images.Add(local); err != nil {
+		glog.Errorf("Could not update tags of image %s: %v", local.ID, err)
+	}
+}
+
+// reclaimShared deletes files of removed images that are not used by any node for
+// two sync intervals, so that nodes which still had image in index have reported
+// it. Images that are pulled again or are still in registry info file are kept.
+// It should be called with s.m held.
+func (s *SingularityRegistry) reclaimShared(inFile map[string]bool) {
+	used := s.usedElsewhere()
+	for id, d := range s.shared.deleting {
+		if _, err := s.images.Find(id); err == nil {
+			glog.V(2).Infof("Image %s is pulled again, cancelling its deletion", id)
+			delete(s.shared.deleting, id)
+			continue
+		}
+		if d.info != nil && len(d.info.UsedBy()) != 0 {
+			continue
+		}
+		if inFile[id] || len(used[id]) != 0 || time.Since(d.Since) < 2*s.shared.interval {
+			continue
+		}
+		glog.V(2).Infof("Removing file %s of image %s that is no longer used by any node", d.Path, id)
+		if err := os.Remove(d.Path); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Could not remove image %s: %v", id, err)
+			continue
+		}
+		delete(s.shared.deleting, id)
+	}
+}
+
+// usedElsewhere returns names of other nodes that use images keyed by image
+// id according to their usage files. Outdated usage files are ignored.
+func (s *SingularityRegistry) usedElsewhere() map[string][]string {
+	dir := filepath.Join(s.storage, sharedDir, usageDir)
+	fii, err := ioutil.ReadDir(dir)
+	if err != nil {
+		glog.Errorf("Could not read node usage directory: %v", err)
+		return nil
+	}
+	used := make(map[string][]string)
+	for _, fi := range fii {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			glog.Warningf("Could not read node usage file %s: %v", fi.Name(), err)
+			continue
+		}
+		var usage nodeUsage
+		if err := json.Unmarshal(data, &usage); err != nil {
+			glog.Warningf("Could not decode node usage file %s: %v", fi.Name(), err)
+			continue
+		}
+		if usage.Node == s.shared.node {
+			continue
+		}
+		if time.Since(usage.Updated) > usageTTLFactor*s.shared.interval {
+			glog.V(4).Infof("Ignoring outdated usage of node %s updated at %s", usage.Node, usage.Updated)
+			continue
+		}
+		for _, id := range usage.Images {
+			used[id] = append(used[id], usage.Node)
+		}
+	}
+	return used
+}
+
+// writeUsage saves images used by containers of this node into its usage file.
+func (s *SingularityRegistry) writeUsage() error {
+	usage := nodeUsage{
+		Node:    s.shared.node,
+		Updated: time.Now(),
+		Images:  []string{},
+	}
+	s.images.Iterate(func(info *image.Info) {
+		if len(info.UsedBy()) != 0 {
+			usage.Images = append(usage.Images, info.ID)
+		}
+	})
+	for id, d := range s.shared.deleting {
+		if d.info != nil && len(d.info.UsedBy()) != 0 {
+			usage.Images = append(usage.Images, id)
+		}
+	}
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return fmt.Errorf("could not encode node usage: %v", err)
+	}
+	path := filepath.Join(s.storage, sharedDir, usageDir, s.shared.node+".json")
+	if err := fs.WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("could not write node usage file: %v", err)
+	}
+	return nil
+}
+
+// writeSharedInfo saves index and pending deletions into registry info
+// file and remembers saved images along with their tags. It should be called
+// with s.m held.
+func (s *SingularityRegistry) writeSharedInfo() error {
+	info := registryInfo{
+		Version:  registryInfoVersion,
+		Images:   []json.RawMessage{},
+		Deleting: s.shared.deleting,
+	}
+	known := make(map[string][]string)
+	var encodeErr error
+	s.images.Iterate(func(img *image.Info) {
+		if img.Ref.URI() == singularity.LocalFileDomain {
+			return
+		}
+		record, err := json.Marshal(img)
+		if err != nil {
+			encodeErr = fmt.Errorf("could not encode image %s: %v", img.ID, err)
+			return
+		}
+		info.Images = append(info.Images, record)
+		known[img.ID] = img.Ref.Tags()
+	})
+	if encodeErr != nil {
+		return encodeErr
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("could not encode registry info: %v", err)
+	}
+	if err := fs.WriteFileAtomic(filepath.Join(s.storage, registryInfoFile), data, 0644); err != nil {
+		return fmt.Errorf("could not write registry info file: %v", err)
+	}
+	s.shared.known = known
+	return nil
+}
+
+// readSharedInfo returns raw image records and pending deletions of registry info file
+// located at path. Corrupt file is kept with .corrupt suffix and is treated as empty.
+func readSharedInfo(path string) ([]json.RawMessage, map[string]*pendingDeletion, error) {
+	deleting := make(map[string]*pendingDeletion)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, deleting, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read registry info file: %v", err)
+	}
+	records, err := decodeRegistryInfo(data)
+	if err != nil {
+		glog.Errorf("Could not decode registry info file, moving it to %s: %v", path+corruptSuffix, err)
+		if err := os.Rename(path, path+corruptSuffix); err != nil {
+			return nil, nil, fmt.Errorf("could not move corrupt registry info file: %v", err)
+		}
+		return nil, deleting, nil
+	}
+	var info registryInfo
+	if err := json.Unmarshal(data, &info); err == nil {
+		for id, d := range info.Deleting {
+			if d != nil {
+				deleting[id] = d
+			}
+		}
+	}
+	return records, deleting, nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const testSyncInterval = 50 * time.Millisecond
+
+func newSharedRegistry(t *testing.T, dir, node string) *SingularityRegistry {
+	registry := &SingularityRegistry{
+		storage: dir,
+		images:  index.NewImageIndex(),
+	}
+	WithSharedStorage(node, testSyncInterval)(registry)
+	require.NoError(t, registry.initShared(), "could not init shared storage")
+	return registry
+}
+
+func TestSharedStorage_Remove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared-storage-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	node1 := newSharedRegistry(t, dir, "node1")
+	node2 := newSharedRegistry(t, dir, "node2")
+
+	id := strings.Repeat("a", image.IDLen)
+	path := filepath.Join(dir, id)
+	require.NoError(t, ioutil.WriteFile(path, []byte("busybox"), 0644), "could not write image")
+	ref, err := image.ParseRef("busybox:1.28")
+	require.NoError(t, err, "could not parse reference")
+	require.NoError(t, node1.images.Add(&image.Info{
+		ID:     id,
+		Sha256: id,
+		Path:   path,
+		Ref:    ref,
+	}), "could not add image")
+	require.NoError(t, node1.dumpInfo(), "could not dump registry info")
+
+	require.NoError(t, node2.syncShared(context.Background()), "could not sync")
+	busybox, err := node2.images.Find("busybox:1.28")
+	require.NoError(t, err, "image pulled by another node is not found")
+	busybox.Borrow("container")
+	require.NoError(t, node2.syncShared(context.Background()), "could not sync")
+
+	_, err = node1.RemoveImage(context.Background(), &k8s.RemoveImageRequest{
+		Image: &k8s.ImageSpec{Image: "busybox:1.28"},
+	})
+	require.NoError(t, err, "could not remove image")
+	_, err = node1.images.Find(id)
+	require.Equal(t, index.ErrNotFound, err, "removed image is indexed")
+
+	require.NoError(t, node2.syncShared(context.Background()), "could not sync")
+	_, err = node2.images.Find(id)
+	require.Equal(t, index.ErrNotFound, err, "image removed by another node is indexed")
+
+	time.Sleep(2 * testSyncInterval)
+	require.NoError(t, node1.syncShared(context.Background()), "could not sync")
+	_, err = os.Stat(path)
+	require.NoError(t, err, "image used by another node is removed")
+
+	busybox.Return("container")
+	require.NoError(t, node2.syncShared(context.Background()), "could not sync")
+	require.NoError(t, node1.syncShared(context.Background()), "could not sync")
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "unused image is not removed")
+
+	require.NoError(t, node2.syncShared(context.Background()), "could not sync")
+	require.Empty(t, node1.shared.deleting, "removed image is still pending deletion")
+	require.Empty(t, node2.shared.deleting, "removed image is still pending deletion")
+}
+
+func TestSharedStorage_Pull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared-storage-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	node1 := newSharedRegistry(t, dir, "node1")
+	node2 := newSharedRegistry(t, dir, "node2")
+
+	ref, err := image.ParseRef("busybox:1.28")
+	require.NoError(t, err, "could not parse reference")
+	info, lock, err := node1.pulledElsewhere(context.Background(), ref, nil)
+	require.NoError(t, err, "could not lock pull")
+	require.Nil(t, info, "image is not pulled yet")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err = node2.pulledElsewhere(ctx, ref, nil)
+	require.Error(t, err, "image is pulled by two nodes at once")
+
+	id := strings.Repeat("a", image.IDLen)
+	require.NoError(t, node1.images.Add(&image.Info{
+		ID:     id,
+		Sha256: id,
+		Path:   filepath.Join(dir, id),
+		Ref:    ref,
+	}), "could not add image")
+	require.NoError(t, node1.dumpInfo(), "could not dump registry info")
+	require.NoError(t, lock.Unlock(), "could not unlock pull")
+
+	info, lock, err = node2.pulledElsewhere(context.Background(), ref, nil)
+	require.NoError(t, err, "could not lock pull")
+	defer lock.Unlock()
+	require.NotNil(t, info, "image pulled by another node is not found")
+	require.Equal(t, id, info.ID)
+}
+
+func TestSharedStorage_Tags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shared-storage-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	node1 := newSharedRegistry(t, dir, "node1")
+	node2 := newSharedRegistry(t, dir, "node2")
+
+	tag := func(t *testing.T, registry *SingularityRegistry, id, tag string) {
+		ref, err := image.ParseRef(tag)
+		require.NoError(t, err, "could not parse reference")
+		require.NoError(t, registry.images.Add(&image.Info{ID: id, Ref: ref}), "could not tag image")
+	}
+	requireTags := func(t *testing.T, registry *SingularityRegistry, id string, tags ...string) {
+		info, err := registry.images.Find(id)
+		require.NoError(t, err, "image is not found")
+		require.ElementsMatch(t, tags, info.Ref.Tags(), "unexpected image tags")
+		for _, tag := range tags {
+			tagged, err := registry.images.Find(tag)
+			require.NoError(t, err, "tag is not indexed")
+			require.Equal(t, id, tagged.ID, "tag points to another image")
+		}
+	}
+
+	id := strings.Repeat("a", image.IDLen)
+	ref, err := image.ParseRef("busybox:1.28")
+	require.NoError(t, err, "could not parse reference")
+	require.NoError(t, node1.images.Add(&image.Info{
+		ID:     id,
+		Sha256: id,
+		Path:   filepath.Join(dir, id),
+		Ref:    ref,
+	}), "could not add image")
+	require.NoError(t, node1.dumpInfo(), "could not dump registry info")
+	require.NoError(t, node2.syncShared(context.Background()), "could not sync")
+	requireTags(t, node2, id, "busybox:1.28")
+
+	// tag added to known image by another node is merged
+	// and is not overwritten with local state
+	tag(t, node2, id, "busybox:latest")
+	require.NoError(t, node2.dumpInfo(), "could not dump registry info")
+	tag(t, node1, id, "busybox:stable")
+	require.NoError(t, node1.syncShared(context.Background()), "could not sync")
+	requireTags(t, node1, id, "busybox:1.28", "busybox:latest", "busybox:stable")
+	require.NoError(t, node2.syncShared(context.Background()), "could not sync")
+	requireTags(t, node2, id, "busybox:1.28", "busybox:latest", "busybox:stable")
+
+	// tag removed by another node is removed, while tag
+	// removed locally is not brought back from file
+	node1.images.RemoveTag("busybox:1.28")
+	require.NoError(t, node1.dumpInfo(), "could not dump registry info")
+	node2.images.RemoveTag("busybox:stable")
+	require.NoError(t, node2.syncShared(context.Background()), "could not sync")
+	requireTags(t, node2, id, "busybox:latest")
+	require.NoError(t, node1.syncShared(context.Background()), "could not sync")
+	requireTags(t, node1, id, "busybox:latest")
+}
@@ -20,6 +20,7 @@ import (
 	"path/filepath"
 
 	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
 	"github.com/sylabs/singularity-cri/pkg/index"
 	"github.com/sylabs/singularity-cri/pkg/kube"
 	"google.golang.org/grpc/codes"
@@ -47,12 +48,31 @@ func (s *SingularityRuntime) CreateContainer(_ context.Context, req *k8s.CreateC
 		return nil, status.Error(codes.NotFound, "image is not found")
 	}
 
+	if s.checkIntegrity {
+		if err := info.CheckIntegrity(); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "image %s failed integrity check: %v", info.ID, err)
+		}
+	}
+
 	pod, err := s.findPod(req.PodSandboxId)
 	if err != nil {
 		return nil, err
 	}
 
 	cont := kube.NewContainer(req.Config, pod, info, s.trashDir)
+	if info.Encrypted {
+		namespace := pod.GetMetadata().GetNamespace()
+		keys := image.SelectDecryptionKeys(s.decryptionKeys, namespace, info.Ref)
+		if len(keys) == 0 {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"no decryption key matches encrypted image %s in namespace %q", info.Ref, namespace)
+		}
+		cont.SetDecryptionKeys(keys)
+	}
+	if s.imageCache != nil {
+		cont.SetImageCache(s.imageCache)
+	}
+	cont.SetImageMounts(s.imageMounts)
 	cleanupOnFailure := func() {
 		if err := s.containers.Remove(cont.ID()); err != nil {
 			glog.Errorf("Could not remove container from index: %v", err)
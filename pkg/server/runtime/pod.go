@@ -35,16 +35,22 @@ func (s *SingularityRuntime) RunPodSandbox(_ context.Context, req *k8s.RunPodSan
 		return nil, status.Errorf(codes.FailedPrecondition, "only %s runtime is supported", singularity.RuntimeName)
 	}
 
-	pod := kube.NewPod(req.Config)
+	var pod *kube.Pod
+	if s.sandboxPool != nil {
+		pod = s.sandboxPool.Claim(req.Config)
+	}
 	cleanupOnFailure := func() {
 		if err := s.pods.Remove(pod.ID()); err != nil {
 			glog.Errorf("Could not remove pod from index: %v", err)
 		}
 	}
-	podBaseDir := filepath.Join(s.baseRunDir, "pods", pod.ID())
-	if err := pod.Run(podBaseDir); err != nil {
-		cleanupOnFailure()
-		return nil, status.Errorf(codes.Internal, "could not run pod: %v", err)
+	if pod == nil {
+		pod = kube.NewPod(req.Config)
+		podBaseDir := filepath.Join(s.baseRunDir, "pods", pod.ID())
+		if err := pod.Run(podBaseDir); err != nil {
+			cleanupOnFailure()
+			return nil, status.Errorf(codes.Internal, "could not run pod: %v", err)
+		}
 	}
 
 	// bring up network interface if requested
@@ -191,3 +197,14 @@ func (s *SingularityRuntime) findPod(id string) (*kube.Pod, error) {
 	}
 	return pod, nil
 }
+
+// sandboxPoolStatus returns number of pod sandboxes that are ready to be claimed.
+func (s *SingularityRuntime) sandboxPoolStatus() interface{} {
+	return struct {
+		Size  int `json:"size"`
+		Ready int `json:"ready"`
+	}{
+		Size:  s.poolSize,
+		Ready: s.sandboxPool.Ready(),
+	}
+}
@@ -16,14 +16,17 @@ package runtime
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
 	snetwork "github.com/apptainer/apptainer/pkg/network"
 	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
 	"github.com/sylabs/singularity-cri/pkg/index"
 	"github.com/sylabs/singularity-cri/pkg/kube"
 	"github.com/sylabs/singularity-cri/pkg/network"
@@ -54,6 +57,17 @@ type SingularityRuntime struct {
 	streaming streaming.Server
 
 	networkManager *network.Manager
+
+	decryptionKeys []image.DecryptionKey
+	checkIntegrity bool
+	imageCache     *image.Cache
+	imageMounts    *kube.ImageMounts
+
+	poolSize    int
+	poolRules   kube.PoolRules
+	sandboxPool *kube.PodPool
+
+	statusInfo map[string]func() interface{}
 }
 
 // Option is run during SingularityRuntime initialization.
@@ -80,6 +94,18 @@ func NewSingularityRuntime(imgIndex *index.ImageIndex, opts ...Option) (*Singula
 	for _, opt := range opts {
 		opt(runtime)
 	}
+
+	mountsDir := filepath.Join(runtime.baseRunDir, "images")
+	runtime.imageMounts, err = kube.NewImageMounts(mountsDir, kube.DefaultImageMountLinger)
+	if err != nil {
+		return nil, fmt.Errorf("could not init image mounts: %v", err)
+	}
+	if runtime.poolSize > 0 {
+		podsDir := filepath.Join(runtime.baseRunDir, "pods")
+		runtime.sandboxPool = kube.NewPodPool(podsDir, runtime.poolSize, runtime.poolRules)
+		runtime.sandboxPool.Start()
+		WithStatusInfo("sandboxPool", runtime.sandboxPoolStatus)(runtime)
+	}
 	return runtime, nil
 }
 
@@ -150,6 +176,52 @@ func WithTrashDir(dir string) Option {
 	}
 }
 
+// WithDecryptionKeys sets keys encrypted images are opened with. Keys are
+// selected per container by pod namespace and image reference.
+func WithDecryptionKeys(keys ...image.DecryptionKey) Option {
+	return func(r *SingularityRuntime) {
+		r.decryptionKeys = keys
+	}
+}
+
+// WithIntegrityCheck enables a fast integrity check of image file
+// before each container is created, see image.Info.CheckIntegrity.
+func WithIntegrityCheck() Option {
+	return func(r *SingularityRuntime) {
+		r.checkIntegrity = true
+	}
+}
+
+// WithImageCache sets local cache tier images are copied to when containers
+// are created, so that container bundles are created from cached copies.
+func WithImageCache(cache *image.Cache) Option {
+	return func(r *SingularityRuntime) {
+		r.imageCache = cache
+	}
+}
+
+// WithSandboxPool keeps size empty pod sandboxes ready in background, so
+// that pods eligible according to rules are run without waiting for
+// namespaces and pod process to be created. Zero size disables pool.
+func WithSandboxPool(size int, rules kube.PoolRules) Option {
+	return func(r *SingularityRuntime) {
+		r.poolSize = size
+		r.poolRules = rules
+	}
+}
+
+// WithStatusInfo registers a provider of additional information that is
+// reported by Status under the passed key when verbose output is requested.
+// Value returned by provider is encoded into JSON, nil values are skipped.
+func WithStatusInfo(key string, provider func() interface{}) Option {
+	return func(r *SingularityRuntime) {
+		if r.statusInfo == nil {
+			r.statusInfo = make(map[string]func() interface{})
+		}
+		r.statusInfo[key] = provider
+	}
+}
+
 // Shutdown shuts down any running background tasks created by SingularityRuntime.
 // This methods should be called when SingularityRuntime will no longer be used.
 func (s *SingularityRuntime) Shutdown() error {
@@ -157,6 +229,11 @@ func (s *SingularityRuntime) Shutdown() error {
 		return fmt.Errorf("could not stop streaming server: %v", err)
 	}
 
+	if s.sandboxPool != nil {
+		glog.V(4).Infof("Removing pooled pods")
+		s.sandboxPool.Close()
+	}
+
 	var cleanupErr error
 	glog.V(4).Infof("Stopping all running pods")
 	s.pods.Iterate(func(pod *kube.Pod) {
@@ -172,6 +249,7 @@ func (s *SingularityRuntime) Shutdown() error {
 			glog.Errorf("Cleanup failed: %v", cleanupErr)
 		}
 	})
+	s.imageMounts.Close()
 	return cleanupErr
 }
 
@@ -362,10 +440,27 @@ func (s *SingularityRuntime) Status(ctx context.Context, req *k8s.StatusRequest)
 		networkReady.Reason = "NetworkNotReady"
 		networkReady.Message = fmt.Sprintf("sycri: network is not ready: %v", err)
 	}
+	var verboseInfo map[string]string
+	if req.Verbose {
+		verboseInfo = make(map[string]string, len(s.statusInfo))
+		for key, provider := range s.statusInfo {
+			info := provider()
+			if info == nil {
+				continue
+			}
+			jsonInfo, err := json.Marshal(info)
+			if err != nil {
+				glog.Errorf("Could not encode %s status info: %v", key, err)
+				continue
+			}
+			verboseInfo[key] = string(jsonInfo)
+		}
+	}
 	return &k8s.StatusResponse{
 		Status: &k8s.RuntimeStatus{
 			Conditions: conditions,
 		},
+		Info: verboseInfo,
 	}, nil
 }
 
@@ -22,16 +22,38 @@ const (
 	// For more info refer to https://cloud.sylabs.io/library.
 	LibraryDomain = "cloud.sylabs.io"
 
+	// LibraryProtocol holds library base URI. References with this
+	// prefix may point to any library, e.g. library://example.com/user/collection/image.
+	LibraryProtocol = "library"
+
 	// LocalFileDomain is a special case domain that should be used
 	// for a pre-pulled SIF images.
 	LocalFileDomain = "local.file"
 
+	// LocalOCIArchiveDomain, LocalDockerArchiveDomain and LocalOCIDirDomain
+	// are special case domains for images distributed as OCI archives,
+	// docker save tarballs and OCI layout directories respectively,
+	// e.g. local.oci-archive/var/lib/images/busybox.tar. Such images are
+	// converted to SIF on pull.
+	LocalOCIArchiveDomain    = "local.oci-archive"
+	LocalDockerArchiveDomain = "local.docker-archive"
+	LocalOCIDirDomain        = "local.oci-dir"
+
 	// DockerDomain holds docker primary domain to pull images from.
 	DockerDomain = "docker.io"
 
 	// DockerProtocol holds docker hub base URI.
 	DockerProtocol = "docker"
 
+	// OrasProtocol holds URI prefix of SIF images stored as ORAS
+	// artifacts in OCI registries, e.g. oras://registry.example.com/user/image:tag.
+	OrasProtocol = "oras"
+
+	// HTTPProtocol and HTTPSProtocol are URI prefixes of SIF images
+	// downloaded from plain web servers, e.g. https://example.com/image.sif.
+	HTTPProtocol  = "http"
+	HTTPSProtocol = "https"
+
 	// KeysServer is a default singularity key management and verification server.
 	KeysServer = "https://keys.sylabs.io"
 
@@ -42,12 +64,4 @@ const (
 	// RunScript is a path to a shell script that should be used as a default container
 	// entrypoint based on a native SIF image.
 	RunScript = "/.singularity.d/actions/run"
-
-	// EnvDockerUsername should be used to set Docker username for
-	// build engine when building from a private registry.
-	EnvDockerUsername = "SINGULARITY_DOCKER_USERNAME"
-
-	// EnvDockerPassword should be used to set Docker password for
-	// build engine when building from a private registry.
-	EnvDockerPassword = "SINGULARITY_DOCKER_PASSWORD"
 )